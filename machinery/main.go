@@ -8,6 +8,7 @@ import (
 
 	"github.com/kerberos-io/agent/machinery/src/capture"
 	"github.com/kerberos-io/agent/machinery/src/components"
+	"github.com/kerberos-io/agent/machinery/src/database"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
 	"github.com/kerberos-io/agent/machinery/src/onvif"
@@ -157,6 +158,20 @@ func main() {
 				}
 			}
 
+			// Recover the recordings that were interrupted, when the agent stopped while recording.
+			capture.RecoverRecordings(configDirectory, &configuration)
+
+			// Open the recording index, and rebuild it from the recordings on disk, as recordings
+			// might have been added or removed while the agent was not running.
+			if err := database.OpenIndex(configDirectory); err == nil {
+				defer database.CloseIndex()
+				if err := database.RebuildIndex(configDirectory); err != nil {
+					log.Log.Error("main.Main(): something went wrong while rebuilding the recording index: " + err.Error())
+				}
+			} else {
+				log.Log.Error("main.Main(): could not open the recording index, falling back to the recordings directory: " + err.Error())
+			}
+
 			// Create a cancelable context, which will be used to cancel and restart.
 			// This is used to restart the agent when the configuration is updated.
 			ctx, cancel := context.WithCancel(context.Background())
@@ -175,7 +190,12 @@ func main() {
 				HandleBootstrap: make(chan string, 1),
 			}
 
-			go components.Bootstrap(configDirectory, &configuration, &communication, &capture)
+			// In multi-camera mode every camera has its own pipeline, next to the services they share.
+			if len(configuration.Config.Cameras) > 0 {
+				go components.BootstrapCameras(configDirectory, &configuration, &communication)
+			} else {
+				go components.Bootstrap(configDirectory, &configuration, &communication, &capture)
+			}
 
 			// Start the REST API.
 			routers.StartWebserver(configDirectory, &configuration, &communication, &capture)
@@ -3,34 +3,84 @@ package capture
 import (
 	"context"
 	"image"
+	"time"
 
 	"github.com/kerberos-io/agent/machinery/src/models"
 	"github.com/kerberos-io/agent/machinery/src/packets"
 )
 
 type Capture struct {
-	RTSPClient            *Golibrtsp
-	RTSPSubClient         *Golibrtsp
+	RTSPClient            RTSPClient
+	RTSPSubClient         RTSPClient
 	RTSPBackChannelClient *Golibrtsp
 }
 
-func (c *Capture) SetMainClient(rtspUrl string) *Golibrtsp {
-	c.RTSPClient = &Golibrtsp{
-		Url: rtspUrl,
+// StreamOptions are the settings to connect to a stream with.
+type StreamOptions struct {
+	Transport   string        // The transport to read the stream with: tcp, udp, multicast or auto.
+	ReadTimeout time.Duration // Zero uses the default of the client.
+	UserAgent   string        // Empty uses the default of the client.
+}
+
+// GetStreamOptions returns the options of the main ("main") or sub ("sub") stream of the camera.
+func GetStreamOptions(config models.Config, streamType string) StreamOptions {
+	ipCamera := config.Capture.IPCamera
+	options := StreamOptions{
+		Transport:   ipCamera.Transport,
+		ReadTimeout: time.Duration(ipCamera.ReadTimeout) * time.Second,
+		UserAgent:   ipCamera.UserAgent,
 	}
-	return c.RTSPClient
+	if streamType == "sub" {
+		options.Transport = ipCamera.SubTransport
+	}
+	return options
 }
 
-func (c *Capture) SetSubClient(rtspUrl string) *Golibrtsp {
-	c.RTSPSubClient = &Golibrtsp{
-		Url: rtspUrl,
+// NewRTSPClient returns the client for a stream url, selected by the scheme of the url: a file:// url is
+// played by the virtual camera, a rtmp:// url is read by the RTMP client and a srt:// url by the SRT client.
+func NewRTSPClient(rtspUrl string, options StreamOptions) RTSPClient {
+	if IsVirtualCamera(rtspUrl) {
+		return &VirtualCamera{
+			Url: rtspUrl,
+		}
 	}
+	if IsRTMP(rtspUrl) {
+		return &RTMPClient{
+			Url:     rtspUrl,
+			Options: options,
+		}
+	}
+	if IsSRT(rtspUrl) {
+		return &SRTClient{
+			Url:     rtspUrl,
+			Options: options,
+		}
+	}
+	return &Golibrtsp{
+		Url:     rtspUrl,
+		Options: options,
+	}
+}
+
+// SupportsBackChannel returns true if the stream can have a backchannel, only RTSP cameras have one.
+func SupportsBackChannel(rtspUrl string) bool {
+	return !IsVirtualCamera(rtspUrl) && !IsRTMP(rtspUrl) && !IsSRT(rtspUrl)
+}
+
+func (c *Capture) SetMainClient(rtspUrl string, options StreamOptions) RTSPClient {
+	c.RTSPClient = NewRTSPClient(rtspUrl, options)
+	return c.RTSPClient
+}
+
+func (c *Capture) SetSubClient(rtspUrl string, options StreamOptions) RTSPClient {
+	c.RTSPSubClient = NewRTSPClient(rtspUrl, options)
 	return c.RTSPSubClient
 }
 
-func (c *Capture) SetBackChannelClient(rtspUrl string) *Golibrtsp {
+func (c *Capture) SetBackChannelClient(rtspUrl string, options StreamOptions) *Golibrtsp {
 	c.RTSPBackChannelClient = &Golibrtsp{
-		Url: rtspUrl,
+		Url:     rtspUrl,
+		Options: options,
 	}
 	return c.RTSPBackChannelClient
 }
@@ -69,4 +119,7 @@ type RTSPClient interface {
 
 	// Get a list of audio streams from the RTSP server.
 	GetAudioStreams() ([]packets.Stream, error)
+
+	// Get the transport the stream is read with.
+	GetTransport() string
 }
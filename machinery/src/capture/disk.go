@@ -0,0 +1,215 @@
+package capture
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// The disk watchdog checks the free disk space of the data volume, and degrades recording step by step
+// when it drops below the configured thresholds. A step is only left once the free disk space is a margin
+// above its threshold, so we don't switch back and forth around a threshold. The recorder, manual recordings
+// and the motion detection read how they should record from RecordingConfiguration. When that changes, the
+// recorder finishes its recording and starts over (see HandleRecording), the agent is not restarted.
+
+// The states of the watchdog, in order of severity.
+var diskStates = []string{
+	models.DiskStateOK,
+	models.DiskStateEmergencyRetention,
+	models.DiskStateMotionOnly,
+	models.DiskStateSubOnly,
+	models.DiskStatePaused,
+}
+
+// The margin (percentage) above a threshold, before a step is left.
+const diskWatchdogMargin = 1.0
+
+// ErrDiskFull is returned when recording is paused by the disk watchdog.
+var ErrDiskFull = errors.New("recording is paused, the disk is full")
+
+var (
+	diskStatusMutex sync.Mutex
+	diskStatus      = models.DiskStatus{State: models.DiskStateOK}
+	// Closed (and replaced) when the recording mode changes.
+	recordingModeChanged = make(chan struct{})
+)
+
+// GetDiskStatus returns the state of the disk watchdog.
+func GetDiskStatus() models.DiskStatus {
+	diskStatusMutex.Lock()
+	defer diskStatusMutex.Unlock()
+	return diskStatus
+}
+
+// RecordingModeChanged returns a channel that is closed when the disk watchdog changes how we record.
+func RecordingModeChanged() <-chan struct{} {
+	diskStatusMutex.Lock()
+	defer diskStatusMutex.Unlock()
+	return recordingModeChanged
+}
+
+// HandleDiskWatchdog checks the free disk space on a schedule, it keeps running as long as the agent does.
+// The configuration is read on every check, so changes are picked up without a restart.
+func HandleDiskWatchdog(configDirectory string, configuration *models.Configuration, communication *models.Communication) {
+	log.Log.Debug("capture.disk.HandleDiskWatchdog(): started")
+	for {
+		checkDisk(configDirectory, configuration, communication)
+		interval := configuration.Config.DiskWatchdog.Interval
+		if interval <= 0 {
+			interval = 30
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+func checkDisk(configDirectory string, configuration *models.Configuration, communication *models.Communication) {
+	watchdog := configuration.Config.DiskWatchdog
+	previous := GetDiskStatus()
+	status := previous
+	status.Checked = time.Now().UnixMilli()
+
+	if watchdog.Enabled != "true" {
+		status.State = models.DiskStateOK
+	} else {
+		total, free, err := utils.GetDiskUsage(configDirectory + "/data")
+		if err != nil {
+			log.Log.Error("capture.disk.HandleDiskWatchdog(): could not read disk usage: " + err.Error())
+			return
+		}
+		thresholds := diskThresholds(watchdog)
+		level := nextDiskLevel(diskLevel(previous.State), freePercentage(total, free), thresholds)
+
+		// Make room, before we degrade recording any further.
+		if level > 0 && thresholds[1] > 0 {
+			ApplyEmergencyRetention(configDirectory, configuration, float64(thresholds[1])+diskWatchdogMargin)
+			if total, free, err = utils.GetDiskUsage(configDirectory + "/data"); err != nil {
+				log.Log.Error("capture.disk.HandleDiskWatchdog(): could not read disk usage: " + err.Error())
+				return
+			}
+			level = nextDiskLevel(level, freePercentage(total, free), thresholds)
+		}
+		status.State = diskStates[level]
+		status.Total = total
+		status.Free = free
+		status.FreePercentage = freePercentage(total, free)
+	}
+
+	if status.State != previous.State {
+		status.Since = status.Checked
+	}
+	modeChanged := diskRecordingMode(previous.State) != diskRecordingMode(status.State)
+	diskStatusMutex.Lock()
+	diskStatus = status
+	if modeChanged {
+		close(recordingModeChanged)
+		recordingModeChanged = make(chan struct{})
+	}
+	diskStatusMutex.Unlock()
+	if status.State == previous.State {
+		return
+	}
+
+	log.Log.Warning("capture.disk.HandleDiskWatchdog(): disk state changed from " + previous.State + " to " + status.State +
+		" (" + strconv.FormatFloat(status.FreePercentage, 'f', 1, 64) + "% free)")
+	if communication.HandleDiskState != nil {
+		select {
+		case communication.HandleDiskState <- status:
+		default:
+		}
+	}
+	if modeChanged {
+		log.Log.Info("capture.disk.HandleDiskWatchdog(): the recording mode changed, the recorder starts over once its recording is finished.")
+	}
+}
+
+func freePercentage(total uint64, free uint64) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(free) / float64(total) * 100
+}
+
+// diskThresholds returns the threshold (free disk percentage) of every state.
+func diskThresholds(watchdog models.DiskWatchdog) []int64 {
+	return []int64{0, watchdog.EmergencyRetention, watchdog.MotionOnly, watchdog.SubOnly, watchdog.Pause}
+}
+
+func diskLevel(state string) int {
+	for level, s := range diskStates {
+		if s == state {
+			return level
+		}
+	}
+	return 0
+}
+
+// nextDiskLevel returns the most severe state of which the threshold is reached. When the disk space
+// recovers, we step back as long as the free disk space is a margin above the threshold.
+func nextDiskLevel(current int, free float64, thresholds []int64) int {
+	level := 0
+	for l := len(thresholds) - 1; l > 0; l-- {
+		if thresholds[l] > 0 && free < float64(thresholds[l]) {
+			level = l
+			break
+		}
+	}
+	for l := current; l > level; l-- {
+		if thresholds[l] > 0 && free < float64(thresholds[l])+diskWatchdogMargin {
+			return l
+		}
+	}
+	return level
+}
+
+// diskRecordingMode returns how we record in a state, emergency retention doesn't change the recording.
+func diskRecordingMode(state string) string {
+	if state == models.DiskStateEmergencyRetention {
+		return models.DiskStateOK
+	}
+	return state
+}
+
+// RecordingConfiguration returns the configuration the recorder (and motion detection) should use, as
+// the disk watchdog can degrade recording. The configuration itself is not changed. If the sub stream
+// should be recorded instead of the main stream, true is returned. Without a sub stream we fall back
+// to motion based recording of the main stream.
+func RecordingConfiguration(configuration *models.Configuration, hasSubStream bool) (*models.Configuration, bool) {
+	state := GetDiskStatus().State
+	if diskRecordingMode(state) == models.DiskStateOK {
+		return configuration, false
+	}
+
+	// The structs we change are copied, so the configuration itself is left as it is.
+	config := configuration.Config
+	capture := config.Capture
+	ipCamera := capture.IPCamera
+	capture.Continuous = "false"
+	recordSubStream := false
+	switch state {
+	case models.DiskStateSubOnly:
+		capture.SubRecording = "false"
+		if hasSubStream {
+			ipCamera.Width = ipCamera.SubWidth
+			ipCamera.Height = ipCamera.SubHeight
+			recordSubStream = true
+		}
+	case models.DiskStatePaused:
+		capture.Recording = "false"
+	}
+	capture.IPCamera = ipCamera
+	config.Capture = capture
+	degraded := *configuration
+	degraded.Config = config
+	return &degraded, recordSubStream
+}
+
+// SubOnlyEnabled returns true if the disk watchdog can record the sub stream instead of the main stream,
+// the sub stream then needs the same pre-recording as the main stream.
+func SubOnlyEnabled(config models.Config) bool {
+	return config.DiskWatchdog.Enabled == "true" && config.DiskWatchdog.SubOnly > 0
+}
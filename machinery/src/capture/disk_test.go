@@ -0,0 +1,77 @@
+package capture
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+func TestRecordingConfiguration(t *testing.T) {
+	tests := []struct {
+		state        string
+		hasSubStream bool
+		// What we expect.
+		recordSubStream bool
+		continuous      string
+		recording       string
+		subRecording    string
+		width           int
+	}{
+		{state: models.DiskStateOK, continuous: "true", recording: "true", subRecording: "true", width: 1920},
+		{state: models.DiskStateEmergencyRetention, continuous: "true", recording: "true", subRecording: "true", width: 1920},
+		{state: models.DiskStateMotionOnly, continuous: "false", recording: "true", subRecording: "true", width: 1920},
+		{state: models.DiskStateSubOnly, hasSubStream: true, recordSubStream: true, continuous: "false", recording: "true", subRecording: "false", width: 640},
+		{state: models.DiskStateSubOnly, continuous: "false", recording: "true", subRecording: "false", width: 1920},
+		{state: models.DiskStatePaused, continuous: "false", recording: "false", subRecording: "true", width: 1920},
+	}
+	defer func() { diskStatus = models.DiskStatus{State: models.DiskStateOK} }()
+	for _, test := range tests {
+		t.Run(test.state, func(t *testing.T) {
+			configuration := &models.Configuration{}
+			configuration.Config.Capture.Continuous = "true"
+			configuration.Config.Capture.Recording = "true"
+			configuration.Config.Capture.SubRecording = "true"
+			configuration.Config.Capture.IPCamera.Width = 1920
+			configuration.Config.Capture.IPCamera.SubWidth = 640
+			original := *configuration
+			diskStatus = models.DiskStatus{State: test.state}
+
+			recordingConfiguration, recordSubStream := RecordingConfiguration(configuration, test.hasSubStream)
+			capture := recordingConfiguration.Config.Capture
+			if recordSubStream != test.recordSubStream || capture.Continuous != test.continuous || capture.Recording != test.recording ||
+				capture.SubRecording != test.subRecording || capture.IPCamera.Width != test.width {
+				t.Errorf("unexpected recording configuration %+v (sub stream %v)", capture, recordSubStream)
+			}
+			// The configuration itself is never changed.
+			if !reflect.DeepEqual(*configuration, original) {
+				t.Error("the configuration was changed")
+			}
+		})
+	}
+}
+
+func TestRecordingModeChanged(t *testing.T) {
+	defer func() { diskStatus = models.DiskStatus{State: models.DiskStateOK} }()
+	configuration := &models.Configuration{}
+	communication := &models.Communication{}
+	setState := func(state string) {
+		// With the watchdog disabled the state is OK, so we set the state it changes from.
+		diskStatus = models.DiskStatus{State: state}
+		checkDisk(t.TempDir(), configuration, communication)
+	}
+
+	// Leaving emergency retention doesn't change how we record.
+	modeChanged := RecordingModeChanged()
+	setState(models.DiskStateEmergencyRetention)
+	if isCancelled(modeChanged) {
+		t.Error("leaving emergency retention shouldn't change the recording mode")
+	}
+	setState(models.DiskStateMotionOnly)
+	if !isCancelled(modeChanged) {
+		t.Error("leaving motion only should change the recording mode")
+	}
+	if isCancelled(RecordingModeChanged()) {
+		t.Error("the recording mode should only change once")
+	}
+}
@@ -0,0 +1,915 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	amp4 "github.com/abema/go-mp4"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/kerberos-io/agent/machinery/src/database"
+	"github.com/kerberos-io/agent/machinery/src/encryption"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// ErrNoFootage is returned when there are no recordings (with a keyframe) in the requested time range.
+var ErrNoFootage = errors.New("no footage found in the requested time range")
+
+// errStopDemuxing is returned by a packet handler to stop demuxing a recording, it's not an error.
+var errStopDemuxing = errors.New("stop demuxing")
+
+const (
+	// The largest sample (or Matroska block) we read from a recording.
+	maxRecordingSampleSize = 32 << 20
+	// The largest fragment (a moof and its mdat box) we read from a fragmented MP4.
+	maxRecordingFragmentSize = 64 << 20
+)
+
+// ExportResult describes the clip that was exported.
+type ExportResult struct {
+	StartTime  int64    // Unix timestamp in milliseconds, of the first keyframe.
+	EndTime    int64    // Unix timestamp in milliseconds, of the last packet.
+	Recordings []string // The recordings the clip was stitched from.
+}
+
+// ExportRecordings writes the footage between from and to (unix timestamps in milliseconds) into a
+// single MP4. The recordings that overlap the time range are remuxed (not re-encoded), so the clip
+// starts at the last keyframe before from, and ends at the first keyframe after to. Encrypted
+// recordings are decrypted while they're read, the clip itself is not encrypted.
+func ExportRecordings(configDirectory string, configuration *models.Configuration, from int64, to int64, output io.WriteSeeker) (ExportResult, error) {
+	var result ExportResult
+	if to <= from {
+		return result, errors.New("the end of the time range should be after the start")
+	}
+
+	recordings, err := database.ListRecordings()
+	if err != nil {
+		recordings, err = database.ScanRecordings(configDirectory)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	config := configuration.Config
+	exporter := &clipExporter{
+		from:   from,
+		to:     to,
+		output: output,
+		width:  config.Capture.IPCamera.Width,
+		height: config.Capture.IPCamera.Height,
+	}
+
+	// Recordings without metadata don't have an end time, so we assume the maximum length.
+	maxLength := config.Capture.MaxLengthRecording + config.Capture.PostRecording
+	if maxLength <= 0 {
+		maxLength = 60
+	}
+	for _, recording := range recordings {
+		if exporter.done {
+			break
+		}
+		start := recording.StartTime
+		end := start + maxLength*1000
+		if recording.Metadata != nil && recording.Metadata.EndTime > start {
+			end = recording.Metadata.EndTime
+		}
+		// Recordings of the sub stream have a different resolution, they can't be stitched to the main stream.
+		if end < from || start >= to || utils.IsSubRecording(recording.Name) {
+			continue
+		}
+		// In multi-camera mode the recordings of all cameras are stored together.
+		if configuration.CameraID != "" && (recording.Metadata == nil || recording.Metadata.CameraKey != config.Key) {
+			continue
+		}
+
+		file, reader, err := openRecording(configDirectory+"/data/recordings/"+recording.Name, configuration)
+		if err != nil {
+			log.Log.Error("capture.export.ExportRecordings(): could not read " + recording.Name + ": " + err.Error())
+			continue
+		}
+		used, err := exporter.addRecording(recording.Name, reader, start)
+		file.Close()
+		if err != nil {
+			return result, err
+		}
+		if used {
+			result.Recordings = append(result.Recordings, recording.Name)
+		}
+	}
+
+	if exporter.writer == nil {
+		return result, ErrNoFootage
+	}
+	if err := exporter.writer.Close(); err != nil {
+		return result, err
+	}
+	result.StartTime = exporter.start
+	result.EndTime = exporter.end
+	return result, nil
+}
+
+// clipExporter writes the packets of consecutive recordings into a single MP4, packets are
+// timestamped in milliseconds since epoch.
+type clipExporter struct {
+	from   int64
+	to     int64
+	output io.WriteSeeker
+	width  int
+	height int
+
+	writer     *MP4Writer
+	videoCodec string
+	hasAudio   bool
+	// The packets since the last keyframe, before the clip started.
+	pending   []exportPacket
+	start     int64
+	end       int64
+	lastVideo int64
+	lastAudio int64
+	done      bool
+}
+
+type exportPacket struct {
+	packet packets.Packet
+	time   int64
+}
+
+// addRecording adds the packets of a recording while it's demuxed, returns true if any of them ended
+// up in the clip. A recording that can't be demuxed is skipped (from where it went wrong), only an
+// error writing the clip is returned.
+func (e *clipExporter) addRecording(name string, reader io.ReadSeeker, start int64) (bool, error) {
+	// Recordings can overlap (e.g. a motion recording during pre-recording), so video of the next
+	// recording is only written from a keyframe after the last video we wrote.
+	synced := e.writer == nil
+	used := false
+	started := false
+	var first time.Duration
+	var writeErr error
+	_, err := demuxRecording(reader, func(tracks recordingTracks, pkt packets.Packet) error {
+		if e.done {
+			return errStopDemuxing
+		}
+		if !started {
+			if e.writer != nil && tracks.videoCodec != e.videoCodec {
+				log.Log.Warning("capture.export.addRecording(): skipping " + name + ", the video codec changed from " + e.videoCodec + " to " + tracks.videoCodec)
+				return errStopDemuxing
+			}
+			if e.writer == nil {
+				e.videoCodec = tracks.videoCodec
+				e.hasAudio = tracks.hasAudio
+			}
+			started = true
+			first = pkt.Time
+		}
+		t := start + (pkt.Time - first).Milliseconds()
+		if e.writer != nil {
+			if pkt.IsVideo && !synced {
+				if !pkt.IsKeyFrame || t <= e.lastVideo {
+					return nil
+				}
+				synced = true
+			}
+			if pkt.IsAudio && (!tracks.hasAudio || t <= e.lastAudio) {
+				return nil
+			}
+		}
+		written, err := e.push(pkt, t)
+		if err != nil {
+			writeErr = err
+			return err
+		}
+		used = used || written
+		return nil
+	})
+	if writeErr != nil {
+		return used, writeErr
+	}
+	if err != nil {
+		log.Log.Error("capture.export.addRecording(): could not demux " + name + ": " + err.Error())
+	}
+	return used, nil
+}
+
+// push adds a single packet, packets are kept until we reach the start of the range, so the clip
+// can start with the last keyframe before the range.
+func (e *clipExporter) push(pkt packets.Packet, t int64) (bool, error) {
+	if pkt.IsVideo && pkt.IsKeyFrame && t >= e.to {
+		e.done = true
+		// The range is within a single group of pictures.
+		if e.writer == nil && len(e.pending) > 0 {
+			return true, e.startClip()
+		}
+		return false, nil
+	}
+
+	if e.writer == nil {
+		if pkt.IsVideo && pkt.IsKeyFrame {
+			e.pending = e.pending[:0]
+		}
+		if len(e.pending) == 0 && !(pkt.IsVideo && pkt.IsKeyFrame) {
+			return false, nil
+		}
+		e.pending = append(e.pending, exportPacket{packet: pkt, time: t})
+		if t >= e.from {
+			return true, e.startClip()
+		}
+		return false, nil
+	}
+	return true, e.write(pkt, t)
+}
+
+func (e *clipExporter) startClip() error {
+	writer, err := NewMP4Writer(e.output, e.videoCodec, e.width, e.height, e.hasAudio)
+	if err != nil {
+		return err
+	}
+	e.writer = writer
+	e.start = e.pending[0].time
+	e.lastVideo = e.start - 1
+	e.lastAudio = e.start - 1
+	for _, p := range e.pending {
+		if err := e.write(p.packet, p.time); err != nil {
+			return err
+		}
+	}
+	e.pending = nil
+	return nil
+}
+
+func (e *clipExporter) write(pkt packets.Packet, t int64) error {
+	if pkt.IsAudio {
+		if !e.hasAudio || t >= e.to || t <= e.lastAudio {
+			return nil
+		}
+		e.lastAudio = t
+	} else {
+		if t <= e.lastVideo {
+			return nil
+		}
+		e.lastVideo = t
+	}
+	if t > e.end {
+		e.end = t
+	}
+	pkt.Time = time.Duration(t-e.start) * time.Millisecond
+	return e.writer.WritePacket(pkt)
+}
+
+// openRecording opens a recording for reading, encrypted recordings are decrypted while they're read.
+// The file should be closed when the recording is read.
+func openRecording(recordingPath string, configuration *models.Configuration) (*os.File, io.ReadSeeker, error) {
+	file, err := os.Open(recordingPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	symmetricKey := ""
+	encryptedRecordings := ""
+	if configuration.Config.Encryption != nil {
+		symmetricKey = configuration.Config.Encryption.SymmetricKey
+		encryptedRecordings = configuration.Config.Encryption.Recordings
+	}
+
+	header := make([]byte, encryption.ChunkedHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	header = header[:n]
+
+	var reader io.ReadSeeker = file
+	if encryption.IsChunked(header) {
+		reader, err = encryption.NewReader(file, symmetricKey)
+	} else if encryption.IsLegacy(header) && encryptedRecordings == "true" && symmetricKey != "" {
+		reader, err = encryption.NewLegacyReader(file, symmetricKey)
+	}
+	if err == nil {
+		_, err = reader.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, reader, nil
+}
+
+// recordingTracks describes the tracks of a recording.
+type recordingTracks struct {
+	videoCodec string // H264 or H265.
+	hasAudio   bool   // An AAC track.
+}
+
+// demuxRecording reads the packets of a recording (MP4, fragmented MP4, MPEG-TS or Matroska), in the same format
+// as the packets of the queue: Annex-B video with the parameter sets on keyframes, and ADTS audio. Only AAC audio
+// is returned. The packets are passed to onPacket while the recording is read, in the order of their (decode)
+// time, together with the tracks of the recording. When onPacket returns an error, demuxing stops and the error
+// is returned, unless it's errStopDemuxing. The recording is validated while it's read, a malformed recording
+// returns an error.
+func demuxRecording(reader io.ReadSeeker, onPacket func(recordingTracks, packets.Packet) error) (recordingTracks, error) {
+	header := make([]byte, 2*mpegTSPacketSize)
+	n, err := io.ReadFull(reader, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return recordingTracks{}, err
+	}
+	header = header[:n]
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return recordingTracks{}, err
+	}
+
+	// Packets are only passed on once we know the video track.
+	handler := func(tracks recordingTracks, pkt packets.Packet) error {
+		if tracks.videoCodec == "" {
+			return errors.New("no video track found")
+		}
+		return onPacket(tracks, pkt)
+	}
+	var tracks recordingTracks
+	if isMatroska(header) {
+		tracks, err = demuxMatroska(reader, handler)
+	} else if isMPEGTS(header) {
+		tracks, err = demuxMPEGTS(reader, handler)
+	} else {
+		var fragmented bool
+		if fragmented, err = isFragmentedMP4(reader); err == nil {
+			if fragmented {
+				tracks, err = demuxFragmentedMP4(reader, handler)
+			} else {
+				tracks, err = demuxMP4(reader, handler)
+			}
+		}
+	}
+	if err == errStopDemuxing {
+		err = nil
+	}
+	if err == nil && tracks.videoCodec == "" {
+		err = errors.New("no video track found")
+	}
+	return tracks, err
+}
+
+// readBoxHeader reads the header of the (MP4) box at the current position, and returns its type,
+// its size (including the header) and the size of the header.
+func readBoxHeader(reader io.Reader) (string, int64, int64, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header[:8]); err != nil {
+		return "", 0, 0, err
+	}
+	boxType := string(header[4:8])
+	size := int64(binary.BigEndian.Uint32(header))
+	headerSize := int64(8)
+	if size == 1 {
+		if _, err := io.ReadFull(reader, header[8:]); err != nil {
+			return "", 0, 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(header[8:]))
+		headerSize = 16
+	}
+	if size < headerSize {
+		return "", 0, 0, errors.New("invalid size of the " + boxType + " box")
+	}
+	return boxType, size, headerSize, nil
+}
+
+// isFragmentedMP4 returns true if the MP4 has a moof box.
+func isFragmentedMP4(reader io.ReadSeeker) (bool, error) {
+	defer reader.Seek(0, io.SeekStart)
+	for {
+		boxType, size, headerSize, err := readBoxHeader(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if boxType == "moof" {
+			return true, nil
+		}
+		if _, err := reader.Seek(size-headerSize, io.SeekCurrent); err != nil {
+			return false, err
+		}
+	}
+}
+
+// mp4Track is a track of a (non fragmented) MP4, it's read from the sample table.
+type mp4Track struct {
+	codec         string // H264, H265 or AAC.
+	timeScale     uint64
+	lengthSize    int      // Of the length prefix of the NAL units.
+	parameterSets [][]byte // Added in front of the keyframes.
+	audioConfig   mpeg4audio.Config
+	samples       []mp4Sample
+	next          int
+}
+
+type mp4Sample struct {
+	offset    int64
+	size      int64
+	dts       uint64
+	ptsOffset int64
+}
+
+// demuxMP4 reads the packets of a (non fragmented) MP4 from its sample table. The samples of the tracks
+// are interleaved on their decode time, and read one at a time.
+func demuxMP4(reader io.ReadSeeker, onPacket func(recordingTracks, packets.Packet) error) (recordingTracks, error) {
+	var tracks recordingTracks
+	mp4Tracks, err := readMP4Tracks(reader)
+	if err != nil {
+		return tracks, err
+	}
+	for _, track := range mp4Tracks {
+		if track.codec == "AAC" {
+			tracks.hasAudio = true
+		} else {
+			tracks.videoCodec = track.codec
+		}
+	}
+
+	for {
+		var track *mp4Track
+		for _, t := range mp4Tracks {
+			if t.next < len(t.samples) && (track == nil || t.sampleTime(t.next) < track.sampleTime(track.next)) {
+				track = t
+			}
+		}
+		if track == nil {
+			return tracks, nil
+		}
+		sample := track.samples[track.next]
+		pkt := packets.Packet{
+			Time: track.sampleTime(track.next),
+		}
+		track.next++
+
+		if _, err := reader.Seek(sample.offset, io.SeekStart); err != nil {
+			return tracks, err
+		}
+		data := make([]byte, sample.size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return tracks, err
+		}
+		if track.codec == "AAC" {
+			pkt.IsAudio = true
+			pkt.Codec = "AAC"
+			pkt.Data, err = mpeg4audio.ADTSPackets{{
+				Type:         track.audioConfig.Type,
+				SampleRate:   track.audioConfig.SampleRate,
+				ChannelCount: track.audioConfig.ChannelCount,
+				AU:           data,
+			}}.Marshal()
+			if err != nil {
+				return tracks, err
+			}
+		} else {
+			nalus, keyFrame, err := splitLengthPrefixed(track.codec, data, track.lengthSize)
+			if err != nil {
+				return tracks, err
+			}
+			// A sample with only parameter sets.
+			if len(nalus) == 0 {
+				continue
+			}
+			if keyFrame {
+				nalus = append(append([][]byte{}, track.parameterSets...), nalus...)
+			}
+			if pkt.Data, err = h264.AnnexBMarshal(nalus); err != nil {
+				return tracks, err
+			}
+			pkt.IsVideo = true
+			pkt.IsKeyFrame = keyFrame
+			pkt.Codec = track.codec
+			pkt.CompositionTime = mp4Duration(sample.ptsOffset, track.timeScale)
+		}
+		if err := onPacket(tracks, pkt); err != nil {
+			return tracks, err
+		}
+	}
+}
+
+func (t *mp4Track) sampleTime(i int) time.Duration {
+	return mp4Duration(int64(t.samples[i].dts), t.timeScale)
+}
+
+// mp4Duration converts a timestamp in the time scale of a track to a duration.
+func mp4Duration(ts int64, timeScale uint64) time.Duration {
+	scale := int64(timeScale)
+	return time.Duration(ts/scale)*time.Second + time.Duration(ts%scale)*time.Second/time.Duration(scale)
+}
+
+// readMP4Tracks reads the sample tables of the H264, H265 and AAC tracks of an MP4 (the first video
+// and audio track). The sample tables are validated: every sample should be within the file.
+func readMP4Tracks(reader io.ReadSeeker) ([]*mp4Track, error) {
+	fileSize, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	traks, err := amp4.ExtractBoxes(reader, nil, []amp4.BoxPath{{amp4.BoxTypeMoov(), amp4.BoxTypeTrak()}})
+	if err != nil {
+		return nil, err
+	}
+	if len(traks) == 0 {
+		return nil, errors.New("no tracks found")
+	}
+
+	stbl := func(boxTypes ...amp4.BoxType) amp4.BoxPath {
+		return append(amp4.BoxPath{amp4.BoxTypeMdia(), amp4.BoxTypeMinf(), amp4.BoxTypeStbl()}, boxTypes...)
+	}
+	stsd := func(boxTypes ...amp4.BoxType) amp4.BoxPath {
+		return stbl(append([]amp4.BoxType{amp4.BoxTypeStsd()}, boxTypes...)...)
+	}
+	var tracks []*mp4Track
+	hasVideo, hasAudio := false, false
+	for _, trak := range traks {
+		boxes, err := amp4.ExtractBoxesWithPayload(reader, trak, []amp4.BoxPath{
+			{amp4.BoxTypeMdia(), amp4.BoxTypeMdhd()},
+			stsd(amp4.BoxTypeAvc1(), amp4.BoxTypeAvcC()),
+			stsd(amp4.BoxTypeHvc1(), amp4.BoxTypeHvcC()),
+			stsd(amp4.BoxTypeHev1(), amp4.BoxTypeHvcC()),
+			stsd(amp4.BoxTypeMp4a(), amp4.BoxTypeEsds()),
+			// QuickTime files have the esds box in a wave box.
+			stsd(amp4.BoxTypeMp4a(), amp4.BoxTypeWave(), amp4.BoxTypeEsds()),
+			stbl(amp4.BoxTypeStts()),
+			stbl(amp4.BoxTypeCtts()),
+			stbl(amp4.BoxTypeStsc()),
+			stbl(amp4.BoxTypeStsz()),
+			stbl(amp4.BoxTypeStco()),
+			stbl(amp4.BoxTypeCo64()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		track := &mp4Track{}
+		var stts *amp4.Stts
+		var ctts *amp4.Ctts
+		var stsc *amp4.Stsc
+		var stsz *amp4.Stsz
+		var chunkOffsets []uint64
+		for _, box := range boxes {
+			switch payload := box.Payload.(type) {
+			case *amp4.Mdhd:
+				track.timeScale = uint64(payload.Timescale)
+			case *amp4.AVCDecoderConfiguration:
+				track.codec = "H264"
+				track.lengthSize = int(payload.LengthSizeMinusOne) + 1
+				track.parameterSets = avcParameterSets(payload)
+			case *amp4.HvcC:
+				track.codec = "H265"
+				track.lengthSize = int(payload.LengthSizeMinusOne) + 1
+				track.parameterSets = hevcParameterSets(payload)
+			case *amp4.Esds:
+				for _, descriptor := range payload.Descriptors {
+					if descriptor.Tag == amp4.DecSpecificInfoTag {
+						if err := track.audioConfig.Unmarshal(descriptor.Data); err != nil {
+							return nil, err
+						}
+						track.codec = "AAC"
+					}
+				}
+			case *amp4.Stts:
+				stts = payload
+			case *amp4.Ctts:
+				ctts = payload
+			case *amp4.Stsc:
+				stsc = payload
+			case *amp4.Stsz:
+				stsz = payload
+			case *amp4.Stco:
+				for _, offset := range payload.ChunkOffset {
+					chunkOffsets = append(chunkOffsets, uint64(offset))
+				}
+			case *amp4.Co64:
+				chunkOffsets = append(chunkOffsets, payload.ChunkOffset...)
+			}
+		}
+		// Tracks of other codecs, and additional video or audio tracks, are skipped.
+		if track.codec == "" || (track.codec == "AAC" && hasAudio) || (track.codec != "AAC" && hasVideo) {
+			continue
+		}
+		if track.timeScale == 0 || stts == nil || stsc == nil || stsz == nil || chunkOffsets == nil {
+			return nil, errors.New("the sample table of the " + track.codec + " track is incomplete")
+		}
+		if track.samples, err = readMP4Samples(stts, ctts, stsc, stsz, chunkOffsets, fileSize); err != nil {
+			return nil, errors.New("the sample table of the " + track.codec + " track is invalid: " + err.Error())
+		}
+		hasAudio = hasAudio || track.codec == "AAC"
+		hasVideo = hasVideo || track.codec != "AAC"
+		tracks = append(tracks, track)
+	}
+	return tracks, nil
+}
+
+// readMP4Samples returns where the samples of a track are, and their timestamps.
+func readMP4Samples(stts *amp4.Stts, ctts *amp4.Ctts, stsc *amp4.Stsc, stsz *amp4.Stsz, chunkOffsets []uint64, fileSize int64) ([]mp4Sample, error) {
+	sampleCount := len(stsz.EntrySize)
+	if stsz.SampleSize != 0 {
+		// Every sample has at least a byte, so a sample table can't have more samples than the file has bytes.
+		if int64(stsz.SampleCount) > fileSize/int64(stsz.SampleSize) {
+			return nil, errors.New("more samples than fit in the file")
+		}
+		sampleCount = int(stsz.SampleCount)
+	}
+	for i, entry := range stsc.Entries {
+		if entry.FirstChunk == 0 || int(entry.FirstChunk) > len(chunkOffsets) || (i > 0 && entry.FirstChunk <= stsc.Entries[i-1].FirstChunk) {
+			return nil, errors.New("invalid sample to chunk table")
+		}
+	}
+
+	samples := make([]mp4Sample, 0, sampleCount)
+	entry := 0
+	for chunk, chunkOffset := range chunkOffsets {
+		for entry+1 < len(stsc.Entries) && int(stsc.Entries[entry+1].FirstChunk) <= chunk+1 {
+			entry++
+		}
+		if len(stsc.Entries) == 0 || int(stsc.Entries[entry].FirstChunk) > chunk+1 {
+			return nil, errors.New("a chunk is missing in the sample to chunk table")
+		}
+		offset := int64(chunkOffset)
+		for i := uint32(0); i < stsc.Entries[entry].SamplesPerChunk && len(samples) < sampleCount; i++ {
+			size := int64(stsz.SampleSize)
+			if size == 0 {
+				size = int64(stsz.EntrySize[len(samples)])
+			}
+			if offset < 0 || size > maxRecordingSampleSize || offset > fileSize || size > fileSize-offset {
+				return nil, errors.New("a sample is outside of the file")
+			}
+			samples = append(samples, mp4Sample{offset: offset, size: size})
+			offset += size
+		}
+	}
+	if len(samples) < sampleCount {
+		return nil, errors.New("more samples than in the chunks")
+	}
+
+	// Samples without a duration (or composition offset) in the table get zero.
+	dts := uint64(0)
+	i := 0
+	for _, entry := range stts.Entries {
+		for n := uint32(0); n < entry.SampleCount && i < len(samples); n++ {
+			samples[i].dts = dts
+			dts += uint64(entry.SampleDelta)
+			i++
+		}
+	}
+	for ; i < len(samples); i++ {
+		samples[i].dts = dts
+	}
+	if ctts != nil {
+		i = 0
+		for index, entry := range ctts.Entries {
+			// QuickTime files use negative offsets (version 0 of the ctts box is unsigned).
+			ptsOffset := int64(int32(ctts.GetSampleOffset(index)))
+			for n := uint32(0); n < entry.SampleCount && i < len(samples); n++ {
+				samples[i].ptsOffset = ptsOffset
+				i++
+			}
+		}
+	}
+	return samples, nil
+}
+
+// avcParameterSets returns the parameter sets of an AVC decoder configuration (avcC).
+func avcParameterSets(avcC *amp4.AVCDecoderConfiguration) [][]byte {
+	var parameterSets [][]byte
+	for _, sps := range avcC.SequenceParameterSets {
+		parameterSets = append(parameterSets, sps.NALUnit)
+	}
+	for _, pps := range avcC.PictureParameterSets {
+		parameterSets = append(parameterSets, pps.NALUnit)
+	}
+	return parameterSets
+}
+
+// hevcParameterSets returns the parameter sets (VPS, SPS and PPS) of an HEVC decoder configuration (hvcC).
+func hevcParameterSets(hvcC *amp4.HvcC) [][]byte {
+	var parameterSets [][]byte
+	for _, naluType := range []uint8{32, 33, 34} {
+		for _, array := range hvcC.NaluArrays {
+			if array.NaluType != naluType {
+				continue
+			}
+			for _, nalu := range array.Nalus {
+				parameterSets = append(parameterSets, nalu.NALUnit)
+			}
+		}
+	}
+	return parameterSets
+}
+
+// splitLengthPrefixed splits a length prefixed (H264 or H265) sample into NAL units, and returns if it's a
+// keyframe. The parameter sets and access unit delimiters in the sample are dropped.
+func splitLengthPrefixed(videoCodec string, sample []byte, lengthSize int) ([][]byte, bool, error) {
+	var nalus [][]byte
+	keyFrame := false
+	for len(sample) > 0 {
+		if len(sample) < lengthSize {
+			return nil, false, errors.New("invalid NAL unit length")
+		}
+		size := 0
+		for _, b := range sample[:lengthSize] {
+			size = size<<8 | int(b)
+		}
+		sample = sample[lengthSize:]
+		if size > len(sample) {
+			return nil, false, errors.New("the NAL unit is longer than the sample")
+		}
+		nalu := sample[:size]
+		sample = sample[size:]
+		if size == 0 {
+			continue
+		}
+		if videoCodec == "H265" {
+			switch (nalu[0] >> 1) & 0x3F {
+			case 32, 33, 34, 35:
+				continue
+			case 16, 17, 18, 19, 20, 21:
+				keyFrame = true
+			}
+		} else {
+			switch h264.NALUType(nalu[0] & 0x1F) {
+			case h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeAccessUnitDelimiter:
+				continue
+			case h264.NALUTypeIDR:
+				keyFrame = true
+			}
+		}
+		nalus = append(nalus, nalu)
+	}
+	return nalus, keyFrame, nil
+}
+
+// demuxFragmentedMP4 reads the packets of a fragmented MP4, a fragment (a moof and its mdat box) at a time.
+func demuxFragmentedMP4(reader io.ReadSeeker, onPacket func(recordingTracks, packets.Packet) error) (recordingTracks, error) {
+	var tracks recordingTracks
+	var init fmp4.Init
+	if err := init.Unmarshal(reader); err != nil {
+		return tracks, err
+	}
+	initTracks := make(map[int]*fmp4.InitTrack)
+	var parameterSets [][]byte
+	for _, track := range init.Tracks {
+		switch codec := track.Codec.(type) {
+		case *fmp4.CodecH264:
+			tracks.videoCodec = "H264"
+			parameterSets = [][]byte{codec.SPS, codec.PPS}
+		case *fmp4.CodecH265:
+			tracks.videoCodec = "H265"
+			parameterSets = [][]byte{codec.VPS, codec.SPS, codec.PPS}
+		case *fmp4.CodecMPEG4Audio:
+			tracks.hasAudio = true
+		default:
+			continue
+		}
+		if track.TimeScale == 0 {
+			return tracks, errors.New("invalid time scale")
+		}
+		initTracks[track.ID] = track
+	}
+
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return tracks, err
+	}
+	var fragment []byte
+	for {
+		boxType, size, headerSize, err := readBoxHeader(reader)
+		if err == io.EOF {
+			return tracks, nil
+		} else if err != nil {
+			return tracks, err
+		}
+		// A fragment is read into memory when its mdat box follows, other boxes are skipped.
+		if boxType != "moof" && (boxType != "mdat" || fragment == nil) {
+			fragment = nil
+			if _, err := reader.Seek(size-headerSize, io.SeekCurrent); err != nil {
+				return tracks, err
+			}
+			continue
+		}
+		if size > maxRecordingFragmentSize-int64(len(fragment)) {
+			return tracks, errors.New("the fragment is too large")
+		}
+		box := make([]byte, size)
+		if _, err := reader.Seek(-headerSize, io.SeekCurrent); err != nil {
+			return tracks, err
+		}
+		if _, err := io.ReadFull(reader, box); err != nil {
+			return tracks, err
+		}
+		if boxType == "moof" {
+			fragment = box
+			continue
+		}
+		fragment = append(fragment, box...)
+
+		var parts fmp4.Parts
+		if err := parts.Unmarshal(fragment); err != nil {
+			return tracks, err
+		}
+		fragment = nil
+		fragmentPackets, err := readFragment(parts, initTracks, tracks.videoCodec, parameterSets)
+		if err != nil {
+			return tracks, err
+		}
+		for _, pkt := range fragmentPackets {
+			if err := onPacket(tracks, pkt); err != nil {
+				return tracks, err
+			}
+		}
+	}
+}
+
+// readFragment returns the packets of a fragment, sorted on time.
+func readFragment(parts fmp4.Parts, tracks map[int]*fmp4.InitTrack, videoCodec string, parameterSets [][]byte) ([]packets.Packet, error) {
+	var fragmentPackets []packets.Packet
+	for _, part := range parts {
+		for _, partTrack := range part.Tracks {
+			track, ok := tracks[partTrack.ID]
+			if !ok {
+				continue
+			}
+			timeScale := uint64(track.TimeScale)
+			ts := partTrack.BaseTime
+			for _, sample := range partTrack.Samples {
+				pkt := packets.Packet{
+					Time: mp4Duration(int64(ts), timeScale),
+				}
+				ts += uint64(sample.Duration)
+
+				if audioCodec, ok := track.Codec.(*fmp4.CodecMPEG4Audio); ok {
+					adts, err := mpeg4audio.ADTSPackets{{
+						Type:         audioCodec.Type,
+						SampleRate:   audioCodec.SampleRate,
+						ChannelCount: audioCodec.ChannelCount,
+						AU:           sample.Payload,
+					}}.Marshal()
+					if err != nil {
+						return nil, err
+					}
+					pkt.IsAudio = true
+					pkt.Codec = "AAC"
+					pkt.Data = adts
+				} else {
+					au, err := sample.GetH26x()
+					if err != nil {
+						return nil, err
+					}
+					if !sample.IsNonSyncSample {
+						au = append(append([][]byte{}, parameterSets...), au...)
+					}
+					pkt.Data, err = h264.AnnexBMarshal(au)
+					if err != nil {
+						return nil, err
+					}
+					pkt.IsVideo = true
+					pkt.IsKeyFrame = !sample.IsNonSyncSample
+					pkt.Codec = videoCodec
+					pkt.CompositionTime = mp4Duration(int64(sample.PTSOffset), timeScale)
+				}
+				fragmentPackets = append(fragmentPackets, pkt)
+			}
+		}
+	}
+
+	// The fragments hold the samples per track, we interleave them on time.
+	sort.SliceStable(fragmentPackets, func(i, j int) bool {
+		return fragmentPackets[i].Time < fragmentPackets[j].Time
+	})
+	return fragmentPackets, nil
+}
+
+// isKeyFrame returns true if the (Annex-B) access unit contains an IDR (or IRAP for H265) slice.
+func isKeyFrame(videoCodec string, data []byte) bool {
+	au, _, err := SplitAccessUnit(videoCodec, data)
+	if err != nil {
+		return false
+	}
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		if _, _, keyFrame := startsAccessUnit(videoCodec, nalu); keyFrame {
+			return true
+		}
+	}
+	return false
+}
+
+// unmarshalDecoderConfiguration reads the parameter sets, and the size of the length prefix of the NAL
+// units, from an AVC (avcC) or HEVC (hvcC) decoder configuration.
+func unmarshalDecoderConfiguration(videoCodec string, data []byte) ([][]byte, int, error) {
+	if videoCodec == "H265" {
+		var hvcC amp4.HvcC
+		if _, err := amp4.Unmarshal(bytes.NewReader(data), uint64(len(data)), &hvcC, amp4.Context{}); err != nil {
+			return nil, 0, err
+		}
+		return hevcParameterSets(&hvcC), int(hvcC.LengthSizeMinusOne) + 1, nil
+	}
+	avcC := amp4.AVCDecoderConfiguration{AnyTypeBox: amp4.AnyTypeBox{Type: amp4.BoxTypeAvcC()}}
+	if _, err := amp4.Unmarshal(bytes.NewReader(data), uint64(len(data)), &avcC, amp4.Context{}); err != nil {
+		return nil, 0, err
+	}
+	return avcParameterSets(&avcC), int(avcC.LengthSizeMinusOne) + 1, nil
+}
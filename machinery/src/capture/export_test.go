@@ -0,0 +1,155 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+func TestExportRecordings(t *testing.T) {
+	// Three consecutive recordings of 4 seconds, with a keyframe every second.
+	const start = int64(1700000000000)
+	names := []string{
+		"1700000000_6-967003_frontdoor_200-200-400-400_24_769.mp4",
+		"1700000004_6-967003_frontdoor_200-200-400-400_24_769.mp4",
+		"1700000008_6-967003_frontdoor_200-200-400-400_24_769.mp4",
+	}
+	tests := []struct {
+		name      string
+		encrypted bool
+		from      int64
+		to        int64
+		// What we expect.
+		err         error
+		recordings  []string
+		startTime   int64
+		endTime     int64
+		videoFrames int
+	}{
+		{
+			name:      "range that covers several recordings",
+			encrypted: true,
+			from:      start + 2500,
+			to:        start + 9500,
+			// The clip starts at the keyframe before the range, and ends before the keyframe after it.
+			recordings: names,
+			startTime:  start + 2000, endTime: start + 9960,
+			videoFrames: 200,
+		},
+		{
+			name: "range that starts on a keyframe",
+			from: start + 4000,
+			to:   start + 6000,
+			// The first recording ends before the range, so none of it is used. The last packet is
+			// an audio frame, audio is only exported up to the end of the range.
+			recordings: names[1:2],
+			startTime:  start + 4000, endTime: start + 5984,
+			videoFrames: 50,
+		},
+		{
+			name: "range after the last recording",
+			from: start + 20000,
+			to:   start + 30000,
+			err:  ErrNoFootage,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configDirectory := t.TempDir()
+			if err := os.MkdirAll(configDirectory+"/data/recordings", 0755); err != nil {
+				t.Fatal(err)
+			}
+			configuration := &models.Configuration{}
+			configuration.Config.Key = "frontdoor"
+			configuration.Config.Capture.IPCamera.Width = 640
+			configuration.Config.Capture.IPCamera.Height = 480
+			if test.encrypted {
+				configuration.Config.Encryption = &models.Encryption{
+					Enabled:      "true",
+					Recordings:   "true",
+					SymmetricKey: testRecoveryKey,
+				}
+			}
+			for _, name := range names {
+				writeTestRecording(t, configDirectory, configuration, name, true)
+			}
+
+			clipPath := t.TempDir() + "/clip.mp4"
+			clip, err := os.Create(clipPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clip.Close()
+			result, err := ExportRecordings(configDirectory, configuration, test.from, test.to, clip)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("error is %v, expected %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			if !reflect.DeepEqual(result.Recordings, test.recordings) {
+				t.Errorf("exported %v, expected %v", result.Recordings, test.recordings)
+			}
+			if result.StartTime != test.startTime || result.EndTime != test.endTime {
+				t.Errorf("the clip is from %d to %d, expected %d to %d", result.StartTime, result.EndTime, test.startTime, test.endTime)
+			}
+
+			// The clip should play from its first keyframe, without gaps between the recordings.
+			videoFrames, audioFrames := 0, 0
+			for _, pkt := range readTestRecording(t, clipPath) {
+				if pkt.IsAudio {
+					audioFrames++
+					continue
+				}
+				if videoFrames == 0 && !pkt.IsKeyFrame {
+					t.Error("the clip doesn't start with a keyframe")
+				}
+				if expected := time.Duration(videoFrames) * 40 * time.Millisecond; pkt.Time != expected {
+					t.Fatalf("video frame %d is at %s, expected %s", videoFrames, pkt.Time, expected)
+				}
+				videoFrames++
+			}
+			if videoFrames != test.videoFrames {
+				t.Errorf("%d video frames, expected %d", videoFrames, test.videoFrames)
+			}
+			if audioFrames == 0 {
+				t.Error("the clip has no audio")
+			}
+		})
+	}
+}
+
+func TestDemuxMalformedRecording(t *testing.T) {
+	configDirectory := t.TempDir()
+	if err := os.MkdirAll(configDirectory+"/data/recordings", 0755); err != nil {
+		t.Fatal(err)
+	}
+	recordingPath := writeTestRecording(t, configDirectory, &models.Configuration{}, testRecoveryName, true)
+	data, err := os.ReadFile(recordingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moov := bytes.Index(data, []byte("moov")) - 4
+	if moov < 0 {
+		t.Fatal("the recording has no moov box")
+	}
+
+	// A recording that is cut in its moov box, or has corrupted sample tables, is rejected (or read
+	// up to where it's corrupted) while it's demuxed.
+	for offset := moov; offset < len(data); offset += 5 {
+		corrupted := append([]byte(nil), data...)
+		copy(corrupted[offset:], []byte{0xff, 0xff, 0xff, 0xff})
+		demuxRecording(bytes.NewReader(corrupted), func(recordingTracks, packets.Packet) error { return nil })
+
+		_, err := demuxRecording(bytes.NewReader(data[:offset]), func(recordingTracks, packets.Packet) error { return nil })
+		if err == nil {
+			t.Errorf("a recording cut at %d of %d should return an error", offset, len(data))
+		}
+	}
+}
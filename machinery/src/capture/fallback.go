@@ -0,0 +1,107 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"image"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+// FallbackClient implements the RTSPClient interface, for a consumer of the sub stream (motion detection,
+// livestreams) that reads the main stream while the sub stream isn't available. A packet is decoded with
+// the client of the stream the cursor read it from. The clients are connected and closed by the agent.
+type FallbackClient struct {
+	Client   RTSPClient // The client of the sub stream.
+	Fallback RTSPClient // The client of the main stream.
+	Cursor   *packets.QueueCursor
+}
+
+var _ RTSPClient = (*FallbackClient)(nil)
+
+// NewFallbackClient returns the client for the consumer that reads the cursor.
+func NewFallbackClient(client RTSPClient, fallback RTSPClient, cursor *packets.QueueCursor) *FallbackClient {
+	return &FallbackClient{
+		Client:   client,
+		Fallback: fallback,
+		Cursor:   cursor,
+	}
+}
+
+// current returns the client of the stream the cursor read the last packet from.
+func (f *FallbackClient) current() RTSPClient {
+	if f.Cursor.IsFallback() {
+		return f.Fallback
+	}
+	return f.Client
+}
+
+// Connect does nothing, the clients are connected by the agent.
+func (f *FallbackClient) Connect(ctx context.Context) (err error) {
+	return nil
+}
+
+// ConnectBackChannel is done by a separate client.
+func (f *FallbackClient) ConnectBackChannel(ctx context.Context) (err error) {
+	return errors.New("capture.fallback.ConnectBackChannel(): the backchannel has its own client")
+}
+
+// Start does nothing, the clients are started by the agent.
+func (f *FallbackClient) Start(ctx context.Context, streamType string, queue *packets.Queue, configuration *models.Configuration, communication *models.Communication) (err error) {
+	return nil
+}
+
+// StartBackChannel is done by a separate client.
+func (f *FallbackClient) StartBackChannel(ctx context.Context) (err error) {
+	return nil
+}
+
+// Decode a packet to an image, with the client of the stream the packet was read from.
+func (f *FallbackClient) DecodePacket(pkt packets.Packet) (image.YCbCr, error) {
+	return f.current().DecodePacket(pkt)
+}
+
+// Decode a packet to a Gray image, with the client of the stream the packet was read from.
+func (f *FallbackClient) DecodePacketRaw(pkt packets.Packet) (image.Gray, error) {
+	return f.current().DecodePacketRaw(pkt)
+}
+
+// WritePacket is done by a separate client.
+func (f *FallbackClient) WritePacket(pkt packets.Packet) error {
+	return nil
+}
+
+// Close does nothing, the clients are closed by the agent.
+func (f *FallbackClient) Close() error {
+	return nil
+}
+
+// Get a list of streams of the sub stream, or of the main stream while the sub stream was never connected.
+func (f *FallbackClient) GetStreams() ([]packets.Stream, error) {
+	if streams, err := f.Client.GetStreams(); len(streams) > 0 {
+		return streams, err
+	}
+	return f.Fallback.GetStreams()
+}
+
+// Get a list of video streams of the sub stream, or of the main stream while the sub stream was never connected.
+func (f *FallbackClient) GetVideoStreams() ([]packets.Stream, error) {
+	if streams, err := f.Client.GetVideoStreams(); len(streams) > 0 {
+		return streams, err
+	}
+	return f.Fallback.GetVideoStreams()
+}
+
+// Get a list of audio streams of the sub stream, or of the main stream while the sub stream was never connected.
+func (f *FallbackClient) GetAudioStreams() ([]packets.Stream, error) {
+	if videoStreams, _ := f.Client.GetVideoStreams(); len(videoStreams) > 0 {
+		return f.Client.GetAudioStreams()
+	}
+	return f.Fallback.GetAudioStreams()
+}
+
+// GetTransport returns the transport of the stream the cursor reads.
+func (f *FallbackClient) GetTransport() string {
+	return f.current().GetTransport()
+}
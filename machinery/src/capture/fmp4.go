@@ -0,0 +1,417 @@
+package capture
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4/seekablebuffer"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+const (
+	fmp4VideoTrackID = 1
+	fmp4AudioTrackID = 2
+
+	// VideoTimeScale is the time scale of the video track of a fragmented MP4 (90kHz).
+	VideoTimeScale = 90000
+)
+
+// FragmentTrack holds the samples of a single track for the fragment that is being built.
+// A sample is only added to the fragment once the next sample arrives, as we need
+// the timestamp of the next sample to know the duration of the current one.
+type FragmentTrack struct {
+	id        int
+	timeScale uint32
+	baseTime  uint64
+	end       uint64
+	samples   []*fmp4.PartSample
+	pending   *fmp4.PartSample
+	pendingTs uint64
+}
+
+// NewVideoTrack creates the (H264 or H265) video track of a fragmented MP4.
+func NewVideoTrack() *FragmentTrack {
+	return &FragmentTrack{
+		id:        fmp4VideoTrackID,
+		timeScale: VideoTimeScale,
+	}
+}
+
+// NewAudioTrack creates the AAC audio track of a fragmented MP4, the time scale is the sample rate.
+func NewAudioTrack(config *mpeg4audio.Config) *FragmentTrack {
+	return &FragmentTrack{
+		id:        fmp4AudioTrackID,
+		timeScale: uint32(config.SampleRate),
+	}
+}
+
+// TimeScale returns the time scale of the timestamps of the track.
+func (t *FragmentTrack) TimeScale() uint32 {
+	return t.timeScale
+}
+
+// Len returns the number of samples in the fragment, without the pending sample.
+func (t *FragmentTrack) Len() int {
+	return len(t.samples)
+}
+
+// End returns the timestamp at which the last sample of the fragment ends.
+func (t *FragmentTrack) End() uint64 {
+	return t.end
+}
+
+// Push adds a sample at timestamp ts, the previous sample is moved into the fragment.
+func (t *FragmentTrack) Push(sample *fmp4.PartSample, ts uint64) {
+	t.Complete(ts)
+	t.pending = sample
+	t.pendingTs = ts
+}
+
+// Complete moves the pending sample into the fragment, ts is the timestamp of the next sample.
+func (t *FragmentTrack) Complete(ts uint64) {
+	if t.pending == nil {
+		return
+	}
+	if ts > t.pendingTs {
+		t.pending.Duration = uint32(ts - t.pendingTs)
+	}
+	t.add(t.pending)
+}
+
+// Flush moves the last sample into the fragment, this is done when the stream ends.
+// We don't know the duration of the last sample, so we reuse the duration of the previous one.
+func (t *FragmentTrack) Flush() {
+	if t.pending == nil {
+		return
+	}
+	if len(t.samples) > 0 {
+		t.pending.Duration = t.samples[len(t.samples)-1].Duration
+	}
+	t.add(t.pending)
+}
+
+func (t *FragmentTrack) add(sample *fmp4.PartSample) {
+	if len(t.samples) == 0 {
+		t.baseTime = t.pendingTs
+	}
+	t.samples = append(t.samples, sample)
+	t.end = t.pendingTs + uint64(sample.Duration)
+	t.pending = nil
+}
+
+// MarshalFragment marshals the samples of the tracks as a fragment (moof and mdat), the samples are
+// removed from the tracks. Nil is returned when none of the tracks has samples.
+func MarshalFragment(sequenceNumber uint32, tracks ...*FragmentTrack) ([]byte, error) {
+	part := fmp4.Part{
+		SequenceNumber: sequenceNumber,
+	}
+	for _, track := range tracks {
+		if track != nil && len(track.samples) > 0 {
+			part.Tracks = append(part.Tracks, &fmp4.PartTrack{
+				ID:       track.id,
+				BaseTime: track.baseTime,
+				Samples:  track.samples,
+			})
+			track.samples = nil
+		}
+	}
+	if len(part.Tracks) == 0 {
+		return nil, nil
+	}
+
+	// The part is marshalled in memory, as this requires seeking.
+	var buf seekablebuffer.Buffer
+	if err := part.Marshal(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalInit marshals the init segment (ftyp and moov) of a fragmented MP4, with a video track and,
+// when the audio config is set, an AAC audio track.
+func MarshalInit(videoCodec string, parameterSets ParameterSets, audioConfig *mpeg4audio.Config) ([]byte, error) {
+	codec, err := NewInitTrackCodec(videoCodec, parameterSets)
+	if err != nil {
+		return nil, err
+	}
+	init := fmp4.Init{
+		Tracks: []*fmp4.InitTrack{{
+			ID:        fmp4VideoTrackID,
+			TimeScale: VideoTimeScale,
+			Codec:     codec,
+		}},
+	}
+	if audioConfig != nil {
+		init.Tracks = append(init.Tracks, &fmp4.InitTrack{
+			ID:        fmp4AudioTrackID,
+			TimeScale: uint32(audioConfig.SampleRate),
+			Codec: &fmp4.CodecMPEG4Audio{
+				Config: *audioConfig,
+			},
+		})
+	}
+	var buf seekablebuffer.Buffer
+	if err := init.Marshal(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// FragmentedMP4Writer writes a fragmented MP4 (fMP4) while recording. The file starts with an
+// init segment (ftyp and moov), followed by moof/mdat fragments of (at least) the fragment duration.
+// Fragments are cut at keyframes and written as soon as they are complete, so the file can be read
+// while it's still being written, and a file that was truncated by a crash is playable up to the last fragment.
+type FragmentedMP4Writer struct {
+	writer           io.Writer
+	fragmentDuration time.Duration
+	videoCodec       string
+
+	// The parameters of the video and audio codec, these are read from the stream itself.
+	sps         []byte
+	pps         []byte
+	vps         []byte
+	audioConfig *mpeg4audio.Config
+
+	video          *FragmentTrack
+	audio          *FragmentTrack
+	started        bool
+	initWritten    bool
+	sequenceNumber uint32
+	startTime      time.Duration
+	fragmentStart  time.Duration
+}
+
+// NewFragmentedMP4Writer creates a writer for a fragmented MP4, the video codec should be either H264 or H265.
+func NewFragmentedMP4Writer(writer io.Writer, videoCodec string, fragmentDuration time.Duration) *FragmentedMP4Writer {
+	return &FragmentedMP4Writer{
+		writer:           writer,
+		videoCodec:       videoCodec,
+		fragmentDuration: fragmentDuration,
+		sequenceNumber:   1,
+		video:            NewVideoTrack(),
+	}
+}
+
+// WritePacket adds a packet to the current fragment. Packets before the first keyframe are dropped.
+func (f *FragmentedMP4Writer) WritePacket(pkt packets.Packet) error {
+	if pkt.IsVideo {
+		return f.writeVideo(pkt)
+	} else if pkt.IsAudio && pkt.Codec == "AAC" {
+		return f.writeAudio(pkt)
+	}
+	return nil
+}
+
+func (f *FragmentedMP4Writer) writeVideo(pkt packets.Packet) error {
+	if !f.started && !pkt.IsKeyFrame {
+		return nil
+	}
+
+	filteredAU, parameterSets, err := SplitAccessUnit(f.videoCodec, pkt.Data)
+	if err != nil {
+		return err
+	}
+	if parameterSets.VPS != nil {
+		f.vps = parameterSets.VPS
+	}
+	if parameterSets.SPS != nil {
+		f.sps = parameterSets.SPS
+	}
+	if parameterSets.PPS != nil {
+		f.pps = parameterSets.PPS
+	}
+	if len(filteredAU) == 0 {
+		return nil
+	}
+
+	if !f.started {
+		f.started = true
+		f.startTime = pkt.Time
+		f.fragmentStart = pkt.Time
+	}
+	ts := DurationToTimeScale(pkt.Time-f.startTime, VideoTimeScale)
+
+	if pkt.IsKeyFrame && pkt.Time-f.fragmentStart >= f.fragmentDuration {
+		// Cut a new fragment, the keyframe will be the first sample of the next fragment. The last
+		// sample of the previous GOP is completed first (we know its duration now), so it's part of
+		// the fragment that is written.
+		f.video.Complete(ts)
+		if err := f.writeFragment(); err != nil {
+			return err
+		}
+		f.fragmentStart = pkt.Time
+	}
+
+	sample, err := fmp4.NewPartSampleH26x(0, pkt.IsKeyFrame, filteredAU)
+	if err != nil {
+		return err
+	}
+	f.video.Push(sample, ts)
+	return nil
+}
+
+func (f *FragmentedMP4Writer) writeAudio(pkt packets.Packet) error {
+	// Audio is only written once we have video, so both tracks start at the same time.
+	if !f.started || pkt.Time < f.startTime {
+		return nil
+	}
+
+	var adtsPackets mpeg4audio.ADTSPackets
+	if err := adtsPackets.Unmarshal(pkt.Data); err != nil {
+		return err
+	}
+	if len(adtsPackets) == 0 {
+		return nil
+	}
+
+	if f.audio == nil {
+		// Once the init segment is written we can't add an audio track anymore.
+		if f.initWritten {
+			return nil
+		}
+		f.audioConfig = &mpeg4audio.Config{
+			Type:         adtsPackets[0].Type,
+			SampleRate:   adtsPackets[0].SampleRate,
+			ChannelCount: adtsPackets[0].ChannelCount,
+		}
+		f.audio = NewAudioTrack(f.audioConfig)
+	}
+
+	ts := DurationToTimeScale(pkt.Time-f.startTime, f.audio.timeScale)
+	for i, adtsPacket := range adtsPackets {
+		f.audio.Push(&fmp4.PartSample{
+			Payload: adtsPacket.AU,
+		}, ts+uint64(i*mpeg4audio.SamplesPerAccessUnit))
+	}
+	return nil
+}
+
+func (f *FragmentedMP4Writer) writeInit() error {
+	init, err := MarshalInit(f.videoCodec, ParameterSets{VPS: f.vps, SPS: f.sps, PPS: f.pps}, f.audioConfig)
+	if err != nil {
+		return err
+	}
+	if _, err := f.writer.Write(init); err != nil {
+		return err
+	}
+	f.initWritten = true
+	return nil
+}
+
+func (f *FragmentedMP4Writer) writeFragment() error {
+	if !f.initWritten {
+		if err := f.writeInit(); err != nil {
+			return err
+		}
+	}
+	fragment, err := MarshalFragment(f.sequenceNumber, f.video, f.audio)
+	if err != nil || fragment == nil {
+		return err
+	}
+	if _, err := f.writer.Write(fragment); err != nil {
+		return err
+	}
+	f.sequenceNumber++
+	return nil
+}
+
+// Close writes the last fragment, including the samples we were still holding on to.
+func (f *FragmentedMP4Writer) Close() error {
+	if !f.started {
+		return nil
+	}
+	f.video.Flush()
+	if f.audio != nil {
+		f.audio.Flush()
+	}
+	return f.writeFragment()
+}
+
+// ParameterSets are the parameter sets of a H264 (SPS and PPS) or H265 (VPS, SPS and PPS) stream.
+type ParameterSets struct {
+	VPS []byte
+	SPS []byte
+	PPS []byte
+}
+
+// SplitAccessUnit splits an Annex-B encoded packet from the queue into NAL units, as MP4 expects
+// length prefixed NAL units. The parameter sets are returned separately (they belong in the init
+// segment), and access unit delimiters are dropped.
+func SplitAccessUnit(videoCodec string, data []byte) ([][]byte, ParameterSets, error) {
+	var parameterSets ParameterSets
+	if len(data) < 3 || data[0] != 0 || data[1] != 0 || (data[2] != 1 && (data[2] != 0 || len(data) < 4 || data[3] != 1)) {
+		data = append([]byte{0x00, 0x00, 0x00, 0x01}, data...)
+	}
+	au, err := h264.AnnexBUnmarshal(data)
+	if err != nil {
+		return nil, parameterSets, err
+	}
+	var filteredAU [][]byte
+	for _, nalu := range au {
+		if len(nalu) == 0 {
+			continue
+		}
+		if videoCodec == "H265" {
+			switch h265.NALUType((nalu[0] >> 1) & 0b111111) {
+			case h265.NALUType_VPS_NUT:
+				parameterSets.VPS = nalu
+				continue
+			case h265.NALUType_SPS_NUT:
+				parameterSets.SPS = nalu
+				continue
+			case h265.NALUType_PPS_NUT:
+				parameterSets.PPS = nalu
+				continue
+			case h265.NALUType_AUD_NUT:
+				continue
+			}
+		} else {
+			switch h264.NALUType(nalu[0] & 0x1F) {
+			case h264.NALUTypeSPS:
+				parameterSets.SPS = nalu
+				continue
+			case h264.NALUTypePPS:
+				parameterSets.PPS = nalu
+				continue
+			case h264.NALUTypeAccessUnitDelimiter:
+				continue
+			}
+		}
+		filteredAU = append(filteredAU, nalu)
+	}
+	return filteredAU, parameterSets, nil
+}
+
+// NewInitTrackCodec returns the codec of the video track in the init segment.
+func NewInitTrackCodec(videoCodec string, parameterSets ParameterSets) (fmp4.Codec, error) {
+	if videoCodec == "H265" {
+		if parameterSets.VPS == nil || parameterSets.SPS == nil || parameterSets.PPS == nil {
+			return nil, errors.New("capture.fmp4.NewInitTrackCodec(): no parameter sets found in the video stream")
+		}
+		return &fmp4.CodecH265{
+			VPS: parameterSets.VPS,
+			SPS: parameterSets.SPS,
+			PPS: parameterSets.PPS,
+		}, nil
+	}
+	if parameterSets.SPS == nil || parameterSets.PPS == nil {
+		return nil, errors.New("capture.fmp4.NewInitTrackCodec(): no parameter sets found in the video stream")
+	}
+	return &fmp4.CodecH264{
+		SPS: parameterSets.SPS,
+		PPS: parameterSets.PPS,
+	}, nil
+}
+
+// DurationToTimeScale converts a duration to a timestamp in a time scale, negative durations are 0.
+func DurationToTimeScale(d time.Duration, timeScale uint32) uint64 {
+	if d < 0 {
+		return 0
+	}
+	return uint64(d) * uint64(timeScale) / uint64(time.Second)
+}
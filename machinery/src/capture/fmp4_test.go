@@ -0,0 +1,94 @@
+package capture
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/kerberos-io/agent/machinery/src/internal/testutil"
+)
+
+func TestFragmentedMP4WriterFragmentBoundaries(t *testing.T) {
+	tests := []struct {
+		name             string
+		frames           int
+		gopSize          int
+		fragmentDuration time.Duration
+		fragments        []int // The number of samples in each fragment.
+	}{
+		{"fragment per GOP", 75, 25, time.Second, []int{25, 25, 25}},
+		{"fragment of multiple GOPs", 100, 25, 2 * time.Second, []int{50, 50}},
+		{"fragment cut at the next keyframe", 60, 10, time.Second, []int{30, 30}},
+		{"single fragment", 20, 25, time.Second, []int{20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer := NewFragmentedMP4Writer(&buf, "H264", tt.fragmentDuration)
+			for _, pkt := range testutil.H264Packets(tt.frames, tt.gopSize, 0) {
+				if err := writer.WritePacket(pkt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			var parts fmp4.Parts
+			if err := parts.Unmarshal(buf.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if len(parts) != len(tt.fragments) {
+				t.Fatalf("expected %d fragments, got %d", len(tt.fragments), len(parts))
+			}
+
+			var baseTime uint64
+			for i, part := range parts {
+				if part.SequenceNumber != uint32(i+1) {
+					t.Errorf("fragment %d: expected sequence number %d, got %d", i, i+1, part.SequenceNumber)
+				}
+				track := part.Tracks[0]
+				if len(track.Samples) != tt.fragments[i] {
+					t.Fatalf("fragment %d: expected %d samples, got %d", i, tt.fragments[i], len(track.Samples))
+				}
+				if track.Samples[0].IsNonSyncSample {
+					t.Errorf("fragment %d: doesn't start with a keyframe", i)
+				}
+				if track.BaseTime != baseTime {
+					t.Errorf("fragment %d: expected base time %d, got %d", i, baseTime, track.BaseTime)
+				}
+				for j, sample := range track.Samples {
+					if sample.Duration != 3600 {
+						t.Errorf("fragment %d, sample %d: expected duration 3600, got %d", i, j, sample.Duration)
+					}
+					baseTime += uint64(sample.Duration)
+				}
+			}
+		})
+	}
+}
+
+func TestFragmentedMP4WriterStartsAtKeyFrame(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewFragmentedMP4Writer(&buf, "H264", time.Second)
+	// The first 5 packets are before the first keyframe, these are dropped.
+	for _, pkt := range testutil.H264Packets(55, 25, 0)[20:] {
+		if err := writer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var parts fmp4.Parts
+	if err := parts.Unmarshal(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || len(parts[0].Tracks[0].Samples) != 25 || len(parts[1].Tracks[0].Samples) != 5 {
+		t.Fatalf("unexpected fragments: %d", len(parts))
+	}
+	if parts[0].Tracks[0].Samples[0].IsNonSyncSample {
+		t.Error("the recording doesn't start with a keyframe")
+	}
+}
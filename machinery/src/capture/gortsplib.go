@@ -37,7 +37,11 @@ import (
 // Implements the RTSPClient interface.
 type Golibrtsp struct {
 	RTSPClient
-	Url string
+	Url     string
+	Options StreamOptions
+
+	transportMutex sync.Mutex
+	transport      string // The transport the stream is read with, it changes when auto switches to TCP.
 
 	Client            gortsplib.Client
 	VideoDecoderMutex *sync.Mutex
@@ -80,12 +84,6 @@ type Golibrtsp struct {
 // Connect to the RTSP server.
 func (g *Golibrtsp) Connect(ctx context.Context) (err error) {
 
-	transport := gortsplib.TransportTCP
-	g.Client = gortsplib.Client{
-		RequestBackChannels: false,
-		Transport:           &transport,
-	}
-
 	// parse URL
 	u, err := base.ParseURL(g.Url)
 	if err != nil {
@@ -93,10 +91,92 @@ func (g *Golibrtsp) Connect(ctx context.Context) (err error) {
 		return
 	}
 
+	// We try the transports in order, until we could setup a video stream.
+	transports := rtspTransports(g.Options.Transport)
+	for i, transport := range transports {
+		var started bool
+		started, err = g.connect(u, transport)
+		if i == len(transports)-1 {
+			break
+		}
+		if videoStreams, _ := g.GetVideoStreams(); err == nil && len(videoStreams) > 0 {
+			break
+		}
+		log.Log.Warning("capture.golibrtsp.Connect(): could not setup the stream over " + transport +
+			", falling back to " + transports[i+1])
+		if started {
+			g.Client.Close()
+		}
+	}
+	return
+}
+
+// rtspTransports returns the transports to try in order, for the configured transport.
+func rtspTransports(transport string) []string {
+	switch transport {
+	case models.TransportMulticast:
+		return []string{models.TransportMulticast, models.TransportUDP, models.TransportTCP}
+	case models.TransportUDP:
+		return []string{models.TransportUDP, models.TransportTCP}
+	case models.TransportAuto:
+		return []string{models.TransportAuto}
+	default:
+		return []string{models.TransportTCP}
+	}
+}
+
+// GetTransport returns the transport the stream is read with: tcp, udp or multicast.
+func (g *Golibrtsp) GetTransport() string {
+	g.transportMutex.Lock()
+	defer g.transportMutex.Unlock()
+	return g.transport
+}
+
+func (g *Golibrtsp) setTransport(transport string) {
+	g.transportMutex.Lock()
+	g.transport = transport
+	g.transportMutex.Unlock()
+}
+
+// connect connects to the RTSP server with a transport, and sets up the medias. If the client was
+// started (and should be closed), true is returned.
+func (g *Golibrtsp) connect(u *base.URL, transport string) (started bool, err error) {
+
+	g.Client = gortsplib.Client{
+		RequestBackChannels: false,
+		ReadTimeout:         g.Options.ReadTimeout,
+		UserAgent:           g.Options.UserAgent,
+	}
+	g.Streams = nil
+
+	// Auto will start with UDP, and switches to TCP when no packets are received.
+	switch transport {
+	case models.TransportAuto:
+		g.setTransport(models.TransportUDP)
+		g.Client.OnTransportSwitch = func(err error) {
+			log.Log.Warning("capture.golibrtsp.Connect(): " + err.Error())
+			g.setTransport(models.TransportTCP)
+		}
+	case models.TransportMulticast:
+		rtspTransport := gortsplib.TransportUDPMulticast
+		g.Client.Transport = &rtspTransport
+		g.setTransport(transport)
+	case models.TransportUDP:
+		rtspTransport := gortsplib.TransportUDP
+		g.Client.Transport = &rtspTransport
+		g.setTransport(transport)
+	default:
+		rtspTransport := gortsplib.TransportTCP
+		g.Client.Transport = &rtspTransport
+		g.setTransport(models.TransportTCP)
+	}
+
 	// connect to the server
 	err = g.Client.Start(u.Scheme, u.Host)
 	if err != nil {
 		log.Log.Debug("capture.golibrtsp.Connect(Start): " + err.Error())
+	} else {
+		started = true
 	}
 
 	// find published medias
@@ -231,8 +311,8 @@ func (g *Golibrtsp) Connect(ctx context.Context) (err error) {
 	}
 
 	// Look for audio stream.
-	// find the G711 media and format
-	audioForma, audioMedi := FindPCMU(desc, false)
+	// find the G711 (µ-law or A-law) media and format
+	audioForma, audioMedi := FindG711(desc, false)
 	g.AudioG711Media = audioMedi
 	g.AudioG711Forma = audioForma
 	if audioMedi == nil {
@@ -253,9 +333,11 @@ func (g *Golibrtsp) Connect(ctx context.Context) (err error) {
 				g.AudioG711Decoder = audiortpDec
 
 				g.Streams = append(g.Streams, packets.Stream{
-					Name:          "PCM_MULAW",
+					Name:          g711CodecName(audioForma),
 					IsVideo:       false,
 					IsAudio:       true,
+					SampleRate:    audioForma.SampleRate,
+					Channels:      audioForma.ChannelCount,
 					IsBackChannel: false,
 				})
 
@@ -283,6 +365,8 @@ func (g *Golibrtsp) Connect(ctx context.Context) (err error) {
 				Name:          "AAC",
 				IsVideo:       false,
 				IsAudio:       true,
+				SampleRate:    audioFormaMPEG4.ClockRate(),
+				Channels:      audioFormaMPEG4.Config.ChannelCount,
 				IsBackChannel: false,
 			})
 
@@ -309,6 +393,8 @@ func (g *Golibrtsp) ConnectBackChannel(ctx context.Context) (err error) {
 	g.Client = gortsplib.Client{
 		RequestBackChannels: true,
 		Transport:           &transport,
+		ReadTimeout:         g.Options.ReadTimeout,
+		UserAgent:           g.Options.UserAgent,
 	}
 	// parse URL
 	u, err := base.ParseURL(g.Url)
@@ -365,9 +451,14 @@ func (g *Golibrtsp) ConnectBackChannel(ctx context.Context) (err error) {
 func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets.Queue, configuration *models.Configuration, communication *models.Communication) (err error) {
 	log.Log.Debug("capture.golibrtsp.Start(): started")
 
-	// called when a MULAW audio RTP packet arrives
+	// called when a G711 (MULAW or ALAW) audio RTP packet arrives
 	if g.AudioG711Media != nil && g.AudioG711Forma != nil {
+		var sequence rtpSequence
 		g.Client.OnPacketRTP(g.AudioG711Media, g.AudioG711Forma, func(rtppkt *rtp.Packet) {
+			if lost := sequence.lost(rtppkt.SequenceNumber); lost > 0 {
+				queue.ReportLostPackets(lost)
+			}
+
 			// decode timestamp
 			pts, ok := g.Client.PacketPTS(g.AudioG711Media, rtppkt)
 			if !ok {
@@ -379,6 +470,7 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 			op, err := g.AudioG711Decoder.Decode(rtppkt)
 			if err != nil {
 				log.Log.Error("capture.golibrtsp.Start(): " + err.Error())
+				queue.ReportDecodeError()
 				return
 			}
 
@@ -391,7 +483,7 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 				Idx:             g.AudioG711Index,
 				IsVideo:         false,
 				IsAudio:         true,
-				Codec:           "PCM_MULAW",
+				Codec:           g711CodecName(g.AudioG711Forma),
 			}
 			queue.WritePacket(pkt)
 		})
@@ -399,7 +491,12 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 
 	// called when a AAC audio RTP packet arrives
 	if g.AudioMPEG4Media != nil && g.AudioMPEG4Forma != nil {
+		var sequence rtpSequence
 		g.Client.OnPacketRTP(g.AudioMPEG4Media, g.AudioMPEG4Forma, func(rtppkt *rtp.Packet) {
+			if lost := sequence.lost(rtppkt.SequenceNumber); lost > 0 {
+				queue.ReportLostPackets(lost)
+			}
+
 			// decode timestamp
 			pts, ok := g.Client.PacketPTS(g.AudioMPEG4Media, rtppkt)
 			if !ok {
@@ -412,6 +509,7 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 			aus, err := g.AudioMPEG4Decoder.Decode(rtppkt)
 			if err != nil {
 				log.Log.Error("capture.golibrtsp.Start(): " + err.Error())
+				queue.ReportDecodeError()
 				return
 			}
 
@@ -427,7 +525,7 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 				Data:            enc,
 				Time:            pts,
 				CompositionTime: pts,
-				Idx:             g.AudioG711Index,
+				Idx:             g.AudioMPEG4Index,
 				IsVideo:         false,
 				IsAudio:         true,
 				Codec:           "AAC",
@@ -439,6 +537,7 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 	// called when a video RTP packet arrives for H264
 	var filteredAU [][]byte
 	if g.VideoH264Media != nil && g.VideoH264Forma != nil {
+		var sequence rtpSequence
 		g.Client.OnPacketRTP(g.VideoH264Media, g.VideoH264Forma, func(rtppkt *rtp.Packet) {
 
 			// This will check if we need to stop the thread,
@@ -449,6 +548,11 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 			default:
 			}
 
+			// A gap in the sequence numbers means packets were lost.
+			if lost := sequence.lost(rtppkt.SequenceNumber); lost > 0 {
+				queue.ReportLostPackets(lost)
+			}
+
 			if len(rtppkt.Payload) > 0 {
 
 				// decode timestamp
@@ -466,6 +570,7 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 				if errDecode != nil {
 					if errDecode != rtph264.ErrNonStartingPacketAndNoPrevious && errDecode != rtph264.ErrMorePacketsNeeded {
 						log.Log.Error("capture.golibrtsp.Start(): " + errDecode.Error())
+						queue.ReportDecodeError()
 					}
 					return
 				}
@@ -584,6 +689,7 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 
 	// called when a video RTP packet arrives for H265
 	if g.VideoH265Media != nil && g.VideoH265Forma != nil {
+		var sequence rtpSequence
 		g.Client.OnPacketRTP(g.VideoH265Media, g.VideoH265Forma, func(rtppkt *rtp.Packet) {
 
 			// This will check if we need to stop the thread,
@@ -594,6 +700,11 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 			default:
 			}
 
+			// A gap in the sequence numbers means packets were lost.
+			if lost := sequence.lost(rtppkt.SequenceNumber); lost > 0 {
+				queue.ReportLostPackets(lost)
+			}
+
 			if len(rtppkt.Payload) > 0 {
 
 				// decode timestamp
@@ -611,6 +722,7 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 				if errDecode != nil {
 					if errDecode != rtph265.ErrNonStartingPacketAndNoPrevious && errDecode != rtph265.ErrMorePacketsNeeded {
 						log.Log.Error("capture.golibrtsp.Start(): " + errDecode.Error())
+						queue.ReportDecodeError()
 					}
 					return
 				}
@@ -710,6 +822,28 @@ func (g *Golibrtsp) Start(ctx context.Context, streamType string, queue *packets
 	return
 }
 
+// rtpSequence follows the sequence numbers of the RTP packets of a media, to detect the lost packets.
+type rtpSequence struct {
+	last    uint16
+	started bool
+}
+
+// lost returns the number of packets that are missing before the packet. A packet that's older
+// than the last one (reordered or duplicated) is ignored.
+func (s *rtpSequence) lost(sequenceNumber uint16) int {
+	if !s.started {
+		s.started = true
+		s.last = sequenceNumber
+		return 0
+	}
+	diff := sequenceNumber - s.last
+	if diff == 0 || diff >= 0x8000 {
+		return 0
+	}
+	s.last = sequenceNumber
+	return int(diff) - 1
+}
+
 // Start the RTSP client, and start reading packets.
 func (g *Golibrtsp) StartBackChannel(ctx context.Context) (err error) {
 	log.Log.Info("capture.golibrtsp.StartBackChannel(): started")
@@ -986,6 +1120,29 @@ func FindPCMU(desc *description.Session, isBackChannel bool) (*format.G711, *des
 	return nil, nil
 }
 
+// FindG711 returns the first G711 format, either µ-law or A-law. The backchannel only
+// supports µ-law, use FindPCMU for it.
+func FindG711(desc *description.Session, isBackChannel bool) (*format.G711, *description.Media) {
+	for _, media := range desc.Medias {
+		if media.IsBackChannel == isBackChannel {
+			for _, forma := range media.Formats {
+				if g711, ok := forma.(*format.G711); ok {
+					return g711, media
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// g711CodecName returns the codec name we use for a G711 format in streams and packets.
+func g711CodecName(forma *format.G711) string {
+	if forma.MULaw {
+		return "PCM_MULAW"
+	}
+	return "PCM_ALAW"
+}
+
 func FindMPEG4Audio(desc *description.Session, isBackChannel bool) (*format.MPEG4Audio, *description.Media) {
 	for _, media := range desc.Medias {
 		if media.IsBackChannel == isBackChannel {
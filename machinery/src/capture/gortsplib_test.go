@@ -0,0 +1,30 @@
+package capture
+
+import "testing"
+
+func TestRTPSequenceLost(t *testing.T) {
+	tests := []struct {
+		name      string
+		sequences []uint16
+		lost      []int // The lost packets reported for every sequence number.
+	}{
+		{"in order", []uint16{10, 11, 12}, []int{0, 0, 0}},
+		{"gap", []uint16{10, 11, 15}, []int{0, 0, 3}},
+		{"duplicate", []uint16{10, 11, 11, 12}, []int{0, 0, 0, 0}},
+		{"reordered", []uint16{10, 12, 11, 13}, []int{0, 1, 0, 0}},
+		{"wraparound", []uint16{65534, 65535, 0, 1}, []int{0, 0, 0, 0}},
+		{"gap across the wraparound", []uint16{65534, 2}, []int{0, 3}},
+		{"reordered across the wraparound", []uint16{0, 65535, 1}, []int{0, 0, 0}},
+		{"first packet", []uint16{40000}, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sequence rtpSequence
+			for i, sequenceNumber := range tt.sequences {
+				if lost := sequence.lost(sequenceNumber); lost != tt.lost[i] {
+					t.Fatalf("sequence number %d: expected %d lost, got %d", sequenceNumber, tt.lost[i], lost)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+)
+
+// While a regular MP4 is written, the samples only get their timestamps (and the audio frames their
+// boundaries) in the moov box, which is written when the recording is closed. The sample journal
+// records where every sample is written in the mdat box, and its timestamp, so an interrupted recording
+// can be rebuilt with its audio and its original timing. The journal is a small file next to the
+// recording (see utils.SamplesPath) which is removed once the recording is closed. It only holds the
+// offsets, sizes and timestamps of the samples, never their data.
+//
+// The journal starts with a header (magic, version, video codec, audio), followed by records of
+// journalRecordSize bytes: the kind, flags, size, offset (in the MP4) and timestamp (milliseconds).
+// The AAC configuration is recorded once, before the first audio sample.
+
+const (
+	journalMagic      = "KSMP"
+	journalVersion    = 1
+	journalHeaderSize = 8
+	journalRecordSize = 24
+
+	journalVideo       = 'V'
+	journalAudio       = 'A'
+	journalAudioConfig = 'C'
+
+	journalKeyFrame = 0x01
+
+	// The largest sample we accept, when reading the journal or scanning the mdat box.
+	maxRecoveredSampleSize = 32 << 20
+)
+
+// sampleJournal records the samples of an MP4 while it's written.
+type sampleJournal struct {
+	file   *os.File
+	record []byte
+}
+
+func newSampleJournal(path string, videoCodec string, hasAudio bool) (*sampleJournal, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, journalHeaderSize)
+	copy(header, journalMagic)
+	header[4] = journalVersion
+	if videoCodec == "H265" {
+		header[5] = 2
+	} else {
+		header[5] = 1
+	}
+	if hasAudio {
+		header[6] = 1
+	}
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &sampleJournal{
+		file:   file,
+		record: make([]byte, journalRecordSize),
+	}, nil
+}
+
+// writeSample records a sample, the timestamp is in milliseconds.
+func (j *sampleJournal) writeSample(kind byte, keyFrame bool, offset int64, size int64, timestamp uint64) error {
+	for i := range j.record {
+		j.record[i] = 0
+	}
+	j.record[0] = kind
+	if keyFrame {
+		j.record[1] = journalKeyFrame
+	}
+	binary.BigEndian.PutUint32(j.record[4:], uint32(size))
+	binary.BigEndian.PutUint64(j.record[8:], uint64(offset))
+	binary.BigEndian.PutUint64(j.record[16:], timestamp)
+	_, err := j.file.Write(j.record)
+	return err
+}
+
+// writeAudioConfig records the AAC configuration, which we need to turn the audio samples into ADTS again.
+func (j *sampleJournal) writeAudioConfig(objectType mpeg4audio.ObjectType, sampleRate int, channelCount int) error {
+	for i := range j.record {
+		j.record[i] = 0
+	}
+	j.record[0] = journalAudioConfig
+	j.record[1] = byte(objectType)
+	binary.BigEndian.PutUint16(j.record[2:], uint16(channelCount))
+	binary.BigEndian.PutUint32(j.record[4:], uint32(sampleRate))
+	_, err := j.file.Write(j.record)
+	return err
+}
+
+// remove closes and removes the journal, once the recording is closed.
+func (j *sampleJournal) remove() error {
+	j.file.Close()
+	return os.Remove(j.file.Name())
+}
+
+// journalSample is a record of the journal.
+type journalSample struct {
+	kind      byte
+	keyFrame  bool
+	offset    int64
+	size      int64
+	timestamp uint64 // Milliseconds.
+
+	// For the audio configuration.
+	objectType   mpeg4audio.ObjectType
+	sampleRate   int
+	channelCount int
+}
+
+// sampleJournalReader reads the records of a journal, a record that was only partially written is ignored.
+type sampleJournalReader struct {
+	file       *os.File
+	videoCodec string
+	hasAudio   bool
+	record     []byte
+}
+
+func openSampleJournal(path string) (*sampleJournalReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, journalHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:4]) != journalMagic || header[4] != journalVersion {
+		file.Close()
+		return nil, errors.New("invalid sample journal")
+	}
+	r := &sampleJournalReader{
+		file:       file,
+		videoCodec: "H264",
+		hasAudio:   header[6] == 1,
+		record:     make([]byte, journalRecordSize),
+	}
+	if header[5] == 2 {
+		r.videoCodec = "H265"
+	}
+	return r, nil
+}
+
+// next returns the next record, io.EOF is returned at the end of the journal.
+func (r *sampleJournalReader) next() (journalSample, error) {
+	if _, err := io.ReadFull(r.file, r.record); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return journalSample{}, err
+	}
+	sample := journalSample{
+		kind: r.record[0],
+	}
+	switch sample.kind {
+	case journalVideo, journalAudio:
+		sample.keyFrame = r.record[1]&journalKeyFrame != 0
+		sample.size = int64(binary.BigEndian.Uint32(r.record[4:]))
+		sample.offset = int64(binary.BigEndian.Uint64(r.record[8:]))
+		sample.timestamp = binary.BigEndian.Uint64(r.record[16:])
+	case journalAudioConfig:
+		sample.objectType = mpeg4audio.ObjectType(r.record[1])
+		sample.channelCount = int(binary.BigEndian.Uint16(r.record[2:]))
+		sample.sampleRate = int(binary.BigEndian.Uint32(r.record[4:]))
+	default:
+		return sample, errors.New("invalid sample journal record")
+	}
+	return sample, nil
+}
+
+// rewind reads the journal from its first record again.
+func (r *sampleJournalReader) rewind() error {
+	_, err := r.file.Seek(journalHeaderSize, io.SeekStart)
+	return err
+}
+
+func (r *sampleJournalReader) Close() error {
+	return r.file.Close()
+}
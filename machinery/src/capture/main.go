@@ -11,49 +11,47 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/kerberos-io/agent/machinery/src/conditions"
-	"github.com/kerberos-io/agent/machinery/src/encryption"
+	"github.com/kerberos-io/agent/machinery/src/database"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
 	"github.com/kerberos-io/agent/machinery/src/packets"
 	"github.com/kerberos-io/agent/machinery/src/utils"
-	"github.com/yapingcat/gomedia/go-mp4"
 )
 
+// CleanupRecordingDirectory applies the retention rules, it's called after every recording
+// so we don't have to wait for the next scheduled run.
 func CleanupRecordingDirectory(configDirectory string, configuration *models.Configuration) {
-	autoClean := configuration.Config.AutoClean
-	if autoClean == "true" {
-		maxSize := configuration.Config.MaxDirectorySize
-		if maxSize == 0 {
-			maxSize = 300
+	ApplyRetention(configDirectory, configuration)
+}
+
+// HandleRecording records the main stream, or the sub stream when the disk watchdog only allows the sub stream to be
+// recorded. When the recording mode changes, the recorder finishes its recording and starts over in the new mode. It
+// keeps running until the context of the agent is cancelled.
+func HandleRecording(queue *packets.Queue, configDirectory string, configuration *models.Configuration, communication *models.Communication, rtspClient RTSPClient, subQueue *packets.Queue, rtspSubClient RTSPClient, subStreamConnected bool) {
+	for {
+		modeChanged := RecordingModeChanged()
+		recordingConfiguration, recordSubStream := RecordingConfiguration(configuration, subStreamConnected)
+		if recordingConfiguration != configuration {
+			log.Log.Warning("capture.main.HandleRecording(): recording is degraded, the disk state is " + GetDiskStatus().State)
 		}
-		// Total size of the recording directory.
-		recordingsDirectory := configDirectory + "/data/recordings"
-		size, err := utils.DirSize(recordingsDirectory)
-		if err == nil {
-			sizeInMB := size / 1000 / 1000
-			if sizeInMB >= maxSize {
-				// Remove the oldest recording
-				oldestFile, err := utils.FindOldestFile(recordingsDirectory)
-				if err == nil {
-					err := os.Remove(recordingsDirectory + "/" + oldestFile.Name())
-					log.Log.Info("HandleRecordStream: removed oldest file as part of cleanup - " + recordingsDirectory + "/" + oldestFile.Name())
-					if err != nil {
-						log.Log.Info("HandleRecordStream: something went wrong, " + err.Error())
-					}
-				} else {
-					log.Log.Info("HandleRecordStream: something went wrong, " + err.Error())
-				}
-			}
+		if recordSubStream {
+			HandleRecordStream(subQueue, configDirectory, recordingConfiguration, communication, rtspSubClient, nil, nil, modeChanged)
 		} else {
-			log.Log.Info("HandleRecordStream: something went wrong, " + err.Error())
+			HandleRecordStream(queue, configDirectory, recordingConfiguration, communication, rtspClient, subQueue, rtspSubClient, modeChanged)
 		}
 
-	} else {
-		log.Log.Info("HandleRecordStream: Autoclean disabled, nothing to do here.")
+		select {
+		case <-modeChanged:
+			log.Log.Info("capture.main.HandleRecording(): the recording mode changed, starting over.")
+		case <-(*communication.Context).Done():
+			return
+		}
 	}
 }
 
-func HandleRecordStream(queue *packets.Queue, configDirectory string, configuration *models.Configuration, communication *models.Communication, rtspClient RTSPClient) {
+// HandleRecordStream records continuously or on motion, until the queue is closed or stop is closed. When stop
+// is closed, the recording that is in progress is finished first.
+func HandleRecordStream(queue *packets.Queue, configDirectory string, configuration *models.Configuration, communication *models.Communication, rtspClient RTSPClient, subQueue *packets.Queue, rtspSubClient RTSPClient, stop <-chan struct{}) {
 
 	config := configuration.Config
 	loc, _ := time.LoadLocation(config.Timezone)
@@ -81,12 +79,34 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 		// Check if continuous recording.
 		if config.Capture.Continuous == "true" {
 
-			//var cws *cacheWriterSeeker
-			var myMuxer *mp4.Movmuxer
-			var videoTrack uint32
-			var audioTrack uint32
+			var writer RecordingWriter
 			var name string
 
+			// The metadata of the recording, and the first and last
+			// timestamp written to the recording (to calculate the duration).
+			var metadata models.RecordingMetadata
+			var firstPts time.Duration
+			var lastPts time.Duration
+
+			// The poster and thumbnails of the recording.
+			var preview *RecordingPreview
+
+			// The recording of the sub stream, if enabled.
+			var subRecording *SubRecording
+
+			// Recordings can be aligned to the wall clock, we keep track of the next boundary
+			// and the GOP duration to cut at the keyframe nearest to it.
+			alignSegments := config.Capture.AlignSegments == "true" && maxRecordingPeriod > 0
+			segmentLength := time.Duration(maxRecordingPeriod) * time.Second
+			var nextBoundary time.Time
+			var segmentBoundary time.Time
+			var lastKeyFrame time.Duration
+			var gopDuration time.Duration
+
+			// The end of the previous recording, to detect gaps in the footage.
+			lastEnd := lastContinuousRecordingEnd(database.CameraKey(configuration))
+			gapReason := models.GapDisconnected
+
 			// Do not do anything!
 			log.Log.Info("capture.main.HandleRecordStream(continuous): start recording")
 
@@ -104,7 +124,7 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 			var pkt packets.Packet
 			var nextPkt packets.Packet
 			recordingStatus := "idle"
-			recordingCursor := queue.Oldest()
+			recordingCursor := queue.Oldest().Named("recording")
 
 			if cursorError == nil {
 				pkt, cursorError = recordingCursor.ReadPacket()
@@ -116,28 +136,35 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 
 				now := time.Now().Unix()
 
+				if nextPkt.IsKeyFrame {
+					if lastKeyFrame > 0 {
+						gopDuration = nextPkt.Time - lastKeyFrame
+					}
+					lastKeyFrame = nextPkt.Time
+				}
+
+				// Stop at the max length, or at the keyframe nearest to the wall-clock boundary.
+				cut := timestamp+recordingPeriod-now <= 0 || now-startRecording >= maxRecordingPeriod
+				if alignSegments {
+					cut = cutAtBoundary(time.Now(), nextBoundary, gopDuration)
+				}
+				stopping := isCancelled(stop)
+				if stopping && !start {
+					break
+				}
+
 				if start && // If already recording and current frame is a keyframe and we should stop recording
-					nextPkt.IsKeyFrame && (timestamp+recordingPeriod-now <= 0 || now-startRecording >= maxRecordingPeriod) {
+					nextPkt.IsKeyFrame && (cut || stopping) {
 
 					// Write the last packet
-					ttime := convertPTS(pkt.Time)
-					if pkt.IsVideo {
-						if err := myMuxer.Write(videoTrack, pkt.Data, ttime, ttime); err != nil {
-							log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
-						}
-					} else if pkt.IsAudio {
-						if pkt.Codec == "AAC" {
-							if err := myMuxer.Write(audioTrack, pkt.Data, ttime, ttime); err != nil {
-								log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
-							}
-						} else if pkt.Codec == "PCM_MULAW" {
-							// TODO: transcode to AAC, some work to do..
-							log.Log.Debug("capture.main.HandleRecordStream(continuous): no AAC audio codec detected, skipping audio track.")
-						}
+					if err := writer.WritePacket(pkt); err != nil {
+						log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
 					}
+					preview.AddPacket(pkt)
+					lastPts = pkt.Time
 
 					// This will write the trailer a well.
-					if err := myMuxer.WriteTrailer(); err != nil {
+					if err := writer.Close(); err != nil {
 						log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
 					}
 
@@ -148,40 +175,20 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 					file.Close()
 					file = nil
 
-					// Check if need to convert to fragmented using bento
-					if config.Capture.Fragmented == "true" && config.Capture.FragmentedDuration > 0 {
-						utils.CreateFragmentedMP4(fullName, config.Capture.FragmentedDuration)
-					}
-
-					// Check if we need to encrypt the recording.
-					if config.Encryption != nil && config.Encryption.Enabled == "true" && config.Encryption.Recordings == "true" && config.Encryption.SymmetricKey != "" {
-						// reopen file into memory 'fullName'
-						contents, err := os.ReadFile(fullName)
-						if err == nil {
-							// encrypt
-							encryptedContents, err := encryption.AesEncrypt(contents, config.Encryption.SymmetricKey)
-							if err == nil {
-								// write back to file
-								err := os.WriteFile(fullName, []byte(encryptedContents), 0644)
-								if err != nil {
-									log.Log.Error("capture.main.HandleRecordStream(continuous): error writing file: " + err.Error())
-								}
-							} else {
-								log.Log.Error("capture.main.HandleRecordStream(continuous): error encrypting file: " + err.Error())
-							}
-						} else {
-							log.Log.Error("capture.main.HandleRecordStream(continuous): error reading file: " + err.Error())
-						}
-					}
-
-					// Create a symbol link.
-					fc, _ := os.Create(configDirectory + "/data/cloud/" + name)
-					fc.Close()
-
+					metadata.Duration = (lastPts - firstPts).Milliseconds()
+					metadata.SubRecording = subRecording.Stop()
+					preview.Save(configuration, fullName, &metadata)
+					finishRecording("continuous", configDirectory, configuration, fullName, metadata)
 					recordingStatus = "idle"
 
-					// Clean up the recording directory if necessary.
-					CleanupRecordingDirectory(configDirectory, configuration)
+					// The next recording is named after the boundary we've cut at.
+					lastEnd = metadata.StartTime + metadata.Duration
+					if alignSegments {
+						segmentBoundary = nextBoundary
+					}
+					if stopping {
+						break
+					}
 				}
 
 				// If not yet started and a keyframe, let's make a recording
@@ -192,6 +199,8 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 					valid, err := conditions.Validate(loc, configuration)
 					if !valid && err != nil {
 						log.Log.Debug("capture.main.HandleRecordStream(continuous): " + err.Error() + ".")
+						gapReason = models.GapConditions
+						segmentBoundary = time.Time{}
 						time.Sleep(5 * time.Second)
 						continue
 					}
@@ -207,75 +216,79 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 					// - Region
 					// - Number of changes
 					// - Token
-
-					startRecording = time.Now().Unix() // we mark the current time when the record started.ss
-					s := strconv.FormatInt(startRecording, 10) + "_" +
+					// The filename is kept for backwards compatibility, the metadata
+					// of the recording is stored in a JSON sidecar next to it.
+
+					// An aligned recording is named after its boundary, instead of the time it started.
+					startTime := time.Now()
+					segmentTime := startTime
+					if !segmentBoundary.IsZero() {
+						segmentTime = segmentBoundary
+					}
+					startRecording = startTime.Unix() // we mark the current time when the record started.ss
+					s := strconv.FormatInt(segmentTime.Unix(), 10) + "_" +
 						"6" + "-" +
 						"967003" + "_" +
 						config.Name + "_" +
 						"200-200-400-400" + "_0_" +
 						"769"
 
-					name = s + ".mp4"
+					name = s + RecordingExtension(configuration)
 					fullName = configDirectory + "/data/recordings/" + name
+					metadata = newRecordingMetadata(name, models.TriggerContinuous, startTime.UnixMilli(), configuration, rtspClient)
+					preview = NewRecordingPreview(configuration, rtspClient, 0)
+					firstPts = pkt.Time
+					if alignSegments {
+						if !segmentBoundary.IsZero() {
+							metadata.SegmentStart = segmentBoundary.UnixMilli()
+						}
+						nextBoundary = nextSegmentBoundary(segmentTime, segmentLength, loc)
+						segmentBoundary = time.Time{}
+					}
+					if lastEnd > 0 {
+						addGap(config.Key, lastEnd, metadata.StartTime, gapReason)
+					}
+					gapReason = models.GapStream
 
 					// Running...
 					log.Log.Info("capture.main.HandleRecordStream(continuous): recording started")
 
 					file, err = os.Create(fullName)
 					if err == nil {
-						//cws = newCacheWriterSeeker(4096)
-						myMuxer, _ = mp4.CreateMp4Muxer(file)
-						// We choose between H264 and H265
-						width := configuration.Config.Capture.IPCamera.Width
-						height := configuration.Config.Capture.IPCamera.Height
-						widthOption := mp4.WithVideoWidth(uint32(width))
-						heightOption := mp4.WithVideoHeight(uint32(height))
-						if pkt.Codec == "H264" {
-							videoTrack = myMuxer.AddVideoTrack(mp4.MP4_CODEC_H264, widthOption, heightOption)
-						} else if pkt.Codec == "H265" {
-							videoTrack = myMuxer.AddVideoTrack(mp4.MP4_CODEC_H265, widthOption, heightOption)
-						}
-						// For an MP4 container, AAC is the only audio codec supported.
-						audioTrack = myMuxer.AddAudioTrack(mp4.MP4_CODEC_AAC)
-					} else {
+						// We choose between H264 and H265, and a regular or fragmented MP4.
+						writer, err = NewRecordingWriter(file, configuration, pkt.Codec, GetRecordingAudioStream(rtspClient))
+					}
+					if err != nil {
 						log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
+						if file != nil {
+							file.Close()
+							file = nil
+						}
+						start = false
+						pkt = nextPkt
+						continue
 					}
 
-					ttime := convertPTS(pkt.Time)
-					if pkt.IsVideo {
-						if err := myMuxer.Write(videoTrack, pkt.Data, ttime, ttime); err != nil {
-							log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
-						}
-					} else if pkt.IsAudio {
-						if pkt.Codec == "AAC" {
-							if err := myMuxer.Write(audioTrack, pkt.Data, ttime, ttime); err != nil {
-								log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
-							}
-						} else if pkt.Codec == "PCM_MULAW" {
-							// TODO: transcode to AAC, some work to do..
-							log.Log.Debug("capture.main.HandleRecordStream(continuous): no AAC audio codec detected, skipping audio track.")
-						}
+					if err := writer.WritePacket(pkt); err != nil {
+						log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
 					}
+					preview.AddPacket(pkt)
+					lastPts = pkt.Time
 
+					subRecording = StartSubRecording(subQueue, configDirectory, configuration, rtspSubClient, name, models.TriggerContinuous, metadata.StartTime, false)
 					recordingStatus = "started"
 
 				} else if start {
-					ttime := convertPTS(pkt.Time)
-					if pkt.IsVideo {
-						if err := myMuxer.Write(videoTrack, pkt.Data, ttime, ttime); err != nil {
-							log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
-						}
-					} else if pkt.IsAudio {
-						if pkt.Codec == "AAC" {
-							if err := myMuxer.Write(audioTrack, pkt.Data, ttime, ttime); err != nil {
-								log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
-							}
-						} else if pkt.Codec == "PCM_MULAW" {
-							// TODO: transcode to AAC, some work to do..
-							log.Log.Debug("capture.main.HandleRecordStream(continuous): no AAC audio codec detected, skipping audio track.")
-						}
+					// The stream stalled (without reconnecting), there is a gap in the recording.
+					if pkt.Time-lastPts > minimumGap {
+						gapStart := metadata.StartTime + (lastPts - firstPts).Milliseconds()
+						addGap(config.Key, gapStart, gapStart+(pkt.Time-lastPts).Milliseconds(), models.GapStream)
+					}
+					if err := writer.WritePacket(pkt); err != nil {
+						log.Log.Error("capture.main.HandleRecordStream(continuous): " + err.Error())
 					}
+					preview.AddPacket(pkt)
+					lastPts = pkt.Time
 				}
 
 				pkt = nextPkt
@@ -286,7 +299,7 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 			if cursorError != nil {
 				if recordingStatus == "started" {
 					// This will write the trailer a well.
-					if err := myMuxer.WriteTrailer(); err != nil {
+					if err := writer.Close(); err != nil {
 						log.Log.Error(err.Error())
 					}
 
@@ -297,40 +310,11 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 					file.Close()
 					file = nil
 
-					// Check if need to convert to fragmented using bento
-					if config.Capture.Fragmented == "true" && config.Capture.FragmentedDuration > 0 {
-						utils.CreateFragmentedMP4(fullName, config.Capture.FragmentedDuration)
-					}
-
-					// Check if we need to encrypt the recording.
-					if config.Encryption != nil && config.Encryption.Enabled == "true" && config.Encryption.Recordings == "true" && config.Encryption.SymmetricKey != "" {
-						// reopen file into memory 'fullName'
-						contents, err := os.ReadFile(fullName)
-						if err == nil {
-							// encrypt
-							encryptedContents, err := encryption.AesEncrypt(contents, config.Encryption.SymmetricKey)
-							if err == nil {
-								// write back to file
-								err := os.WriteFile(fullName, []byte(encryptedContents), 0644)
-								if err != nil {
-									log.Log.Error("capture.main.HandleRecordStream(motiondetection): error writing file: " + err.Error())
-								}
-							} else {
-								log.Log.Error("capture.main.HandleRecordStream(motiondetection): error encrypting file: " + err.Error())
-							}
-						} else {
-							log.Log.Error("capture.main.HandleRecordStream(motiondetection): error reading file: " + err.Error())
-						}
-					}
-
-					// Create a symbol link.
-					fc, _ := os.Create(configDirectory + "/data/cloud/" + name)
-					fc.Close()
-
+					metadata.Duration = (lastPts - firstPts).Milliseconds()
+					metadata.SubRecording = subRecording.Stop()
+					preview.Save(configuration, fullName, &metadata)
+					finishRecording("continuous", configDirectory, configuration, fullName, metadata)
 					recordingStatus = "idle"
-
-					// Clean up the recording directory if necessary.
-					CleanupRecordingDirectory(configDirectory, configuration)
 				}
 			}
 		} else {
@@ -340,19 +324,25 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 			var lastDuration time.Duration
 			var lastRecordingTime int64
 
-			//var cws *cacheWriterSeeker
-			var myMuxer *mp4.Movmuxer
-			var videoTrack uint32
-			var audioTrack uint32
+			var writer RecordingWriter
 
-			for motion := range communication.HandleMotion {
+			handleMotion := communication.HandleMotion
+			for {
+				var motion models.MotionDataPartial
+				var ok bool
+				select {
+				case motion, ok = <-handleMotion:
+				case <-stop:
+				}
+				if !ok {
+					break
+				}
 
 				timestamp = time.Now().Unix()
 				startRecording = time.Now().Unix() // we mark the current time when the record started.
 				numberOfChanges := motion.NumberOfChanges
 
 				// If we have prerecording we will substract the number of seconds.
-				// Taking into account FPS = GOP size (Keyfram interval)
 				if config.Capture.PreRecording > 0 {
 
 					// Might be that recordings are coming short after each other.
@@ -360,7 +350,7 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 
 					timeBetweenNowAndLastRecording := startRecording - lastRecordingTime
 					if timeBetweenNowAndLastRecording > int64(config.Capture.PreRecording) {
-						startRecording = startRecording - int64(config.Capture.PreRecording) + 1
+						startRecording = startRecording - int64(config.Capture.PreRecording)
 					} else {
 						startRecording = startRecording - timeBetweenNowAndLastRecording
 					}
@@ -374,6 +364,8 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 				// - Region
 				// - Number of changes
 				// - Token
+				// The filename is kept for backwards compatibility, the metadata
+				// of the recording is stored in a JSON sidecar next to it.
 
 				s := strconv.FormatInt(startRecording, 10) + "_" +
 					"6" + "-" +
@@ -383,36 +375,58 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 					strconv.Itoa(numberOfChanges) + "_" +
 					"769"
 
-				name := s + ".mp4"
+				name := s + RecordingExtension(configuration)
 				fullName := configDirectory + "/data/recordings/" + name
 
+				// The trigger of the recording is part of the motion message,
+				// older producers don't set it, so we assume it's motion.
+				trigger := motion.Trigger
+				if trigger == "" {
+					trigger = models.TriggerMotion
+				}
+				metadata := newRecordingMetadata(name, trigger, startRecording*1000, configuration, rtspClient)
+				addMotionToMetadata(&metadata, motion)
+				var firstPts time.Duration
+				var lastPts time.Duration
+
+				// The poster is taken from the moment of the trigger, after the pre-recording.
+				preview := NewRecordingPreview(configuration, rtspClient, time.Duration(timestamp-startRecording)*time.Second)
+
 				// Running...
 				log.Log.Info("capture.main.HandleRecordStream(motiondetection): recording started")
-				file, _ = os.Create(fullName)
-				myMuxer, _ = mp4.CreateMp4Muxer(file)
-
 				// Check which video codec we need to use.
+				videoCodec := ""
 				videoSteams, _ := rtspClient.GetVideoStreams()
 				for _, stream := range videoSteams {
-					width := configuration.Config.Capture.IPCamera.Width
-					height := configuration.Config.Capture.IPCamera.Height
-					widthOption := mp4.WithVideoWidth(uint32(width))
-					heightOption := mp4.WithVideoHeight(uint32(height))
-					if stream.Name == "H264" {
-						videoTrack = myMuxer.AddVideoTrack(mp4.MP4_CODEC_H264, widthOption, heightOption)
-					} else if stream.Name == "H265" {
-						videoTrack = myMuxer.AddVideoTrack(mp4.MP4_CODEC_H265, widthOption, heightOption)
+					if stream.Name == "H264" || stream.Name == "H265" {
+						videoCodec = stream.Name
+					}
+				}
+
+				var err error
+				file, err = os.Create(fullName)
+				if err == nil {
+					writer, err = NewRecordingWriter(file, configuration, videoCodec, GetRecordingAudioStream(rtspClient))
+				}
+				if err != nil {
+					log.Log.Error("capture.main.HandleRecordStream(motiondetection): " + err.Error())
+					if file != nil {
+						file.Close()
+						file = nil
 					}
+					continue
 				}
-				// For an MP4 container, AAC is the only audio codec supported.
-				audioTrack = myMuxer.AddAudioTrack(mp4.MP4_CODEC_AAC)
 				start := false
 
+				// Record the sub stream over the same period.
+				subRecording := StartSubRecording(subQueue, configDirectory, configuration, rtspSubClient, name, trigger, metadata.StartTime, config.Capture.PreRecording > 0)
+
 				// Get as much packets we need.
 				var cursorError error
 				var pkt packets.Packet
 				var nextPkt packets.Packet
-				recordingCursor := queue.DelayedGopCount(int(config.Capture.PreRecording + 1))
+				// We start at the keyframe (at least) the pre-recording time before the live edge.
+				recordingCursor := queue.DelayedKeyFrame(time.Duration(config.Capture.PreRecording) * time.Second).Named("recording")
 
 				if cursorError == nil {
 					pkt, cursorError = recordingCursor.ReadPacket()
@@ -431,6 +445,7 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 						timestamp = now
 						log.Log.Info("capture.main.HandleRecordStream(motiondetection): motion detected while recording. Expanding recording.")
 						numberOfChanges = motion.NumberOfChanges
+						addMotionToMetadata(&metadata, motion)
 						log.Log.Info("capture.main.HandleRecordStream(motiondetection): Received message with recording data, detected changes to save: " + strconv.Itoa(numberOfChanges))
 					default:
 					}
@@ -442,24 +457,15 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 					if pkt.IsKeyFrame && !start && pkt.Time >= lastDuration {
 						log.Log.Debug("capture.main.HandleRecordStream(motiondetection): write frames")
 						start = true
+						firstPts = pkt.Time
 					}
 					if start {
 
-						ttime := convertPTS(pkt.Time)
-						if pkt.IsVideo {
-							if err := myMuxer.Write(videoTrack, pkt.Data, ttime, ttime); err != nil {
-								log.Log.Error("capture.main.HandleRecordStream(motiondetection): " + err.Error())
-							}
-						} else if pkt.IsAudio {
-							if pkt.Codec == "AAC" {
-								if err := myMuxer.Write(audioTrack, pkt.Data, ttime, ttime); err != nil {
-									log.Log.Error("capture.main.HandleRecordStream(motiondetection): " + err.Error())
-								}
-							} else if pkt.Codec == "PCM_MULAW" {
-								// TODO: transcode to AAC, some work to do..
-								log.Log.Debug("capture.main.HandleRecordStream(motiondetection): no AAC audio codec detected, skipping audio track.")
-							}
+						if err := writer.WritePacket(pkt); err != nil {
+							log.Log.Error("capture.main.HandleRecordStream(motiondetection): " + err.Error())
 						}
+						preview.AddPacket(pkt)
+						lastPts = pkt.Time
 
 						// We will sync to file every keyframe.
 						if pkt.IsKeyFrame {
@@ -476,7 +482,9 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 				}
 
 				// This will write the trailer a well.
-				myMuxer.WriteTrailer()
+				if err := writer.Close(); err != nil {
+					log.Log.Error("capture.main.HandleRecordStream(motiondetection): " + err.Error())
+				}
 
 				log.Log.Info("capture.main.HandleRecordStream(motiondetection): file save: " + name)
 
@@ -485,43 +493,90 @@ func HandleRecordStream(queue *packets.Queue, configDirectory string, configurat
 				file.Close()
 				file = nil
 
-				// Check if need to convert to fragmented using bento
-				if config.Capture.Fragmented == "true" && config.Capture.FragmentedDuration > 0 {
-					utils.CreateFragmentedMP4(fullName, config.Capture.FragmentedDuration)
-				}
+				metadata.Duration = (lastPts - firstPts).Milliseconds()
+				metadata.SubRecording = subRecording.Stop()
+				preview.Save(configuration, fullName, &metadata)
+				finishRecording("motiondetection", configDirectory, configuration, fullName, metadata)
+			}
+		}
 
-				// Check if we need to encrypt the recording.
-				if config.Encryption != nil && config.Encryption.Enabled == "true" && config.Encryption.Recordings == "true" && config.Encryption.SymmetricKey != "" {
-					// reopen file into memory 'fullName'
-					contents, err := os.ReadFile(fullName)
-					if err == nil {
-						// encrypt
-						encryptedContents, err := encryption.AesEncrypt(contents, config.Encryption.SymmetricKey)
-						if err == nil {
-							// write back to file
-							err := os.WriteFile(fullName, []byte(encryptedContents), 0644)
-							if err != nil {
-								log.Log.Error("capture.main.HandleRecordStream(motiondetection): error writing file: " + err.Error())
-							}
-						} else {
-							log.Log.Error("capture.main.HandleRecordStream(motiondetection): error encrypting file: " + err.Error())
-						}
-					} else {
-						log.Log.Error("capture.main.HandleRecordStream(motiondetection): error reading file: " + err.Error())
-					}
-				}
+		log.Log.Debug("capture.main.HandleRecordStream(): finished")
+	}
+}
 
-				// Create a symbol linc.
-				fc, _ := os.Create(configDirectory + "/data/cloud/" + name)
-				fc.Close()
+// newRecordingMetadata creates the metadata of a recording that is about to start,
+// the codecs and resolution are taken from the streams of the camera.
+func newRecordingMetadata(name string, trigger string, startTime int64, configuration *models.Configuration, rtspClient RTSPClient) models.RecordingMetadata {
+	config := configuration.Config
+	metadata := models.RecordingMetadata{
+		Name:       name,
+		Stream:     "main",
+		CameraKey:  config.Key,
+		CameraName: config.Name,
+		StartTime:  startTime,
+		Trigger:    trigger,
+		Width:      config.Capture.IPCamera.Width,
+		Height:     config.Capture.IPCamera.Height,
+		Regions:    []string{},
+		Encrypted:  EncryptRecordings(configuration),
+	}
+	videoStreams, _ := rtspClient.GetVideoStreams()
+	if len(videoStreams) > 0 {
+		metadata.VideoCodec = videoStreams[0].Name
+		if metadata.Width == 0 || metadata.Height == 0 {
+			metadata.Width = videoStreams[0].Width
+			metadata.Height = videoStreams[0].Height
+		}
+	}
+	// For an MP4 container, AAC is the only audio codec we write, G711 is transcoded to AAC.
+	if audioStream := GetRecordingAudioStream(rtspClient); audioStream != nil {
+		metadata.AudioCodec = "AAC"
+	}
+	return metadata
+}
 
-				// Clean up the recording directory if necessary.
-				CleanupRecordingDirectory(configDirectory, configuration)
+// addMotionToMetadata keeps track of the changes and regions of the motion
+// events that were received while recording.
+func addMotionToMetadata(metadata *models.RecordingMetadata, motion models.MotionDataPartial) {
+	if motion.Trigger == "" || motion.Trigger == models.TriggerMotion {
+		metadata.TotalChanges += motion.NumberOfChanges
+		if motion.NumberOfChanges > metadata.PeakChanges {
+			metadata.PeakChanges = motion.NumberOfChanges
+		}
+	}
+	for _, region := range motion.Regions {
+		exists := false
+		for _, r := range metadata.Regions {
+			if r == region {
+				exists = true
+				break
 			}
 		}
+		if !exists {
+			metadata.Regions = append(metadata.Regions, region)
+		}
+	}
+}
 
-		log.Log.Debug("capture.main.HandleRecordStream(): finished")
+// finishRecording is called once a recording is closed. It will write the metadata sidecar
+// and queue the recording for upload.
+func finishRecording(mode string, configDirectory string, configuration *models.Configuration, fullName string, metadata models.RecordingMetadata) {
+	metadata.EndTime = metadata.StartTime + metadata.Duration
+
+	// Store the metadata next to the recording.
+	if err := utils.WriteRecordingMetadata(fullName, metadata); err != nil {
+		log.Log.Error("capture.main.HandleRecordStream(" + mode + "): error writing metadata: " + err.Error())
 	}
+
+	// Create a symbol link.
+	fc, _ := os.Create(configDirectory + "/data/cloud/" + metadata.Name)
+	fc.Close()
+
+	// Add the recording to the index, so it shows up in the media APIs.
+	database.IndexRecording(configDirectory, metadata.Name)
+
+	// Clean up the recording directory if necessary.
+	CleanupRecordingDirectory(configDirectory, configuration)
 }
 
 // VerifyCamera godoc
@@ -550,15 +605,15 @@ func VerifyCamera(c *gin.Context) {
 		}
 
 		rtspUrl := cameraStreams.RTSP
+		transport := cameraStreams.Transport
 		if streamType == "secondary" {
 			rtspUrl = cameraStreams.SubRTSP
+			transport = cameraStreams.SubTransport
 		}
 
 		// Currently only support H264 encoded cameras, this will change.
 		// Establishing the camera connection without backchannel if no substream
-		rtspClient := &Golibrtsp{
-			Url: rtspUrl,
-		}
+		rtspClient := NewRTSPClient(rtspUrl, StreamOptions{Transport: transport})
 
 		err := rtspClient.Connect(ctx)
 		if err == nil {
@@ -571,7 +626,7 @@ func VerifyCamera(c *gin.Context) {
 			for i, stream := range streams {
 				if (stream.Name == "H264" || stream.Name == "H265") && videoIdx < 0 {
 					videoIdx = i
-				} else if stream.Name == "PCM_MULAW" && audioIdx < 0 {
+				} else if (stream.Name == "PCM_MULAW" || stream.Name == "PCM_ALAW") && audioIdx < 0 {
 					audioIdx = i
 				}
 			}
@@ -614,11 +669,11 @@ func Base64Image(captureDevice *Capture, communication *models.Communication) st
 	rtspClient := captureDevice.RTSPSubClient
 	if rtspClient != nil {
 		queue = communication.SubQueue
-		cursor = queue.Latest()
+		cursor = queue.Latest().Named("snapshot")
 	} else {
 		rtspClient = captureDevice.RTSPClient
 		queue = communication.Queue
-		cursor = queue.Latest()
+		cursor = queue.Latest().Named("snapshot")
 	}
 
 	// We'll try to have a keyframe, if not we'll return an empty string.
@@ -633,7 +688,7 @@ func Base64Image(captureDevice *Capture, communication *models.Communication) st
 					continue
 				}
 				var img image.YCbCr
-				img, err = (*rtspClient).DecodePacket(pkt)
+				img, err = rtspClient.DecodePacket(pkt)
 				if err == nil {
 					bytes, _ := utils.ImageToBytes(&img)
 					encodedImage = base64.StdEncoding.EncodeToString(bytes)
@@ -659,11 +714,11 @@ func JpegImage(captureDevice *Capture, communication *models.Communication) imag
 	rtspClient := captureDevice.RTSPSubClient
 	if rtspClient != nil {
 		queue = communication.SubQueue
-		cursor = queue.Latest()
+		cursor = queue.Latest().Named("snapshot")
 	} else {
 		rtspClient = captureDevice.RTSPClient
 		queue = communication.Queue
-		cursor = queue.Latest()
+		cursor = queue.Latest().Named("snapshot")
 	}
 
 	// We'll try to have a keyframe, if not we'll return an empty string.
@@ -677,7 +732,7 @@ func JpegImage(captureDevice *Capture, communication *models.Communication) imag
 				if !pkt.IsKeyFrame {
 					continue
 				}
-				image, err = (*rtspClient).DecodePacket(pkt)
+				image, err = rtspClient.DecodePacket(pkt)
 				if err != nil {
 					count++
 					continue
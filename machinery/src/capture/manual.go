@@ -0,0 +1,342 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// Manual recordings are recorded next to the continuous or motion based recordings, by their own
+// goroutine, so they work in both modes. The requests are kept in memory, so they can be polled
+// (or cancelled) by their ID. Only the most recent ones are remembered.
+const maxManualRecordings = 100
+
+var (
+	ErrRecordingDisabled  = errors.New("recording is disabled")
+	ErrCameraDisconnected = errors.New("the camera is not connected")
+)
+
+type manualRecording struct {
+	state     models.ManualRecording
+	cancel    chan struct{}
+	cancelled bool
+}
+
+var (
+	manualRecordingsMutex sync.Mutex
+	manualRecordings      = make(map[string]*manualRecording)
+	manualRecordingIDs    []string // In the order they were requested.
+)
+
+// RequestManualRecording validates a request and hands it over to the recorder. The duration defaults
+// to the post recording, the pre-roll to the pre recording. The returned recording is pending, and can
+// be polled with GetManualRecording.
+func RequestManualRecording(configuration *models.Configuration, communication *models.Communication, trigger string, request models.RecordRequest) (models.ManualRecording, error) {
+	config := configuration.Config
+	if config.Capture.Recording == "false" {
+		return models.ManualRecording{}, ErrRecordingDisabled
+	}
+	if GetDiskStatus().State == models.DiskStatePaused {
+		return models.ManualRecording{}, ErrDiskFull
+	}
+	if request.Duration < 0 || (request.PreRoll != nil && *request.PreRoll < 0) {
+		return models.ManualRecording{}, errors.New("duration and pre-roll should be positive")
+	}
+
+	duration := request.Duration
+	if duration == 0 {
+		duration = config.Capture.PostRecording
+	}
+	if duration <= 0 {
+		duration = 10
+	}
+	preRoll := config.Capture.PreRecording
+	if request.PreRoll != nil {
+		preRoll = *request.PreRoll
+	}
+
+	recording := models.ManualRecording{
+		ID:          strconv.FormatInt(time.Now().UnixMilli(), 10) + "-" + utils.RandStringBytesMaskImpr(6),
+		Status:      models.ManualRecordingPending,
+		Trigger:     trigger,
+		Label:       request.Label,
+		Duration:    duration,
+		PreRoll:     preRoll,
+		RequestedAt: time.Now().UnixMilli(),
+		CameraID:    configuration.CameraID,
+	}
+
+	handleRecord := communication.HandleRecord
+	if handleRecord == nil {
+		return models.ManualRecording{}, ErrCameraDisconnected
+	}
+	addManualRecording(recording)
+	select {
+	case handleRecord <- recording:
+	case <-time.After(time.Second):
+		removeManualRecording(recording.ID)
+		return models.ManualRecording{}, errors.New("the recorder is not responding")
+	}
+	log.Log.Info("capture.manual.RequestManualRecording(): requested recording " + recording.ID + " of " + strconv.FormatInt(duration, 10) + " seconds")
+	return recording, nil
+}
+
+// The manual recordings of every camera are kept together, a camera (multi-camera mode) only sees its own.
+// The camera ID is empty when the agent runs a single camera.
+
+// GetManualRecording returns the state of a manual recording of a camera.
+func GetManualRecording(cameraID string, id string) (models.ManualRecording, bool) {
+	manualRecordingsMutex.Lock()
+	defer manualRecordingsMutex.Unlock()
+	if entry, ok := manualRecordings[id]; ok && entry.state.CameraID == cameraID {
+		return entry.state, true
+	}
+	return models.ManualRecording{}, false
+}
+
+// ListManualRecordings returns the state of the most recent manual recordings of a camera, the newest first.
+func ListManualRecordings(cameraID string) []models.ManualRecording {
+	manualRecordingsMutex.Lock()
+	defer manualRecordingsMutex.Unlock()
+	recordings := []models.ManualRecording{}
+	for i := len(manualRecordingIDs) - 1; i >= 0; i-- {
+		if state := manualRecordings[manualRecordingIDs[i]].state; state.CameraID == cameraID {
+			recordings = append(recordings, state)
+		}
+	}
+	return recordings
+}
+
+// CancelManualRecording stops a manual recording of a camera. A pending recording is not started, a recording
+// that is running is closed at the next packet, the footage recorded so far is kept.
+func CancelManualRecording(cameraID string, id string) (models.ManualRecording, bool) {
+	manualRecordingsMutex.Lock()
+	defer manualRecordingsMutex.Unlock()
+	entry, ok := manualRecordings[id]
+	if !ok || entry.state.CameraID != cameraID {
+		return models.ManualRecording{}, false
+	}
+	if !entry.cancelled && (entry.state.Status == models.ManualRecordingPending || entry.state.Status == models.ManualRecordingRecording) {
+		entry.cancelled = true
+		close(entry.cancel)
+		if entry.state.Status == models.ManualRecordingPending {
+			entry.state.Status = models.ManualRecordingCancelled
+		}
+		log.Log.Info("capture.manual.CancelManualRecording(): cancelled recording " + id)
+	}
+	return entry.state, true
+}
+
+func addManualRecording(recording models.ManualRecording) {
+	manualRecordingsMutex.Lock()
+	defer manualRecordingsMutex.Unlock()
+	manualRecordings[recording.ID] = &manualRecording{
+		state:  recording,
+		cancel: make(chan struct{}),
+	}
+	manualRecordingIDs = append(manualRecordingIDs, recording.ID)
+
+	// Forget the oldest recordings that are done.
+	for i := 0; len(manualRecordingIDs) > maxManualRecordings && i < len(manualRecordingIDs); {
+		status := manualRecordings[manualRecordingIDs[i]].state.Status
+		if status == models.ManualRecordingPending || status == models.ManualRecordingRecording {
+			i++
+			continue
+		}
+		delete(manualRecordings, manualRecordingIDs[i])
+		manualRecordingIDs = append(manualRecordingIDs[:i], manualRecordingIDs[i+1:]...)
+	}
+}
+
+func removeManualRecording(id string) {
+	manualRecordingsMutex.Lock()
+	defer manualRecordingsMutex.Unlock()
+	delete(manualRecordings, id)
+	for i, recordingID := range manualRecordingIDs {
+		if recordingID == id {
+			manualRecordingIDs = append(manualRecordingIDs[:i], manualRecordingIDs[i+1:]...)
+			break
+		}
+	}
+}
+
+// updateManualRecording changes the state of a manual recording, it returns the cancel channel
+// (nil if the recording is unknown).
+func updateManualRecording(id string, update func(state *models.ManualRecording)) chan struct{} {
+	manualRecordingsMutex.Lock()
+	defer manualRecordingsMutex.Unlock()
+	entry, ok := manualRecordings[id]
+	if !ok {
+		return nil
+	}
+	update(&entry.state)
+	return entry.cancel
+}
+
+// HandleManualRecordings starts a recording for every manual recording that is requested. The stream that is
+// recorded depends on the disk watchdog, as it does for the recorder (see HandleRecording).
+func HandleManualRecordings(queue *packets.Queue, configDirectory string, configuration *models.Configuration, communication *models.Communication, rtspClient RTSPClient, subQueue *packets.Queue, rtspSubClient RTSPClient, subStreamConnected bool) {
+	log.Log.Debug("capture.manual.HandleManualRecordings(): started")
+	for request := range communication.HandleRecord {
+		recordingConfiguration, recordSubStream := RecordingConfiguration(configuration, subStreamConnected)
+		if recordingConfiguration.Config.Capture.Recording == "false" {
+			updateManualRecording(request.ID, func(state *models.ManualRecording) {
+				state.Status = models.ManualRecordingFailed
+				state.Error = ErrDiskFull.Error()
+			})
+			continue
+		}
+		if recordSubStream {
+			go recordManually(request, subQueue, configDirectory, recordingConfiguration, rtspSubClient, nil, nil)
+		} else {
+			go recordManually(request, queue, configDirectory, recordingConfiguration, rtspClient, subQueue, rtspSubClient)
+		}
+	}
+	log.Log.Debug("capture.manual.HandleManualRecordings(): finished")
+}
+
+func recordManually(request models.ManualRecording, queue *packets.Queue, configDirectory string, configuration *models.Configuration, rtspClient RTSPClient, subQueue *packets.Queue, rtspSubClient RTSPClient) {
+	config := configuration.Config
+	fail := func(err error) {
+		log.Log.Error("capture.manual.HandleManualRecordings(): recording " + request.ID + " failed: " + err.Error())
+		updateManualRecording(request.ID, func(state *models.ManualRecording) {
+			state.Status = models.ManualRecordingFailed
+			state.Error = err.Error()
+		})
+	}
+
+	// The next packet is the live edge, the pre-roll and duration are relative to it.
+	cancel := updateManualRecording(request.ID, func(*models.ManualRecording) {})
+	if cancel == nil || isCancelled(cancel) {
+		return
+	}
+	live, err := queue.Latest().Named("manual-recording").ReadPacket()
+	if err != nil {
+		fail(ErrCameraDisconnected)
+		return
+	}
+	requestTime := time.Now()
+	startPts := live.Time - time.Duration(request.PreRoll)*time.Second
+	endPts := live.Time + time.Duration(request.Duration)*time.Second
+
+	// We read the buffered packets, and start at the last keyframe before the pre-roll
+	// (or the first keyframe, if the pre-roll is longer than what's buffered).
+	cursor := queue.Oldest().Named("manual-recording")
+	var gop []packets.Packet
+	for {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			fail(ErrCameraDisconnected)
+			return
+		}
+		if pkt.IsVideo && pkt.IsKeyFrame && len(gop) > 0 && pkt.Time > startPts {
+			gop = append(gop, pkt)
+			break
+		}
+		if pkt.IsVideo && pkt.IsKeyFrame {
+			gop = gop[:0]
+		}
+		if len(gop) > 0 || (pkt.IsVideo && pkt.IsKeyFrame) {
+			gop = append(gop, pkt)
+		}
+	}
+
+	startTime := requestTime.Add(gop[0].Time - live.Time)
+	name := strconv.FormatInt(startTime.Unix(), 10) + "_" +
+		"6" + "-" +
+		fmt.Sprintf("%06d", startTime.Nanosecond()/1000) + "_" +
+		config.Name + "_" +
+		"200-200-400-400" + "_0_" +
+		"769" + RecordingExtension(configuration)
+	fullName := configDirectory + "/data/recordings/" + name
+
+	metadata := newRecordingMetadata(name, request.Trigger, startTime.UnixMilli(), configuration, rtspClient)
+	metadata.Label = request.Label
+
+	file, err := os.Create(fullName)
+	var writer RecordingWriter
+	if err == nil {
+		writer, err = NewRecordingWriter(file, configuration, gop[0].Codec, GetRecordingAudioStream(rtspClient))
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+			os.Remove(fullName)
+		}
+		fail(err)
+		return
+	}
+	updateManualRecording(request.ID, func(state *models.ManualRecording) {
+		state.Status = models.ManualRecordingRecording
+		state.Recording = name
+		state.StartTime = metadata.StartTime
+	})
+	log.Log.Info("capture.manual.HandleManualRecordings(): recording " + request.ID + " started: " + name)
+
+	// The poster is taken from the moment of the request, after the pre-roll.
+	preview := NewRecordingPreview(configuration, rtspClient, live.Time-gop[0].Time)
+	subRecording := StartSubRecording(subQueue, configDirectory, configuration, rtspSubClient, name, request.Trigger, metadata.StartTime, request.PreRoll > 0)
+
+	firstPts := gop[0].Time
+	lastPts := firstPts
+	write := func(pkt packets.Packet) {
+		if err := writer.WritePacket(pkt); err != nil {
+			log.Log.Error("capture.manual.HandleManualRecordings(): " + err.Error())
+		}
+		preview.AddPacket(pkt)
+		lastPts = pkt.Time
+	}
+	for _, pkt := range gop {
+		write(pkt)
+	}
+
+	// Record until the first keyframe after the duration, or until cancelled.
+	status := models.ManualRecordingFinished
+	for {
+		if isCancelled(cancel) {
+			status = models.ManualRecordingCancelled
+			break
+		}
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			break
+		}
+		if pkt.IsVideo && pkt.IsKeyFrame && pkt.Time >= endPts {
+			break
+		}
+		write(pkt)
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Log.Error("capture.manual.HandleManualRecordings(): " + err.Error())
+	}
+	file.Close()
+	log.Log.Info("capture.manual.HandleManualRecordings(): recording " + request.ID + " " + status + ": file save: " + name)
+
+	metadata.Duration = (lastPts - firstPts).Milliseconds()
+	metadata.SubRecording = subRecording.Stop()
+	preview.Save(configuration, fullName, &metadata)
+	finishRecording("manual", configDirectory, configuration, fullName, metadata)
+
+	updateManualRecording(request.ID, func(state *models.ManualRecording) {
+		state.Status = status
+		state.EndTime = metadata.StartTime + metadata.Duration
+	})
+}
+
+func isCancelled(cancel <-chan struct{}) bool {
+	select {
+	case <-cancel:
+		return true
+	default:
+		return false
+	}
+}
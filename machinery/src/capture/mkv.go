@@ -0,0 +1,769 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/yapingcat/gomedia/go-codec"
+)
+
+// The EBML elements we write (and read) in a Matroska file.
+const (
+	mkvEBML               = 0x1A45DFA3
+	mkvEBMLVersion        = 0x4286
+	mkvEBMLReadVersion    = 0x42F7
+	mkvEBMLMaxIDLength    = 0x42F2
+	mkvEBMLMaxSizeLength  = 0x42F3
+	mkvDocType            = 0x4282
+	mkvDocTypeVersion     = 0x4287
+	mkvDocTypeReadVersion = 0x4285
+	mkvSegment            = 0x18538067
+	mkvInfo               = 0x1549A966
+	mkvTimecodeScale      = 0x2AD7B1
+	mkvMuxingApp          = 0x4D80
+	mkvWritingApp         = 0x5741
+	mkvDuration           = 0x4489
+	mkvTracks             = 0x1654AE6B
+	mkvTrackEntry         = 0xAE
+	mkvTrackNumber        = 0xD7
+	mkvTrackUID           = 0x73C5
+	mkvTrackType          = 0x83
+	mkvFlagLacing         = 0x9C
+	mkvCodecID            = 0x86
+	mkvCodecPrivate       = 0x63A2
+	mkvVideo              = 0xE0
+	mkvPixelWidth         = 0xB0
+	mkvPixelHeight        = 0xBA
+	mkvAudio              = 0xE1
+	mkvSamplingFrequency  = 0xB5
+	mkvChannels           = 0x9F
+	mkvCluster            = 0x1F43B675
+	mkvTimecode           = 0xE7
+	mkvSimpleBlock        = 0xA3
+	mkvVoid               = 0xEC
+	mkvSeekHead           = 0x114D9B74
+	mkvSeek               = 0x4DBB
+	mkvSeekID             = 0x53AB
+	mkvSeekPosition       = 0x53AC
+	mkvCues               = 0x1C53BB6B
+	mkvCuePoint           = 0xBB
+	mkvCueTime            = 0xB3
+	mkvCueTrackPositions  = 0xB7
+	mkvCueTrack           = 0xF7
+	mkvCueClusterPosition = 0xF1
+)
+
+const (
+	mkvVideoTrack = 1
+	mkvAudioTrack = 2
+
+	// A block has a 16 bit timestamp (in milliseconds) relative to its cluster,
+	// so a cluster can't be longer than 32 seconds.
+	mkvMaxClusterDuration = 30 * time.Second
+
+	// The space we reserve for the seek head, at the start of the segment.
+	mkvSeekHeadSize = 32
+)
+
+// MatroskaWriter writes a Matroska (MKV) file while recording. The header is followed by clusters,
+// which start at a keyframe and are written as soon as they are complete. The segment has an unknown
+// size until the recording is closed, so a file that was cut by a crash is playable up to the last cluster.
+// When the recording is closed, the cues (to seek to the keyframes) are written after the last cluster.
+type MatroskaWriter struct {
+	writer     io.WriteSeeker
+	videoCodec string
+	width      int
+	height     int
+
+	// The parameters of the video and audio codec, these are read from the stream itself.
+	parameterSets ParameterSets
+	audioConfig   *mpeg4audio.Config
+
+	started        bool
+	headerWritten  bool
+	startTime      time.Duration
+	endTime        time.Duration
+	clusterStart   time.Duration
+	cluster        bytes.Buffer
+	segmentOffset  int64 // Where the size of the segment is written.
+	durationOffset int64 // Where the duration of the recording is written.
+	position       int64
+
+	// Where the data of the segment starts, the positions of the cues are relative to it. The seek head is
+	// written at the start of the segment.
+	segmentStart    int64
+	clusterKeyFrame bool
+	cues            []mkvCue
+}
+
+// mkvCue is the position of a cluster that starts with a keyframe.
+type mkvCue struct {
+	time     uint64 // In milliseconds.
+	position uint64
+}
+
+// NewMatroskaWriter creates a writer for a Matroska file, the video codec should be either H264 or H265.
+func NewMatroskaWriter(writer io.WriteSeeker, videoCodec string, width int, height int) *MatroskaWriter {
+	return &MatroskaWriter{
+		writer:     writer,
+		videoCodec: videoCodec,
+		width:      width,
+		height:     height,
+	}
+}
+
+// WritePacket adds a packet to the current cluster. Packets before the first keyframe are dropped.
+func (m *MatroskaWriter) WritePacket(pkt packets.Packet) error {
+	if pkt.IsVideo {
+		return m.writeVideo(pkt)
+	} else if pkt.IsAudio && pkt.Codec == "AAC" {
+		return m.writeAudio(pkt)
+	}
+	return nil
+}
+
+func (m *MatroskaWriter) writeVideo(pkt packets.Packet) error {
+	if !m.started && !pkt.IsKeyFrame {
+		return nil
+	}
+
+	filteredAU, parameterSets, err := SplitAccessUnit(m.videoCodec, pkt.Data)
+	if err != nil {
+		return err
+	}
+	if parameterSets.VPS != nil {
+		m.parameterSets.VPS = parameterSets.VPS
+	}
+	if parameterSets.SPS != nil {
+		m.parameterSets.SPS = parameterSets.SPS
+	}
+	if parameterSets.PPS != nil {
+		m.parameterSets.PPS = parameterSets.PPS
+	}
+	if len(filteredAU) == 0 {
+		return nil
+	}
+
+	if !m.started {
+		m.started = true
+		m.startTime = pkt.Time
+		m.clusterStart = pkt.Time
+		m.clusterKeyFrame = true
+	} else if pkt.IsKeyFrame || pkt.Time-m.clusterStart >= mkvMaxClusterDuration {
+		if err := m.writeCluster(); err != nil {
+			return err
+		}
+		m.clusterStart = pkt.Time
+		m.clusterKeyFrame = pkt.IsKeyFrame
+	}
+
+	data, err := h264.AVCCMarshal(filteredAU)
+	if err != nil {
+		return err
+	}
+	// Matroska stores the presentation time of a frame.
+	m.addBlock(mkvVideoTrack, pkt.Time+pkt.CompositionTime, pkt.IsKeyFrame, data)
+	if pkt.Time > m.endTime {
+		m.endTime = pkt.Time
+	}
+	return nil
+}
+
+func (m *MatroskaWriter) writeAudio(pkt packets.Packet) error {
+	// Audio is only written once we have video, so both tracks start at the same time.
+	if !m.started || pkt.Time < m.startTime {
+		return nil
+	}
+
+	var adtsPackets mpeg4audio.ADTSPackets
+	if err := adtsPackets.Unmarshal(pkt.Data); err != nil {
+		return err
+	}
+	if len(adtsPackets) == 0 {
+		return nil
+	}
+	if m.audioConfig == nil {
+		// Once the header is written we can't add an audio track anymore.
+		if m.headerWritten {
+			return nil
+		}
+		m.audioConfig = &mpeg4audio.Config{
+			Type:         adtsPackets[0].Type,
+			SampleRate:   adtsPackets[0].SampleRate,
+			ChannelCount: adtsPackets[0].ChannelCount,
+		}
+	}
+
+	for i, adtsPacket := range adtsPackets {
+		offset := time.Duration(i*mpeg4audio.SamplesPerAccessUnit) * time.Second / time.Duration(m.audioConfig.SampleRate)
+		m.addBlock(mkvAudioTrack, pkt.Time+offset, true, adtsPacket.AU)
+	}
+	return nil
+}
+
+// addBlock adds a SimpleBlock to the cluster that is being buffered.
+func (m *MatroskaWriter) addBlock(track byte, ts time.Duration, keyFrame bool, data []byte) {
+	header := make([]byte, 4)
+	header[0] = 0x80 | track
+	binary.BigEndian.PutUint16(header[1:], uint16(int16((ts - m.clusterStart).Milliseconds())))
+	if keyFrame {
+		header[3] = 0x80
+	}
+	writeEBMLElement(&m.cluster, mkvSimpleBlock, append(header, data...))
+}
+
+func (m *MatroskaWriter) writeHeader() error {
+	var header bytes.Buffer
+	var ebml bytes.Buffer
+	writeEBMLUint(&ebml, mkvEBMLVersion, 1)
+	writeEBMLUint(&ebml, mkvEBMLReadVersion, 1)
+	writeEBMLUint(&ebml, mkvEBMLMaxIDLength, 4)
+	writeEBMLUint(&ebml, mkvEBMLMaxSizeLength, 8)
+	writeEBMLElement(&ebml, mkvDocType, []byte("matroska"))
+	writeEBMLUint(&ebml, mkvDocTypeVersion, 4)
+	writeEBMLUint(&ebml, mkvDocTypeReadVersion, 2)
+	writeEBMLElement(&header, mkvEBML, ebml.Bytes())
+
+	// The size of the segment is unknown until the recording is closed.
+	writeEBMLID(&header, mkvSegment)
+	m.segmentOffset = int64(header.Len())
+	header.Write([]byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+	m.segmentStart = int64(header.Len())
+	writeEBMLElement(&header, mkvVoid, make([]byte, mkvSeekHeadSize-2))
+
+	var info bytes.Buffer
+	writeEBMLUint(&info, mkvTimecodeScale, uint64(time.Millisecond))
+	writeEBMLElement(&info, mkvMuxingApp, []byte("Kerberos Agent"))
+	writeEBMLElement(&info, mkvWritingApp, []byte("Kerberos Agent"))
+	writeEBMLID(&info, mkvDuration)
+	writeEBMLSize(&info, 8)
+	durationOffset := int64(info.Len())
+	info.Write(make([]byte, 8))
+	writeEBMLID(&header, mkvInfo)
+	writeEBMLSize(&header, uint64(info.Len()))
+	m.durationOffset = int64(header.Len()) + durationOffset
+	header.Write(info.Bytes())
+
+	codecID, codecPrivate, err := m.videoCodecPrivate()
+	if err != nil {
+		return err
+	}
+	var tracks bytes.Buffer
+	var video bytes.Buffer
+	writeEBMLUint(&video, mkvTrackNumber, mkvVideoTrack)
+	writeEBMLUint(&video, mkvTrackUID, mkvVideoTrack)
+	writeEBMLUint(&video, mkvTrackType, 1)
+	writeEBMLUint(&video, mkvFlagLacing, 0)
+	writeEBMLElement(&video, mkvCodecID, []byte(codecID))
+	writeEBMLElement(&video, mkvCodecPrivate, codecPrivate)
+	if m.width > 0 && m.height > 0 {
+		var dimensions bytes.Buffer
+		writeEBMLUint(&dimensions, mkvPixelWidth, uint64(m.width))
+		writeEBMLUint(&dimensions, mkvPixelHeight, uint64(m.height))
+		writeEBMLElement(&video, mkvVideo, dimensions.Bytes())
+	}
+	writeEBMLElement(&tracks, mkvTrackEntry, video.Bytes())
+
+	if m.audioConfig != nil {
+		audioSpecificConfig, err := m.audioConfig.Marshal()
+		if err != nil {
+			return err
+		}
+		var audio bytes.Buffer
+		writeEBMLUint(&audio, mkvTrackNumber, mkvAudioTrack)
+		writeEBMLUint(&audio, mkvTrackUID, mkvAudioTrack)
+		writeEBMLUint(&audio, mkvTrackType, 2)
+		writeEBMLUint(&audio, mkvFlagLacing, 0)
+		writeEBMLElement(&audio, mkvCodecID, []byte("A_AAC"))
+		writeEBMLElement(&audio, mkvCodecPrivate, audioSpecificConfig)
+		var sampling bytes.Buffer
+		writeEBMLFloat(&sampling, mkvSamplingFrequency, float64(m.audioConfig.SampleRate))
+		writeEBMLUint(&sampling, mkvChannels, uint64(m.audioConfig.ChannelCount))
+		writeEBMLElement(&audio, mkvAudio, sampling.Bytes())
+		writeEBMLElement(&tracks, mkvTrackEntry, audio.Bytes())
+	}
+	writeEBMLElement(&header, mkvTracks, tracks.Bytes())
+
+	if err := m.write(header.Bytes()); err != nil {
+		return err
+	}
+	m.headerWritten = true
+	return nil
+}
+
+// videoCodecPrivate returns the codec ID and the decoder configuration (avcC or hvcC) of the video track.
+func (m *MatroskaWriter) videoCodecPrivate() (string, []byte, error) {
+	startCode := []byte{0x00, 0x00, 0x00, 0x01}
+	if m.videoCodec == "H265" {
+		if m.parameterSets.VPS == nil || m.parameterSets.SPS == nil || m.parameterSets.PPS == nil {
+			return "", nil, errors.New("capture.mkv.videoCodecPrivate(): no parameter sets found in the video stream")
+		}
+		hvcc := codec.NewHEVCRecordConfiguration()
+		hvcc.UpdateVPS(append(append([]byte{}, startCode...), m.parameterSets.VPS...))
+		hvcc.UpdateSPS(append(append([]byte{}, startCode...), m.parameterSets.SPS...))
+		hvcc.UpdatePPS(append(append([]byte{}, startCode...), m.parameterSets.PPS...))
+		hvcC, err := hvcc.Encode()
+		return "V_MPEGH/ISO/HEVC", hvcC, err
+	}
+	if m.parameterSets.SPS == nil || m.parameterSets.PPS == nil {
+		return "", nil, errors.New("capture.mkv.videoCodecPrivate(): no parameter sets found in the video stream")
+	}
+	avcC, err := codec.CreateH264AVCCExtradata(
+		[][]byte{append(append([]byte{}, startCode...), m.parameterSets.SPS...)},
+		[][]byte{append(append([]byte{}, startCode...), m.parameterSets.PPS...)})
+	return "V_MPEG4/ISO/AVC", avcC, err
+}
+
+func (m *MatroskaWriter) writeCluster() error {
+	if m.cluster.Len() == 0 {
+		return nil
+	}
+	if !m.headerWritten {
+		if err := m.writeHeader(); err != nil {
+			return err
+		}
+	}
+	clusterTime := uint64((m.clusterStart - m.startTime).Milliseconds())
+	if m.clusterKeyFrame {
+		m.cues = append(m.cues, mkvCue{time: clusterTime, position: uint64(m.position - m.segmentStart)})
+	}
+	var timecode bytes.Buffer
+	writeEBMLUint(&timecode, mkvTimecode, clusterTime)
+
+	var cluster bytes.Buffer
+	writeEBMLID(&cluster, mkvCluster)
+	writeEBMLSize(&cluster, uint64(timecode.Len()+m.cluster.Len()))
+	cluster.Write(timecode.Bytes())
+	cluster.Write(m.cluster.Bytes())
+	m.cluster.Reset()
+	return m.write(cluster.Bytes())
+}
+
+func (m *MatroskaWriter) write(data []byte) error {
+	n, err := m.writer.Write(data)
+	m.position += int64(n)
+	return err
+}
+
+// Close writes the last cluster and the cues, and fills in the size of the segment and the duration of the recording.
+func (m *MatroskaWriter) Close() error {
+	if !m.started {
+		return nil
+	}
+	if err := m.writeCluster(); err != nil {
+		return err
+	}
+	if !m.headerWritten {
+		return nil
+	}
+	if err := m.writeCues(); err != nil {
+		return err
+	}
+	end := m.position
+
+	segmentSize := make([]byte, 8)
+	binary.BigEndian.PutUint64(segmentSize, uint64(end-m.segmentOffset-8))
+	segmentSize[0] = 0x01
+	if err := m.writeAt(segmentSize, m.segmentOffset); err != nil {
+		return err
+	}
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(float64((m.endTime - m.startTime).Milliseconds())))
+	if err := m.writeAt(duration, m.durationOffset); err != nil {
+		return err
+	}
+	_, err := m.writer.Seek(end, io.SeekStart)
+	return err
+}
+
+// writeCues writes the cues after the last cluster, and the seek head (which points to the cues) in the
+// space we reserved at the start of the segment.
+func (m *MatroskaWriter) writeCues() error {
+	cuesPosition := uint64(m.position - m.segmentStart)
+	var cuePoints bytes.Buffer
+	for _, cue := range m.cues {
+		var positions bytes.Buffer
+		writeEBMLUint(&positions, mkvCueTrack, mkvVideoTrack)
+		writeEBMLUint(&positions, mkvCueClusterPosition, cue.position)
+		var cuePoint bytes.Buffer
+		writeEBMLUint(&cuePoint, mkvCueTime, cue.time)
+		writeEBMLElement(&cuePoint, mkvCueTrackPositions, positions.Bytes())
+		writeEBMLElement(&cuePoints, mkvCuePoint, cuePoint.Bytes())
+	}
+	var cues bytes.Buffer
+	writeEBMLElement(&cues, mkvCues, cuePoints.Bytes())
+	if err := m.write(cues.Bytes()); err != nil {
+		return err
+	}
+
+	var seekID bytes.Buffer
+	writeEBMLID(&seekID, mkvCues)
+	var seek bytes.Buffer
+	writeEBMLElement(&seek, mkvSeekID, seekID.Bytes())
+	writeEBMLUint(&seek, mkvSeekPosition, cuesPosition)
+	var seekHead bytes.Buffer
+	var seekEntries bytes.Buffer
+	writeEBMLElement(&seekEntries, mkvSeek, seek.Bytes())
+	writeEBMLElement(&seekHead, mkvSeekHead, seekEntries.Bytes())
+	// The rest of the reserved space stays void.
+	writeEBMLElement(&seekHead, mkvVoid, make([]byte, mkvSeekHeadSize-seekHead.Len()-2))
+	return m.writeAt(seekHead.Bytes(), m.segmentStart)
+}
+
+func (m *MatroskaWriter) writeAt(data []byte, offset int64) error {
+	if _, err := m.writer.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := m.writer.Write(data)
+	return err
+}
+
+func writeEBMLID(buf *bytes.Buffer, id uint32) {
+	switch {
+	case id > 0xFFFFFF:
+		buf.Write([]byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)})
+	case id > 0xFFFF:
+		buf.Write([]byte{byte(id >> 16), byte(id >> 8), byte(id)})
+	case id > 0xFF:
+		buf.Write([]byte{byte(id >> 8), byte(id)})
+	default:
+		buf.WriteByte(byte(id))
+	}
+}
+
+// writeEBMLSize writes the size of an element as a variable length integer, in as few bytes as possible.
+func writeEBMLSize(buf *bytes.Buffer, size uint64) {
+	length := 1
+	for length < 8 && size >= (uint64(1)<<(7*length))-1 {
+		length++
+	}
+	for i := length - 1; i >= 0; i-- {
+		b := byte(size >> (8 * i))
+		if i == length-1 {
+			b |= 0x80 >> (length - 1)
+		}
+		buf.WriteByte(b)
+	}
+}
+
+func writeEBMLElement(buf *bytes.Buffer, id uint32, data []byte) {
+	writeEBMLID(buf, id)
+	writeEBMLSize(buf, uint64(len(data)))
+	buf.Write(data)
+}
+
+func writeEBMLUint(buf *bytes.Buffer, id uint32, value uint64) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	i := 0
+	for i < 7 && data[i] == 0 {
+		i++
+	}
+	writeEBMLElement(buf, id, data[i:])
+}
+
+func writeEBMLFloat(buf *bytes.Buffer, id uint32, value float64) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(value))
+	writeEBMLElement(buf, id, data)
+}
+
+// readEBMLVint reads a variable length integer, the length marker is removed for sizes, but kept for IDs.
+func readEBMLVint(data []byte, keepMarker bool) (uint64, int, bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false
+	}
+	length := 1
+	for data[0]&(0x80>>(length-1)) == 0 {
+		length++
+	}
+	if len(data) < length {
+		return 0, 0, false
+	}
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	unknown := value == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(data[i])
+		unknown = unknown && data[i] == 0xFF
+	}
+	if unknown && !keepMarker {
+		value = math.MaxUint64
+	}
+	return value, length, true
+}
+
+// isMatroska returns true if the data starts with an EBML header.
+func isMatroska(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data) == mkvEBML
+}
+
+// ebmlReader reads the elements of a Matroska file one at a time.
+type ebmlReader struct {
+	reader *bufio.Reader
+}
+
+// readElement reads the ID and size of the next element, the size of an element with an unknown
+// size (a segment or cluster that is being written) is math.MaxUint64.
+func (r *ebmlReader) readElement() (uint64, uint64, error) {
+	id, err := r.readVint(true)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := r.readVint(false)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return id, size, err
+}
+
+func (r *ebmlReader) readVint(keepMarker bool) (uint64, error) {
+	first, err := r.reader.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if first[0] == 0 {
+		return 0, errors.New("invalid EBML variable length integer")
+	}
+	data, err := r.reader.Peek(1 + bits.LeadingZeros8(first[0]))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	value, length, _ := readEBMLVint(data, keepMarker)
+	_, err = r.reader.Discard(length)
+	return value, err
+}
+
+// demuxMatroska reads the packets of a Matroska recording, a cluster at a time. The video is converted
+// back to Annex-B (with the parameter sets in front of every keyframe) and the audio to ADTS, as in
+// the queue. A recording that was cut (by a crash) is read up to the last complete element.
+func demuxMatroska(reader io.Reader, onPacket func(recordingTracks, packets.Packet) error) (recordingTracks, error) {
+	type mkvTrack struct {
+		number       uint64
+		codecID      string
+		codecPrivate []byte
+	}
+	var trackEntries []*mkvTrack
+	var track *mkvTrack
+	var clusterTime int64
+	type mkvBlock struct {
+		track    uint64
+		ts       int64
+		keyFrame bool
+		data     []byte
+	}
+	var blocks []mkvBlock
+
+	// The tracks are read before the first cluster.
+	var tracks recordingTracks
+	tracksRead := false
+	var videoTrack, audioTrack uint64
+	var parameterSets [][]byte
+	lengthSize := 4
+	var audioConfig mpeg4audio.Config
+	readTracks := func() error {
+		tracksRead = true
+		for _, t := range trackEntries {
+			switch t.codecID {
+			case "V_MPEG4/ISO/AVC", "V_MPEGH/ISO/HEVC":
+				tracks.videoCodec = "H264"
+				if t.codecID == "V_MPEGH/ISO/HEVC" {
+					tracks.videoCodec = "H265"
+				}
+				videoTrack = t.number
+				if len(t.codecPrivate) > 0 {
+					var err error
+					if parameterSets, lengthSize, err = unmarshalDecoderConfiguration(tracks.videoCodec, t.codecPrivate); err != nil {
+						return err
+					}
+				}
+			case "A_AAC":
+				if err := audioConfig.Unmarshal(t.codecPrivate); err != nil {
+					return err
+				}
+				tracks.hasAudio = true
+				audioTrack = t.number
+			}
+		}
+		return nil
+	}
+
+	// Blocks have a presentation time, the decoding time of a frame is the presentation time of the
+	// frame at the same position in presentation order. A cluster starts with a keyframe, so frames
+	// are only reordered within a cluster.
+	flushCluster := func() error {
+		defer func() { blocks = nil }()
+		if len(blocks) == 0 {
+			return nil
+		}
+		if !tracksRead {
+			if err := readTracks(); err != nil {
+				return err
+			}
+		}
+		var presentationTimes []int64
+		for _, block := range blocks {
+			if block.track == videoTrack {
+				presentationTimes = append(presentationTimes, block.ts)
+			}
+		}
+		sort.Slice(presentationTimes, func(i, j int) bool { return presentationTimes[i] < presentationTimes[j] })
+
+		frame := 0
+		for _, block := range blocks {
+			var pkt packets.Packet
+			if videoTrack != 0 && block.track == videoTrack {
+				dts := presentationTimes[frame]
+				frame++
+				nalus, _, err := splitLengthPrefixed(tracks.videoCodec, block.data, lengthSize)
+				if err != nil {
+					return err
+				}
+				if len(nalus) == 0 {
+					continue
+				}
+				if block.keyFrame {
+					nalus = append(append([][]byte{}, parameterSets...), nalus...)
+				}
+				annexB, err := h264.AnnexBMarshal(nalus)
+				if err != nil {
+					return err
+				}
+				pkt = packets.Packet{
+					IsVideo:         true,
+					IsKeyFrame:      block.keyFrame,
+					Codec:           tracks.videoCodec,
+					Time:            time.Duration(dts) * time.Millisecond,
+					CompositionTime: time.Duration(block.ts-dts) * time.Millisecond,
+					Data:            annexB,
+				}
+			} else if audioTrack != 0 && block.track == audioTrack {
+				adts, err := mpeg4audio.ADTSPackets{{
+					Type:         audioConfig.Type,
+					SampleRate:   audioConfig.SampleRate,
+					ChannelCount: audioConfig.ChannelCount,
+					AU:           block.data,
+				}}.Marshal()
+				if err != nil {
+					return err
+				}
+				pkt = packets.Packet{
+					IsAudio: true,
+					Codec:   "AAC",
+					Time:    time.Duration(block.ts) * time.Millisecond,
+					Data:    adts,
+				}
+			} else {
+				continue
+			}
+			if err := onPacket(tracks, pkt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The master elements we need are entered, all other elements are skipped.
+	masters := map[uint64]bool{mkvSegment: true, mkvTracks: true, mkvCluster: true, mkvTrackEntry: true}
+	r := &ebmlReader{reader: bufio.NewReader(reader)}
+elements:
+	for {
+		id, size, err := r.readElement()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return tracks, err
+		}
+		if masters[id] {
+			if id == mkvCluster {
+				if err := flushCluster(); err != nil {
+					return tracks, err
+				}
+			}
+			if id == mkvTrackEntry {
+				track = &mkvTrack{}
+				trackEntries = append(trackEntries, track)
+			}
+			continue
+		}
+		if size > math.MaxInt64 {
+			return tracks, errors.New("an element has an unknown size")
+		}
+
+		switch id {
+		case mkvTrackNumber, mkvCodecID, mkvCodecPrivate, mkvTimecode, mkvSimpleBlock:
+		default:
+			if _, err := io.CopyN(io.Discard, r.reader, int64(size)); err != nil {
+				break elements
+			}
+			continue
+		}
+		if size > maxRecordingSampleSize {
+			return tracks, errors.New("an element is too large")
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r.reader, payload); err != nil {
+			break
+		}
+
+		switch id {
+		case mkvTrackNumber:
+			if track != nil {
+				track.number = readEBMLUint(payload)
+			}
+		case mkvCodecID:
+			if track != nil {
+				track.codecID = string(payload)
+			}
+		case mkvCodecPrivate:
+			if track != nil {
+				track.codecPrivate = payload
+			}
+		case mkvTimecode:
+			clusterTime = int64(readEBMLUint(payload))
+		case mkvSimpleBlock:
+			number, length, ok := readEBMLVint(payload, false)
+			if !ok || len(payload) < length+3 {
+				return tracks, errors.New("invalid block")
+			}
+			blocks = append(blocks, mkvBlock{
+				track:    number,
+				ts:       clusterTime + int64(int16(binary.BigEndian.Uint16(payload[length:]))),
+				keyFrame: payload[length+2]&0x80 != 0,
+				data:     payload[length+3:],
+			})
+		}
+	}
+	if err := flushCluster(); err != nil {
+		return tracks, err
+	}
+	if !tracksRead {
+		if err := readTracks(); err != nil {
+			return tracks, err
+		}
+	}
+	return tracks, nil
+}
+
+func readEBMLUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
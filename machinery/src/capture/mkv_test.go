@@ -0,0 +1,198 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+// ebmlElement is an element of a Matroska file.
+type ebmlElement struct {
+	id         uint64
+	offset     int // Of the element in the file.
+	dataOffset int
+	data       []byte
+}
+
+// parseEBML parses the elements in data (at an offset in the file), the elements should exactly fill the data.
+func parseEBML(t *testing.T, data []byte, offset int) []ebmlElement {
+	t.Helper()
+	var elements []ebmlElement
+	for pos := 0; pos < len(data); {
+		id, idLength, ok := readEBMLVint(data[pos:], true)
+		if !ok {
+			t.Fatalf("invalid element ID at %d", offset+pos)
+		}
+		size, sizeLength, ok := readEBMLVint(data[pos+idLength:], false)
+		if !ok || size > uint64(len(data)-pos-idLength-sizeLength) {
+			t.Fatalf("element %x at %d doesn't fit in its parent", id, offset+pos)
+		}
+		start := pos + idLength + sizeLength
+		elements = append(elements, ebmlElement{id: id, offset: offset + pos, dataOffset: offset + start, data: data[start : start+int(size)]})
+		pos = start + int(size)
+	}
+	return elements
+}
+
+// findEBML returns the first element with the ID.
+func findEBML(t *testing.T, elements []ebmlElement, id uint64) ebmlElement {
+	t.Helper()
+	for _, element := range elements {
+		if element.id == id {
+			return element
+		}
+	}
+	t.Fatalf("element %x not found", id)
+	return ebmlElement{}
+}
+
+// checkRoundTrip demuxes a recording, and compares the packets with the packets that were written. The
+// writers start at the first keyframe, so the packets before it are not expected back.
+func checkRoundTrip(t *testing.T, written []packets.Packet, reader io.ReadSeeker) {
+	t.Helper()
+	for len(written) > 0 && !written[0].IsKeyFrame {
+		written = written[1:]
+	}
+	var demuxed []packets.Packet
+	tracks, err := demuxRecording(reader, func(_ recordingTracks, pkt packets.Packet) error {
+		demuxed = append(demuxed, pkt)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tracks.videoCodec != "H264" || !tracks.hasAudio {
+		t.Errorf("unexpected tracks %+v", tracks)
+	}
+	for _, isVideo := range []bool{true, false} {
+		var expected, actual []packets.Packet
+		for _, pkt := range written {
+			if pkt.IsVideo == isVideo {
+				expected = append(expected, pkt)
+			}
+		}
+		for _, pkt := range demuxed {
+			if pkt.IsVideo == isVideo {
+				// A TS starts every access unit with a delimiter.
+				pkt.Data = bytes.TrimPrefix(pkt.Data, []byte{0, 0, 0, 1, 0x09, 0xF0})
+				actual = append(actual, pkt)
+			}
+		}
+		if len(actual) != len(expected) {
+			t.Fatalf("%d packets (video %v), expected %d", len(actual), isVideo, len(expected))
+		}
+		for i := range expected {
+			if actual[i].Time != expected[i].Time || actual[i].IsKeyFrame != expected[i].IsKeyFrame || !bytes.Equal(actual[i].Data, expected[i].Data) {
+				t.Fatalf("packet %d (video %v) at %s isn't the packet at %s that was written", i, isVideo, actual[i].Time, expected[i].Time)
+			}
+		}
+	}
+}
+
+func TestMatroskaWriterRoundTrip(t *testing.T) {
+	// 4 GOPs of a second, with audio.
+	written := testRecoveryPackets()
+	file, err := os.Create(t.TempDir() + "/recording.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := NewMatroskaWriter(file, "H264", 640, 480)
+	for _, pkt := range written {
+		if err := writer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The size of the segment is filled in, and every element fits in its parent.
+	top := parseEBML(t, data, 0)
+	if len(top) != 2 || top[0].id != mkvEBML || top[1].id != mkvSegment {
+		t.Fatalf("expected an EBML header and a segment, got %d elements", len(top))
+	}
+	segment := top[1]
+	elements := parseEBML(t, segment.data, segment.dataOffset)
+	var ids []uint64
+	for _, element := range elements {
+		ids = append(ids, element.id)
+	}
+	expectedIDs := []uint64{mkvSeekHead, mkvVoid, mkvInfo, mkvTracks, mkvCluster, mkvCluster, mkvCluster, mkvCluster, mkvCues}
+	if !reflect.DeepEqual(ids, expectedIDs) {
+		t.Fatalf("the segment has the elements %x, expected %x", ids, expectedIDs)
+	}
+
+	info := parseEBML(t, elements[2].data, elements[2].dataOffset)
+	if duration := math.Float64frombits(binary.BigEndian.Uint64(findEBML(t, info, mkvDuration).data)); duration != 3960 {
+		t.Errorf("the duration is %v, expected 3960", duration)
+	}
+
+	// A cluster per GOP, which starts with the keyframe.
+	var clusterOffsets []int
+	for i, cluster := range elements[4:8] {
+		clusterOffsets = append(clusterOffsets, cluster.offset)
+		children := parseEBML(t, cluster.data, cluster.dataOffset)
+		if children[0].id != mkvTimecode || readEBMLUint(children[0].data) != uint64(i*1000) {
+			t.Errorf("cluster %d doesn't start with the timecode %d", i, i*1000)
+		}
+		videoBlocks := 0
+		for _, child := range children[1:] {
+			if child.id != mkvSimpleBlock {
+				t.Fatalf("cluster %d has an element %x", i, child.id)
+			}
+			if child.data[0] != 0x80|mkvVideoTrack {
+				continue
+			}
+			keyFrame := child.data[3]&0x80 != 0
+			if ts := int16(binary.BigEndian.Uint16(child.data[1:])); keyFrame != (videoBlocks == 0) || int(ts) != videoBlocks*40 {
+				t.Errorf("video block %d of cluster %d is at %dms (keyframe %v)", videoBlocks, i, ts, keyFrame)
+			}
+			videoBlocks++
+		}
+		if videoBlocks != 25 {
+			t.Errorf("cluster %d has %d video blocks, expected 25", i, videoBlocks)
+		}
+	}
+
+	// The cues point to the clusters, and the seek head to the cues.
+	cues := elements[8]
+	cuePoints := parseEBML(t, cues.data, cues.dataOffset)
+	if len(cuePoints) != 4 {
+		t.Fatalf("%d cue points, expected 4", len(cuePoints))
+	}
+	for i, cuePoint := range cuePoints {
+		children := parseEBML(t, cuePoint.data, cuePoint.dataOffset)
+		positions := findEBML(t, children, mkvCueTrackPositions)
+		position := parseEBML(t, positions.data, positions.dataOffset)
+		if cueTime := readEBMLUint(findEBML(t, children, mkvCueTime).data); cueTime != uint64(i*1000) {
+			t.Errorf("cue point %d is at %d, expected %d", i, cueTime, i*1000)
+		}
+		if track := readEBMLUint(findEBML(t, position, mkvCueTrack).data); track != mkvVideoTrack {
+			t.Errorf("cue point %d is of track %d", i, track)
+		}
+		if offset := segment.dataOffset + int(readEBMLUint(findEBML(t, position, mkvCueClusterPosition).data)); offset != clusterOffsets[i] {
+			t.Errorf("cue point %d points to %d, the cluster is at %d", i, offset, clusterOffsets[i])
+		}
+	}
+	seekHead := parseEBML(t, elements[0].data, elements[0].dataOffset)
+	seek := parseEBML(t, seekHead[0].data, seekHead[0].dataOffset)
+	if seekID := findEBML(t, seek, mkvSeekID).data; !bytes.Equal(seekID, []byte{0x1C, 0x53, 0xBB, 0x6B}) {
+		t.Errorf("the seek head points to %x, expected the cues", seekID)
+	}
+	if offset := segment.dataOffset + int(readEBMLUint(findEBML(t, seek, mkvSeekPosition).data)); offset != cues.offset {
+		t.Errorf("the seek head points to %d, the cues are at %d", offset, cues.offset)
+	}
+
+	checkRoundTrip(t, written, bytes.NewReader(data))
+}
@@ -0,0 +1,228 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/encryption"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+const (
+	previewThumbnailWidth = 160
+	previewSpriteColumns  = 10
+)
+
+// RecordingPreview collects the frames for the poster and the thumbnail sprite of a recording,
+// while the recording is being written. Only keyframes are decoded, and only when we need one:
+// for the poster (the keyframe of the trigger) or for the next thumbnail.
+type RecordingPreview struct {
+	rtspClient   RTSPClient
+	interval     time.Duration
+	posterOffset time.Duration
+
+	started       bool
+	firstPts      time.Duration
+	lastOffset    time.Duration
+	poster        *image.YCbCr
+	posterFinal   bool
+	thumbnails    []*image.RGBA
+	offsets       []time.Duration
+	nextThumbnail time.Duration
+}
+
+// NewRecordingPreview creates the preview of a recording, the poster is taken from the first keyframe
+// at (or after) the poster offset, which is the time between the start of the recording and the trigger.
+// Nil is returned if previews are disabled.
+func NewRecordingPreview(configuration *models.Configuration, rtspClient RTSPClient, posterOffset time.Duration) *RecordingPreview {
+	config := configuration.Config
+	if config.Capture.Preview == "false" || rtspClient == nil {
+		return nil
+	}
+	interval := time.Duration(config.Capture.PreviewInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &RecordingPreview{
+		rtspClient:   rtspClient,
+		interval:     interval,
+		posterOffset: posterOffset,
+	}
+}
+
+// AddPacket is called for every packet written to the recording.
+func (p *RecordingPreview) AddPacket(pkt packets.Packet) {
+	if p == nil || !pkt.IsVideo {
+		return
+	}
+	if !p.started {
+		p.started = true
+		p.firstPts = pkt.Time
+	}
+	offset := pkt.Time - p.firstPts
+	p.lastOffset = offset
+	if !pkt.IsKeyFrame {
+		return
+	}
+
+	needPoster := !p.posterFinal && (p.poster == nil || offset >= p.posterOffset)
+	needThumbnail := offset >= p.nextThumbnail
+	if !needPoster && !needThumbnail {
+		return
+	}
+
+	img, err := p.rtspClient.DecodePacket(pkt)
+	if err != nil {
+		return
+	}
+
+	// The decoded image is reused by the decoder, so we keep a copy.
+	if needPoster {
+		p.poster = copyYCbCr(&img)
+		p.posterFinal = offset >= p.posterOffset
+	}
+	if needThumbnail {
+		p.thumbnails = append(p.thumbnails, scaleYCbCr(&img, previewThumbnailWidth))
+		p.offsets = append(p.offsets, offset)
+		p.nextThumbnail = offset + p.interval
+	}
+}
+
+// Save writes the poster (<recording>.jpg), the thumbnail sprite (<recording>_sprite.jpg) and the WebVTT
+// file describing the sprite (<recording>.vtt) next to the recording, and adds them to the metadata.
+// When recordings are encrypted, the previews are encrypted as well.
+func (p *RecordingPreview) Save(configuration *models.Configuration, recordingPath string, metadata *models.RecordingMetadata) {
+	if p == nil || p.poster == nil {
+		return
+	}
+
+	posterPath := utils.PosterPath(recordingPath)
+	var poster bytes.Buffer
+	if err := jpeg.Encode(&poster, p.poster, &jpeg.Options{Quality: 75}); err != nil {
+		log.Log.Error("capture.preview.Save(): could not encode poster: " + err.Error())
+		return
+	}
+	if err := writePreviewFile(configuration, posterPath, poster.Bytes()); err != nil {
+		log.Log.Error("capture.preview.Save(): could not write poster: " + err.Error())
+		return
+	}
+	metadata.Poster = filepath.Base(posterPath)
+
+	if len(p.thumbnails) == 0 {
+		return
+	}
+
+	// All thumbnails are drawn on a single image, with a fixed number of columns.
+	thumbnailSize := p.thumbnails[0].Bounds().Size()
+	columns := previewSpriteColumns
+	if len(p.thumbnails) < columns {
+		columns = len(p.thumbnails)
+	}
+	rows := (len(p.thumbnails) + columns - 1) / columns
+	sprite := image.NewRGBA(image.Rect(0, 0, columns*thumbnailSize.X, rows*thumbnailSize.Y))
+
+	spritePath := utils.SpritePath(recordingPath)
+	spriteName := filepath.Base(spritePath)
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i, thumbnail := range p.thumbnails {
+		x := (i % columns) * thumbnailSize.X
+		y := (i / columns) * thumbnailSize.Y
+		draw.Draw(sprite, image.Rect(x, y, x+thumbnailSize.X, y+thumbnailSize.Y), thumbnail, image.Point{}, draw.Src)
+
+		// A thumbnail is shown until the next one, the last one until the end of the recording.
+		end := p.lastOffset
+		if i+1 < len(p.offsets) {
+			end = p.offsets[i+1]
+		}
+		if end <= p.offsets[i] {
+			end = p.offsets[i] + p.interval
+		}
+		fmt.Fprintf(&vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", formatVTTTime(p.offsets[i]), formatVTTTime(end),
+			spriteName, x, y, thumbnailSize.X, thumbnailSize.Y)
+	}
+
+	var spriteImage bytes.Buffer
+	if err := jpeg.Encode(&spriteImage, sprite, &jpeg.Options{Quality: 60}); err != nil {
+		log.Log.Error("capture.preview.Save(): could not encode sprite: " + err.Error())
+		return
+	}
+	if err := writePreviewFile(configuration, spritePath, spriteImage.Bytes()); err != nil {
+		log.Log.Error("capture.preview.Save(): could not write sprite: " + err.Error())
+		return
+	}
+	vttPath := utils.ThumbnailsPath(recordingPath)
+	if err := writePreviewFile(configuration, vttPath, []byte(vtt.String())); err != nil {
+		log.Log.Error("capture.preview.Save(): could not write thumbnails: " + err.Error())
+		return
+	}
+	metadata.Sprite = filepath.Base(vttPath)
+}
+
+func writePreviewFile(configuration *models.Configuration, path string, data []byte) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if !EncryptRecordings(configuration) {
+		_, err = file.Write(data)
+		return err
+	}
+	writer, err := encryption.NewWriter(file, configuration.Config.Encryption.SymmetricKey)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// formatVTTTime formats an offset as a WebVTT timestamp (hh:mm:ss.ttt).
+func formatVTTTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+func copyYCbCr(img *image.YCbCr) *image.YCbCr {
+	imgCopy := *img
+	imgCopy.Y = append([]byte(nil), img.Y...)
+	imgCopy.Cb = append([]byte(nil), img.Cb...)
+	imgCopy.Cr = append([]byte(nil), img.Cr...)
+	return &imgCopy
+}
+
+// scaleYCbCr scales an image to the given width (keeping the aspect ratio), using the nearest pixel.
+func scaleYCbCr(img *image.YCbCr, width int) *image.RGBA {
+	bounds := img.Bounds()
+	if bounds.Dx() < width {
+		width = bounds.Dx()
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := bounds.Min.X + x*bounds.Dx()/width
+			c := img.YCbCrAt(sx, sy)
+			r, g, b := color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+			scaled.SetRGBA(x, y, color.RGBA{R: r, G: g, B: b, A: 255})
+		}
+	}
+	return scaled
+}
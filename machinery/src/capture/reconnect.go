@@ -0,0 +1,474 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"image"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+// A stream (main or sub) is reconnected on its own when it fails, without restarting the agent: the
+// consumers (recording, motion detection, livestreams, ...) keep reading the same queue, and continue when
+// the stream is back. The stream has failed when no keyframe is received for a while, it's reconnected with
+// an exponential backoff (and jitter, so cameras on the same network don't reconnect at once). While the
+// queue is unavailable the consumers of the sub stream read the main stream (see packets/fallback.go).
+// When the main stream comes back with other streams (codec, resolution, ...) the queue gets the new
+// streams, a sub stream that changed is dropped: its consumers keep reading the main stream.
+
+const (
+	streamCheckInterval  = 5 * time.Second
+	streamMaxStalls      = 3 // The number of checks without a new keyframe, before the stream has failed.
+	reconnectMinBackoff  = time.Second
+	reconnectMaxBackoff  = time.Minute
+	streamEventsCapacity = 50
+)
+
+// ErrStreamChanged is the error of a sub stream that is dropped, it reconnected with other streams than before.
+var ErrStreamChanged = errors.New("the streams of the camera changed")
+
+// ErrStreamClosed is returned when the reconnecting client is used while the stream is reconnecting, or after it's closed.
+var ErrStreamClosed = errors.New("the stream is not connected")
+
+// ReconnectBackoff returns the time to wait before a reconnect, for the number of failed reconnects.
+// The backoff doubles on every attempt up to a maximum, and is randomised between half and the full backoff.
+func ReconnectBackoff(attempt int) time.Duration {
+	backoff := reconnectMaxBackoff
+	if attempt < 16 {
+		backoff = reconnectMinBackoff << uint(attempt)
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// ReconnectingClient implements the RTSPClient interface. It reads the stream with the client, and
+// replaces the client with a new one when the stream fails. Without a client (the stream wasn't available
+// at boot) it connects the stream first.
+type ReconnectingClient struct {
+	Url        string
+	Options    StreamOptions
+	StreamType string // main or sub
+
+	clientMutex sync.RWMutex
+	client      RTSPClient       // nil, while the stream is reconnecting.
+	streams     []packets.Stream // nil, until the stream is connected.
+
+	statusMutex   sync.Mutex
+	status        models.StreamStatus
+	events        []models.StreamStatus
+	communication *models.Communication
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+var _ RTSPClient = (*ReconnectingClient)(nil)
+
+// NewReconnectingClient returns a client that reconnects the stream of a connected client, the client is
+// nil if the stream couldn't be connected.
+func NewReconnectingClient(client RTSPClient, rtspUrl string, options StreamOptions, streamType string) *ReconnectingClient {
+	var streams []packets.Stream
+	if client != nil {
+		streams, _ = client.GetStreams()
+	}
+	return &ReconnectingClient{
+		Url:        rtspUrl,
+		Options:    options,
+		StreamType: streamType,
+		client:     client,
+		streams:    streams,
+		status: models.StreamStatus{
+			Stream: streamType,
+			State:  models.StreamStateConnecting,
+			Since:  time.Now().UnixMilli(),
+		},
+		done: make(chan struct{}),
+	}
+}
+
+// Connect does nothing, the stream is connected by Start.
+func (r *ReconnectingClient) Connect(ctx context.Context) (err error) {
+	return nil
+}
+
+// ConnectBackChannel is done by a separate client.
+func (r *ReconnectingClient) ConnectBackChannel(ctx context.Context) (err error) {
+	return errors.New("capture.reconnect.ConnectBackChannel(): the backchannel has its own client")
+}
+
+// Start reads the stream into the queue, and reconnects the stream when it fails, until the client is closed.
+func (r *ReconnectingClient) Start(ctx context.Context, streamType string, queue *packets.Queue, configuration *models.Configuration, communication *models.Communication) (err error) {
+	log.Log.Debug("capture.reconnect.Start(" + r.StreamType + "): started")
+	r.statusMutex.Lock()
+	r.communication = communication
+	r.statusMutex.Unlock()
+
+	// A reconnect that is in progress is cancelled, when the client is closed.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	client := r.currentClient()
+	if client != nil {
+		r.setState(models.StreamStateConnected, 0, 0, nil)
+	} else {
+		err = errors.New("the stream wasn't available at boot")
+	}
+	for {
+		if client == nil {
+			r.setConnected(communication, false)
+			queue.SetAvailable(false)
+
+			client, err = r.reconnect(ctx, err)
+			if err != nil {
+				return nil
+			}
+			if !r.useStreams(client, queue, configuration) {
+				client.Close()
+				r.setState(models.StreamStateStopped, 0, 0, ErrStreamChanged)
+				return nil
+			}
+
+			// The timestamps of the new connection start over.
+			queue.Discontinue()
+			if !r.setClient(client) {
+				client.Close()
+				return nil
+			}
+			r.setConnected(communication, true)
+			queue.SetAvailable(true)
+			r.setState(models.StreamStateConnected, 0, 0, nil)
+		}
+
+		ended := make(chan error, 1)
+		go func(client RTSPClient) {
+			ended <- client.Start(ctx, streamType, queue, configuration, communication)
+		}(client)
+
+		err = r.watch(ctx, ended, queue, communication)
+		if err == nil {
+			log.Log.Debug("capture.reconnect.Start(" + r.StreamType + "): finished")
+			return nil
+		}
+		log.Log.Warning("capture.reconnect.Start(): the " + r.StreamType + " stream failed: " + err.Error())
+		r.setClient(nil)
+		client = nil
+	}
+}
+
+// useStreams compares the streams of a (re)connected client with the streams of the queue. The streams of
+// a stream that connects for the first time, or of a main stream that changed, are written to the queue.
+// False is returned for a sub stream that changed, it's dropped.
+func (r *ReconnectingClient) useStreams(client RTSPClient, queue *packets.Queue, configuration *models.Configuration) bool {
+	streams, _ := client.GetStreams()
+	r.clientMutex.RLock()
+	previous := r.streams
+	r.clientMutex.RUnlock()
+	if previous != nil {
+		if sameStreams(previous, streams) {
+			return true
+		}
+		if r.StreamType == "sub" {
+			log.Log.Warning("capture.reconnect.useStreams(): the sub stream changed, continuing with the main stream only")
+			return false
+		}
+		log.Log.Info("capture.reconnect.useStreams(): the main stream changed, continuing with the new streams")
+	}
+
+	r.clientMutex.Lock()
+	r.streams = streams
+	r.clientMutex.Unlock()
+	videoStreams, _ := client.GetVideoStreams()
+	queue.WriteHeader(videoStreams)
+
+	for _, stream := range videoStreams {
+		if stream.IsVideo {
+			if r.StreamType == "sub" {
+				configuration.Config.Capture.IPCamera.SubWidth = stream.Width
+				configuration.Config.Capture.IPCamera.SubHeight = stream.Height
+			} else {
+				configuration.Config.Capture.IPCamera.Width = stream.Width
+				configuration.Config.Capture.IPCamera.Height = stream.Height
+			}
+			break
+		}
+	}
+	return true
+}
+
+// watch returns an error when the stream fails: no keyframe is written to the queue for a while, or the
+// client stopped reading. Nil is returned when the client is closed.
+func (r *ReconnectingClient) watch(ctx context.Context, ended chan error, queue *packets.Queue, communication *models.Communication) error {
+	previousKeyFrames := queue.KeyFrames()
+	stalls := 0
+	ticker := time.NewTicker(streamCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			keyFrames := queue.KeyFrames()
+			if keyFrames != previousKeyFrames {
+				stalls = 0
+			} else if !communication.IsConfiguring.IsSet() {
+				// If we are already reconfiguring,
+				// we dont need to check if the stream is blocking.
+				stalls++
+			}
+			previousKeyFrames = keyFrames
+			log.Log.Debug("capture.reconnect.watch(): number of keyframes read from the " + r.StreamType + " stream: " + strconv.FormatInt(keyFrames, 10))
+			if stalls >= streamMaxStalls {
+				return errors.New("no keyframe received for " + (streamCheckInterval * streamMaxStalls).String())
+			}
+		case err := <-ended:
+			// A RTSP client returns as soon as it's playing, other clients return when they stop reading.
+			if err != nil {
+				return err
+			}
+		case <-r.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// reconnect connects a new client with backoff, until it's connected or the client is closed.
+func (r *ReconnectingClient) reconnect(ctx context.Context, lastErr error) (RTSPClient, error) {
+	for attempt := 0; ; attempt++ {
+		backoff := ReconnectBackoff(attempt)
+		r.setState(models.StreamStateReconnecting, attempt, backoff, lastErr)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-r.done:
+			timer.Stop()
+			return nil, ErrStreamClosed
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ErrStreamClosed
+		}
+
+		r.setState(models.StreamStateConnecting, attempt, 0, nil)
+		client := NewRTSPClient(r.Url, r.Options)
+		lastErr = client.Connect(ctx)
+		if lastErr == nil {
+			if videoStreams, _ := client.GetVideoStreams(); len(videoStreams) == 0 {
+				lastErr = errors.New("no video stream found")
+			}
+		}
+		if lastErr == nil {
+			log.Log.Info("capture.reconnect.reconnect(): reconnected the " + r.StreamType + " stream: " + r.Url + " (" + client.GetTransport() + ")")
+			return client, nil
+		}
+		client.Close()
+		if ctx.Err() != nil {
+			return nil, ErrStreamClosed
+		}
+		log.Log.Error("capture.reconnect.reconnect(): error reconnecting the " + r.StreamType + " stream: " + lastErr.Error())
+	}
+}
+
+// GetStreamStates returns the states of the main and sub stream, and their last changes (the oldest first).
+func (c *Capture) GetStreamStates() models.StreamStates {
+	states := models.StreamStates{
+		Streams: []models.StreamStatus{},
+		Events:  []models.StreamStatus{},
+	}
+	for _, client := range []RTSPClient{c.RTSPClient, c.RTSPSubClient} {
+		if reconnectingClient, ok := client.(*ReconnectingClient); ok {
+			states.Streams = append(states.Streams, reconnectingClient.GetStatus())
+			states.Events = append(states.Events, reconnectingClient.GetEvents()...)
+		}
+	}
+	sort.SliceStable(states.Events, func(i, j int) bool {
+		return states.Events[i].Since < states.Events[j].Since
+	})
+	return states
+}
+
+// sameStreams returns true if the streams are read the same way: the packets of a stream keep their index.
+func sameStreams(previous []packets.Stream, streams []packets.Stream) bool {
+	if len(previous) != len(streams) {
+		return false
+	}
+	for i := range streams {
+		if previous[i].Name != streams[i].Name || previous[i].IsVideo != streams[i].IsVideo || previous[i].IsAudio != streams[i].IsAudio ||
+			previous[i].Width != streams[i].Width || previous[i].Height != streams[i].Height {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ReconnectingClient) currentClient() RTSPClient {
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+	return r.client
+}
+
+// setClient replaces the client, the previous client is closed once it's not used (decoding) anymore.
+// False is returned if the reconnecting client is closed.
+func (r *ReconnectingClient) setClient(client RTSPClient) bool {
+	r.clientMutex.Lock()
+	defer r.clientMutex.Unlock()
+	if r.client != nil {
+		r.client.Close()
+	}
+	select {
+	case <-r.done:
+		r.client = nil
+		return false
+	default:
+	}
+	r.client = client
+	return true
+}
+
+func (r *ReconnectingClient) setConnected(communication *models.Communication, connected bool) {
+	if r.StreamType == "sub" {
+		communication.SubStreamConnected = connected
+	} else {
+		communication.MainStreamConnected = connected
+	}
+}
+
+// setState changes the state of the stream, the change is published as event.
+func (r *ReconnectingClient) setState(state string, attempt int, backoff time.Duration, err error) {
+	r.statusMutex.Lock()
+	status := models.StreamStatus{
+		Stream:   r.StreamType,
+		State:    state,
+		Previous: r.status.State,
+		Attempt:  attempt,
+		Backoff:  backoff.Milliseconds(),
+		Since:    time.Now().UnixMilli(),
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	r.status = status
+	r.events = append(r.events, status)
+	if len(r.events) > streamEventsCapacity {
+		r.events = r.events[len(r.events)-streamEventsCapacity:]
+	}
+	communication := r.communication
+	r.statusMutex.Unlock()
+
+	log.Log.Info("capture.reconnect.setState(): the " + r.StreamType + " stream changed from " + status.Previous + " to " + status.State +
+		" (attempt " + strconv.Itoa(attempt) + ", backoff " + backoff.String() + ")")
+	if communication != nil && communication.HandleStreamState != nil {
+		select {
+		case communication.HandleStreamState <- status:
+		default:
+		}
+	}
+}
+
+// GetStatus returns the state of the stream.
+func (r *ReconnectingClient) GetStatus() models.StreamStatus {
+	r.statusMutex.Lock()
+	defer r.statusMutex.Unlock()
+	return r.status
+}
+
+// GetEvents returns the last changes of the state of the stream, the oldest first.
+func (r *ReconnectingClient) GetEvents() []models.StreamStatus {
+	r.statusMutex.Lock()
+	defer r.statusMutex.Unlock()
+	return append([]models.StreamStatus{}, r.events...)
+}
+
+// StartBackChannel is done by a separate client.
+func (r *ReconnectingClient) StartBackChannel(ctx context.Context) (err error) {
+	return nil
+}
+
+// WritePacket is done by a separate client.
+func (r *ReconnectingClient) WritePacket(pkt packets.Packet) error {
+	return nil
+}
+
+// Decode a packet to an image, with the current client.
+func (r *ReconnectingClient) DecodePacket(pkt packets.Packet) (image.YCbCr, error) {
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+	if r.client == nil {
+		return image.YCbCr{}, ErrStreamClosed
+	}
+	return r.client.DecodePacket(pkt)
+}
+
+// Decode a packet to a Gray image, with the current client.
+func (r *ReconnectingClient) DecodePacketRaw(pkt packets.Packet) (image.Gray, error) {
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+	if r.client == nil {
+		return image.Gray{}, ErrStreamClosed
+	}
+	return r.client.DecodePacketRaw(pkt)
+}
+
+// Get a list of streams, nil until the stream is connected.
+func (r *ReconnectingClient) GetStreams() ([]packets.Stream, error) {
+	r.clientMutex.RLock()
+	defer r.clientMutex.RUnlock()
+	return r.streams, nil
+}
+
+// Get a list of video streams.
+func (r *ReconnectingClient) GetVideoStreams() ([]packets.Stream, error) {
+	streams, _ := r.GetStreams()
+	var videoStreams []packets.Stream
+	for _, stream := range streams {
+		if stream.IsVideo {
+			videoStreams = append(videoStreams, stream)
+		}
+	}
+	return videoStreams, nil
+}
+
+// Get a list of audio streams.
+func (r *ReconnectingClient) GetAudioStreams() ([]packets.Stream, error) {
+	streams, _ := r.GetStreams()
+	var audioStreams []packets.Stream
+	for _, stream := range streams {
+		if stream.IsAudio {
+			audioStreams = append(audioStreams, stream)
+		}
+	}
+	return audioStreams, nil
+}
+
+// GetTransport returns the transport of the current client, empty while the stream is reconnecting.
+func (r *ReconnectingClient) GetTransport() string {
+	client := r.currentClient()
+	if client == nil {
+		return ""
+	}
+	return client.GetTransport()
+}
+
+// Close stops reconnecting, and closes the current client.
+func (r *ReconnectingClient) Close() error {
+	r.doneOnce.Do(func() {
+		close(r.done)
+		r.setClient(nil)
+		r.setState(models.StreamStateStopped, 0, 0, nil)
+	})
+	return nil
+}
@@ -0,0 +1,105 @@
+package capture
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		backoff time.Duration // The backoff before jitter, the result is between half and the full backoff.
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{5, 32 * time.Second},
+		{6, time.Minute},
+		{15, time.Minute},
+		{16, time.Minute},
+		{100, time.Minute},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			backoff := ReconnectBackoff(tt.attempt)
+			if backoff < tt.backoff/2 || backoff > tt.backoff {
+				t.Fatalf("attempt %d: expected a backoff between %s and %s, got %s", tt.attempt, tt.backoff/2, tt.backoff, backoff)
+			}
+		}
+	}
+}
+
+// streamsClient is a connected client with streams, only the streams are used.
+type streamsClient struct {
+	RTSPClient
+	streams []packets.Stream
+}
+
+func (c *streamsClient) GetStreams() ([]packets.Stream, error) {
+	return c.streams, nil
+}
+
+func (c *streamsClient) GetVideoStreams() ([]packets.Stream, error) {
+	var videoStreams []packets.Stream
+	for _, stream := range c.streams {
+		if stream.IsVideo {
+			videoStreams = append(videoStreams, stream)
+		}
+	}
+	return videoStreams, nil
+}
+
+func TestReconnectUseStreams(t *testing.T) {
+	hd := []packets.Stream{{Name: "H264", IsVideo: true, Width: 1920, Height: 1080}, {Name: "AAC", IsAudio: true}}
+	sd := []packets.Stream{{Name: "H264", IsVideo: true, Width: 640, Height: 360}}
+
+	tests := []struct {
+		name       string
+		streamType string
+		previous   []packets.Stream // The streams before the reconnect, nil if the stream wasn't connected.
+		streams    []packets.Stream
+		used       bool
+		header     []packets.Stream // The streams written to the queue, nil if the header isn't written.
+	}{
+		{"main stream unchanged", "main", hd, hd, true, nil},
+		{"main stream changed", "main", hd, sd, true, sd},
+		{"sub stream unchanged", "sub", sd, sd, true, nil},
+		{"sub stream changed", "sub", sd, hd, false, nil},
+		{"sub stream connected after boot", "sub", nil, sd, true, sd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var client RTSPClient
+			if tt.previous != nil {
+				client = &streamsClient{streams: tt.previous}
+			}
+			r := NewReconnectingClient(client, "rtsp://camera", StreamOptions{}, tt.streamType)
+			queue := packets.NewQueue()
+			configuration := &models.Configuration{}
+
+			if used := r.useStreams(&streamsClient{streams: tt.streams}, queue, configuration); used != tt.used {
+				t.Fatalf("expected used %v, got %v", tt.used, used)
+			}
+			queue.Close() // The streams of a closed queue are returned without waiting for the header.
+			header, _ := queue.Latest().Streams()
+			if len(header) != len(tt.header) {
+				t.Fatalf("expected the header %v, got %v", tt.header, header)
+			}
+			if tt.header != nil {
+				width := configuration.Config.Capture.IPCamera.Width
+				if tt.streamType == "sub" {
+					width = configuration.Config.Capture.IPCamera.SubWidth
+				}
+				if width != tt.header[0].Width {
+					t.Fatalf("expected the width %d, got %d", tt.header[0].Width, width)
+				}
+				if streams, _ := r.GetStreams(); len(streams) != len(tt.streams) {
+					t.Fatalf("expected the streams %v, got %v", tt.streams, streams)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,770 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/kerberos-io/agent/machinery/src/encryption"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// When the agent stops in the middle of a recording, the trailer (moov box) of the MP4 is never
+// written and the recording can't be played. The metadata sidecar is only written once a recording
+// is closed, so a recording without a sidecar is either interrupted, or made by an older version.
+// At startup we check those recordings: interrupted MP4s are rebuilt from the samples in the mdat box
+// (with the sample journal that was written next to them), fragmented MP4s are cut after the last
+// complete fragment, MPEG-TS and Matroska recordings only need their metadata. Recordings we can't
+// recover are moved to data/quarantine.
+
+const recoveringSuffix = ".recovering"
+
+// RecoverRecordings checks the recordings that were not closed properly, and recovers or quarantines them.
+// It should be called at startup, before we start recording.
+func RecoverRecordings(configDirectory string, configuration *models.Configuration) {
+	recordingDirectory := configDirectory + "/data/recordings"
+	files, err := os.ReadDir(recordingDirectory)
+	if err != nil {
+		log.Log.Error("capture.recovery.RecoverRecordings(): " + err.Error())
+		return
+	}
+	for _, file := range files {
+		fileName := file.Name()
+
+		// Leftovers of a recovery that was interrupted itself.
+		if strings.Contains(fileName, recoveringSuffix) {
+			os.Remove(recordingDirectory + "/" + fileName)
+			continue
+		}
+		if !utils.IsRecording(fileName) || !file.Type().IsRegular() {
+			continue
+		}
+		if _, err := os.Stat(utils.MetadataPath(recordingDirectory + "/" + fileName)); err == nil {
+			continue
+		}
+
+		recovered, err := recoverRecording(configDirectory, configuration, fileName)
+		if err != nil {
+			quarantineRecording(configDirectory, fileName, err.Error())
+		} else if recovered {
+			// Queue the recovered recording for upload, as any other recording.
+			fc, _ := os.Create(configDirectory + "/data/cloud/" + fileName)
+			fc.Close()
+		}
+	}
+}
+
+func quarantineRecording(configDirectory string, fileName string, reason string) {
+	quarantineDirectory := configDirectory + "/data/quarantine"
+	if err := os.MkdirAll(quarantineDirectory, 0755); err != nil {
+		log.Log.Error("capture.recovery.RecoverRecordings(): could not create quarantine directory: " + err.Error())
+		return
+	}
+	recordingPath := configDirectory + "/data/recordings/" + fileName
+	os.Remove(utils.SamplesPath(recordingPath))
+	if err := os.Rename(recordingPath, quarantineDirectory+"/"+fileName); err != nil {
+		log.Log.Error("capture.recovery.RecoverRecordings(): could not quarantine " + fileName + ": " + err.Error())
+		return
+	}
+	log.Log.Warning("capture.recovery.RecoverRecordings(): quarantined " + fileName + ", " + reason)
+}
+
+// recoverRecording checks a single recording, it returns true if the recording was repaired,
+// false if nothing had to be done, or an error if the recording can't be recovered.
+func recoverRecording(configDirectory string, configuration *models.Configuration, fileName string) (bool, error) {
+	recordingPath := configDirectory + "/data/recordings/" + fileName
+	file, err := os.Open(recordingPath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	header := make([]byte, encryption.ChunkedHeaderSize)
+	n, _ := io.ReadFull(file, header)
+	header = header[:n]
+
+	// A recording encrypted by an older version is encrypted as a whole, once it's complete.
+	if encryption.IsLegacy(header) {
+		return false, nil
+	}
+
+	// The sample journal of an MP4, it's only needed until the recording is checked.
+	journalPath := utils.SamplesPath(recordingPath)
+
+	// The (plaintext) MP4 we are checking, for an encrypted recording we decrypt all chunks
+	// we can authenticate into a temporary file.
+	var mp4 io.ReadSeeker = file
+	size := info.Size()
+	encrypted := encryption.IsChunked(header)
+	symmetricKey := ""
+	encryptionTruncated := false
+	if encrypted {
+		if configuration.Config.Encryption == nil || configuration.Config.Encryption.SymmetricKey == "" {
+			log.Log.Warning("capture.recovery.RecoverRecordings(): can't check " + fileName + ", no symmetric key configured")
+			return false, nil
+		}
+		symmetricKey = configuration.Config.Encryption.SymmetricKey
+		reader, err := encryption.NewReader(file, symmetricKey)
+		if err == nil {
+			// The final chunk is only authenticated when it's read.
+			_, err = reader.Seek(-1, io.SeekEnd)
+			if err == nil {
+				_, err = reader.Read(make([]byte, 1))
+			}
+		}
+		if err == nil {
+			mp4 = reader
+			size = reader.Size()
+		} else {
+			encryptionTruncated = true
+			plaintextPath := recordingPath + recoveringSuffix + ".plain"
+			plaintext, err := os.Create(plaintextPath)
+			if err != nil {
+				return false, err
+			}
+			defer os.Remove(plaintextPath)
+			defer plaintext.Close()
+			size, err = encryption.RecoverChunks(file, symmetricKey, plaintext)
+			if err != nil {
+				return false, err
+			}
+			mp4 = plaintext
+		}
+	}
+	defer os.Remove(journalPath)
+
+	var analysis mp4Analysis
+	if strings.HasSuffix(fileName, ".ts") || strings.HasSuffix(fileName, ".mkv") {
+		// MPEG-TS and Matroska recordings are playable up to the last packet that was written,
+		// we only cut a TS after the last complete packet, and write the metadata.
+		analysis.end = size
+		if strings.HasSuffix(fileName, ".ts") {
+			analysis.end = size - size%188
+		}
+	} else {
+		analysis, err = analyseMP4(mp4, size)
+		if err != nil {
+			return false, err
+		}
+		if analysis.complete && !encryptionTruncated {
+			return false, nil
+		}
+	}
+
+	// Write the repaired recording to a temporary file first, and replace the recording once it's complete.
+	recoveringPath := recordingPath + recoveringSuffix
+	output, err := os.Create(recoveringPath)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(recoveringPath)
+	defer output.Close()
+
+	var metadata models.RecordingMetadata
+	if analysis.mdatStart > 0 {
+		// An interrupted (regular) MP4, we rebuild it from the samples in the mdat box.
+		metadata, err = rebuildMP4(mp4, analysis, output, configuration, fileName, info.ModTime(), symmetricKey, journalPath)
+	} else {
+		// A complete MP4 with a truncated encryption, or a fragmented MP4 (or TS) that we cut after the last fragment.
+		err = copyMP4(mp4, analysis.end, output, symmetricKey)
+		metadata = newRecoveredMetadata(configuration, fileName, info.ModTime(), encrypted)
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := output.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(recoveringPath, recordingPath); err != nil {
+		return false, err
+	}
+	if err := utils.WriteRecordingMetadata(recordingPath, metadata); err != nil {
+		log.Log.Error("capture.recovery.RecoverRecordings(): error writing metadata: " + err.Error())
+	}
+	log.Log.Info("capture.recovery.RecoverRecordings(): recovered " + fileName)
+	return true, nil
+}
+
+// mp4Analysis describes the state of an MP4 file.
+type mp4Analysis struct {
+	// The MP4 has all its boxes, and a moov box.
+	complete bool
+	// For an interrupted MP4 (no moov box), the range of the samples in the mdat box.
+	mdatStart int64
+	mdatEnd   int64
+	// The end of the usable part of the file (after the last complete box or fragment).
+	end int64
+}
+
+// analyseMP4 reads the top-level boxes of an MP4 file.
+func analyseMP4(r io.ReadSeeker, size int64) (mp4Analysis, error) {
+	var analysis mp4Analysis
+	hasMoov := false
+	hasFragments := false
+	completeFragments := 0
+	var offset int64
+	header := make([]byte, 16)
+	for offset < size {
+		if size-offset < 8 {
+			break
+		}
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return analysis, err
+		}
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return analysis, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		if boxSize == 1 {
+			if _, err := io.ReadFull(r, header[8:16]); err != nil {
+				break
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		} else if boxSize == 0 {
+			// The box extends to the end of the file.
+			boxSize = size - offset
+		}
+
+		// The mdat box of an MP4 is only given its size when the trailer is written.
+		if boxType == "mdat" && !hasMoov && (boxSize == headerSize || offset+boxSize > size || boxSize == size-offset) {
+			analysis.mdatStart = offset + headerSize
+			analysis.mdatEnd = size
+			return analysis, nil
+		}
+		if boxSize < headerSize || offset+boxSize > size {
+			break
+		}
+
+		switch boxType {
+		case "moov":
+			hasMoov = true
+		case "moof":
+			hasFragments = true
+		case "mdat":
+			if !hasMoov && !hasFragments {
+				analysis.mdatStart = offset + headerSize
+				analysis.mdatEnd = offset + boxSize
+			}
+			if hasFragments {
+				// A fragment is only complete once its mdat box is.
+				analysis.end = offset + boxSize
+				completeFragments++
+			}
+		}
+		offset += boxSize
+		if !hasFragments {
+			analysis.end = offset
+		}
+	}
+
+	if hasMoov {
+		// A complete MP4, or a fragmented MP4 which we can cut after the last complete fragment.
+		analysis.mdatStart = 0
+		analysis.complete = offset == size
+		if analysis.complete || !hasFragments || completeFragments > 0 {
+			return analysis, nil
+		}
+		return analysis, errors.New("the recording is truncated, and has no complete fragments")
+	}
+	if analysis.mdatStart > 0 {
+		return analysis, nil
+	}
+	return analysis, errors.New("the recording has no moov or mdat box")
+}
+
+// copyMP4 copies the first part of the MP4 to the output, encrypting it if needed.
+func copyMP4(r io.ReadSeeker, end int64, output *os.File, symmetricKey string) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var writer io.Writer = output
+	var encryptedOutput *encryption.Writer
+	if symmetricKey != "" {
+		var err error
+		encryptedOutput, err = encryption.NewWriter(output, symmetricKey)
+		if err != nil {
+			return err
+		}
+		writer = encryptedOutput
+	}
+	if _, err := io.CopyN(writer, r, end); err != nil {
+		return err
+	}
+	if encryptedOutput != nil {
+		return encryptedOutput.Close()
+	}
+	return nil
+}
+
+// rebuildMP4 remuxes the samples of an interrupted MP4 into a new MP4. The mdat box holds the video
+// access units (length prefixed NAL units) interleaved with the AAC frames, without timestamps. The
+// sample journal, written next to the recording, tells us where every sample is and its timestamp,
+// so the video and audio are recovered as they were recorded. Without a journal (or if it's unusable)
+// we can only find the video: the access units are scanned from the mdat box, and spread evenly
+// between the start of the recording (from its name) and the moment the file was last written. The
+// metadata of such a recording is marked as having approximate timing. The mdat box is read through
+// a window, a sample at a time.
+func rebuildMP4(r io.ReadSeeker, analysis mp4Analysis, output *os.File, configuration *models.Configuration, fileName string, modTime time.Time, symmetricKey string, journalPath string) (models.RecordingMetadata, error) {
+	metadata := newRecoveredMetadata(configuration, fileName, modTime, symmetricKey != "")
+	mdat := newMdatReader(r, analysis.mdatStart, analysis.mdatEnd)
+
+	var recovered recoveredSamples
+	var replay func(write func(packets.Packet) error) error
+	journal, err := openSampleJournal(journalPath)
+	if err == nil {
+		defer journal.Close()
+		recovered, err = readSampleJournal(journal, mdat, nil)
+		if err == nil && recovered.videoSamples > 0 {
+			replay = func(write func(packets.Packet) error) error {
+				if err := journal.rewind(); err != nil {
+					return err
+				}
+				_, err := readSampleJournal(journal, mdat, write)
+				return err
+			}
+		} else if err == nil {
+			err = errors.New("no video samples in the sample journal")
+		}
+	}
+	if replay == nil {
+		if !os.IsNotExist(err) {
+			log.Log.Warning("capture.recovery.RecoverRecordings(): scanning " + fileName + ", the sample journal is unusable: " + err.Error())
+		}
+		recovered, err = scanAccessUnits(mdat, nil)
+		if err != nil {
+			return metadata, err
+		}
+		if recovered.videoSamples == 0 {
+			return metadata, errors.New("no video samples found in the mdat box")
+		}
+		frameDuration := 40 * time.Millisecond
+		if duration := time.Duration(metadata.Duration) * time.Millisecond; duration > 0 {
+			if d := duration / time.Duration(recovered.videoSamples); d >= 10*time.Millisecond && d <= time.Second {
+				frameDuration = d
+			}
+		}
+		recovered.duration = time.Duration(recovered.videoSamples) * frameDuration
+		metadata.ApproximateTiming = true
+		replay = func(write func(packets.Packet) error) error {
+			i := 0
+			_, err := scanAccessUnits(mdat, func(unit accessUnit) error {
+				var annexB []byte
+				for _, nalu := range unit.nalus {
+					data, err := mdat.read(nalu.offset, nalu.length)
+					if err != nil {
+						return err
+					}
+					annexB = append(annexB, 0x00, 0x00, 0x00, 0x01)
+					annexB = append(annexB, data...)
+				}
+				pkt := packets.Packet{
+					IsVideo:    true,
+					IsKeyFrame: unit.keyFrame,
+					Codec:      recovered.videoCodec,
+					Time:       time.Duration(i) * frameDuration,
+					Data:       annexB,
+				}
+				i++
+				return write(pkt)
+			})
+			return err
+		}
+	}
+	metadata.VideoCodec = recovered.videoCodec
+	if recovered.hasAudio {
+		metadata.AudioCodec = "AAC"
+	}
+
+	var writer RecordingWriter
+	var writerOutput io.WriteSeeker = output
+	var encryptedOutput *encryption.Writer
+	if symmetricKey != "" {
+		var err error
+		encryptedOutput, err = encryption.NewWriter(output, symmetricKey)
+		if err != nil {
+			return metadata, err
+		}
+		writerOutput = encryptedOutput
+	}
+	mp4Writer, err := NewMP4Writer(writerOutput, recovered.videoCodec, metadata.Width, metadata.Height, recovered.hasAudio)
+	if err != nil {
+		return metadata, err
+	}
+	writer = mp4Writer
+	if encryptedOutput != nil {
+		writer = &EncryptingWriter{
+			writer: writer,
+			output: encryptedOutput,
+		}
+	}
+	if err := replay(writer.WritePacket); err != nil {
+		return metadata, err
+	}
+	if err := writer.Close(); err != nil {
+		return metadata, err
+	}
+	metadata.Duration = recovered.duration.Milliseconds()
+	metadata.EndTime = metadata.StartTime + metadata.Duration
+	return metadata, nil
+}
+
+// recoveredSamples describes the samples we found in an interrupted MP4.
+type recoveredSamples struct {
+	videoCodec   string
+	videoSamples int
+	hasAudio     bool
+	duration     time.Duration
+}
+
+// readSampleJournal reads the samples of the journal from the mdat box, and passes them to write (if any)
+// as packets: Annex-B video and ADTS audio. The recording starts at the first keyframe, and ends at the
+// last sample that was completely written.
+func readSampleJournal(journal *sampleJournalReader, mdat *mdatReader, write func(packets.Packet) error) (recoveredSamples, error) {
+	recovered := recoveredSamples{
+		videoCodec: journal.videoCodec,
+	}
+	var audioConfig *journalSample
+	var firstTime, lastTime uint64
+	for {
+		sample, err := journal.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return recovered, err
+		}
+		if sample.kind == journalAudioConfig {
+			if sample.sampleRate > 0 {
+				audioConfig = &sample
+			}
+			continue
+		}
+		// The samples are recorded in the order they are written, once a sample is incomplete so are the next.
+		if sample.size <= 0 || sample.size > maxRecoveredSampleSize || sample.offset < mdat.start || sample.offset+sample.size > mdat.end {
+			break
+		}
+		if recovered.videoSamples == 0 && (sample.kind != journalVideo || !sample.keyFrame) {
+			continue
+		}
+		if sample.kind == journalAudio && (audioConfig == nil || !journal.hasAudio) {
+			continue
+		}
+		if recovered.videoSamples == 0 {
+			firstTime = sample.timestamp
+		}
+		if sample.kind == journalVideo {
+			recovered.videoSamples++
+		} else {
+			recovered.hasAudio = true
+		}
+		if sample.timestamp > lastTime {
+			lastTime = sample.timestamp
+		}
+		if write == nil {
+			continue
+		}
+
+		data, err := mdat.read(sample.offset, sample.size)
+		if err != nil {
+			return recovered, err
+		}
+		pkt := packets.Packet{
+			Time: time.Duration(sample.timestamp) * time.Millisecond,
+		}
+		if sample.kind == journalVideo {
+			nalus, err := h264.AVCCUnmarshal(data)
+			if err != nil {
+				return recovered, err
+			}
+			if pkt.Data, err = h264.AnnexBMarshal(nalus); err != nil {
+				return recovered, err
+			}
+			pkt.IsVideo = true
+			pkt.IsKeyFrame = sample.keyFrame
+			pkt.Codec = journal.videoCodec
+		} else {
+			adts, err := mpeg4audio.ADTSPackets{{
+				Type:         audioConfig.objectType,
+				SampleRate:   audioConfig.sampleRate,
+				ChannelCount: audioConfig.channelCount,
+				AU:           data,
+			}}.Marshal()
+			if err != nil {
+				return recovered, err
+			}
+			pkt.IsAudio = true
+			pkt.Codec = "AAC"
+			pkt.Data = adts
+		}
+		if err := write(pkt); err != nil {
+			return recovered, err
+		}
+	}
+	recovered.duration = time.Duration(lastTime-firstTime) * time.Millisecond
+	return recovered, nil
+}
+
+// mdatReader reads the data of an mdat box through a window, so we never hold the box in memory.
+type mdatReader struct {
+	reader      io.ReadSeeker
+	start       int64
+	end         int64
+	window      []byte
+	windowStart int64
+}
+
+const mdatWindowSize = 1 << 20
+
+func newMdatReader(reader io.ReadSeeker, start int64, end int64) *mdatReader {
+	return &mdatReader{
+		reader: reader,
+		start:  start,
+		end:    end,
+	}
+}
+
+// peek returns (up to) n bytes at the offset, the data is only valid until the next peek.
+func (m *mdatReader) peek(offset int64, n int) []byte {
+	if offset < m.start || offset >= m.end {
+		return nil
+	}
+	if remaining := m.end - offset; int64(n) > remaining {
+		n = int(remaining)
+	}
+	if offset < m.windowStart || offset+int64(n) > m.windowStart+int64(len(m.window)) {
+		size := int64(mdatWindowSize)
+		if remaining := m.end - offset; size > remaining {
+			size = remaining
+		}
+		if _, err := m.reader.Seek(offset, io.SeekStart); err != nil {
+			return nil
+		}
+		if int64(cap(m.window)) < size {
+			m.window = make([]byte, size)
+		}
+		m.window = m.window[:size]
+		if _, err := io.ReadFull(m.reader, m.window); err != nil {
+			m.window = m.window[:0]
+			return nil
+		}
+		m.windowStart = offset
+	}
+	start := offset - m.windowStart
+	return m.window[start : start+int64(n)]
+}
+
+// read returns the data of a sample (or NAL unit).
+func (m *mdatReader) read(offset int64, size int64) ([]byte, error) {
+	if offset < m.start || size < 0 || offset+size > m.end {
+		return nil, errors.New("the sample is outside the mdat box")
+	}
+	if offset >= m.windowStart && offset+size <= m.windowStart+int64(len(m.window)) {
+		start := offset - m.windowStart
+		return append([]byte(nil), m.window[start:start+size]...), nil
+	}
+	if _, err := m.reader.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(m.reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// newRecoveredMetadata creates the metadata of a recovered recording, the start time is read from its name.
+func newRecoveredMetadata(configuration *models.Configuration, fileName string, modTime time.Time, encrypted bool) models.RecordingMetadata {
+	config := configuration.Config
+	metadata := models.RecordingMetadata{
+		Name:       fileName,
+		CameraKey:  config.Key,
+		CameraName: config.Name,
+		Width:      config.Capture.IPCamera.Width,
+		Height:     config.Capture.IPCamera.Height,
+		Regions:    []string{},
+		Encrypted:  encrypted,
+	}
+	if startTime, err := strconv.ParseInt(strings.Split(fileName, "_")[0], 10, 64); err == nil {
+		metadata.StartTime = startTime * 1000
+		if duration := modTime.UnixMilli() - metadata.StartTime; duration > 0 {
+			metadata.Duration = duration
+		}
+	} else {
+		metadata.StartTime = modTime.UnixMilli()
+	}
+	metadata.EndTime = metadata.StartTime + metadata.Duration
+	return metadata
+}
+
+// accessUnit is a video sample found in the mdat box, as the positions of its NAL units.
+type accessUnit struct {
+	nalus    []nalUnitRange
+	keyFrame bool
+}
+
+type nalUnitRange struct {
+	offset int64
+	length int64
+}
+
+// nalUnitAt returns the length of the (length prefixed) NAL unit at the offset, if it looks valid.
+func nalUnitAt(videoCodec string, mdat *mdatReader, offset int64) (int64, bool) {
+	data := mdat.peek(offset, 6)
+	if len(data) < 5 {
+		return 0, false
+	}
+	length := int64(binary.BigEndian.Uint32(data))
+	if length < 2 || length > mdat.end-offset-4 || length > maxRecoveredSampleSize {
+		return 0, false
+	}
+	header := data[4:]
+	if header[0]&0x80 != 0 {
+		return 0, false
+	}
+	if videoCodec == "H265" {
+		naluType := (header[0] >> 1) & 0x3F
+		layerID := (header[0]&0x01)<<5 | header[1]>>3
+		temporalID := header[1] & 0x07
+		valid := naluType <= 9 || (naluType >= 16 && naluType <= 21) || (naluType >= 32 && naluType <= 40)
+		return length, valid && layerID == 0 && temporalID > 0
+	}
+	naluType := header[0] & 0x1F
+	return length, naluType >= 1 && naluType <= 12
+}
+
+// nalUnitChainAt returns true if a number of valid NAL units follow each other at the offset,
+// which makes it unlikely that we are looking at (audio) data that just happens to look valid.
+func nalUnitChainAt(videoCodec string, mdat *mdatReader, offset int64, depth int) (int64, bool) {
+	length, ok := nalUnitAt(videoCodec, mdat, offset)
+	if !ok {
+		return 0, false
+	}
+	next := offset + 4 + length
+	for i := 1; i < depth && next < mdat.end; i++ {
+		nextLength, ok := nalUnitAt(videoCodec, mdat, next)
+		if !ok {
+			return 0, false
+		}
+		next += 4 + nextLength
+	}
+	return length, true
+}
+
+// startsAccessUnit returns true if the NAL unit is the first of a new access unit, and if it's a keyframe.
+// Only the first bytes of the NAL unit are needed.
+func startsAccessUnit(videoCodec string, nalu []byte) (bool, bool, bool) {
+	if videoCodec == "H265" {
+		naluType := (nalu[0] >> 1) & 0x3F
+		isVCL := naluType <= 31
+		firstSlice := isVCL && len(nalu) > 2 && nalu[2]&0x80 != 0
+		keyFrame := naluType >= 16 && naluType <= 21
+		return firstSlice || naluType == 32 || naluType == 33 || naluType == 34 || naluType == 35 || naluType == 39, isVCL, keyFrame
+	}
+	naluType := nalu[0] & 0x1F
+	isVCL := naluType == 1 || naluType == 5
+	firstSlice := isVCL && len(nalu) > 1 && nalu[1]&0x80 != 0
+	return firstSlice || naluType == 6 || naluType == 7 || naluType == 8 || naluType == 9, isVCL, naluType == 5
+}
+
+// scanAccessUnits finds the video access units in an mdat box, and passes them to onAccessUnit (if any).
+// The codec is detected from the first parameter set (SPS for H264, VPS for H265). Data that isn't video
+// (audio frames, or a sample that was only partially written) is skipped. The recording starts at the
+// first keyframe.
+func scanAccessUnits(mdat *mdatReader, onAccessUnit func(accessUnit) error) (recoveredSamples, error) {
+	var recovered recoveredSamples
+	offset := mdat.start
+	for ; offset+5 < mdat.end; offset++ {
+		header := mdat.peek(offset+4, 1)
+		if len(header) == 0 {
+			break
+		}
+		if header[0]&0x1F == 7 {
+			if _, ok := nalUnitChainAt("H264", mdat, offset, 3); ok {
+				recovered.videoCodec = "H264"
+				break
+			}
+		}
+		if (header[0]>>1)&0x3F == 32 {
+			if _, ok := nalUnitChainAt("H265", mdat, offset, 3); ok {
+				recovered.videoCodec = "H265"
+				break
+			}
+		}
+	}
+	videoCodec := recovered.videoCodec
+	if videoCodec == "" {
+		return recovered, nil
+	}
+
+	var current accessUnit
+	var err error
+	hasVCL := false
+	flush := func() {
+		if hasVCL && err == nil && (recovered.videoSamples > 0 || current.keyFrame) {
+			recovered.videoSamples++
+			if onAccessUnit != nil {
+				err = onAccessUnit(current)
+			}
+		}
+		current = accessUnit{}
+		hasVCL = false
+	}
+	synced := true
+	for offset < mdat.end && err == nil {
+		length, ok := nalUnitAt(videoCodec, mdat, offset)
+		if ok {
+			headerSize := 3
+			if length < 3 {
+				headerSize = int(length)
+			}
+			newAccessUnit, isVCL, keyFrame := startsAccessUnit(videoCodec, mdat.peek(offset+4, headerSize))
+			switch {
+			case synced && !hasVCL:
+				// An access unit is written at once, so its slices directly follow the parameter sets.
+			case !synced && !newAccessUnit:
+				// After skipping other data, we only continue at the start of an access unit.
+				ok = false
+			default:
+				// The NAL unit might be followed by audio, or it might be audio that looks like a NAL unit.
+				// NAL units that start an access unit (parameter sets, or the slices of a P-frame) are small,
+				// otherwise we want the next NAL unit to be valid as well.
+				_, nextOK := nalUnitChainAt(videoCodec, mdat, offset, 2)
+				ok = length < 1<<16 || nextOK
+			}
+			if ok {
+				if newAccessUnit && hasVCL {
+					flush()
+				}
+				current.nalus = append(current.nalus, nalUnitRange{offset: offset + 4, length: length})
+				current.keyFrame = current.keyFrame || keyFrame
+				hasVCL = hasVCL || isVCL
+				offset += 4 + length
+				synced = true
+				continue
+			}
+		}
+		// Not a video sample, the access unit before it is complete.
+		if synced {
+			flush()
+			synced = false
+		}
+		offset++
+	}
+	flush()
+	return recovered, err
+}
@@ -0,0 +1,289 @@
+package capture
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/kerberos-io/agent/machinery/src/internal/testutil"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+const testRecoveryName = "1700000000_6-967003_frontdoor_200-200-400-400_24_769.mp4"
+
+// testRecoveryPackets returns 4 seconds of H264 video (25 fps, a keyframe every second) interleaved with
+// AAC audio (16kHz, a frame every 64ms). The frames are large enough to fill a few encryption chunks.
+func testRecoveryPackets() []packets.Packet {
+	var pkts []packets.Packet
+	audioTime := time.Duration(0)
+	for i := 0; i < 100; i++ {
+		videoTime := time.Duration(i) * 40 * time.Millisecond
+		for ; audioTime <= videoTime; audioTime += 64 * time.Millisecond {
+			adts, _ := mpeg4audio.ADTSPackets{{
+				Type:         mpeg4audio.ObjectTypeAACLC,
+				SampleRate:   16000,
+				ChannelCount: 1,
+				AU:           bytes.Repeat([]byte{0x21}, 48),
+			}}.Marshal()
+			pkts = append(pkts, packets.Packet{
+				IsAudio: true,
+				Codec:   "AAC",
+				Time:    audioTime,
+				Data:    adts,
+			})
+		}
+		isKeyFrame := i%25 == 0
+		padding := 1500
+		if isKeyFrame {
+			padding = 3000
+		}
+		pkts = append(pkts, packets.Packet{
+			IsVideo:    true,
+			IsKeyFrame: isKeyFrame,
+			Codec:      "H264",
+			Time:       videoTime,
+			Data:       testutil.H264AccessUnit(i, isKeyFrame, padding),
+		})
+	}
+	return pkts
+}
+
+// writeTestRecording records the packets as the agent does. Unless the recording is closed, the agent
+// is interrupted: the MP4 has no moov box, and the sample journal is left behind.
+func writeTestRecording(t *testing.T, configDirectory string, configuration *models.Configuration, name string, closed bool) string {
+	t.Helper()
+	recordingPath := configDirectory + "/data/recordings/" + name
+	file, err := os.Create(recordingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer, err := NewRecordingWriter(file, configuration, "H264", &packets.Stream{Name: "AAC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkt := range testRecoveryPackets() {
+		if err := writer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if closed {
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recordingPath
+}
+
+// readTestRecording demuxes a (decrypted) recording.
+func readTestRecording(t *testing.T, recordingPath string) []packets.Packet {
+	t.Helper()
+	configuration := &models.Configuration{}
+	configuration.Config.Encryption = &models.Encryption{SymmetricKey: testRecoveryKey}
+	file, reader, err := openRecording(recordingPath, configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var recordingPackets []packets.Packet
+	_, err = demuxRecording(reader, func(_ recordingTracks, pkt packets.Packet) error {
+		recordingPackets = append(recordingPackets, pkt)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recordingPackets
+}
+
+const testRecoveryKey = "96ab185a8ec2f3bd9ff3c1f4db6a59c6"
+
+func TestRecoverRecordings(t *testing.T) {
+	tests := []struct {
+		name string
+		// How the recording is left behind.
+		encrypted     bool
+		closed        bool
+		removeJournal bool
+		truncate      int64 // Bytes cut from the end of the recording.
+		garbage       bool
+		// What we expect.
+		quarantined bool
+		recovered   bool
+		videoFrames int // -1 for some, but not all, frames.
+		audio       bool
+		approximate bool
+		minDuration time.Duration
+		maxDuration time.Duration
+	}{
+		{
+			name:      "interrupted MP4 with its journal",
+			recovered: true, videoFrames: 99, audio: true,
+			minDuration: 3900 * time.Millisecond, maxDuration: 4 * time.Second,
+		},
+		{
+			name:          "interrupted MP4 without a journal",
+			removeJournal: true,
+			recovered:     true, videoFrames: 99, approximate: true,
+			minDuration: 9 * time.Second, maxDuration: 11 * time.Second,
+		},
+		{
+			name:     "interrupted MP4 cut in the middle of a sample",
+			truncate: 1000,
+			// The last sample that was written is dropped.
+			recovered: true, videoFrames: 98, audio: true,
+			minDuration: 3800 * time.Millisecond, maxDuration: 4 * time.Second,
+		},
+		{
+			name:      "interrupted encrypted MP4",
+			encrypted: true,
+			// Only the complete chunks were written, the samples of the last chunk are lost.
+			recovered: true, videoFrames: -1, audio: true,
+			minDuration: time.Second, maxDuration: 4 * time.Second,
+		},
+		{
+			name:          "interrupted encrypted MP4 without a journal",
+			encrypted:     true,
+			removeJournal: true,
+			recovered:     true, videoFrames: -1, approximate: true,
+			minDuration: time.Second, maxDuration: 11 * time.Second,
+		},
+		{
+			name:   "closed MP4 without metadata",
+			closed: true,
+			// Nothing to recover, the recording is complete.
+			videoFrames: 100, audio: true,
+		},
+		{
+			name:        "unrecognisable recording",
+			garbage:     true,
+			quarantined: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configDirectory := t.TempDir()
+			for _, directory := range []string{"/data/recordings", "/data/cloud"} {
+				if err := os.MkdirAll(configDirectory+directory, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			configuration := &models.Configuration{}
+			configuration.Config.Key = "frontdoor"
+			configuration.Config.Capture.IPCamera.Width = 640
+			configuration.Config.Capture.IPCamera.Height = 480
+			if test.encrypted {
+				configuration.Config.Encryption = &models.Encryption{
+					Enabled:      "true",
+					Recordings:   "true",
+					SymmetricKey: testRecoveryKey,
+				}
+			}
+
+			recordingPath := configDirectory + "/data/recordings/" + testRecoveryName
+			if test.garbage {
+				if err := os.WriteFile(recordingPath, bytes.Repeat([]byte{0x42}, 4096), 0644); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				writeTestRecording(t, configDirectory, configuration, testRecoveryName, test.closed)
+			}
+			journalPath := utils.SamplesPath(recordingPath)
+			if test.closed {
+				if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+					t.Fatal("the sample journal should only exist while recording")
+				}
+			}
+			if test.garbage {
+				if err := os.WriteFile(journalPath, []byte(journalMagic), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.removeJournal {
+				os.Remove(journalPath)
+			}
+			if test.truncate > 0 {
+				info, _ := os.Stat(recordingPath)
+				os.Truncate(recordingPath, info.Size()-test.truncate)
+			}
+			// The recording was last written 10 seconds after it started.
+			modTime := time.Unix(1700000010, 0)
+			os.Chtimes(recordingPath, modTime, modTime)
+
+			RecoverRecordings(configDirectory, configuration)
+
+			if _, err := os.Stat(journalPath); !os.IsNotExist(err) {
+				t.Error("the sample journal should be removed")
+			}
+			_, err := os.Stat(configDirectory + "/data/quarantine/" + testRecoveryName)
+			if quarantined := err == nil; quarantined != test.quarantined {
+				t.Fatalf("quarantined is %v, expected %v", quarantined, test.quarantined)
+			}
+			if test.quarantined {
+				if _, err := os.Stat(recordingPath); !os.IsNotExist(err) {
+					t.Error("the quarantined recording is still in data/recordings")
+				}
+				return
+			}
+			_, err = os.Stat(configDirectory + "/data/cloud/" + testRecoveryName)
+			if queued := err == nil; queued != test.recovered {
+				t.Errorf("queued for upload is %v, expected %v", queued, test.recovered)
+			}
+
+			recordingPackets := readTestRecording(t, recordingPath)
+			videoFrames, audioFrames := 0, 0
+			var lastVideo time.Duration
+			for _, pkt := range recordingPackets {
+				if pkt.IsVideo {
+					if videoFrames == 0 && !pkt.IsKeyFrame {
+						t.Error("the recording doesn't start with a keyframe")
+					}
+					if videoFrames > 0 && pkt.Time <= lastVideo {
+						t.Errorf("video frame %d at %s isn't after %s", videoFrames, pkt.Time, lastVideo)
+					}
+					videoFrames++
+					lastVideo = pkt.Time
+				} else if pkt.IsAudio {
+					audioFrames++
+				}
+			}
+			if test.videoFrames >= 0 && videoFrames != test.videoFrames {
+				t.Errorf("%d video frames, expected %d", videoFrames, test.videoFrames)
+			}
+			if test.videoFrames < 0 && (videoFrames == 0 || videoFrames >= 99) {
+				t.Errorf("%d video frames, expected some of them", videoFrames)
+			}
+			if hasAudio := audioFrames > 0; hasAudio != test.audio {
+				t.Errorf("the recording has audio is %v, expected %v", hasAudio, test.audio)
+			}
+			if !test.recovered {
+				return
+			}
+
+			if !test.approximate && lastVideo != time.Duration(videoFrames-1)*40*time.Millisecond {
+				t.Errorf("the last video frame is at %s, expected the original timing", lastVideo)
+			}
+			metadata, err := utils.ReadRecordingMetadata(recordingPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metadata.ApproximateTiming != test.approximate {
+				t.Errorf("approximate timing is %v, expected %v", metadata.ApproximateTiming, test.approximate)
+			}
+			if metadata.StartTime != 1700000000000 || metadata.EndTime != metadata.StartTime+metadata.Duration {
+				t.Errorf("the recording is from %d to %d", metadata.StartTime, metadata.EndTime)
+			}
+			duration := time.Duration(metadata.Duration) * time.Millisecond
+			if duration < test.minDuration || duration > test.maxDuration {
+				t.Errorf("the duration is %s, expected between %s and %s", duration, test.minDuration, test.maxDuration)
+			}
+			if metadata.Encrypted != test.encrypted || metadata.VideoCodec != "H264" || (metadata.AudioCodec == "AAC") != test.audio {
+				t.Errorf("unexpected metadata %+v", metadata)
+			}
+		})
+	}
+}
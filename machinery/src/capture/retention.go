@@ -0,0 +1,266 @@
+package capture
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/database"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// Only one retention run at a time, it's triggered on a schedule and after every recording.
+var retentionMutex sync.Mutex
+
+// HandleRetention applies the retention rules on a schedule, it keeps running as long as the agent does.
+// The configuration is read on every run, so changes are picked up without a restart.
+func HandleRetention(configDirectory string, configuration *models.Configuration) {
+	log.Log.Debug("capture.retention.HandleRetention(): started")
+	for {
+		ApplyRetention(configDirectory, configuration)
+		interval := configuration.Config.Retention.Interval
+		if interval <= 0 {
+			interval = 60
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+type retentionRun struct {
+	configDirectory string
+	keepPending     bool
+	removed         map[string]bool
+	skipped         map[string]bool
+}
+
+func isContinuousRecording(recording database.IndexedRecording) bool {
+	return recording.Metadata != nil && recording.Metadata.Trigger == models.TriggerContinuous
+}
+
+// remove deletes a recording, unless it's still waiting to be uploaded.
+func (r *retentionRun) remove(recording database.IndexedRecording, reason string) bool {
+	if r.removed[recording.Name] {
+		return false
+	}
+	if r.keepPending {
+		if _, err := os.Stat(r.configDirectory + "/data/cloud/" + recording.Name); err == nil {
+			r.skipped[recording.Name] = true
+			return false
+		}
+	}
+	err := utils.RemoveRecording(r.configDirectory + "/data/recordings/" + recording.Name)
+	if err != nil && !os.IsNotExist(err) {
+		log.Log.Error("capture.retention.ApplyRetention(): could not remove " + recording.Name + ": " + err.Error())
+		return false
+	}
+	database.RemoveFromIndex(recording.Name)
+	r.removed[recording.Name] = true
+	log.Log.Info("capture.retention.ApplyRetention(): removed " + recording.Name + ", " + reason)
+
+	// The recording of the sub stream (if any) takes the place of the main recording.
+	if recording.Metadata != nil && recording.Metadata.SubRecording != "" {
+		if _, err := os.Stat(r.configDirectory + "/data/recordings/" + recording.Metadata.SubRecording); err == nil {
+			database.IndexRecording(r.configDirectory, recording.Metadata.SubRecording)
+		}
+	}
+	return true
+}
+
+// removeUntil removes the oldest recordings (that match) until enough bytes are freed.
+func (r *retentionRun) removeUntil(recordings []database.IndexedRecording, match func(database.IndexedRecording) bool, bytes int64, reason string) {
+	for _, recording := range recordings {
+		if bytes <= 0 {
+			return
+		}
+		if !r.removed[recording.Name] && match(recording) && r.remove(recording, reason) {
+			bytes -= recording.Size
+		}
+	}
+}
+
+func (r *retentionRun) sizeOf(recordings []database.IndexedRecording, match func(database.IndexedRecording) bool) int64 {
+	var size int64
+	for _, recording := range recordings {
+		if !r.removed[recording.Name] && match(recording) {
+			size += recording.Size
+		}
+	}
+	return size
+}
+
+// ApplyRetention removes the recordings that violate one of the retention rules, oldest first:
+//   - recordings older than the max age (days),
+//   - continuous and motion recordings exceeding their quota (MB),
+//   - all recordings exceeding the max directory size (MB), when auto clean is enabled,
+//   - recordings as long as the free disk space is below the minimum (percentage).
+//
+// Recordings of the sub stream have their own max age and quota, and are only removed for the
+// minimum free disk space when removing the main recordings is not enough. Recordings that are
+// still waiting to be uploaded are kept, unless configured otherwise.
+func ApplyRetention(configDirectory string, configuration *models.Configuration) {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+
+	config := configuration.Config
+	retention := config.Retention
+
+	recordings, subRecordings, err := listRetentionCandidates(configDirectory)
+	if err != nil {
+		log.Log.Error("capture.retention.ApplyRetention(): " + err.Error())
+		return
+	}
+	run := newRetentionRun(configDirectory, configuration)
+	all := func(database.IndexedRecording) bool { return true }
+
+	if retention.MaxAge > 0 {
+		reason := "older than " + strconv.FormatInt(retention.MaxAge, 10) + " days (max age)"
+		cutoff := time.Now().AddDate(0, 0, -int(retention.MaxAge)).UnixMilli()
+		for _, recording := range recordings {
+			if recording.StartTime >= cutoff {
+				break
+			}
+			run.remove(recording, reason)
+		}
+	}
+
+	if retention.MaxContinuousSize > 0 {
+		size := run.sizeOf(recordings, isContinuousRecording)
+		if maxSize := retention.MaxContinuousSize * 1000 * 1000; size > maxSize {
+			reason := "continuous recordings exceed " + strconv.FormatInt(retention.MaxContinuousSize, 10) + "MB (continuous quota)"
+			run.removeUntil(recordings, isContinuousRecording, size-maxSize, reason)
+		}
+	}
+
+	if retention.MaxMotionSize > 0 {
+		isMotion := func(recording database.IndexedRecording) bool { return !isContinuousRecording(recording) }
+		size := run.sizeOf(recordings, isMotion)
+		if maxSize := retention.MaxMotionSize * 1000 * 1000; size > maxSize {
+			reason := "motion recordings exceed " + strconv.FormatInt(retention.MaxMotionSize, 10) + "MB (motion quota)"
+			run.removeUntil(recordings, isMotion, size-maxSize, reason)
+		}
+	}
+
+	if config.AutoClean == "true" {
+		maxDirectorySize := config.MaxDirectorySize
+		if maxDirectorySize == 0 {
+			maxDirectorySize = 300
+		}
+		size := run.sizeOf(recordings, all)
+		if maxSize := maxDirectorySize * 1000 * 1000; size > maxSize {
+			reason := "recordings directory exceeds " + strconv.FormatInt(maxDirectorySize, 10) + "MB (max directory size)"
+			run.removeUntil(recordings, all, size-maxSize, reason)
+		}
+	}
+
+	if retention.SubMaxAge > 0 {
+		reason := "older than " + strconv.FormatInt(retention.SubMaxAge, 10) + " days (sub stream max age)"
+		cutoff := time.Now().AddDate(0, 0, -int(retention.SubMaxAge)).UnixMilli()
+		for _, recording := range subRecordings {
+			if recording.StartTime >= cutoff {
+				break
+			}
+			run.remove(recording, reason)
+		}
+	}
+
+	if retention.SubMaxSize > 0 {
+		size := run.sizeOf(subRecordings, all)
+		if maxSize := retention.SubMaxSize * 1000 * 1000; size > maxSize {
+			reason := "sub stream recordings exceed " + strconv.FormatInt(retention.SubMaxSize, 10) + "MB (sub stream quota)"
+			run.removeUntil(subRecordings, all, size-maxSize, reason)
+		}
+	}
+
+	if retention.MinFreeDisk > 0 {
+		reason := "free disk space below " + strconv.FormatInt(retention.MinFreeDisk, 10) + "% (min free disk)"
+		run.freeDisk(recordings, subRecordings, float64(retention.MinFreeDisk), reason)
+	}
+	run.finish(recordings)
+}
+
+// ApplyEmergencyRetention removes the oldest recordings (main before sub) until the free disk space
+// is above the percentage again, it's used by the disk watchdog. Recordings that are still waiting
+// to be uploaded are kept, unless configured otherwise.
+func ApplyEmergencyRetention(configDirectory string, configuration *models.Configuration, minFreePercentage float64) {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+
+	recordings, subRecordings, err := listRetentionCandidates(configDirectory)
+	if err != nil {
+		log.Log.Error("capture.retention.ApplyEmergencyRetention(): " + err.Error())
+		return
+	}
+	run := newRetentionRun(configDirectory, configuration)
+	reason := "free disk space below " + strconv.FormatFloat(minFreePercentage, 'f', -1, 64) + "% (emergency retention)"
+	run.freeDisk(recordings, subRecordings, minFreePercentage, reason)
+	run.finish(recordings)
+}
+
+// listRetentionCandidates returns the recordings of the main stream, and of the sub stream, oldest first.
+func listRetentionCandidates(configDirectory string) ([]database.IndexedRecording, []database.IndexedRecording, error) {
+	indexed, err := database.ListRecordings()
+	if err != nil {
+		indexed, err = database.ScanRecordings(configDirectory)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	recordings := []database.IndexedRecording{}
+	for _, recording := range indexed {
+		if !utils.IsSubRecording(recording.Name) {
+			recordings = append(recordings, recording)
+		}
+	}
+	subRecordings, err := database.ScanSubRecordings(configDirectory)
+	if err != nil {
+		log.Log.Error("capture.retention.ApplyRetention(): " + err.Error())
+	}
+	return recordings, subRecordings, nil
+}
+
+func newRetentionRun(configDirectory string, configuration *models.Configuration) *retentionRun {
+	config := configuration.Config
+	return &retentionRun{
+		configDirectory: configDirectory,
+		// Uploads are not running in offline mode, so nothing is pending.
+		keepPending: config.Retention.KeepPendingUploads != "false" && config.Offline != "true",
+		removed:     make(map[string]bool),
+		skipped:     make(map[string]bool),
+	}
+}
+
+// freeDisk removes the oldest recordings until the free disk space is above the percentage,
+// the recordings of the sub stream are only removed if removing the main recordings is not enough.
+func (r *retentionRun) freeDisk(recordings []database.IndexedRecording, subRecordings []database.IndexedRecording, minFreePercentage float64, reason string) {
+	all := func(database.IndexedRecording) bool { return true }
+	for _, candidates := range [][]database.IndexedRecording{recordings, subRecordings} {
+		total, free, err := utils.GetDiskUsage(r.configDirectory + "/data/recordings")
+		if err != nil {
+			log.Log.Error("capture.retention.ApplyRetention(): could not read disk usage: " + err.Error())
+			return
+		}
+		minFree := uint64(float64(total) * minFreePercentage / 100)
+		if free >= minFree {
+			return
+		}
+		r.removeUntil(candidates, all, int64(minFree-free), reason)
+	}
+}
+
+// finish cleans up after the recordings are removed.
+func (r *retentionRun) finish(recordings []database.IndexedRecording) {
+	// The gaps before the oldest recording are no longer relevant.
+	for _, recording := range recordings {
+		if !r.removed[recording.Name] {
+			database.RemoveGapsBefore(recording.StartTime)
+			break
+		}
+	}
+
+	if len(r.skipped) > 0 {
+		log.Log.Info("capture.retention.ApplyRetention(): kept " + strconv.Itoa(len(r.skipped)) + " recording(s) that violate a retention rule, as they are still waiting to be uploaded")
+	}
+}
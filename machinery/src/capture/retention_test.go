@@ -0,0 +1,211 @@
+package capture
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+type testRetentionRecording struct {
+	name    string // Recordings of the sub stream are named sub/<name>.
+	age     int    // Days.
+	trigger string
+	size    int // KB.
+	pending bool
+	sub     string // The recording of the sub stream, of a main recording.
+}
+
+// writeRetentionRecordings stores the recordings (and their metadata) in a temporary directory.
+func writeRetentionRecordings(t *testing.T, recordings []testRetentionRecording) string {
+	t.Helper()
+	configDirectory := t.TempDir()
+	for _, directory := range []string{"/data/recordings/" + utils.SubRecordingsDirectory, "/data/cloud"} {
+		if err := os.MkdirAll(configDirectory+directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, recording := range recordings {
+		recordingPath := configDirectory + "/data/recordings/" + recording.name
+		if err := os.WriteFile(recordingPath, make([]byte, recording.size*1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// The recordings are a minute apart, so the order is known for recordings of the same age.
+		startTime := time.Now().AddDate(0, 0, -recording.age).Add(-time.Hour + time.Duration(i)*time.Minute)
+		metadata := models.RecordingMetadata{
+			StartTime:    startTime.UnixMilli(),
+			Trigger:      recording.trigger,
+			SubRecording: recording.sub,
+		}
+		if err := utils.WriteRecordingMetadata(recordingPath, metadata); err != nil {
+			t.Fatal(err)
+		}
+		if recording.pending {
+			if err := os.WriteFile(configDirectory+"/data/cloud/"+recording.name, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return configDirectory
+}
+
+// listRetainedRecordings returns the recordings that are still stored, sorted by name.
+func listRetainedRecordings(t *testing.T, configDirectory string) []string {
+	t.Helper()
+	names := []string{}
+	for _, pattern := range []string{"*.mp4", utils.SubRecordingsDirectory + "/*.mp4"} {
+		matches, err := filepath.Glob(configDirectory + "/data/recordings/" + pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range matches {
+			name, _ := filepath.Rel(configDirectory+"/data/recordings", match)
+			names = append(names, filepath.ToSlash(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestApplyRetention(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordings []testRetentionRecording
+		config     func(config *models.Config)
+		retained   []string
+	}{
+		{
+			name: "max age",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 10, trigger: models.TriggerMotion, size: 1},
+				{name: "b.mp4", age: 8, trigger: models.TriggerContinuous, size: 1},
+				{name: "c.mp4", age: 3, trigger: models.TriggerMotion, size: 1},
+			},
+			config:   func(config *models.Config) { config.Retention.MaxAge = 7 },
+			retained: []string{"c.mp4"},
+		},
+		{
+			name: "continuous quota, oldest first",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 3, trigger: models.TriggerMotion, size: 400},
+				{name: "b.mp4", age: 3, trigger: models.TriggerContinuous, size: 400},
+				{name: "c.mp4", age: 2, trigger: models.TriggerContinuous, size: 400},
+				{name: "d.mp4", age: 1, trigger: models.TriggerContinuous, size: 400},
+			},
+			config:   func(config *models.Config) { config.Retention.MaxContinuousSize = 1 },
+			retained: []string{"a.mp4", "c.mp4", "d.mp4"},
+		},
+		{
+			name: "motion quota",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 3, trigger: models.TriggerMotion, size: 400},
+				{name: "b.mp4", age: 3, trigger: models.TriggerContinuous, size: 400},
+				{name: "c.mp4", age: 2, trigger: models.TriggerManual, size: 400},
+				{name: "d.mp4", age: 1, trigger: models.TriggerMotion, size: 400},
+			},
+			config:   func(config *models.Config) { config.Retention.MaxMotionSize = 1 },
+			retained: []string{"b.mp4", "c.mp4", "d.mp4"},
+		},
+		{
+			name: "max directory size",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 4, trigger: models.TriggerMotion, size: 400},
+				{name: "b.mp4", age: 3, trigger: models.TriggerContinuous, size: 400},
+				{name: "c.mp4", age: 2, trigger: models.TriggerMotion, size: 400},
+				{name: "d.mp4", age: 1, trigger: models.TriggerContinuous, size: 400},
+			},
+			config: func(config *models.Config) {
+				config.AutoClean = "true"
+				config.MaxDirectorySize = 1
+			},
+			retained: []string{"c.mp4", "d.mp4"},
+		},
+		{
+			name: "pending uploads are kept",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 10, trigger: models.TriggerMotion, size: 1, pending: true},
+				{name: "b.mp4", age: 9, trigger: models.TriggerMotion, size: 1},
+			},
+			config:   func(config *models.Config) { config.Retention.MaxAge = 7 },
+			retained: []string{"a.mp4"},
+		},
+		{
+			name: "pending uploads are removed, when configured",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 10, trigger: models.TriggerMotion, size: 1, pending: true},
+				{name: "b.mp4", age: 9, trigger: models.TriggerMotion, size: 1},
+			},
+			config: func(config *models.Config) {
+				config.Retention.MaxAge = 7
+				config.Retention.KeepPendingUploads = "false"
+			},
+			retained: []string{},
+		},
+		{
+			name: "pending uploads are removed in offline mode",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 10, trigger: models.TriggerMotion, size: 1, pending: true},
+			},
+			config: func(config *models.Config) {
+				config.Retention.MaxAge = 7
+				config.Offline = "true"
+			},
+			retained: []string{},
+		},
+		{
+			name: "the sub recording outlives its main recording",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 10, trigger: models.TriggerMotion, size: 1, sub: "sub/a.mp4"},
+				{name: "sub/a.mp4", age: 10, trigger: models.TriggerMotion, size: 1},
+			},
+			config:   func(config *models.Config) { config.Retention.MaxAge = 7 },
+			retained: []string{"sub/a.mp4"},
+		},
+		{
+			name: "sub stream max age",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 10, trigger: models.TriggerMotion, size: 1, sub: "sub/a.mp4"},
+				{name: "sub/a.mp4", age: 10, trigger: models.TriggerMotion, size: 1},
+				{name: "sub/b.mp4", age: 1, trigger: models.TriggerMotion, size: 1},
+			},
+			config:   func(config *models.Config) { config.Retention.SubMaxAge = 7 },
+			retained: []string{"a.mp4", "sub/b.mp4"},
+		},
+		{
+			name: "sub stream quota",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 3, trigger: models.TriggerMotion, size: 400},
+				{name: "sub/a.mp4", age: 3, trigger: models.TriggerMotion, size: 400},
+				{name: "sub/b.mp4", age: 2, trigger: models.TriggerMotion, size: 400},
+				{name: "sub/c.mp4", age: 1, trigger: models.TriggerMotion, size: 400},
+			},
+			config:   func(config *models.Config) { config.Retention.SubMaxSize = 1 },
+			retained: []string{"a.mp4", "sub/b.mp4", "sub/c.mp4"},
+		},
+		{
+			name: "no rules",
+			recordings: []testRetentionRecording{
+				{name: "a.mp4", age: 100, trigger: models.TriggerMotion, size: 400},
+			},
+			config:   func(config *models.Config) {},
+			retained: []string{"a.mp4"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configDirectory := writeRetentionRecordings(t, tt.recordings)
+			configuration := &models.Configuration{}
+			tt.config(&configuration.Config)
+
+			ApplyRetention(configDirectory, configuration)
+			if retained := listRetainedRecordings(t, configDirectory); !reflect.DeepEqual(retained, tt.retained) {
+				t.Fatalf("expected %v to be retained, got %v", tt.retained, retained)
+			}
+		})
+	}
+}
@@ -0,0 +1,509 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"image"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/yapingcat/gomedia/go-codec"
+	"github.com/yapingcat/gomedia/go-rtmp"
+)
+
+// The RTMP client reads a camera (an encoder, a drone, ...) that streams RTMP. It's selected with a
+// rtmp:// url, and either pulls the stream from a server (rtmp://server/app/stream), or runs as a
+// listener the camera publishes to (rtmp://0.0.0.0:1935/app/stream?mode=listener). A listener
+// accepts a single publisher, with the app and stream name of the url (if given). Only the video
+// track (H264 or H265) is read.
+
+const (
+	rtmpScheme          = "rtmp://"
+	rtmpDefaultPort     = "1935"
+	rtmpDefaultTimeout  = 10 * time.Second
+	rtmpPublishTimeout  = time.Minute // The time a listener waits for a publisher and its first keyframe.
+	rtmpPacketQueueSize = 256
+)
+
+// ErrRTMPClientClosed is returned when the RTMP client is used before it's connected, or after it's closed.
+var ErrRTMPClientClosed = errors.New("rtmp client is closed")
+
+// RTMPClient implements the RTSPClient interface.
+type RTMPClient struct {
+	RTSPClient
+	Url     string
+	Options StreamOptions
+
+	VideoDecoderMutex *sync.Mutex
+	VideoFrameDecoder *Decoder
+
+	Streams []packets.Stream
+
+	timeout   time.Duration
+	connMutex sync.Mutex
+	listener  net.Listener
+	conn      net.Conn // The connection to the server, or of the publisher.
+	packets   chan packets.Packet
+	readErr   error          // Why the connection ended, set before packets is closed.
+	first     packets.Packet // The first keyframe, read by Connect.
+	done      chan struct{}
+	doneOnce  sync.Once
+
+	// The RTMP timestamps are 32-bit milliseconds, they are unwrapped into the timestamp.
+	timestampStarted bool
+	lastTimestamp    uint32
+	timestamp        time.Duration
+}
+
+// IsRTMP returns true if the url should be read by the RTMP client.
+func IsRTMP(url string) bool {
+	return strings.HasPrefix(url, rtmpScheme)
+}
+
+// Connect connects to the RTMP server, or waits for a camera to publish, and reads the stream from
+// the first keyframe.
+func (r *RTMPClient) Connect(ctx context.Context) (err error) {
+	u, err := url.Parse(r.Url)
+	if err != nil {
+		return errors.New("capture.rtmp.Connect(): " + err.Error())
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), rtmpDefaultPort)
+	}
+	r.timeout = r.Options.ReadTimeout
+	if r.timeout <= 0 {
+		r.timeout = rtmpDefaultTimeout
+	}
+	r.packets = make(chan packets.Packet, rtmpPacketQueueSize)
+	r.done = make(chan struct{})
+	r.VideoDecoderMutex = &sync.Mutex{}
+
+	path := strings.Split(strings.Trim(u.Path, "/"), "/")
+	wait := r.timeout
+	if u.Query().Get("mode") == "listener" {
+		app, streamName := "", ""
+		if len(path) > 0 {
+			app = path[0]
+		}
+		if len(path) > 1 {
+			streamName = strings.Join(path[1:], "/")
+		}
+		err = r.listen(host, app, streamName)
+		wait = rtmpPublishTimeout
+	} else {
+		if len(path) < 2 || path[0] == "" {
+			return errors.New("capture.rtmp.Connect(): the url should have an app and a stream name: rtmp://host/app/stream")
+		}
+		u.RawQuery = ""
+		u.Host = host
+		err = r.dial(host, u.String())
+	}
+	if err != nil {
+		r.Close()
+		return errors.New("capture.rtmp.Connect(): " + err.Error())
+	}
+
+	// Wait for the first keyframe, so the stream (codec, width and height) is known.
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for len(r.first.Data) == 0 {
+		select {
+		case pkt, ok := <-r.packets:
+			if !ok {
+				r.Close()
+				if r.readErr != nil {
+					return errors.New("capture.rtmp.Connect(): the stream ended before the first keyframe: " + r.readErr.Error())
+				}
+				return errors.New("capture.rtmp.Connect(): the stream ended before the first keyframe")
+			}
+			if !pkt.IsKeyFrame {
+				continue
+			}
+			stream, err := newVideoStream(pkt.Codec, pkt.Data)
+			if err != nil {
+				r.Close()
+				return errors.New("capture.rtmp.Connect(): " + err.Error())
+			}
+			r.Streams = []packets.Stream{stream}
+			r.first = pkt
+		case <-timer.C:
+			r.Close()
+			return errors.New("capture.rtmp.Connect(): no keyframe received within " + wait.String())
+		case <-ctx.Done():
+			r.Close()
+			return errors.New("capture.rtmp.Connect(): " + ctx.Err().Error())
+		}
+	}
+
+	// setup the H264 or H265 -> raw frames decoder
+	frameDec, err := newDecoder(r.first.Codec)
+	if err != nil {
+		log.Log.Error("capture.rtmp.Connect(" + r.first.Codec + "): " + err.Error())
+	}
+	r.VideoDecoderMutex.Lock()
+	r.VideoFrameDecoder = frameDec
+	r.VideoDecoderMutex.Unlock()
+
+	stream := r.Streams[0]
+	log.Log.Info("capture.rtmp.Connect(): reading " + r.Url + " (" + stream.Name + ", " +
+		strconv.Itoa(stream.Width) + "x" + strconv.Itoa(stream.Height) + ")")
+	return nil
+}
+
+// dial connects to the RTMP server and plays the stream.
+func (r *RTMPClient) dial(host string, playUrl string) error {
+	conn, err := net.DialTimeout("tcp", host, r.timeout)
+	if err != nil {
+		return err
+	}
+	r.connMutex.Lock()
+	r.conn = conn
+	r.connMutex.Unlock()
+
+	client := rtmp.NewRtmpClient(rtmp.WithChunkSize(6000), rtmp.WithComplexHandshake())
+	client.SetOutput(func(data []byte) error {
+		_, err := conn.Write(data)
+		return err
+	})
+	client.OnFrame(r.onFrame)
+	client.OnError(func(code, describe string) {
+		r.readErr = errors.New(code + ": " + describe)
+		conn.Close()
+	})
+	client.OnStateChange(func(state rtmp.RtmpState) {
+		if state == rtmp.STATE_RTMP_PLAY_FAILED {
+			if r.readErr == nil {
+				r.readErr = errors.New("the server refused to play " + playUrl)
+			}
+			conn.Close()
+		}
+	})
+	client.Start(playUrl)
+
+	// The callbacks are called from this goroutine, while the data is read.
+	go func() {
+		err := r.read(conn, client.Input)
+		if r.readErr == nil {
+			r.readErr = err
+		}
+		close(r.packets)
+	}()
+	return nil
+}
+
+// listen accepts the cameras that publish to the listener, the first camera that publishes the stream is read.
+func (r *RTMPClient) listen(host string, app string, streamName string) error {
+	listener, err := net.Listen("tcp", host)
+	if err != nil {
+		return err
+	}
+	r.connMutex.Lock()
+	r.listener = listener
+	r.connMutex.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn, app, streamName)
+		}
+	}()
+	return nil
+}
+
+// serve handles a connection to the listener, the stream is read if it's the publisher.
+func (r *RTMPClient) serve(conn net.Conn, app string, streamName string) {
+	publisher := false
+	server := rtmp.NewRtmpServerHandle()
+	server.SetOutput(func(data []byte) error {
+		_, err := conn.Write(data)
+		return err
+	})
+	server.OnPublish(func(publishApp string, publishStreamName string) rtmp.StatusCode {
+		if (app != "" && publishApp != app) || (streamName != "" && publishStreamName != streamName) {
+			log.Log.Warning("capture.rtmp.serve(): refused publisher " + conn.RemoteAddr().String() +
+				", unknown stream " + publishApp + "/" + publishStreamName)
+			return rtmp.NETCONNECT_CONNECT_REJECTED
+		}
+		return rtmp.NETSTREAM_PUBLISH_START
+	})
+	server.OnStateChange(func(state rtmp.RtmpState) {
+		if state == rtmp.STATE_RTMP_PUBLISH_START {
+			publisher = r.acceptPublisher(conn)
+			if !publisher {
+				log.Log.Warning("capture.rtmp.serve(): refused publisher " + conn.RemoteAddr().String() + ", already publishing")
+				conn.Close()
+			}
+		} else if state == rtmp.STATE_RTMP_PUBLISH_FAILED {
+			conn.Close()
+		}
+	})
+	server.OnFrame(func(cid codec.CodecID, pts, dts uint32, frame []byte) {
+		if publisher {
+			r.onFrame(cid, pts, dts, frame)
+		}
+	})
+
+	err := r.read(conn, server.Input)
+	if publisher {
+		log.Log.Info("capture.rtmp.serve(): publisher " + conn.RemoteAddr().String() + " disconnected")
+		r.readErr = err
+		close(r.packets)
+	} else {
+		conn.Close()
+	}
+}
+
+// acceptPublisher makes the connection the publisher, if there is none yet. The listener is closed,
+// other cameras can't publish anymore.
+func (r *RTMPClient) acceptPublisher(conn net.Conn) bool {
+	r.connMutex.Lock()
+	defer r.connMutex.Unlock()
+	select {
+	case <-r.done:
+		return false
+	default:
+	}
+	if r.conn != nil {
+		return false
+	}
+	r.conn = conn
+	if r.listener != nil {
+		r.listener.Close()
+	}
+	log.Log.Info("capture.rtmp.acceptPublisher(): " + conn.RemoteAddr().String() + " is publishing")
+	return true
+}
+
+// read reads the connection until it's closed, or no data is received within the read timeout.
+func (r *RTMPClient) read(conn net.Conn, input func([]byte) error) error {
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(r.timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if err := input(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// onFrame normalises a video frame (Annex-B, keyframes include the parameter sets) into a packet.
+func (r *RTMPClient) onFrame(cid codec.CodecID, pts, dts uint32, frame []byte) {
+	var videoCodec string
+	switch cid {
+	case codec.CODECID_VIDEO_H264:
+		videoCodec = "H264"
+	case codec.CODECID_VIDEO_H265:
+		videoCodec = "H265"
+	default:
+		return
+	}
+
+	if r.timestampStarted {
+		r.timestamp += time.Duration(int32(dts-r.lastTimestamp)) * time.Millisecond
+	}
+	r.timestampStarted = true
+	r.lastTimestamp = dts
+
+	data := append([]byte(nil), frame...)
+	pkt := packets.Packet{
+		IsVideo:         true,
+		IsKeyFrame:      isKeyFrame(videoCodec, data),
+		Idx:             0,
+		Codec:           videoCodec,
+		CompositionTime: time.Duration(int32(pts-dts)) * time.Millisecond,
+		Time:            r.timestamp,
+		Data:            data,
+	}
+	select {
+	case r.packets <- pkt:
+	case <-r.done:
+	}
+}
+
+// ConnectBackChannel is not supported, RTMP has no backchannel.
+func (r *RTMPClient) ConnectBackChannel(ctx context.Context) (err error) {
+	return errors.New("capture.rtmp.ConnectBackChannel(): a RTMP stream has no backchannel")
+}
+
+// Start writes the packets to the queue, until the stream ends or the client is closed.
+func (r *RTMPClient) Start(ctx context.Context, streamType string, queue *packets.Queue, configuration *models.Configuration, communication *models.Communication) (err error) {
+	log.Log.Debug("capture.rtmp.Start(): started")
+	if r.done == nil || len(r.first.Data) == 0 {
+		return ErrRTMPClientClosed
+	}
+
+	pkt := r.first
+	for {
+		queue.WritePacket(pkt)
+
+		if pkt.IsKeyFrame {
+			// Increment packets, so we know the device
+			// is not blocking.
+			if streamType == "main" {
+				count := communication.PackageCounter.Load().(int64)
+				communication.PackageCounter.Store((count + 1) % 1000)
+				communication.LastPacketTimer.Store(time.Now().Unix())
+			} else if streamType == "sub" {
+				count := communication.PackageCounterSub.Load().(int64)
+				communication.PackageCounterSub.Store((count + 1) % 1000)
+				communication.LastPacketTimerSub.Store(time.Now().Unix())
+			}
+		}
+
+		var ok bool
+		select {
+		case pkt, ok = <-r.packets:
+			if !ok {
+				if r.readErr != nil {
+					log.Log.Error("capture.rtmp.Start(): the stream ended: " + r.readErr.Error())
+				}
+				return r.readErr
+			}
+		case <-r.done:
+			log.Log.Debug("capture.rtmp.Start(): finished")
+			return nil
+		case <-ctx.Done():
+			log.Log.Debug("capture.rtmp.Start(): finished")
+			return nil
+		}
+	}
+}
+
+// StartBackChannel is not supported, RTMP has no backchannel.
+func (r *RTMPClient) StartBackChannel(ctx context.Context) (err error) {
+	return nil
+}
+
+// WritePacket is not supported, RTMP has no backchannel.
+func (r *RTMPClient) WritePacket(pkt packets.Packet) error {
+	return nil
+}
+
+// Decode a packet to an image.
+func (r *RTMPClient) DecodePacket(pkt packets.Packet) (image.YCbCr, error) {
+	var img image.YCbCr
+	var err error
+	if r.VideoDecoderMutex == nil {
+		return image.YCbCr{}, ErrRTMPClientClosed
+	}
+	r.VideoDecoderMutex.Lock()
+	if len(pkt.Data) == 0 {
+		err = errors.New("capture.rtmp.DecodePacket(): empty frame")
+	} else if r.VideoFrameDecoder != nil {
+		img, err = r.VideoFrameDecoder.decode(pkt.Data)
+	} else {
+		err = errors.New("capture.rtmp.DecodePacket(): no decoder found, might already be closed")
+	}
+	r.VideoDecoderMutex.Unlock()
+	if err != nil {
+		log.Log.Error("capture.rtmp.DecodePacket(): " + err.Error())
+		return image.YCbCr{}, err
+	}
+	if img.Bounds().Empty() {
+		log.Log.Debug("capture.rtmp.DecodePacket(): empty frame")
+		return image.YCbCr{}, errors.New("Empty image")
+	}
+	return img, nil
+}
+
+// Decode a packet to a Gray image.
+func (r *RTMPClient) DecodePacketRaw(pkt packets.Packet) (image.Gray, error) {
+	var img image.Gray
+	var err error
+	if r.VideoDecoderMutex == nil {
+		return image.Gray{}, ErrRTMPClientClosed
+	}
+	r.VideoDecoderMutex.Lock()
+	if len(pkt.Data) == 0 {
+		err = errors.New("capture.rtmp.DecodePacketRaw(): empty frame")
+	} else if r.VideoFrameDecoder != nil {
+		img, err = r.VideoFrameDecoder.decodeRaw(pkt.Data)
+	} else {
+		err = errors.New("capture.rtmp.DecodePacketRaw(): no decoder found, might already be closed")
+	}
+	r.VideoDecoderMutex.Unlock()
+	if err != nil {
+		log.Log.Error("capture.rtmp.DecodePacketRaw(): " + err.Error())
+		return image.Gray{}, err
+	}
+	if img.Bounds().Empty() {
+		log.Log.Debug("capture.rtmp.DecodePacketRaw(): empty image")
+		return image.Gray{}, errors.New("Empty image")
+	}
+
+	// Do a deep copy of the image
+	imgDeepCopy := image.NewGray(img.Bounds())
+	imgDeepCopy.Stride = img.Stride
+	copy(imgDeepCopy.Pix, img.Pix)
+
+	return *imgDeepCopy, err
+}
+
+// Get a list of streams of the RTMP stream.
+func (r *RTMPClient) GetStreams() ([]packets.Stream, error) {
+	return r.Streams, nil
+}
+
+// Get a list of video streams of the RTMP stream.
+func (r *RTMPClient) GetVideoStreams() ([]packets.Stream, error) {
+	var videoStreams []packets.Stream
+	for _, stream := range r.Streams {
+		if stream.IsVideo {
+			videoStreams = append(videoStreams, stream)
+		}
+	}
+	return videoStreams, nil
+}
+
+// Get a list of audio streams of the RTMP stream, audio is not read.
+func (r *RTMPClient) GetAudioStreams() ([]packets.Stream, error) {
+	return nil, nil
+}
+
+// GetTransport returns "rtmp", or "rtmp listener" when the camera publishes to the agent.
+func (r *RTMPClient) GetTransport() string {
+	if strings.Contains(r.Url, "mode=listener") {
+		return "rtmp listener"
+	}
+	return "rtmp"
+}
+
+// Close closes the connection (and the listener), and the decoder.
+func (r *RTMPClient) Close() error {
+	r.doneOnce.Do(func() {
+		if r.done != nil {
+			close(r.done)
+		}
+		r.connMutex.Lock()
+		if r.listener != nil {
+			r.listener.Close()
+		}
+		if r.conn != nil {
+			r.conn.Close()
+		}
+		r.connMutex.Unlock()
+		if r.VideoDecoderMutex != nil {
+			r.VideoDecoderMutex.Lock()
+			if r.VideoFrameDecoder != nil {
+				r.VideoFrameDecoder.Close()
+				r.VideoFrameDecoder = nil
+			}
+			r.VideoDecoderMutex.Unlock()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,66 @@
+package capture
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/database"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// Continuous recordings can be aligned to the wall clock: a recording is cut at the keyframe nearest
+// to every multiple of the max length (counted from midnight), and is named after that boundary.
+// While recording continuously, the intervals without footage are stored as gaps.
+
+// minimumGap is the shortest interval without footage that is stored as a gap.
+const minimumGap = 3 * time.Second
+
+// nextSegmentBoundary returns the first wall-clock boundary after t.
+func nextSegmentBoundary(t time.Time, length time.Duration, loc *time.Location) time.Time {
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	return midnight.Add((t.Sub(midnight)/length + 1) * length)
+}
+
+// cutAtBoundary returns true if a keyframe (arriving now) is the keyframe nearest to the boundary,
+// the next keyframe is expected a GOP later.
+func cutAtBoundary(now time.Time, boundary time.Time, gopDuration time.Duration) bool {
+	return !now.Before(boundary) || boundary.Sub(now) < gopDuration/2
+}
+
+// addGap stores an interval (milliseconds) without footage of a camera, if it's long enough.
+func addGap(cameraKey string, start int64, end int64, reason string) {
+	if time.Duration(end-start)*time.Millisecond < minimumGap {
+		return
+	}
+	log.Log.Warning("capture.segments.addGap(): no footage for " + strconv.FormatInt((end-start)/1000, 10) + " seconds (" + reason + ")")
+	database.AddGap(models.RecordingGap{
+		Start:     start,
+		End:       end,
+		Duration:  end - start,
+		Reason:    reason,
+		CameraKey: cameraKey,
+	})
+}
+
+// lastContinuousRecordingEnd returns the end (milliseconds) of the last continuous recording (of the camera,
+// in multi-camera mode) in the index, so we can detect the gap when recording resumes.
+func lastContinuousRecordingEnd(cameraKey string) int64 {
+	recordings, err := database.ListRecordings()
+	if err != nil {
+		return 0
+	}
+	for i := len(recordings) - 1; i >= 0; i-- {
+		recording := recordings[i]
+		if isContinuousRecording(recording) && !utils.IsSubRecording(recording.Name) &&
+			(cameraKey == "" || recording.Metadata.CameraKey == cameraKey) {
+			return recording.Metadata.EndTime
+		}
+	}
+	return 0
+}
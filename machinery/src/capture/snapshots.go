@@ -0,0 +1,326 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/encryption"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// Snapshots are decoded from keyframes, so a snapshot is taken at the first keyframe after it's due.
+// Every snapshot has a JSON sidecar (like the recordings) with its trigger and the regions with motion.
+const snapshotExtension = ".jpg"
+
+// ErrSnapshotNotFound is returned when a snapshot doesn't exist (or the name is not valid).
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// HandleSnapshots takes a snapshot of the (main) stream every interval, and a burst of snapshots when
+// motion is detected, until the queue is closed.
+func HandleSnapshots(snapshotCursor *packets.QueueCursor, configDirectory string, configuration *models.Configuration, communication *models.Communication, rtspClient RTSPClient) {
+	log.Log.Debug("capture.snapshots.HandleSnapshots(): started")
+	config := configuration.Config
+
+	snapshotDirectory := configDirectory + "/data/snapshots"
+	if err := os.MkdirAll(snapshotDirectory, 0755); err != nil {
+		log.Log.Error("capture.snapshots.HandleSnapshots(): " + err.Error())
+		return
+	}
+	applySnapshotRetention(configDirectory, configuration)
+
+	interval := time.Duration(config.Snapshots.Interval) * time.Second
+	motionInterval := time.Duration(config.Snapshots.MotionInterval) * time.Second
+	if motionInterval <= 0 {
+		motionInterval = time.Second
+	}
+
+	var lastPeriodic time.Time
+	var lastMotion time.Time
+	var lastRetention = time.Now()
+	var lastKeyFrame packets.Packet
+	var lastKeyFrameTime time.Time
+	var motion models.MotionDataPartial
+	var burst int64
+	var cursorError error
+	var pkt packets.Packet
+	for cursorError == nil {
+		pkt, cursorError = snapshotCursor.ReadPacket()
+		if cursorError != nil {
+			continue
+		}
+
+		// Motion was detected, the keyframe we just read is the one the motion was found in (or close to it).
+		select {
+		case m, ok := <-communication.HandleSnapshot:
+			if ok && config.Snapshots.MotionCount > 0 {
+				motion = m
+				burst = config.Snapshots.MotionCount
+				if len(lastKeyFrame.Data) > 0 && time.Since(lastKeyFrameTime) < motionInterval {
+					if saveSnapshot(configDirectory, configuration, rtspClient, lastKeyFrame, models.TriggerMotion, motion) {
+						lastMotion = time.Now()
+						burst--
+					}
+				}
+			}
+		default:
+		}
+
+		if !pkt.IsVideo || !pkt.IsKeyFrame || (pkt.Codec != "H264" && pkt.Codec != "H265") {
+			continue
+		}
+		now := time.Now()
+		lastKeyFrame = pkt
+		lastKeyFrameTime = now
+
+		if burst > 0 && now.Sub(lastMotion) >= motionInterval {
+			if saveSnapshot(configDirectory, configuration, rtspClient, pkt, models.TriggerMotion, motion) {
+				lastMotion = now
+				burst--
+			}
+		} else if interval > 0 && now.Sub(lastPeriodic) >= interval {
+			if saveSnapshot(configDirectory, configuration, rtspClient, pkt, models.TriggerPeriodic, models.MotionDataPartial{}) {
+				lastPeriodic = now
+			}
+		}
+
+		// The retention is applied once a minute, so we don't read the directory for every snapshot.
+		if now.Sub(lastRetention) >= time.Minute {
+			applySnapshotRetention(configDirectory, configuration)
+			lastRetention = now
+		}
+	}
+
+	log.Log.Debug("capture.snapshots.HandleSnapshots(): finished")
+}
+
+// saveSnapshot decodes a keyframe into a JPEG, and stores it (encrypted if recordings are encrypted)
+// with its metadata. The snapshot is queued for upload if enabled. False is returned if it failed.
+func saveSnapshot(configDirectory string, configuration *models.Configuration, rtspClient RTSPClient, pkt packets.Packet, trigger string, motion models.MotionDataPartial) bool {
+	config := configuration.Config
+	img, err := rtspClient.DecodePacket(pkt)
+	if err != nil {
+		return false
+	}
+	quality := int(config.Snapshots.Quality)
+	if quality <= 0 || quality > 100 {
+		quality = 80
+	}
+	var data bytes.Buffer
+	if err := jpeg.Encode(&data, &img, &jpeg.Options{Quality: quality}); err != nil {
+		log.Log.Error("capture.snapshots.saveSnapshot(): could not encode snapshot: " + err.Error())
+		return false
+	}
+
+	// The name follows the format of the recordings, so it's accepted by the cloud providers. The
+	// microseconds make sure the snapshots of a burst have a different name.
+	now := time.Now()
+	name := strconv.FormatInt(now.Unix(), 10) + "_" +
+		"6" + "-" +
+		fmt.Sprintf("%06d", now.Nanosecond()/1000) + "_" +
+		config.Name + "_" +
+		"0-0-0-0" + "_" +
+		strconv.Itoa(motion.NumberOfChanges) + "_" +
+		"769" + snapshotExtension
+	fullName := configDirectory + "/data/snapshots/" + name
+	if err := writePreviewFile(configuration, fullName, data.Bytes()); err != nil {
+		log.Log.Error("capture.snapshots.saveSnapshot(): could not write snapshot: " + err.Error())
+		os.Remove(fullName)
+		return false
+	}
+
+	regions := motion.Regions
+	if regions == nil {
+		regions = []string{}
+	}
+	metadata := models.RecordingMetadata{
+		Name:         name,
+		CameraKey:    config.Key,
+		CameraName:   config.Name,
+		StartTime:    now.UnixMilli(),
+		EndTime:      now.UnixMilli(),
+		VideoCodec:   pkt.Codec,
+		Width:        img.Bounds().Dx(),
+		Height:       img.Bounds().Dy(),
+		Trigger:      trigger,
+		PeakChanges:  motion.NumberOfChanges,
+		TotalChanges: motion.NumberOfChanges,
+		Regions:      regions,
+		Encrypted:    EncryptRecordings(configuration),
+	}
+	if err := utils.WriteRecordingMetadata(fullName, metadata); err != nil {
+		log.Log.Error("capture.snapshots.saveSnapshot(): error writing metadata: " + err.Error())
+	}
+
+	// Queue the snapshot for upload, the marker holds the directory of the snapshot.
+	if config.Snapshots.Upload == "true" {
+		if err := os.WriteFile(configDirectory+"/data/cloud/"+name, []byte("data/snapshots"), 0644); err != nil {
+			log.Log.Error("capture.snapshots.saveSnapshot(): " + err.Error())
+		}
+	}
+	log.Log.Debug("capture.snapshots.saveSnapshot(): saved " + trigger + " snapshot " + name)
+	return true
+}
+
+// applySnapshotRetention removes the oldest snapshots, when they are older than the max age or
+// exceed the max size. Snapshots that are still waiting to be uploaded are kept.
+func applySnapshotRetention(configDirectory string, configuration *models.Configuration) {
+	config := configuration.Config
+	maxAge := config.Snapshots.MaxAge
+	maxSize := config.Snapshots.MaxSize * 1000 * 1000
+	if maxAge <= 0 && maxSize <= 0 {
+		return
+	}
+
+	snapshotDirectory := configDirectory + "/data/snapshots"
+	files, err := os.ReadDir(snapshotDirectory)
+	if err != nil {
+		return
+	}
+	type snapshot struct {
+		name      string
+		timestamp int64
+		size      int64
+	}
+	var snapshots []snapshot
+	var totalSize int64
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != snapshotExtension {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(strings.Split(file.Name(), "_")[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot{name: file.Name(), timestamp: timestamp, size: info.Size()})
+		totalSize += info.Size()
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].name < snapshots[j].name
+	})
+
+	cutoff := time.Now().AddDate(0, 0, -int(maxAge)).Unix()
+	removed := 0
+	for _, s := range snapshots {
+		if !(maxAge > 0 && s.timestamp < cutoff) && !(maxSize > 0 && totalSize > maxSize) {
+			break
+		}
+		if _, err := os.Stat(configDirectory + "/data/cloud/" + s.name); err == nil {
+			continue
+		}
+		if err := utils.RemoveRecording(snapshotDirectory + "/" + s.name); err != nil {
+			log.Log.Error("capture.snapshots.applySnapshotRetention(): could not remove " + s.name + ": " + err.Error())
+			continue
+		}
+		totalSize -= s.size
+		removed++
+	}
+	if removed > 0 {
+		log.Log.Info("capture.snapshots.applySnapshotRetention(): removed " + strconv.Itoa(removed) + " snapshots (max age or max size)")
+	}
+}
+
+// GetSnapshots returns the snapshots in data/snapshots, the most recent first. The snapshots can be
+// filtered on camera (key), trigger and time range (unix timestamps in seconds, 0 is no limit).
+func GetSnapshots(configDirectory string, cameraKey string, trigger string, from int64, to int64, limit int) ([]models.Snapshot, error) {
+	snapshotDirectory := configDirectory + "/data/snapshots"
+	files, err := os.ReadDir(snapshotDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []models.Snapshot{}, nil
+		}
+		return nil, err
+	}
+
+	// The names start with the timestamp, so the most recent snapshots are at the end.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() > files[j].Name()
+	})
+	snapshots := []models.Snapshot{}
+	for _, file := range files {
+		if limit > 0 && len(snapshots) >= limit {
+			break
+		}
+		if filepath.Ext(file.Name()) != snapshotExtension {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(strings.Split(file.Name(), "_")[0], 10, 64)
+		if err != nil || (from > 0 && timestamp < from) || (to > 0 && timestamp >= to) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		snapshot := models.Snapshot{
+			Name:      file.Name(),
+			Timestamp: timestamp * 1000,
+			Size:      info.Size(),
+			Regions:   []string{},
+		}
+		metadata, err := utils.ReadRecordingMetadata(snapshotDirectory + "/" + file.Name())
+		if cameraKey != "" && (err != nil || metadata.CameraKey != cameraKey) {
+			continue
+		}
+		if err == nil {
+			snapshot.Timestamp = metadata.StartTime
+			snapshot.Trigger = metadata.Trigger
+			snapshot.Width = metadata.Width
+			snapshot.Height = metadata.Height
+			snapshot.Encrypted = metadata.Encrypted
+			if metadata.Regions != nil {
+				snapshot.Regions = metadata.Regions
+			}
+		}
+		if trigger != "" && snapshot.Trigger != trigger {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// ReadSnapshot returns the JPEG of a snapshot, an encrypted snapshot is decrypted.
+func ReadSnapshot(configDirectory string, configuration *models.Configuration, name string) ([]byte, error) {
+	if name != filepath.Base(name) || filepath.Ext(name) != snapshotExtension {
+		return nil, ErrSnapshotNotFound
+	}
+	file, err := os.Open(configDirectory + "/data/snapshots/" + name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrSnapshotNotFound
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, encryption.ChunkedHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	if !encryption.IsChunked(header[:n]) {
+		return io.ReadAll(file)
+	}
+	symmetricKey := ""
+	if configuration.Config.Encryption != nil {
+		symmetricKey = configuration.Config.Encryption.SymmetricKey
+	}
+	reader, err := encryption.NewReader(file, symmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
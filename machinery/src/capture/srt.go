@@ -0,0 +1,450 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"image"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	srt "github.com/datarhei/gosrt"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+)
+
+// The SRT client reads a camera (an encoder, a drone, ...) that streams MPEG-TS over SRT. It's selected
+// with a srt:// url, and either connects to the camera or a server (srt://host:port?streamid=...), or runs
+// as a listener the camera connects to (srt://0.0.0.0:9000?mode=listener). The options of the url are the
+// ones of srt-live-transmit, e.g. passphrase and latency. A listener accepts a single camera, with the
+// streamid of the url (if given). Only the video track (H264 or H265) is read.
+
+const (
+	srtScheme          = "srt://"
+	srtDefaultTimeout  = 10 * time.Second
+	srtPublishTimeout  = time.Minute // The time a listener waits for a camera and its first keyframe.
+	srtPacketQueueSize = 256
+
+	// The timestamps of the MPEG-TS demuxer are milliseconds, of a 33-bit 90kHz clock.
+	srtTimestampWrap = (1 << 33) / 90
+)
+
+// ErrSRTClientClosed is returned when the SRT client is used before it's connected, or after it's closed.
+var ErrSRTClientClosed = errors.New("srt client is closed")
+
+// SRTClient implements the RTSPClient interface.
+type SRTClient struct {
+	Url     string
+	Options StreamOptions
+
+	VideoDecoderMutex *sync.Mutex
+	VideoFrameDecoder *Decoder
+
+	Streams []packets.Stream
+
+	timeout   time.Duration
+	connMutex sync.Mutex
+	listener  srt.Listener
+	conn      srt.Conn // The connection to the camera (or server).
+	packets   chan packets.Packet
+	readErr   error          // Why the connection ended, set before packets is closed.
+	first     packets.Packet // The first keyframe, read by Connect.
+	done      chan struct{}
+	doneOnce  sync.Once
+
+	// The timestamps of the transport stream wrap around, they are unwrapped into the timestamp.
+	timestampStarted bool
+	lastTimestamp    uint64
+	timestamp        time.Duration
+}
+
+var _ RTSPClient = (*SRTClient)(nil)
+
+// IsSRT returns true if the url should be read by the SRT client.
+func IsSRT(url string) bool {
+	return strings.HasPrefix(url, srtScheme)
+}
+
+// Connect connects to the camera, or waits for the camera to connect, and reads the stream from the
+// first keyframe.
+func (s *SRTClient) Connect(ctx context.Context) (err error) {
+	u, err := url.Parse(s.Url)
+	if err != nil {
+		return errors.New("capture.srt.Connect(): " + err.Error())
+	}
+	s.timeout = s.Options.ReadTimeout
+	if s.timeout <= 0 {
+		s.timeout = srtDefaultTimeout
+	}
+	config := srt.DefaultConfig()
+	config.ConnectionTimeout = s.timeout
+	config.PeerIdleTimeout = s.timeout
+	address, err := config.UnmarshalURL(s.Url)
+	if err != nil {
+		return errors.New("capture.srt.Connect(): " + err.Error())
+	}
+	s.packets = make(chan packets.Packet, srtPacketQueueSize)
+	s.done = make(chan struct{})
+	s.VideoDecoderMutex = &sync.Mutex{}
+
+	wait := s.timeout
+	if u.Query().Get("mode") == "listener" {
+		err = s.listen(address, config)
+		wait = srtPublishTimeout
+	} else {
+		err = s.dial(address, config)
+	}
+	if err != nil {
+		s.Close()
+		return errors.New("capture.srt.Connect(): " + err.Error())
+	}
+
+	// Wait for the first keyframe, so the stream (codec, width and height) is known.
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for len(s.first.Data) == 0 {
+		select {
+		case pkt, ok := <-s.packets:
+			if !ok {
+				s.Close()
+				if s.readErr != nil {
+					return errors.New("capture.srt.Connect(): the stream ended before the first keyframe: " + s.readErr.Error())
+				}
+				return errors.New("capture.srt.Connect(): the stream ended before the first keyframe")
+			}
+			if !pkt.IsKeyFrame {
+				continue
+			}
+			stream, err := newVideoStream(pkt.Codec, pkt.Data)
+			if err != nil {
+				s.Close()
+				return errors.New("capture.srt.Connect(): " + err.Error())
+			}
+			s.Streams = []packets.Stream{stream}
+			s.first = pkt
+		case <-timer.C:
+			s.Close()
+			return errors.New("capture.srt.Connect(): no keyframe received within " + wait.String())
+		case <-ctx.Done():
+			s.Close()
+			return errors.New("capture.srt.Connect(): " + ctx.Err().Error())
+		}
+	}
+
+	// setup the H264 or H265 -> raw frames decoder
+	frameDec, err := newDecoder(s.first.Codec)
+	if err != nil {
+		log.Log.Error("capture.srt.Connect(" + s.first.Codec + "): " + err.Error())
+	}
+	s.VideoDecoderMutex.Lock()
+	s.VideoFrameDecoder = frameDec
+	s.VideoDecoderMutex.Unlock()
+
+	stream := s.Streams[0]
+	log.Log.Info("capture.srt.Connect(): reading " + u.Host + " (" + stream.Name + ", " +
+		strconv.Itoa(stream.Width) + "x" + strconv.Itoa(stream.Height) + ")")
+	return nil
+}
+
+// dial connects to the camera (or server), and reads the stream.
+func (s *SRTClient) dial(address string, config srt.Config) error {
+	conn, err := srt.Dial("srt", address, config)
+	if err != nil {
+		return err
+	}
+	s.connMutex.Lock()
+	s.conn = conn
+	s.connMutex.Unlock()
+	go s.read(conn)
+	return nil
+}
+
+// listen accepts the cameras that connect to the listener, the first camera with the streamid is read.
+func (s *SRTClient) listen(address string, config srt.Config) error {
+	listener, err := srt.Listen("srt", address, config)
+	if err != nil {
+		return err
+	}
+	s.connMutex.Lock()
+	s.listener = listener
+	s.connMutex.Unlock()
+
+	go func() {
+		for {
+			request, err := listener.Accept2()
+			if err != nil {
+				return
+			}
+			if config.StreamId != "" && request.StreamId() != config.StreamId {
+				log.Log.Warning("capture.srt.listen(): refused " + request.RemoteAddr().String() + ", unknown streamid " + request.StreamId())
+				request.Reject(srt.REJ_PEER)
+				continue
+			}
+			if request.IsEncrypted() {
+				if err := request.SetPassphrase(config.Passphrase); err != nil {
+					log.Log.Warning("capture.srt.listen(): refused " + request.RemoteAddr().String() + ", wrong passphrase")
+					request.Reject(srt.REJ_BADSECRET)
+					continue
+				}
+			}
+			conn, err := request.Accept()
+			if err != nil {
+				continue
+			}
+			if !s.acceptPublisher(conn) {
+				log.Log.Warning("capture.srt.listen(): refused " + conn.RemoteAddr().String() + ", already publishing")
+				conn.Close()
+				continue
+			}
+			go s.read(conn)
+		}
+	}()
+	return nil
+}
+
+// acceptPublisher makes the connection the one we read, if there is none yet. The listener stays open
+// (the connection is read from its socket), other cameras are refused.
+func (s *SRTClient) acceptPublisher(conn srt.Conn) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	if s.conn != nil {
+		return false
+	}
+	s.conn = conn
+	log.Log.Info("capture.srt.acceptPublisher(): " + conn.RemoteAddr().String() + " is publishing")
+	return true
+}
+
+// read demuxes the transport stream of the connection, until it's closed. A connection without data
+// is closed by SRT after the read timeout (peer idle timeout).
+func (s *SRTClient) read(conn srt.Conn) {
+	demuxer := mpeg2.NewTSDemuxer()
+	demuxer.OnFrame = s.onFrame
+	err := demuxer.Input(conn)
+	if err == nil {
+		err = errors.New("the connection was closed")
+	}
+	s.readErr = err
+	close(s.packets)
+}
+
+// onFrame normalises a video frame of the transport stream into a packet.
+func (s *SRTClient) onFrame(cid mpeg2.TS_STREAM_TYPE, frame []byte, pts uint64, dts uint64) {
+	var videoCodec string
+	switch cid {
+	case mpeg2.TS_STREAM_H264:
+		videoCodec = "H264"
+	case mpeg2.TS_STREAM_H265:
+		videoCodec = "H265"
+	default:
+		return
+	}
+
+	if s.timestampStarted {
+		diff := int64(dts) - int64(s.lastTimestamp)
+		if diff < -srtTimestampWrap/2 {
+			diff += srtTimestampWrap
+		}
+		s.timestamp += time.Duration(diff) * time.Millisecond
+	}
+	s.timestampStarted = true
+	s.lastTimestamp = dts
+
+	data := append([]byte(nil), frame...)
+	pkt := packets.Packet{
+		IsVideo:         true,
+		IsKeyFrame:      isKeyFrame(videoCodec, data),
+		Idx:             0,
+		Codec:           videoCodec,
+		CompositionTime: time.Duration(int64(pts)-int64(dts)) * time.Millisecond,
+		Time:            s.timestamp,
+		Data:            data,
+	}
+	select {
+	case s.packets <- pkt:
+	case <-s.done:
+	}
+}
+
+// ConnectBackChannel is not supported, SRT has no backchannel.
+func (s *SRTClient) ConnectBackChannel(ctx context.Context) (err error) {
+	return errors.New("capture.srt.ConnectBackChannel(): a SRT stream has no backchannel")
+}
+
+// Start writes the packets to the queue, until the stream ends or the client is closed.
+func (s *SRTClient) Start(ctx context.Context, streamType string, queue *packets.Queue, configuration *models.Configuration, communication *models.Communication) (err error) {
+	log.Log.Debug("capture.srt.Start(): started")
+	if s.done == nil || len(s.first.Data) == 0 {
+		return ErrSRTClientClosed
+	}
+
+	pkt := s.first
+	for {
+		queue.WritePacket(pkt)
+
+		if pkt.IsKeyFrame {
+			// Increment packets, so we know the device
+			// is not blocking.
+			if streamType == "main" {
+				count := communication.PackageCounter.Load().(int64)
+				communication.PackageCounter.Store((count + 1) % 1000)
+				communication.LastPacketTimer.Store(time.Now().Unix())
+			} else if streamType == "sub" {
+				count := communication.PackageCounterSub.Load().(int64)
+				communication.PackageCounterSub.Store((count + 1) % 1000)
+				communication.LastPacketTimerSub.Store(time.Now().Unix())
+			}
+		}
+
+		var ok bool
+		select {
+		case pkt, ok = <-s.packets:
+			if !ok {
+				if s.readErr != nil {
+					log.Log.Error("capture.srt.Start(): the stream ended: " + s.readErr.Error())
+				}
+				return s.readErr
+			}
+		case <-s.done:
+			log.Log.Debug("capture.srt.Start(): finished")
+			return nil
+		case <-ctx.Done():
+			log.Log.Debug("capture.srt.Start(): finished")
+			return nil
+		}
+	}
+}
+
+// StartBackChannel is not supported, SRT has no backchannel.
+func (s *SRTClient) StartBackChannel(ctx context.Context) (err error) {
+	return nil
+}
+
+// WritePacket is not supported, SRT has no backchannel.
+func (s *SRTClient) WritePacket(pkt packets.Packet) error {
+	return nil
+}
+
+// Decode a packet to an image.
+func (s *SRTClient) DecodePacket(pkt packets.Packet) (image.YCbCr, error) {
+	var img image.YCbCr
+	var err error
+	if s.VideoDecoderMutex == nil {
+		return image.YCbCr{}, ErrSRTClientClosed
+	}
+	s.VideoDecoderMutex.Lock()
+	if len(pkt.Data) == 0 {
+		err = errors.New("capture.srt.DecodePacket(): empty frame")
+	} else if s.VideoFrameDecoder != nil {
+		img, err = s.VideoFrameDecoder.decode(pkt.Data)
+	} else {
+		err = errors.New("capture.srt.DecodePacket(): no decoder found, might already be closed")
+	}
+	s.VideoDecoderMutex.Unlock()
+	if err != nil {
+		log.Log.Error("capture.srt.DecodePacket(): " + err.Error())
+		return image.YCbCr{}, err
+	}
+	if img.Bounds().Empty() {
+		log.Log.Debug("capture.srt.DecodePacket(): empty frame")
+		return image.YCbCr{}, errors.New("Empty image")
+	}
+	return img, nil
+}
+
+// Decode a packet to a Gray image.
+func (s *SRTClient) DecodePacketRaw(pkt packets.Packet) (image.Gray, error) {
+	var img image.Gray
+	var err error
+	if s.VideoDecoderMutex == nil {
+		return image.Gray{}, ErrSRTClientClosed
+	}
+	s.VideoDecoderMutex.Lock()
+	if len(pkt.Data) == 0 {
+		err = errors.New("capture.srt.DecodePacketRaw(): empty frame")
+	} else if s.VideoFrameDecoder != nil {
+		img, err = s.VideoFrameDecoder.decodeRaw(pkt.Data)
+	} else {
+		err = errors.New("capture.srt.DecodePacketRaw(): no decoder found, might already be closed")
+	}
+	s.VideoDecoderMutex.Unlock()
+	if err != nil {
+		log.Log.Error("capture.srt.DecodePacketRaw(): " + err.Error())
+		return image.Gray{}, err
+	}
+	if img.Bounds().Empty() {
+		log.Log.Debug("capture.srt.DecodePacketRaw(): empty image")
+		return image.Gray{}, errors.New("Empty image")
+	}
+
+	// Do a deep copy of the image
+	imgDeepCopy := image.NewGray(img.Bounds())
+	imgDeepCopy.Stride = img.Stride
+	copy(imgDeepCopy.Pix, img.Pix)
+
+	return *imgDeepCopy, err
+}
+
+// Get a list of streams of the SRT stream.
+func (s *SRTClient) GetStreams() ([]packets.Stream, error) {
+	return s.Streams, nil
+}
+
+// Get a list of video streams of the SRT stream.
+func (s *SRTClient) GetVideoStreams() ([]packets.Stream, error) {
+	var videoStreams []packets.Stream
+	for _, stream := range s.Streams {
+		if stream.IsVideo {
+			videoStreams = append(videoStreams, stream)
+		}
+	}
+	return videoStreams, nil
+}
+
+// Get a list of audio streams of the SRT stream, audio is not read.
+func (s *SRTClient) GetAudioStreams() ([]packets.Stream, error) {
+	return nil, nil
+}
+
+// GetTransport returns "srt", or "srt listener" when the camera connects to the agent.
+func (s *SRTClient) GetTransport() string {
+	if strings.Contains(s.Url, "mode=listener") {
+		return "srt listener"
+	}
+	return "srt"
+}
+
+// Close closes the connection (and the listener), and the decoder.
+func (s *SRTClient) Close() error {
+	s.doneOnce.Do(func() {
+		if s.done != nil {
+			close(s.done)
+		}
+		s.connMutex.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		s.connMutex.Unlock()
+		if s.VideoDecoderMutex != nil {
+			s.VideoDecoderMutex.Lock()
+			if s.VideoFrameDecoder != nil {
+				s.VideoFrameDecoder.Close()
+				s.VideoFrameDecoder = nil
+			}
+			s.VideoDecoderMutex.Unlock()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,20 @@
+package capture
+
+import (
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// GetStreamStats returns the statistics of the main and sub stream: the measured fps and bitrate, the
+// GOP, the lost packets and decode errors, and the depth of the queue and the lag of its consumers.
+func GetStreamStats(communication *models.Communication) models.StreamStats {
+	var stats models.StreamStats
+	if queue := communication.Queue; queue != nil {
+		mainStats := queue.Stats()
+		stats.Main = &mainStats
+	}
+	if queue := communication.SubQueue; queue != nil {
+		subStats := queue.Stats()
+		stats.Sub = &subStats
+	}
+	return stats
+}
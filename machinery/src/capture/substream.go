@@ -0,0 +1,144 @@
+package capture
+
+import (
+	"os"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// SubRecording records the sub stream next to a recording of the main stream. It has the same
+// name as the main recording, and is stored in data/recordings/sub with its own retention.
+// The recordings are linked in their metadata, so the sub recording can be used once the
+// main recording is removed.
+type SubRecording struct {
+	name     string
+	fullName string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// StartSubRecording starts recording the sub stream, if enabled. With pre-recording the sub recording
+// starts (like the main recording) the pre-recording time before the trigger. Nil is returned if the sub
+// stream isn't recorded, or isn't available (e.g. it's reconnecting).
+func StartSubRecording(subQueue *packets.Queue, configDirectory string, configuration *models.Configuration, rtspSubClient RTSPClient, name string, trigger string, startTime int64, preRecording bool) *SubRecording {
+	config := configuration.Config
+	if config.Capture.SubRecording != "true" || subQueue == nil || rtspSubClient == nil || !subQueue.IsAvailable() {
+		return nil
+	}
+	subDirectory := configDirectory + "/data/recordings/" + utils.SubRecordingsDirectory
+	if err := os.MkdirAll(subDirectory, 0755); err != nil {
+		log.Log.Error("capture.substream.StartSubRecording(): " + err.Error())
+		return nil
+	}
+
+	var cursor *packets.QueueCursor
+	if preRecording {
+		cursor = subQueue.DelayedKeyFrame(time.Duration(config.Capture.PreRecording) * time.Second).Named("sub-recording")
+	} else {
+		cursor = subQueue.Latest().Named("sub-recording")
+	}
+
+	s := &SubRecording{
+		name:     name,
+		fullName: subDirectory + "/" + name,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.record(cursor, configuration, rtspSubClient, trigger, startTime)
+	return s
+}
+
+func (s *SubRecording) record(cursor *packets.QueueCursor, configuration *models.Configuration, rtspSubClient RTSPClient, trigger string, startTime int64) {
+	defer close(s.done)
+
+	// The resolution of the sub stream is used for the MP4 (and the metadata).
+	subConfiguration := *configuration
+	subConfiguration.Config.Capture.IPCamera.Width = configuration.Config.Capture.IPCamera.SubWidth
+	subConfiguration.Config.Capture.IPCamera.Height = configuration.Config.Capture.IPCamera.SubHeight
+
+	metadata := newRecordingMetadata(s.name, trigger, startTime, &subConfiguration, rtspSubClient)
+	metadata.Stream = "sub"
+	metadata.MainRecording = s.name
+	preview := NewRecordingPreview(&subConfiguration, rtspSubClient, 0)
+
+	var file *os.File
+	var writer RecordingWriter
+	var firstPts time.Duration
+	var lastPts time.Duration
+	for !s.stopped() {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			break
+		}
+		if writer == nil {
+			if !pkt.IsVideo || !pkt.IsKeyFrame {
+				continue
+			}
+			file, err = os.Create(s.fullName)
+			if err == nil {
+				writer, err = NewRecordingWriter(file, &subConfiguration, pkt.Codec, GetRecordingAudioStream(rtspSubClient))
+			}
+			if err != nil {
+				log.Log.Error("capture.substream.SubRecording(): " + err.Error())
+				if file != nil {
+					file.Close()
+				}
+				return
+			}
+			firstPts = pkt.Time
+		}
+		if err := writer.WritePacket(pkt); err != nil {
+			log.Log.Error("capture.substream.SubRecording(): " + err.Error())
+		}
+		preview.AddPacket(pkt)
+		lastPts = pkt.Time
+	}
+
+	if writer == nil {
+		return
+	}
+	if err := writer.Close(); err != nil {
+		log.Log.Error("capture.substream.SubRecording(): " + err.Error())
+	}
+	file.Close()
+
+	metadata.Duration = (lastPts - firstPts).Milliseconds()
+	metadata.EndTime = metadata.StartTime + metadata.Duration
+	preview.Save(&subConfiguration, s.fullName, &metadata)
+	if err := utils.WriteRecordingMetadata(s.fullName, metadata); err != nil {
+		log.Log.Error("capture.substream.SubRecording(): error writing metadata: " + err.Error())
+	}
+	log.Log.Info("capture.substream.SubRecording(): file save: " + utils.SubRecordingsDirectory + "/" + s.name)
+}
+
+func (s *SubRecording) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop stops the sub recording, together with the main recording. It returns the sub recording
+// (relative to data/recordings), so it can be linked in the metadata of the main recording.
+func (s *SubRecording) Stop() string {
+	if s == nil {
+		return ""
+	}
+	close(s.stop)
+	// The sub recording is stopped on the next packet, if the sub stream stalls we don't wait for it.
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		log.Log.Warning("capture.substream.SubRecording(): sub stream is not responding, " + s.name + " is closed in the background")
+	}
+	if _, err := os.Stat(s.fullName); err != nil {
+		return ""
+	}
+	return utils.SubRecordingsDirectory + "/" + s.name
+}
@@ -0,0 +1,320 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// A time-lapse is built from keyframes, which can be decoded on their own. While a period is running
+// the keyframes are appended to a spool file (data/timelapse/<period start>.frames), so they survive a
+// restart. Once the period is over, the spool is turned into an MP4 and queued for upload.
+//
+// In multi-camera mode the spool of a camera is data/timelapse/<period start>_<camera>.frames.
+//
+// A frame in the spool: codec (1 byte, 0 = H264, 1 = H265) | timestamp (8 bytes, milliseconds) | size (4 bytes) | data
+const (
+	timelapseSpoolExtension = ".frames"
+	timelapseFrameHeader    = 13
+)
+
+// HandleTimelapse samples a keyframe every interval from the (main) stream, until the queue is closed.
+func HandleTimelapse(timelapseCursor *packets.QueueCursor, configDirectory string, configuration *models.Configuration) {
+	log.Log.Debug("capture.timelapse.HandleTimelapse(): started")
+	config := configuration.Config
+
+	timelapseDirectory := configDirectory + "/data/timelapse"
+	if err := os.MkdirAll(timelapseDirectory, 0755); err != nil {
+		log.Log.Error("capture.timelapse.HandleTimelapse(): " + err.Error())
+		return
+	}
+
+	interval := time.Duration(config.Timelapse.Interval) * time.Second
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+	period := time.Duration(config.Timelapse.Period) * time.Hour
+	if period <= 0 {
+		period = 24 * time.Hour
+	}
+	loc, _ := time.LoadLocation(config.Timezone)
+
+	// Spools of periods that ended while the agent was not running.
+	finishTimelapses(configDirectory, configuration, timelapsePeriodStart(time.Now(), period, loc))
+	applyTimelapseRetention(configDirectory, configuration)
+
+	var spool *os.File
+	var spoolStart time.Time
+	var lastSample time.Time
+	var cursorError error
+	var pkt packets.Packet
+	for cursorError == nil {
+		pkt, cursorError = timelapseCursor.ReadPacket()
+		if cursorError != nil || !pkt.IsVideo || !pkt.IsKeyFrame || (pkt.Codec != "H264" && pkt.Codec != "H265") {
+			continue
+		}
+		now := time.Now()
+		if now.Sub(lastSample) < interval {
+			continue
+		}
+		lastSample = now
+
+		// A new period has started, so the previous time-lapse can be created.
+		periodStart := timelapsePeriodStart(now, period, loc)
+		if spool == nil || !periodStart.Equal(spoolStart) {
+			if spool != nil {
+				spool.Close()
+				spool = nil
+			}
+			finishTimelapses(configDirectory, configuration, periodStart)
+			applyTimelapseRetention(configDirectory, configuration)
+
+			spoolPath := timelapseDirectory + "/" + timelapseSpoolName(configuration, periodStart.Unix())
+			var err error
+			spool, err = os.OpenFile(spoolPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				log.Log.Error("capture.timelapse.HandleTimelapse(): " + err.Error())
+				continue
+			}
+			spoolStart = periodStart
+		}
+
+		frame := make([]byte, timelapseFrameHeader+len(pkt.Data))
+		if pkt.Codec == "H265" {
+			frame[0] = 1
+		}
+		binary.BigEndian.PutUint64(frame[1:], uint64(now.UnixMilli()))
+		binary.BigEndian.PutUint32(frame[9:], uint32(len(pkt.Data)))
+		copy(frame[timelapseFrameHeader:], pkt.Data)
+		if _, err := spool.Write(frame); err != nil {
+			log.Log.Error("capture.timelapse.HandleTimelapse(): " + err.Error())
+		}
+	}
+
+	if spool != nil {
+		spool.Close()
+	}
+	log.Log.Debug("capture.timelapse.HandleTimelapse(): finished")
+}
+
+// timelapsePeriodStart returns the start of the period the time belongs to, periods are aligned
+// to midnight (in the timezone of the agent), so a period of 24 hours is a day.
+func timelapsePeriodStart(t time.Time, period time.Duration, loc *time.Location) time.Time {
+	t = t.In(loc)
+	_, offset := t.Zone()
+	seconds := int64(period / time.Second)
+	local := t.Unix() + int64(offset)
+	return time.Unix(local-local%seconds-int64(offset), 0).In(loc)
+}
+
+func timelapseSpoolName(configuration *models.Configuration, start int64) string {
+	if configuration.CameraID == "" {
+		return strconv.FormatInt(start, 10) + timelapseSpoolExtension
+	}
+	return strconv.FormatInt(start, 10) + "_" + configuration.CameraID + timelapseSpoolExtension
+}
+
+// finishTimelapses creates an MP4 of every spool that belongs to a period before the current one.
+func finishTimelapses(configDirectory string, configuration *models.Configuration, currentPeriod time.Time) {
+	timelapseDirectory := configDirectory + "/data/timelapse"
+	files, err := os.ReadDir(timelapseDirectory)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != timelapseSpoolExtension {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.Split(strings.TrimSuffix(file.Name(), timelapseSpoolExtension), "_")[0], 10, 64)
+		if err != nil || start >= currentPeriod.Unix() || file.Name() != timelapseSpoolName(configuration, start) {
+			continue
+		}
+		spoolPath := timelapseDirectory + "/" + file.Name()
+		if err := createTimelapse(configDirectory, configuration, spoolPath, start); err != nil {
+			log.Log.Error("capture.timelapse.finishTimelapses(): could not create time-lapse of " + file.Name() + ": " + err.Error())
+		}
+		os.Remove(spoolPath)
+	}
+}
+
+// createTimelapse writes the frames of a spool into an MP4, and queues it for upload.
+func createTimelapse(configDirectory string, configuration *models.Configuration, spoolPath string, start int64) error {
+	config := configuration.Config
+	spool, err := os.Open(spoolPath)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	// The name follows the format of the recordings, so it's accepted by the cloud providers.
+	name := strconv.FormatInt(start, 10) + "_" +
+		"6" + "-" +
+		"967003" + "_" +
+		config.Name + "_" +
+		"0-0-0-0" + "_0_" +
+		"769" + ".mp4"
+	fullName := configDirectory + "/data/timelapse/" + name
+
+	fps := config.Timelapse.FPS
+	if fps <= 0 {
+		fps = 25
+	}
+	frameDuration := time.Second / time.Duration(fps)
+
+	var file *os.File
+	var writer RecordingWriter
+	var videoCodec string
+	var lastTimestamp int64
+	frames := 0
+	reader := bufio.NewReader(spool)
+	header := make([]byte, timelapseFrameHeader)
+	for {
+		// A frame that was only partially written (the agent stopped) is skipped.
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[9:]))
+		if _, err := io.ReadFull(reader, data); err != nil {
+			break
+		}
+		codec := "H264"
+		if header[0] == 1 {
+			codec = "H265"
+		}
+
+		if writer == nil {
+			videoCodec = codec
+			file, err = os.Create(fullName)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			writer, err = NewRecordingWriter(file, configuration, videoCodec, nil)
+			if err != nil {
+				return err
+			}
+		}
+		// The camera might have been reconfigured, we can't mix codecs in a single MP4.
+		if codec != videoCodec {
+			continue
+		}
+		pkt := packets.Packet{
+			IsVideo:    true,
+			IsKeyFrame: true,
+			Codec:      videoCodec,
+			Time:       time.Duration(frames) * frameDuration,
+			Data:       data,
+		}
+		if err := writer.WritePacket(pkt); err != nil {
+			return err
+		}
+		lastTimestamp = int64(binary.BigEndian.Uint64(header[1:]))
+		frames++
+	}
+	if writer == nil {
+		return nil
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	// The start and end time of a time-lapse is the period it covers, the duration is how long it plays.
+	metadata := models.RecordingMetadata{
+		Name:       name,
+		CameraKey:  config.Key,
+		CameraName: config.Name,
+		StartTime:  start * 1000,
+		EndTime:    lastTimestamp,
+		Duration:   (time.Duration(frames) * frameDuration).Milliseconds(),
+		VideoCodec: videoCodec,
+		Width:      config.Capture.IPCamera.Width,
+		Height:     config.Capture.IPCamera.Height,
+		Trigger:    models.TriggerTimelapse,
+		Regions:    []string{},
+		Encrypted:  EncryptRecordings(configuration),
+	}
+	if err := utils.WriteRecordingMetadata(fullName, metadata); err != nil {
+		log.Log.Error("capture.timelapse.createTimelapse(): error writing metadata: " + err.Error())
+	}
+
+	// Queue the time-lapse for upload, the marker holds the directory of the time-lapse.
+	if err := os.WriteFile(configDirectory+"/data/cloud/"+name, []byte("data/timelapse"), 0644); err != nil {
+		log.Log.Error("capture.timelapse.createTimelapse(): " + err.Error())
+	}
+	log.Log.Info("capture.timelapse.createTimelapse(): created time-lapse " + name + " of " + strconv.Itoa(frames) + " frames")
+	return nil
+}
+
+// applyTimelapseRetention removes the oldest time-lapses, when they are older than the max age or
+// exceed the max size. Time-lapses that are still waiting to be uploaded are kept.
+func applyTimelapseRetention(configDirectory string, configuration *models.Configuration) {
+	config := configuration.Config
+	maxAge := config.Timelapse.MaxAge
+	maxSize := config.Timelapse.MaxSize * 1000 * 1000
+	if maxAge <= 0 && maxSize <= 0 {
+		return
+	}
+
+	timelapseDirectory := configDirectory + "/data/timelapse"
+	files, err := os.ReadDir(timelapseDirectory)
+	if err != nil {
+		return
+	}
+	type timelapse struct {
+		name  string
+		start int64
+		size  int64
+	}
+	var timelapses []timelapse
+	var totalSize int64
+	for _, file := range files {
+		if !utils.IsRecording(file.Name()) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.Split(file.Name(), "_")[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		timelapses = append(timelapses, timelapse{name: file.Name(), start: start, size: info.Size()})
+		totalSize += info.Size()
+	}
+	sort.Slice(timelapses, func(i, j int) bool {
+		return timelapses[i].start < timelapses[j].start
+	})
+
+	cutoff := time.Now().AddDate(0, 0, -int(maxAge)).Unix()
+	for _, t := range timelapses {
+		reason := ""
+		if maxAge > 0 && t.start < cutoff {
+			reason = "older than " + strconv.FormatInt(maxAge, 10) + " days (max age)"
+		} else if maxSize > 0 && totalSize > maxSize {
+			reason = "time-lapses exceed " + strconv.FormatInt(config.Timelapse.MaxSize, 10) + "MB (max size)"
+		} else {
+			break
+		}
+		if _, err := os.Stat(configDirectory + "/data/cloud/" + t.name); err == nil {
+			continue
+		}
+		if err := utils.RemoveRecording(timelapseDirectory + "/" + t.name); err != nil {
+			log.Log.Error("capture.timelapse.applyTimelapseRetention(): could not remove " + t.name + ": " + err.Error())
+			continue
+		}
+		totalSize -= t.size
+		log.Log.Info("capture.timelapse.applyTimelapseRetention(): removed " + t.name + ", " + reason)
+	}
+}
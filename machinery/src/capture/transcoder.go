@@ -0,0 +1,288 @@
+package capture
+
+// #cgo pkg-config: libavcodec libavutil
+// #include <libavcodec/avcodec.h>
+// #include <libavutil/avutil.h>
+// #include <libavutil/channel_layout.h>
+//
+// static void set_mono_channel_layout(AVCodecContext *ctx, AVFrame *frame) {
+// #if LIBAVUTIL_VERSION_INT >= AV_VERSION_INT(57, 24, 100)
+//   av_channel_layout_default(&ctx->ch_layout, 1);
+//   av_channel_layout_copy(&frame->ch_layout, &ctx->ch_layout);
+// #else
+//   ctx->channels = 1;
+//   ctx->channel_layout = AV_CH_LAYOUT_MONO;
+//   frame->channels = 1;
+//   frame->channel_layout = AV_CH_LAYOUT_MONO;
+// #endif
+// }
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/zaf/g711"
+)
+
+// The bitrate of the AAC audio, G.711 is narrowband (8kHz) so we don't need much.
+const aacBitRate = 32000
+
+// AudioTranscoder transcodes G.711 (µ-law or A-law) audio to AAC, as AAC is the only
+// audio codec we can store in an MP4. The G.711 samples are decoded to PCM, and encoded
+// to AAC with libav. The AAC frames are returned as ADTS packets, just like the AAC
+// packets we receive from cameras that stream AAC.
+type AudioTranscoder struct {
+	codecCtx   *C.AVCodecContext
+	frame      *C.AVFrame
+	packet     *C.AVPacket
+	aLaw       bool
+	sampleRate int
+	channels   int
+	frameSize  int
+
+	// PCM samples waiting for a complete AAC frame.
+	samples []float32
+	// The timestamp of the first sample we received, and the number of samples
+	// sent to the encoder since. Together they give us the timestamp of a frame.
+	startTime   time.Duration
+	started     bool
+	sampleCount int64
+
+	// The encoder starts with priming samples, so the first frames have a negative timestamp. We
+	// offset the timestamps with the priming, so the first frame starts at the first sample.
+	priming    int64
+	hasPriming bool
+	lastPacket packets.Packet
+	flushed    bool
+}
+
+// NewAudioTranscoder creates a transcoder for a G.711 stream, the codec is either PCM_MULAW or PCM_ALAW.
+func NewAudioTranscoder(codecName string, sampleRate int, channels int) (*AudioTranscoder, error) {
+	if codecName != "PCM_MULAW" && codecName != "PCM_ALAW" {
+		return nil, errors.New("capture.transcoder.NewAudioTranscoder(): unsupported audio codec " + codecName)
+	}
+	if sampleRate <= 0 {
+		sampleRate = 8000
+	}
+	if channels <= 0 {
+		channels = 1
+	}
+
+	codec := C.avcodec_find_encoder(C.AV_CODEC_ID_AAC)
+	if codec == nil {
+		return nil, fmt.Errorf("avcodec_find_encoder() failed")
+	}
+
+	codecCtx := C.avcodec_alloc_context3(codec)
+	if codecCtx == nil {
+		return nil, fmt.Errorf("avcodec_alloc_context3() failed")
+	}
+
+	frame := C.av_frame_alloc()
+	if frame == nil {
+		C.avcodec_free_context(&codecCtx)
+		return nil, fmt.Errorf("av_frame_alloc() failed")
+	}
+
+	// The native AAC encoder of libav expects planar float samples,
+	// we downmix to a single channel.
+	codecCtx.sample_fmt = C.AV_SAMPLE_FMT_FLTP
+	codecCtx.sample_rate = C.int(sampleRate)
+	codecCtx.bit_rate = aacBitRate
+	codecCtx.time_base = C.AVRational{num: 1, den: C.int(sampleRate)}
+	C.set_mono_channel_layout(codecCtx, frame)
+
+	res := C.avcodec_open2(codecCtx, codec, nil)
+	if res < 0 {
+		C.av_frame_free(&frame)
+		C.avcodec_free_context(&codecCtx)
+		return nil, fmt.Errorf("avcodec_open2() failed")
+	}
+
+	frameSize := int(codecCtx.frame_size)
+	if frameSize <= 0 {
+		frameSize = mpeg4audio.SamplesPerAccessUnit
+	}
+	frame.nb_samples = C.int(frameSize)
+	frame.format = C.int(codecCtx.sample_fmt)
+	frame.sample_rate = codecCtx.sample_rate
+	res = C.av_frame_get_buffer(frame, 0)
+	if res < 0 {
+		C.av_frame_free(&frame)
+		C.avcodec_free_context(&codecCtx)
+		return nil, fmt.Errorf("av_frame_get_buffer() failed")
+	}
+
+	packet := C.av_packet_alloc()
+	if packet == nil {
+		C.av_frame_free(&frame)
+		C.avcodec_free_context(&codecCtx)
+		return nil, fmt.Errorf("av_packet_alloc() failed")
+	}
+
+	return &AudioTranscoder{
+		codecCtx:   codecCtx,
+		frame:      frame,
+		packet:     packet,
+		aLaw:       codecName == "PCM_ALAW",
+		sampleRate: sampleRate,
+		channels:   channels,
+		frameSize:  frameSize,
+	}, nil
+}
+
+// Transcode takes a G.711 packet, and returns the AAC packets that are ready.
+// As an AAC frame holds more samples than a G.711 packet, it's common that nothing is returned.
+func (t *AudioTranscoder) Transcode(pkt packets.Packet) ([]packets.Packet, error) {
+	if t.flushed {
+		return nil, errors.New("capture.transcoder.Transcode(): the transcoder is flushed")
+	}
+	t.lastPacket = pkt
+	if !t.started {
+		t.started = true
+		t.startTime = pkt.Time
+	}
+
+	// Decode G.711 to PCM, and downmix if there is more than one channel.
+	for i := 0; i+t.channels <= len(pkt.Data); i += t.channels {
+		var sum float32
+		for c := 0; c < t.channels; c++ {
+			var sample int16
+			if t.aLaw {
+				sample = g711.DecodeAlawFrame(pkt.Data[i+c])
+			} else {
+				sample = g711.DecodeUlawFrame(pkt.Data[i+c])
+			}
+			sum += float32(sample) / 32768
+		}
+		t.samples = append(t.samples, sum/float32(t.channels))
+	}
+
+	var aacPackets []packets.Packet
+	for len(t.samples) >= t.frameSize {
+		res := C.av_frame_make_writable(t.frame)
+		if res < 0 {
+			return aacPackets, fmt.Errorf("av_frame_make_writable() failed")
+		}
+		frameData := unsafe.Slice((*float32)(unsafe.Pointer(t.frame.data[0])), t.frameSize)
+		copy(frameData, t.samples[:t.frameSize])
+		t.samples = t.samples[t.frameSize:]
+		t.frame.pts = C.int64_t(t.sampleCount)
+		t.sampleCount += int64(t.frameSize)
+
+		res = C.avcodec_send_frame(t.codecCtx, t.frame)
+		if res < 0 {
+			return aacPackets, fmt.Errorf("avcodec_send_frame() failed")
+		}
+		encoded, err := t.receivePackets(pkt)
+		aacPackets = append(aacPackets, encoded...)
+		if err != nil {
+			return aacPackets, err
+		}
+	}
+	return aacPackets, nil
+}
+
+// receivePackets reads the encoded AAC frames from the encoder, and wraps them in ADTS.
+func (t *AudioTranscoder) receivePackets(pkt packets.Packet) ([]packets.Packet, error) {
+	var aacPackets []packets.Packet
+	for {
+		res := C.avcodec_receive_packet(t.codecCtx, t.packet)
+		if res < 0 {
+			// We need more samples (EAGAIN) or the encoder is flushed (EOF).
+			return aacPackets, nil
+		}
+		au := C.GoBytes(unsafe.Pointer(t.packet.data), t.packet.size)
+		pts := int64(t.packet.pts)
+		C.av_packet_unref(t.packet)
+		if !t.hasPriming {
+			t.hasPriming = true
+			if pts < 0 {
+				t.priming = -pts
+			}
+		}
+		pts += t.priming
+
+		adts, err := mpeg4audio.ADTSPackets{{
+			Type:         mpeg4audio.ObjectTypeAACLC,
+			SampleRate:   t.sampleRate,
+			ChannelCount: 1,
+			AU:           au,
+		}}.Marshal()
+		if err != nil {
+			return aacPackets, err
+		}
+
+		aacPackets = append(aacPackets, packets.Packet{
+			IsKeyFrame:      false,
+			Packet:          pkt.Packet,
+			Data:            adts,
+			Time:            t.startTime + time.Duration(pts)*time.Second/time.Duration(t.sampleRate),
+			CompositionTime: t.startTime + time.Duration(pts)*time.Second/time.Duration(t.sampleRate),
+			Idx:             pkt.Idx,
+			IsVideo:         false,
+			IsAudio:         true,
+			Codec:           "AAC",
+		})
+	}
+}
+
+// Flush encodes the samples that are still buffered (padded with silence to a complete frame), and
+// drains the encoder. It returns the last AAC packets, the transcoder can't be used afterwards.
+func (t *AudioTranscoder) Flush() ([]packets.Packet, error) {
+	if t.flushed || !t.started {
+		t.flushed = true
+		return nil, nil
+	}
+	t.flushed = true
+
+	var aacPackets []packets.Packet
+	if len(t.samples) > 0 {
+		res := C.av_frame_make_writable(t.frame)
+		if res < 0 {
+			return aacPackets, fmt.Errorf("av_frame_make_writable() failed")
+		}
+		frameData := unsafe.Slice((*float32)(unsafe.Pointer(t.frame.data[0])), t.frameSize)
+		n := copy(frameData, t.samples)
+		for i := n; i < t.frameSize; i++ {
+			frameData[i] = 0
+		}
+		t.samples = nil
+		t.frame.pts = C.int64_t(t.sampleCount)
+		t.sampleCount += int64(t.frameSize)
+		if res := C.avcodec_send_frame(t.codecCtx, t.frame); res < 0 {
+			return aacPackets, fmt.Errorf("avcodec_send_frame() failed")
+		}
+		encoded, err := t.receivePackets(t.lastPacket)
+		aacPackets = append(aacPackets, encoded...)
+		if err != nil {
+			return aacPackets, err
+		}
+	}
+
+	// Sending no frame puts the encoder in draining mode, it returns the frames it was holding on to.
+	if res := C.avcodec_send_frame(t.codecCtx, nil); res < 0 {
+		return aacPackets, fmt.Errorf("avcodec_send_frame() failed")
+	}
+	encoded, err := t.receivePackets(t.lastPacket)
+	aacPackets = append(aacPackets, encoded...)
+	return aacPackets, err
+}
+
+// Close releases the encoder, call Flush first to get the last AAC packets.
+func (t *AudioTranscoder) Close() {
+	if t.packet != nil {
+		C.av_packet_free(&t.packet)
+	}
+	if t.frame != nil {
+		C.av_frame_free(&t.frame)
+	}
+	if t.codecCtx != nil {
+		C.avcodec_free_context(&t.codecCtx)
+	}
+}
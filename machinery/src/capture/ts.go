@@ -0,0 +1,307 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/yapingcat/gomedia/go-mpeg2"
+)
+
+// MPEGTSWriter writes an MPEG transport stream (TS). Packets are written as they arrive, and
+// a TS has no index or trailer, so a file that was cut by a crash or power loss is playable
+// up to the last packet that was written.
+type MPEGTSWriter struct {
+	muxer     *mpeg2.TSMuxer
+	output    *bufio.Writer
+	err       error
+	videoPid  uint16
+	audioPid  uint16
+	hasAudio  bool
+	started   bool
+	startTime time.Duration
+}
+
+// NewMPEGTSWriter creates a writer for an MPEG-TS, the video codec should be either H264 or H265.
+// An (AAC) audio stream is only added when the recording has audio.
+func NewMPEGTSWriter(writer io.Writer, videoCodec string, hasAudio bool) *MPEGTSWriter {
+	w := &MPEGTSWriter{
+		muxer:  mpeg2.NewTSMuxer(),
+		output: bufio.NewWriterSize(writer, 64*1024),
+	}
+	// The muxer writes TS packets of 188 bytes, these are buffered and written once per frame.
+	w.muxer.OnPacket = func(pkg []byte) {
+		if w.err == nil {
+			_, w.err = w.output.Write(pkg)
+		}
+	}
+	if videoCodec == "H265" {
+		w.videoPid = w.muxer.AddStream(mpeg2.TS_STREAM_H265)
+	} else {
+		w.videoPid = w.muxer.AddStream(mpeg2.TS_STREAM_H264)
+	}
+	if hasAudio {
+		w.audioPid = w.muxer.AddStream(mpeg2.TS_STREAM_AAC)
+		w.hasAudio = true
+	}
+	return w
+}
+
+// WritePacket writes a packet to the TS, packets before the first keyframe and audio which is not AAC are skipped.
+func (w *MPEGTSWriter) WritePacket(pkt packets.Packet) error {
+	if !w.started {
+		if !pkt.IsVideo || !pkt.IsKeyFrame {
+			return nil
+		}
+		w.started = true
+		w.startTime = pkt.Time
+	}
+	if pkt.Time < w.startTime {
+		return nil
+	}
+
+	// The timestamps start at zero, so they don't wrap around in long running streams.
+	dts := convertPTS(pkt.Time - w.startTime)
+	if pkt.IsVideo {
+		pts := convertPTS(pkt.Time - w.startTime + pkt.CompositionTime)
+		if err := w.muxer.Write(w.videoPid, pkt.Data, pts, dts); err != nil {
+			return err
+		}
+	} else if pkt.IsAudio && pkt.Codec == "AAC" && w.hasAudio {
+		if err := w.muxer.Write(w.audioPid, pkt.Data, dts, dts); err != nil {
+			return err
+		}
+	} else {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return w.output.Flush()
+}
+
+// Close flushes the buffered TS packets, there is no trailer to write.
+func (w *MPEGTSWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.output.Flush()
+}
+
+// The size of a TS packet.
+const mpegTSPacketSize = 188
+
+// isMPEGTS returns true if the data starts with (two) TS packets.
+func isMPEGTS(data []byte) bool {
+	return len(data) > mpegTSPacketSize && data[0] == 0x47 && data[mpegTSPacketSize] == 0x47
+}
+
+// tsStream is an elementary stream of an MPEG-TS, with the PES packet that is being read.
+type tsStream struct {
+	codec   string // H264, H265 or AAC.
+	data    []byte
+	started bool
+}
+
+// demuxMPEGTS reads the packets of an MPEG-TS recording, a PES packet at a time. Every TS packet
+// is validated before it's used. A TS packet that was cut (by a crash) at the end is ignored.
+func demuxMPEGTS(reader io.Reader, onPacket func(recordingTracks, packets.Packet) error) (recordingTracks, error) {
+	var tracks recordingTracks
+	pmtPIDs := make(map[uint16]bool)
+	streams := make(map[uint16]*tsStream)
+	var streamOrder []*tsStream
+
+	input := bufio.NewReader(reader)
+	packet := make([]byte, mpegTSPacketSize)
+	for {
+		if _, err := io.ReadFull(input, packet); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return tracks, err
+		}
+		if packet[0] != 0x47 {
+			return tracks, errors.New("invalid TS packet")
+		}
+		unitStart := packet[1]&0x40 != 0
+		pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+		adaptationField := (packet[3] >> 4) & 0x03
+		payload := packet[4:]
+		if adaptationField&0x02 != 0 {
+			length := int(payload[0])
+			if 1+length > len(payload) {
+				return tracks, errors.New("invalid adaptation field")
+			}
+			payload = payload[1+length:]
+		}
+		if adaptationField&0x01 == 0 || len(payload) == 0 {
+			continue
+		}
+
+		switch {
+		case pid == 0:
+			// The sections we write fit in a single TS packet.
+			if !unitStart {
+				continue
+			}
+			section, err := readPSISection(payload, 0x00)
+			if err != nil {
+				return tracks, err
+			}
+			for i := 5; i+4 <= len(section)-4; i += 4 {
+				if binary.BigEndian.Uint16(section[i:]) != 0 {
+					pmtPIDs[binary.BigEndian.Uint16(section[i+2:])&0x1FFF] = true
+				}
+			}
+
+		case pmtPIDs[pid]:
+			if !unitStart {
+				continue
+			}
+			section, err := readPSISection(payload, 0x02)
+			if err != nil {
+				return tracks, err
+			}
+			if len(section) < 9+4 {
+				return tracks, errors.New("invalid PMT")
+			}
+			i := 9 + int(binary.BigEndian.Uint16(section[7:])&0x0FFF)
+			for i+5 <= len(section)-4 {
+				streamType := section[i]
+				streamPID := binary.BigEndian.Uint16(section[i+1:]) & 0x1FFF
+				i += 5 + int(binary.BigEndian.Uint16(section[i+3:])&0x0FFF)
+				codec := ""
+				switch streamType {
+				case 0x1B:
+					codec = "H264"
+				case 0x24:
+					codec = "H265"
+				case 0x0F:
+					codec = "AAC"
+				}
+				if _, ok := streams[streamPID]; ok || codec == "" {
+					continue
+				}
+				if codec == "AAC" {
+					tracks.hasAudio = true
+				} else {
+					tracks.videoCodec = codec
+				}
+				streams[streamPID] = &tsStream{codec: codec}
+				streamOrder = append(streamOrder, streams[streamPID])
+			}
+
+		default:
+			stream, ok := streams[pid]
+			if !ok {
+				continue
+			}
+			// A PES packet ends where the next one starts.
+			if unitStart {
+				if err := demuxPES(tracks, stream, onPacket); err != nil {
+					return tracks, err
+				}
+				stream.data = nil
+				stream.started = true
+			}
+			if !stream.started {
+				continue
+			}
+			if len(stream.data)+len(payload) > maxRecordingSampleSize {
+				return tracks, errors.New("the PES packet is too large")
+			}
+			stream.data = append(stream.data, payload...)
+		}
+	}
+	for _, stream := range streamOrder {
+		if err := demuxPES(tracks, stream, onPacket); err != nil {
+			return tracks, err
+		}
+	}
+	return tracks, nil
+}
+
+// readPSISection returns the section (a PAT or PMT) in the payload of a TS packet, without its header.
+func readPSISection(payload []byte, tableID byte) ([]byte, error) {
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil, errors.New("invalid PSI section")
+	}
+	payload = payload[1+pointer:]
+	length := int(binary.BigEndian.Uint16(payload[1:]) & 0x0FFF)
+	if payload[0] != tableID || 3+length > len(payload) {
+		return nil, errors.New("invalid PSI section")
+	}
+	return payload[3 : 3+length], nil
+}
+
+// demuxPES passes on the packet(s) of the PES packet that was read for a stream. The timestamps of
+// a PES packet are in 90kHz.
+func demuxPES(tracks recordingTracks, stream *tsStream, onPacket func(recordingTracks, packets.Packet) error) error {
+	data := stream.data
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return errors.New("invalid PES packet")
+	}
+	flags := data[7]
+	headerLength := int(data[8])
+	if 9+headerLength > len(data) || (flags&0x80 != 0 && headerLength < 5) || (flags&0xC0 == 0xC0 && headerLength < 10) {
+		return errors.New("invalid PES header")
+	}
+	var pts, dts time.Duration
+	if flags&0x80 != 0 {
+		pts = readPESTimestamp(data[9:])
+		dts = pts
+	}
+	if flags&0xC0 == 0xC0 {
+		dts = readPESTimestamp(data[14:])
+	}
+	payload := data[9+headerLength:]
+	if length := int(binary.BigEndian.Uint16(data[4:])); length != 0 && 6+length < len(data) {
+		payload = data[9+headerLength : 6+length]
+	}
+
+	if stream.codec != "AAC" {
+		return onPacket(tracks, packets.Packet{
+			IsVideo:         true,
+			IsKeyFrame:      isKeyFrame(stream.codec, payload),
+			Codec:           stream.codec,
+			Time:            dts,
+			CompositionTime: pts - dts,
+			Data:            payload,
+		})
+	}
+
+	// A PES packet can hold several audio frames, each of them becomes a packet.
+	var adts mpeg4audio.ADTSPackets
+	if err := adts.Unmarshal(payload); err != nil {
+		return err
+	}
+	for i, frame := range adts {
+		data, err := mpeg4audio.ADTSPackets{frame}.Marshal()
+		if err != nil {
+			return err
+		}
+		err = onPacket(tracks, packets.Packet{
+			IsAudio: true,
+			Codec:   "AAC",
+			Time:    pts + time.Duration(i*mpeg4audio.SamplesPerAccessUnit)*time.Second/time.Duration(frame.SampleRate),
+			Data:    data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPESTimestamp reads a (33 bit) PTS or DTS.
+func readPESTimestamp(data []byte) time.Duration {
+	ts := int64(data[0]>>1&0x07)<<30 | int64(data[1])<<22 | int64(data[2]>>1)<<15 | int64(data[3])<<7 | int64(data[4]>>1)
+	return time.Duration(ts) * time.Second / 90000
+}
@@ -0,0 +1,107 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestMPEGTSWriterRoundTrip(t *testing.T) {
+	// 4 GOPs of a second, with audio.
+	written := testRecoveryPackets()
+	var buf bytes.Buffer
+	writer := NewMPEGTSWriter(&buf, "H264", true)
+	for _, pkt := range written {
+		if err := writer.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if len(data) == 0 || len(data)%mpegTSPacketSize != 0 {
+		t.Fatalf("the stream has %d bytes, expected whole TS packets", len(data))
+	}
+
+	pmtPID := -1
+	streamTypes := make(map[uint16]byte)
+	continuity := make(map[uint16]byte)
+	var videoTimes []time.Duration
+	for offset := 0; offset < len(data); offset += mpegTSPacketSize {
+		packet := data[offset : offset+mpegTSPacketSize]
+		if packet[0] != 0x47 {
+			t.Fatalf("the TS packet at %d has no sync byte", offset)
+		}
+		unitStart := packet[1]&0x40 != 0
+		pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+		adaptationField := (packet[3] >> 4) & 0x03
+		if adaptationField&0x01 == 0 {
+			continue
+		}
+
+		// The continuity counter of a PID is incremented for every packet with a payload.
+		counter := packet[3] & 0x0F
+		if previous, ok := continuity[pid]; ok && counter != (previous+1)&0x0F {
+			t.Fatalf("the TS packet at %d of PID %d has the continuity counter %d after %d", offset, pid, counter, previous)
+		}
+		continuity[pid] = counter
+		if !unitStart {
+			continue
+		}
+		payload := packet[4:]
+		if adaptationField&0x02 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+
+		switch {
+		case pid == 0:
+			section, err := readPSISection(payload, 0x00)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(section) != 5+4+4 || binary.BigEndian.Uint16(section[5:]) == 0 {
+				t.Fatalf("the PAT should have a single program, got %x", section)
+			}
+			pmtPID = int(binary.BigEndian.Uint16(section[7:]) & 0x1FFF)
+
+		case int(pid) == pmtPID:
+			section, err := readPSISection(payload, 0x02)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 9 + int(binary.BigEndian.Uint16(section[7:])&0x0FFF); i+5 <= len(section)-4; {
+				streamTypes[binary.BigEndian.Uint16(section[i+1:])&0x1FFF] = section[i]
+				i += 5 + int(binary.BigEndian.Uint16(section[i+3:])&0x0FFF)
+			}
+
+		case streamTypes[pid] == 0x1B:
+			if len(payload) < 14 || !bytes.Equal(payload[:3], []byte{0, 0, 1}) || payload[7]&0x80 == 0 {
+				t.Fatalf("the video PES packet at %d has no PTS", offset)
+			}
+			videoTimes = append(videoTimes, readPESTimestamp(payload[9:]))
+		}
+	}
+
+	if pmtPID < 0 {
+		t.Fatal("the stream has no PAT")
+	}
+	var types []byte
+	for _, streamType := range streamTypes {
+		types = append(types, streamType)
+	}
+	if len(types) != 2 || !bytes.Contains(types, []byte{0x1B}) || !bytes.Contains(types, []byte{0x0F}) {
+		t.Errorf("the PMT has the stream types %x, expected H264 and AAC", types)
+	}
+	if len(videoTimes) != 100 {
+		t.Fatalf("%d video PES packets, expected 100", len(videoTimes))
+	}
+	for i, videoTime := range videoTimes {
+		if expected := time.Duration(i) * 40 * time.Millisecond; videoTime != expected {
+			t.Errorf("video PES packet %d is at %s, expected %s", i, videoTime, expected)
+		}
+	}
+
+	checkRoundTrip(t, written, bytes.NewReader(data))
+}
@@ -0,0 +1,328 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"image"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+// The virtual camera plays a video file (MP4, MPEG-TS or Matroska) as if it was a camera, so the
+// pipeline (motion detection, recording, livestream, ...) can be run without a camera: in CI or for
+// a demo. It's selected with a file:// url, e.g. file:///home/agent/data/test-480p.mp4 or
+// file://data/test-480p.mp4 (relative to the working directory). The file is looped in real time,
+// and only the video track is played.
+
+const virtualCameraScheme = "file://"
+
+// ErrVirtualCameraClosed is returned when the virtual camera is used before it's connected, or after it's closed.
+var ErrVirtualCameraClosed = errors.New("virtual camera is closed")
+
+// VirtualCamera implements the RTSPClient interface.
+type VirtualCamera struct {
+	RTSPClient
+	Url string
+
+	VideoDecoderMutex *sync.Mutex
+	VideoFrameDecoder *Decoder
+
+	Streams []packets.Stream
+
+	packets  []packets.Packet
+	duration time.Duration // The duration of a single loop of the file.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// IsVirtualCamera returns true if the url should be played by the virtual camera.
+func IsVirtualCamera(url string) bool {
+	return strings.HasPrefix(url, virtualCameraScheme)
+}
+
+// Connect reads and demuxes the file, so the streams are known before the camera is started.
+func (v *VirtualCamera) Connect(ctx context.Context) (err error) {
+	path := strings.TrimPrefix(v.Url, virtualCameraScheme)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// We start at the first keyframe, so the consumers can decode every packet. The timestamps
+	// start at zero, like they do for an RTSP stream.
+	var start time.Duration
+	started := false
+	tracks, err := demuxRecording(file, func(tracks recordingTracks, pkt packets.Packet) error {
+		if !pkt.IsVideo || len(pkt.Data) == 0 {
+			return nil
+		}
+		if !started {
+			if !pkt.IsKeyFrame {
+				return nil
+			}
+			started = true
+			start = pkt.Time
+		}
+		pkt.Time -= start
+		pkt.Idx = 0
+		v.packets = append(v.packets, pkt)
+		return nil
+	})
+	if err != nil {
+		return errors.New("capture.virtualcamera.Connect(): could not read " + path + ": " + err.Error())
+	}
+	videoCodec := tracks.videoCodec
+	if len(v.packets) == 0 {
+		return errors.New("capture.virtualcamera.Connect(): no keyframe found in " + path)
+	}
+
+	stream, err := newVideoStream(videoCodec, v.packets[0].Data)
+	if err != nil {
+		return errors.New("capture.virtualcamera.Connect(): " + err.Error())
+	}
+
+	// The duration of the last frame is unknown, we use the average duration of a frame.
+	last := v.packets[len(v.packets)-1].Time
+	frameDuration := time.Second / 25
+	if len(v.packets) > 1 && last > 0 {
+		frameDuration = last / time.Duration(len(v.packets)-1)
+	}
+	v.duration = last + frameDuration
+	if stream.FPS == 0 {
+		stream.FPS = float64(time.Second) / float64(frameDuration)
+	}
+	v.Streams = []packets.Stream{stream}
+
+	// setup the H264 or H265 -> raw frames decoder
+	frameDec, err := newDecoder(videoCodec)
+	if err != nil {
+		log.Log.Error("capture.virtualcamera.Connect(" + videoCodec + "): " + err.Error())
+	}
+	v.VideoFrameDecoder = frameDec
+	v.VideoDecoderMutex = &sync.Mutex{}
+	v.done = make(chan struct{})
+
+	log.Log.Info("capture.virtualcamera.Connect(): playing " + path + " (" + videoCodec + ", " +
+		strconv.Itoa(stream.Width) + "x" + strconv.Itoa(stream.Height) + ", " + v.duration.String() + ")")
+	return nil
+}
+
+// newVideoStream reads the stream from the parameter sets in the first keyframe.
+func newVideoStream(videoCodec string, keyFrame []byte) (packets.Stream, error) {
+	_, parameterSets, err := SplitAccessUnit(videoCodec, keyFrame)
+	if err != nil {
+		return packets.Stream{}, err
+	}
+	if len(parameterSets.SPS) == 0 || len(parameterSets.PPS) == 0 {
+		return packets.Stream{}, errors.New("no parameter sets found in the first keyframe")
+	}
+	stream := packets.Stream{
+		Name:    videoCodec,
+		IsVideo: true,
+		SPS:     parameterSets.SPS,
+		PPS:     parameterSets.PPS,
+		VPS:     parameterSets.VPS,
+	}
+	if videoCodec == "H265" {
+		var sps h265.SPS
+		if err := sps.Unmarshal(parameterSets.SPS); err != nil {
+			return packets.Stream{}, err
+		}
+		stream.Width = sps.Width()
+		stream.Height = sps.Height()
+		stream.FPS = sps.FPS()
+	} else {
+		var sps h264.SPS
+		if err := sps.Unmarshal(parameterSets.SPS); err != nil {
+			return packets.Stream{}, err
+		}
+		stream.Width = sps.Width()
+		stream.Height = sps.Height()
+		stream.FPS = sps.FPS()
+	}
+	return stream, nil
+}
+
+// ConnectBackChannel is not supported, a file has no backchannel.
+func (v *VirtualCamera) ConnectBackChannel(ctx context.Context) (err error) {
+	return errors.New("capture.virtualcamera.ConnectBackChannel(): a virtual camera has no backchannel")
+}
+
+// Start writes the packets to the queue in real time, and loops the file until the camera is closed.
+// The timestamps keep increasing over the loops, as they would for a camera.
+func (v *VirtualCamera) Start(ctx context.Context, streamType string, queue *packets.Queue, configuration *models.Configuration, communication *models.Communication) (err error) {
+	log.Log.Debug("capture.virtualcamera.Start(): started")
+	if v.done == nil {
+		return ErrVirtualCameraClosed
+	}
+	select {
+	case <-v.done:
+		return ErrVirtualCameraClosed
+	default:
+	}
+
+	start := time.Now()
+	var loopOffset time.Duration
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		for _, pkt := range v.packets {
+			pkt.Time += loopOffset
+
+			// Wait until the packet is due.
+			if wait := time.Until(start.Add(pkt.Time)); wait > 0 {
+				timer.Reset(wait)
+				select {
+				case <-timer.C:
+				case <-v.done:
+					log.Log.Debug("capture.virtualcamera.Start(): finished")
+					return nil
+				case <-ctx.Done():
+					log.Log.Debug("capture.virtualcamera.Start(): finished")
+					return nil
+				}
+			}
+
+			queue.WritePacket(pkt)
+
+			if pkt.IsKeyFrame {
+				// Increment packets, so we know the device
+				// is not blocking.
+				if streamType == "main" {
+					r := communication.PackageCounter.Load().(int64)
+					communication.PackageCounter.Store((r + 1) % 1000)
+					communication.LastPacketTimer.Store(time.Now().Unix())
+				} else if streamType == "sub" {
+					r := communication.PackageCounterSub.Load().(int64)
+					communication.PackageCounterSub.Store((r + 1) % 1000)
+					communication.LastPacketTimerSub.Store(time.Now().Unix())
+				}
+			}
+		}
+		loopOffset += v.duration
+	}
+}
+
+// StartBackChannel is not supported, a file has no backchannel.
+func (v *VirtualCamera) StartBackChannel(ctx context.Context) (err error) {
+	return nil
+}
+
+// WritePacket is not supported, a file has no backchannel.
+func (v *VirtualCamera) WritePacket(pkt packets.Packet) error {
+	return nil
+}
+
+// Decode a packet to an image.
+func (v *VirtualCamera) DecodePacket(pkt packets.Packet) (image.YCbCr, error) {
+	var img image.YCbCr
+	var err error
+	if v.VideoDecoderMutex == nil {
+		return image.YCbCr{}, ErrVirtualCameraClosed
+	}
+	v.VideoDecoderMutex.Lock()
+	if len(pkt.Data) == 0 {
+		err = errors.New("capture.virtualcamera.DecodePacket(): empty frame")
+	} else if v.VideoFrameDecoder != nil {
+		img, err = v.VideoFrameDecoder.decode(pkt.Data)
+	} else {
+		err = errors.New("capture.virtualcamera.DecodePacket(): no decoder found, might already be closed")
+	}
+	v.VideoDecoderMutex.Unlock()
+	if err != nil {
+		log.Log.Error("capture.virtualcamera.DecodePacket(): " + err.Error())
+		return image.YCbCr{}, err
+	}
+	if img.Bounds().Empty() {
+		log.Log.Debug("capture.virtualcamera.DecodePacket(): empty frame")
+		return image.YCbCr{}, errors.New("Empty image")
+	}
+	return img, nil
+}
+
+// Decode a packet to a Gray image.
+func (v *VirtualCamera) DecodePacketRaw(pkt packets.Packet) (image.Gray, error) {
+	var img image.Gray
+	var err error
+	if v.VideoDecoderMutex == nil {
+		return image.Gray{}, ErrVirtualCameraClosed
+	}
+	v.VideoDecoderMutex.Lock()
+	if len(pkt.Data) == 0 {
+		err = errors.New("capture.virtualcamera.DecodePacketRaw(): empty frame")
+	} else if v.VideoFrameDecoder != nil {
+		img, err = v.VideoFrameDecoder.decodeRaw(pkt.Data)
+	} else {
+		err = errors.New("capture.virtualcamera.DecodePacketRaw(): no decoder found, might already be closed")
+	}
+	v.VideoDecoderMutex.Unlock()
+	if err != nil {
+		log.Log.Error("capture.virtualcamera.DecodePacketRaw(): " + err.Error())
+		return image.Gray{}, err
+	}
+	if img.Bounds().Empty() {
+		log.Log.Debug("capture.virtualcamera.DecodePacketRaw(): empty image")
+		return image.Gray{}, errors.New("Empty image")
+	}
+
+	// Do a deep copy of the image
+	imgDeepCopy := image.NewGray(img.Bounds())
+	imgDeepCopy.Stride = img.Stride
+	copy(imgDeepCopy.Pix, img.Pix)
+
+	return *imgDeepCopy, err
+}
+
+// Get a list of streams of the file.
+func (v *VirtualCamera) GetStreams() ([]packets.Stream, error) {
+	return v.Streams, nil
+}
+
+// Get a list of video streams of the file.
+func (v *VirtualCamera) GetVideoStreams() ([]packets.Stream, error) {
+	var videoStreams []packets.Stream
+	for _, stream := range v.Streams {
+		if stream.IsVideo {
+			videoStreams = append(videoStreams, stream)
+		}
+	}
+	return videoStreams, nil
+}
+
+// Get a list of audio streams of the file, audio is not played.
+func (v *VirtualCamera) GetAudioStreams() ([]packets.Stream, error) {
+	return nil, nil
+}
+
+// GetTransport returns "file", the stream is read from a file.
+func (v *VirtualCamera) GetTransport() string {
+	return "file"
+}
+
+// Close stops playing the file, and closes the decoder.
+func (v *VirtualCamera) Close() error {
+	v.doneOnce.Do(func() {
+		if v.done != nil {
+			close(v.done)
+		}
+		if v.VideoDecoderMutex != nil {
+			v.VideoDecoderMutex.Lock()
+			if v.VideoFrameDecoder != nil {
+				v.VideoFrameDecoder.Close()
+				v.VideoFrameDecoder = nil
+			}
+			v.VideoDecoderMutex.Unlock()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,374 @@
+package capture
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/kerberos-io/agent/machinery/src/encryption"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+	"github.com/yapingcat/gomedia/go-mp4"
+)
+
+// RecordingWriter writes the packets of a recording into a container.
+type RecordingWriter interface {
+	// WritePacket writes a single audio or video packet.
+	WritePacket(pkt packets.Packet) error
+	// Close finalises the container (e.g. writing the trailer or the last fragment),
+	// it doesn't close the underlying file.
+	Close() error
+}
+
+// The containers we can record in.
+const (
+	ContainerMP4           = "mp4"
+	ContainerFragmentedMP4 = "fmp4"
+	ContainerMPEGTS        = "ts"
+	ContainerMatroska      = "mkv"
+)
+
+// RecordingContainer returns the container of new recordings. Without a (valid) container
+// we fall back to the fragmented setting, which selected the container before.
+func RecordingContainer(configuration *models.Configuration) string {
+	capture := configuration.Config.Capture
+	switch strings.ToLower(capture.Container) {
+	case ContainerFragmentedMP4:
+		return ContainerFragmentedMP4
+	case ContainerMPEGTS:
+		return ContainerMPEGTS
+	case ContainerMatroska:
+		return ContainerMatroska
+	}
+	if capture.Fragmented == "true" {
+		return ContainerFragmentedMP4
+	}
+	return ContainerMP4
+}
+
+// RecordingExtension returns the extension (including the dot) of new recordings.
+func RecordingExtension(configuration *models.Configuration) string {
+	switch RecordingContainer(configuration) {
+	case ContainerMPEGTS:
+		return ".ts"
+	case ContainerMatroska:
+		return ".mkv"
+	}
+	return ".mp4"
+}
+
+// NewRecordingWriter creates the writer for a new recording, depending on the configuration
+// we will write a regular MP4, a fragmented MP4, MPEG-TS or Matroska. The audio stream is optional,
+// when the camera has no audio (nil) no audio track is added. G711 audio is transcoded to AAC.
+// If recordings need to be encrypted, the container is encrypted while it's written.
+func NewRecordingWriter(file *os.File, configuration *models.Configuration, videoCodec string, audioStream *packets.Stream) (RecordingWriter, error) {
+	config := configuration.Config
+
+	var output io.WriteSeeker = file
+	var encryptedOutput *encryption.Writer
+	if EncryptRecordings(configuration) {
+		var err error
+		encryptedOutput, err = encryption.NewWriter(file, config.Encryption.SymmetricKey)
+		if err != nil {
+			return nil, err
+		}
+		output = encryptedOutput
+	}
+
+	var writer RecordingWriter
+	width := config.Capture.IPCamera.Width
+	height := config.Capture.IPCamera.Height
+	switch RecordingContainer(configuration) {
+	case ContainerFragmentedMP4:
+		fragmentDuration := time.Duration(config.Capture.FragmentedDuration) * time.Second
+		if fragmentDuration <= 0 {
+			fragmentDuration = 8 * time.Second
+		}
+		writer = NewFragmentedMP4Writer(output, videoCodec, fragmentDuration)
+	case ContainerMPEGTS:
+		writer = NewMPEGTSWriter(output, videoCodec, audioStream != nil)
+	case ContainerMatroska:
+		writer = NewMatroskaWriter(output, videoCodec, width, height)
+	default:
+		mp4Writer, err := NewMP4Writer(output, videoCodec, width, height, audioStream != nil)
+		if err != nil {
+			return nil, err
+		}
+		// With the sample journal an interrupted recording is recovered with its audio and timestamps.
+		if err := mp4Writer.StartJournal(utils.SamplesPath(file.Name()), videoCodec); err != nil {
+			log.Log.Error("capture.writer.NewRecordingWriter(): unable to create the sample journal, " + err.Error())
+		}
+		writer = mp4Writer
+	}
+
+	if encryptedOutput != nil {
+		writer = &EncryptingWriter{
+			writer: writer,
+			output: encryptedOutput,
+		}
+	}
+
+	if audioStream != nil && (audioStream.Name == "PCM_MULAW" || audioStream.Name == "PCM_ALAW") {
+		transcoder, err := NewAudioTranscoder(audioStream.Name, audioStream.SampleRate, audioStream.Channels)
+		if err != nil {
+			// We still want the video, so we record without audio.
+			log.Log.Error("capture.writer.NewRecordingWriter(): unable to transcode audio, " + err.Error())
+		} else {
+			writer = &TranscodingWriter{
+				writer:     writer,
+				transcoder: transcoder,
+			}
+		}
+	}
+	return writer, nil
+}
+
+// EncryptRecordings returns true if recordings should be encrypted with the symmetric key.
+func EncryptRecordings(configuration *models.Configuration) bool {
+	config := configuration.Config
+	return config.Encryption != nil && config.Encryption.Enabled == "true" && config.Encryption.Recordings == "true" && config.Encryption.SymmetricKey != ""
+}
+
+// GetRecordingAudioStream returns the audio stream we can record, this is either AAC
+// or G711 (which we transcode to AAC). Nil is returned if the camera has no audio.
+func GetRecordingAudioStream(rtspClient RTSPClient) *packets.Stream {
+	audioStreams, _ := rtspClient.GetAudioStreams()
+	var audioStream *packets.Stream
+	for i, stream := range audioStreams {
+		if stream.IsBackChannel {
+			continue
+		}
+		if stream.Name == "AAC" {
+			// AAC doesn't need to be transcoded, so we prefer it.
+			return &audioStreams[i]
+		} else if (stream.Name == "PCM_MULAW" || stream.Name == "PCM_ALAW") && audioStream == nil {
+			audioStream = &audioStreams[i]
+		}
+	}
+	return audioStream
+}
+
+// TranscodingWriter transcodes G711 audio to AAC, before passing it to the underlying writer.
+type TranscodingWriter struct {
+	writer     RecordingWriter
+	transcoder *AudioTranscoder
+}
+
+// WritePacket writes a packet, G711 packets are buffered until a complete AAC frame is encoded.
+func (w *TranscodingWriter) WritePacket(pkt packets.Packet) error {
+	if pkt.IsAudio && (pkt.Codec == "PCM_MULAW" || pkt.Codec == "PCM_ALAW") {
+		aacPackets, err := w.transcoder.Transcode(pkt)
+		for _, aacPacket := range aacPackets {
+			if err := w.writer.WritePacket(aacPacket); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	return w.writer.WritePacket(pkt)
+}
+
+// Close writes the last AAC packets (the encoder is drained), closes the underlying writer and
+// releases the encoder.
+func (w *TranscodingWriter) Close() error {
+	aacPackets, err := w.transcoder.Flush()
+	if err != nil {
+		log.Log.Error("capture.writer.Close(): " + err.Error())
+	}
+	for _, aacPacket := range aacPackets {
+		if err := w.writer.WritePacket(aacPacket); err != nil {
+			log.Log.Error("capture.writer.Close(): " + err.Error())
+			break
+		}
+	}
+	w.transcoder.Close()
+	return w.writer.Close()
+}
+
+// EncryptingWriter writes the container through an encryption.Writer, which encrypts the
+// recording in chunks. Closing it closes the container and writes the final chunk.
+type EncryptingWriter struct {
+	writer RecordingWriter
+	output *encryption.Writer
+}
+
+// WritePacket writes a packet to the container.
+func (w *EncryptingWriter) WritePacket(pkt packets.Packet) error {
+	return w.writer.WritePacket(pkt)
+}
+
+// Close closes the container, and writes the final (encrypted) chunk.
+func (w *EncryptingWriter) Close() error {
+	err := w.writer.Close()
+	if errOutput := w.output.Close(); err == nil {
+		err = errOutput
+	}
+	return err
+}
+
+// MP4Writer writes a regular MP4, the moov box is written when closing the recording.
+type MP4Writer struct {
+	muxer      *mp4.Movmuxer
+	output     *positionWriter
+	videoTrack uint32
+	audioTrack uint32
+	hasAudio   bool
+
+	// The sample journal (optional). The muxer only writes a video sample once the next one
+	// arrives, so we keep the keyframe flag and timestamp of the sample it holds.
+	journal            *sampleJournal
+	journalAudioConfig bool
+	pendingVideo       bool
+	pendingKeyFrame    bool
+	pendingTime        uint64
+}
+
+// positionWriter keeps track of the position in the file the muxer writes to.
+type positionWriter struct {
+	writer   io.WriteSeeker
+	position int64
+}
+
+func (p *positionWriter) Write(data []byte) (int, error) {
+	n, err := p.writer.Write(data)
+	p.position += int64(n)
+	return n, err
+}
+
+func (p *positionWriter) Seek(offset int64, whence int) (int64, error) {
+	position, err := p.writer.Seek(offset, whence)
+	if err == nil {
+		p.position = position
+	}
+	return position, err
+}
+
+// NewMP4Writer creates a writer for a regular MP4, the video codec should be either H264 or H265.
+// An (AAC) audio track is only added when the recording has audio.
+func NewMP4Writer(file io.WriteSeeker, videoCodec string, width int, height int, hasAudio bool) (*MP4Writer, error) {
+	position, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	output := &positionWriter{
+		writer:   file,
+		position: position,
+	}
+	muxer, err := mp4.CreateMp4Muxer(output)
+	if err != nil {
+		return nil, err
+	}
+	w := &MP4Writer{
+		muxer:  muxer,
+		output: output,
+	}
+	widthOption := mp4.WithVideoWidth(uint32(width))
+	heightOption := mp4.WithVideoHeight(uint32(height))
+	if videoCodec == "H264" {
+		w.videoTrack = muxer.AddVideoTrack(mp4.MP4_CODEC_H264, widthOption, heightOption)
+	} else if videoCodec == "H265" {
+		w.videoTrack = muxer.AddVideoTrack(mp4.MP4_CODEC_H265, widthOption, heightOption)
+	}
+	// For an MP4 container, AAC is the only audio codec supported.
+	if hasAudio {
+		w.audioTrack = muxer.AddAudioTrack(mp4.MP4_CODEC_AAC)
+		w.hasAudio = true
+	}
+	return w, nil
+}
+
+// StartJournal records the samples that are written in a sample journal, which is removed when the
+// MP4 is closed. It should be called before the first packet is written.
+func (w *MP4Writer) StartJournal(path string, videoCodec string) error {
+	journal, err := newSampleJournal(path, videoCodec, w.hasAudio)
+	if err != nil {
+		return err
+	}
+	w.journal = journal
+	return nil
+}
+
+// WritePacket writes a packet to the MP4, audio which is not AAC is skipped.
+func (w *MP4Writer) WritePacket(pkt packets.Packet) error {
+	ttime := convertPTS(pkt.Time)
+	if pkt.IsVideo {
+		start := w.output.position
+		if err := w.muxer.Write(w.videoTrack, pkt.Data, ttime, ttime); err != nil {
+			return err
+		}
+		// What the muxer wrote is the previous sample, this one is written with the next.
+		if w.pendingVideo && w.output.position > start {
+			w.writeJournal(journalVideo, w.pendingKeyFrame, start, w.output.position-start, w.pendingTime)
+		}
+		w.pendingVideo = true
+		w.pendingKeyFrame = pkt.IsKeyFrame
+		w.pendingTime = ttime
+		return nil
+	} else if pkt.IsAudio && pkt.Codec == "AAC" && w.hasAudio {
+		if w.journal == nil {
+			return w.muxer.Write(w.audioTrack, pkt.Data, ttime, ttime)
+		}
+		return w.writeAudio(pkt)
+	}
+	return nil
+}
+
+// writeAudio writes the AAC frames of the packet one by one, so the journal knows where every frame
+// starts. The frames get their own timestamps (a frame holds 1024 samples).
+func (w *MP4Writer) writeAudio(pkt packets.Packet) error {
+	var adtsPackets mpeg4audio.ADTSPackets
+	if err := adtsPackets.Unmarshal(pkt.Data); err != nil {
+		return err
+	}
+	for i, adtsPacket := range adtsPackets {
+		frame, err := mpeg4audio.ADTSPackets{adtsPacket}.Marshal()
+		if err != nil {
+			return err
+		}
+		if !w.journalAudioConfig && w.journal != nil {
+			if err := w.journal.writeAudioConfig(adtsPacket.Type, adtsPacket.SampleRate, adtsPacket.ChannelCount); err != nil {
+				w.stopJournal(err)
+			}
+			w.journalAudioConfig = true
+		}
+		ttime := convertPTS(pkt.Time + time.Duration(i*mpeg4audio.SamplesPerAccessUnit)*time.Second/time.Duration(adtsPacket.SampleRate))
+		start := w.output.position
+		if err := w.muxer.Write(w.audioTrack, frame, ttime, ttime); err != nil {
+			return err
+		}
+		if w.output.position > start {
+			w.writeJournal(journalAudio, false, start, w.output.position-start, ttime)
+		}
+	}
+	return nil
+}
+
+// writeJournal records a sample, if the journal can't be written we continue without it.
+func (w *MP4Writer) writeJournal(kind byte, keyFrame bool, offset int64, size int64, ttime uint64) {
+	if w.journal == nil {
+		return
+	}
+	if err := w.journal.writeSample(kind, keyFrame, offset, size, ttime); err != nil {
+		w.stopJournal(err)
+	}
+}
+
+func (w *MP4Writer) stopJournal(err error) {
+	log.Log.Error("capture.writer.MP4Writer(): unable to write the sample journal, " + err.Error())
+	w.journal.remove()
+	w.journal = nil
+}
+
+// Close writes the trailer (moov box) of the MP4, and removes the sample journal.
+func (w *MP4Writer) Close() error {
+	err := w.muxer.WriteTrailer()
+	if w.journal != nil {
+		w.journal.remove()
+		w.journal = nil
+	}
+	return err
+}
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/kerberos-io/agent/machinery/src/capture"
+	"github.com/kerberos-io/agent/machinery/src/database"
 	"github.com/kerberos-io/agent/machinery/src/encryption"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
@@ -78,6 +79,7 @@ func HandleUpload(configDirectory string, configuration *models.Configuration, c
 					}
 
 					fileName := f.Name()
+					mediaDirectory := utils.GetMediaDirectory(configDirectory, fileName)
 					uploaded := false
 					configured := false
 					err = nil
@@ -116,20 +118,23 @@ func HandleUpload(configDirectory string, configuration *models.Configuration, c
 						if err != nil {
 							log.Log.Error("HandleUpload: " + err.Error())
 						}
+						database.SetPendingUpload(fileName, false)
 
 						// Check if we need to remove the original recording
 						// removeAfterUpload is set to false by default
 						if config.RemoveAfterUpload != "false" {
-							err := os.Remove(configDirectory + "/data/recordings/" + fileName)
+							err := utils.RemoveRecording(configDirectory + "/" + mediaDirectory + "/" + fileName)
 							if err != nil {
 								log.Log.Error("HandleUpload: " + err.Error())
 							}
+							database.RemoveFromIndex(fileName)
 						}
 					} else if !configured {
 						err := os.Remove(watchDirectory + fileName)
 						if err != nil {
 							log.Log.Error("HandleUpload: " + err.Error())
 						}
+						database.SetPendingUpload(fileName, false)
 					} else {
 						delay = 20 * time.Second // slow down
 						if err != nil {
@@ -397,6 +402,12 @@ loop:
 				hasBackChannel = "true"
 			}
 
+			// The state of the disk watchdog, recording might be degraded.
+			diskState, _ := json.Marshal(capture.GetDiskStatus())
+
+			// The statistics of the main and sub stream (fps, bitrate, GOP, lost packets, ...).
+			streamStats, _ := json.Marshal(capture.GetStreamStats(communication))
+
 			hub_encryption := "false"
 			if config.HubEncryption == "true" {
 				hub_encryption = "true"
@@ -455,13 +466,15 @@ loop:
 						"onvif_events_list": %s,
 						"cameraConnected": "%s",
 						"hasBackChannel": "%s",
+						"disk_state": %s,
+						"stream_stats": %s,
 						"numberoffiles" : "33",
 						"timestamp" : 1564747908,
 						"cameratype" : "IPCamera",
 						"docker" : true,
 						"kios" : false,
 						"raspberrypi" : false
-					}`, config.Key, kerberosAgentVersion, hub_encryption, e2e_encryption, system.Version, system.CPUId, username, key, name, isEnterprise, system.Hostname, system.Architecture, system.TotalMemory, system.UsedMemory, system.FreeMemory, system.ProcessUsedMemory, macs, ips, "0", "0", "0", uptimeString, boottimeString, config.HubSite, onvifEnabled, onvifZoom, onvifPanTilt, onvifPresets, onvifPresetsList, onvifEventsList, cameraConnected, hasBackChannel)
+					}`, config.Key, kerberosAgentVersion, hub_encryption, e2e_encryption, system.Version, system.CPUId, username, key, name, isEnterprise, system.Hostname, system.Architecture, system.TotalMemory, system.UsedMemory, system.FreeMemory, system.ProcessUsedMemory, macs, ips, "0", "0", "0", uptimeString, boottimeString, config.HubSite, onvifEnabled, onvifZoom, onvifPanTilt, onvifPresets, onvifPresetsList, onvifEventsList, cameraConnected, hasBackChannel, diskState, streamStats)
 
 				// Get the private key to encrypt the data using symmetric encryption: AES.
 				privateKey := config.HubPrivateKey
@@ -5,6 +5,7 @@ package cloud
 import (
 	"bytes"
 	"errors"
+	"io"
 	"os"
 
 	"github.com/dropbox/dropbox-sdk-go-unofficial/v6/dropbox"
@@ -13,6 +14,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
 )
 
 // UploadDropbox uploads the file to your Dropbox account using the access token and directory.
@@ -37,7 +39,7 @@ func UploadDropbox(configuration *models.Configuration, fileName string) (bool,
 	// Upload to Dropbox
 	log.Log.Info("UploadDropbox: Uploading to Dropbox")
 	log.Log.Info("UploadDropbox: Upload started for " + fileName)
-	fullname := "data/recordings/" + fileName
+	fullname := utils.GetMediaDirectory(".", fileName) + "/" + fileName
 
 	dConfig := dropbox.Config{
 		Token:    token,
@@ -49,6 +51,14 @@ func UploadDropbox(configuration *models.Configuration, fileName string) (bool,
 		defer file.Close()
 	}
 
+	var body io.ReadCloser
+	if err == nil {
+		body, _, err = uploadBody(file, configuration)
+	}
+	if err == nil {
+		defer body.Close()
+	}
+
 	if err == nil {
 		// Upload the file
 		dbf := files.New(dConfig)
@@ -61,7 +71,7 @@ func UploadDropbox(configuration *models.Configuration, fileName string) (bool,
 					},
 				},
 			},
-		}, file)
+		}, body)
 
 		if err != nil {
 			log.Log.Error("UploadDropbox: Error uploading file: " + err.Error())
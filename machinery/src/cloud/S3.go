@@ -11,6 +11,7 @@ import (
 
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
 	"github.com/minio/minio-go/v6"
 )
 
@@ -86,7 +87,35 @@ func UploadS3(configuration *models.Configuration, fileName string) (bool, bool,
 	token, _ := strconv.Atoi(fileParts[5])
 
 	log.Log.Info("UploadS3: Upload started for " + fileName)
-	fullname := "data/recordings/" + fileName
+	fullname := utils.GetMediaDirectory(".", fileName) + "/" + fileName
+
+	userMetadata := map[string]string{
+		"event-timestamp":         strconv.FormatInt(startRecording, 10),
+		"event-microseconds":      deviceKey,
+		"event-instancename":      devicename,
+		"event-regioncoordinates": coordinates,
+		"event-numberofchanges":   deviceKey,
+		"event-token":             strconv.Itoa(token),
+		"productid":               deviceKey,
+		"publickey":               aws_access_key_id,
+		"uploadtime":              "now",
+	}
+
+	// Recordings have a metadata sidecar, which is more accurate than the filename.
+	metadata, err := utils.ReadRecordingMetadata(fullname)
+	if err == nil {
+		userMetadata["event-timestamp"] = strconv.FormatInt(metadata.StartTime/1000, 10)
+		userMetadata["event-instancename"] = metadata.CameraName
+		userMetadata["event-numberofchanges"] = strconv.Itoa(metadata.PeakChanges)
+		userMetadata["event-starttime"] = strconv.FormatInt(metadata.StartTime, 10)
+		userMetadata["event-endtime"] = strconv.FormatInt(metadata.EndTime, 10)
+		userMetadata["event-duration"] = strconv.FormatInt(metadata.Duration, 10)
+		userMetadata["event-codec"] = metadata.VideoCodec
+		userMetadata["event-resolution"] = strconv.Itoa(metadata.Width) + "x" + strconv.Itoa(metadata.Height)
+		userMetadata["event-trigger"] = metadata.Trigger
+		userMetadata["event-totalchanges"] = strconv.Itoa(metadata.TotalChanges)
+		userMetadata["event-regions"] = strings.Join(metadata.Regions, ",")
+	}
 
 	file, err := os.OpenFile(fullname, os.O_RDWR, 0755)
 	if file != nil {
@@ -99,31 +128,22 @@ func UploadS3(configuration *models.Configuration, fileName string) (bool, bool,
 		return false, true, errors.New(errorMessage)
 	}
 
-	fileInfo, err := file.Stat()
+	body, size, err := uploadBody(file, configuration)
 	if err != nil {
 		errorMessage := "UploadS3: " + err.Error()
 		log.Log.Error(errorMessage)
 		return false, true, errors.New(errorMessage)
 	}
+	defer body.Close()
 
 	n, err := s3Client.PutObject(config.S3.Bucket,
 		config.S3.Username+"/"+fileName,
-		file,
-		fileInfo.Size(),
+		body,
+		size,
 		minio.PutObjectOptions{
-			ContentType:  "video/mp4",
+			ContentType:  utils.RecordingContentType(fileName),
 			StorageClass: "ONEZONE_IA",
-			UserMetadata: map[string]string{
-				"event-timestamp":         strconv.FormatInt(startRecording, 10),
-				"event-microseconds":      deviceKey,
-				"event-instancename":      devicename,
-				"event-regioncoordinates": coordinates,
-				"event-numberofchanges":   deviceKey,
-				"event-token":             strconv.Itoa(token),
-				"productid":               deviceKey,
-				"publickey":               aws_access_key_id,
-				"uploadtime":              "now",
-			},
+			UserMetadata: userMetadata,
 		})
 
 	if err != nil {
@@ -0,0 +1,52 @@
+package cloud
+
+import (
+	"io"
+	"os"
+
+	"github.com/kerberos-io/agent/machinery/src/encryption"
+	"github.com/kerberos-io/agent/machinery/src/models"
+)
+
+// uploadBody returns the body (and its size) of the upload of a recording. Recordings are encrypted
+// in chunks on disk, but are uploaded in the legacy format (AES-256-CBC) by default, as that's the
+// only format Kerberos Hub, Kerberos Vault and the S3 consumers can read: a chunked recording is
+// decrypted and encrypted again while it's uploaded, a chunk at a time. With the chunked upload
+// format, recordings are uploaded as they are stored. The body must be closed, which stops the
+// encryption if the upload is aborted.
+func uploadBody(file *os.File, configuration *models.Configuration) (io.ReadCloser, int64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	config := configuration.Config
+	if config.Encryption == nil || config.Encryption.UploadFormat == models.EncryptionFormatChunked {
+		return io.NopCloser(file), fileInfo.Size(), nil
+	}
+
+	header := make([]byte, encryption.ChunkedHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	if !encryption.IsChunked(header[:n]) {
+		return io.NopCloser(file), fileInfo.Size(), nil
+	}
+	reader, err := encryption.NewReader(file, config.Encryption.SymmetricKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		writer, err := encryption.NewLegacyWriter(pipeWriter, config.Encryption.SymmetricKey)
+		if err == nil {
+			_, err = io.Copy(writer, reader)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+	return pipeReader, encryption.LegacySize(reader.Size()), nil
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
 )
 
 func UploadKerberosHub(configuration *models.Configuration, fileName string) (bool, bool, error) {
@@ -34,7 +35,7 @@ func UploadKerberosHub(configuration *models.Configuration, fileName string) (bo
 
 	log.Log.Info("UploadKerberosHub: Uploading to Kerberos Hub (" + config.HubURI + ")")
 	log.Log.Info("UploadKerberosHub: Upload started for " + fileName)
-	fullname := "data/recordings/" + fileName
+	fullname := utils.GetMediaDirectory(".", fileName) + "/" + fileName
 
 	// Check if we still have the file otherwise we abort the request.
 	file, err := os.OpenFile(fullname, os.O_RDWR, 0755)
@@ -92,19 +93,28 @@ func UploadKerberosHub(configuration *models.Configuration, fileName string) (bo
 	}
 
 	// Now we know we are allowed to upload to the hub, we can start uploading.
-	req, err = http.NewRequest("POST", config.HubURI+"/storage/upload", file)
+	body, size, err := uploadBody(file, configuration)
+	if err != nil {
+		errorMessage := "UploadKerberosHub: Upload Failed, " + err.Error()
+		log.Log.Error(errorMessage)
+		return false, true, errors.New(errorMessage)
+	}
+	defer body.Close()
+	req, err = http.NewRequest("POST", config.HubURI+"/storage/upload", body)
 	if err != nil {
 		errorMessage := "UploadKerberosHub: error reading POST request, " + config.KStorage.URI + "/storage/upload: " + err.Error()
 		log.Log.Error(errorMessage)
 		return false, true, errors.New(errorMessage)
 	}
-	req.Header.Set("Content-Type", "video/mp4")
+	req.ContentLength = size
+	req.Header.Set("Content-Type", utils.RecordingContentType(fileName))
 	req.Header.Set("X-Kerberos-Storage-FileName", fileName)
 	req.Header.Set("X-Kerberos-Storage-Capture", "IPCamera")
 	req.Header.Set("X-Kerberos-Storage-Device", config.Key)
 	req.Header.Set("X-Kerberos-Hub-PublicKey", config.HubKey)
 	req.Header.Set("X-Kerberos-Hub-PrivateKey", config.HubPrivateKey)
 	req.Header.Set("X-Kerberos-Hub-Region", config.S3.Region)
+	setMetadataHeaders(req, fullname)
 	resp, err = client.Do(req)
 	if resp != nil {
 		defer resp.Body.Close()
@@ -9,6 +9,7 @@ import (
 
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
 )
 
 func UploadKerberosVault(configuration *models.Configuration, fileName string) (bool, bool, error) {
@@ -35,7 +36,7 @@ func UploadKerberosVault(configuration *models.Configuration, fileName string) (
 	// KerberosCloud, this means storage is disabled and proxy enabled.
 	log.Log.Info("UploadKerberosVault: Uploading to Kerberos Vault (" + config.KStorage.URI + ")")
 	log.Log.Info("UploadKerberosVault: Upload started for " + fileName)
-	fullname := "data/recordings/" + fileName
+	fullname := utils.GetMediaDirectory(".", fileName) + "/" + fileName
 
 	file, err := os.OpenFile(fullname, os.O_RDWR, 0755)
 	if file != nil {
@@ -53,13 +54,21 @@ func UploadKerberosVault(configuration *models.Configuration, fileName string) (
 		publicKey = config.HubKey
 	}
 
-	req, err := http.NewRequest("POST", config.KStorage.URI+"/storage", file)
+	body, size, err := uploadBody(file, configuration)
+	if err != nil {
+		errorMessage := "UploadKerberosVault: Upload Failed, " + err.Error()
+		log.Log.Error(errorMessage)
+		return false, true, errors.New(errorMessage)
+	}
+	defer body.Close()
+	req, err := http.NewRequest("POST", config.KStorage.URI+"/storage", body)
 	if err != nil {
 		errorMessage := "UploadKerberosVault: error reading request, " + config.KStorage.URI + "/storage: " + err.Error()
 		log.Log.Error(errorMessage)
 		return false, true, errors.New(errorMessage)
 	}
-	req.Header.Set("Content-Type", "video/mp4")
+	req.ContentLength = size
+	req.Header.Set("Content-Type", utils.RecordingContentType(fileName))
 	req.Header.Set("X-Kerberos-Storage-CloudKey", publicKey)
 	req.Header.Set("X-Kerberos-Storage-AccessKey", config.KStorage.AccessKey)
 	req.Header.Set("X-Kerberos-Storage-SecretAccessKey", config.KStorage.SecretAccessKey)
@@ -68,6 +77,7 @@ func UploadKerberosVault(configuration *models.Configuration, fileName string) (
 	req.Header.Set("X-Kerberos-Storage-Device", config.Key)
 	req.Header.Set("X-Kerberos-Storage-Capture", "IPCamera")
 	req.Header.Set("X-Kerberos-Storage-Directory", config.KStorage.Directory)
+	setMetadataHeaders(req, fullname)
 
 	var client *http.Client
 	if os.Getenv("AGENT_TLS_INSECURE") == "true" {
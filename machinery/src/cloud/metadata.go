@@ -0,0 +1,33 @@
+package cloud
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kerberos-io/agent/machinery/src/utils"
+)
+
+// setMetadataHeaders adds the metadata of a recording (read from its JSON sidecar)
+// as headers to the upload request. Older recordings don't have a sidecar,
+// for those the receiving end will still parse the filename.
+func setMetadataHeaders(req *http.Request, fullname string) {
+	metadata, err := utils.ReadRecordingMetadata(fullname)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Kerberos-Storage-StartTime", strconv.FormatInt(metadata.StartTime, 10))
+	req.Header.Set("X-Kerberos-Storage-EndTime", strconv.FormatInt(metadata.EndTime, 10))
+	req.Header.Set("X-Kerberos-Storage-Duration", strconv.FormatInt(metadata.Duration, 10))
+	req.Header.Set("X-Kerberos-Storage-Codec", metadata.VideoCodec)
+	req.Header.Set("X-Kerberos-Storage-Resolution", strconv.Itoa(metadata.Width)+"x"+strconv.Itoa(metadata.Height))
+	req.Header.Set("X-Kerberos-Storage-Trigger", metadata.Trigger)
+	req.Header.Set("X-Kerberos-Storage-PeakChanges", strconv.Itoa(metadata.PeakChanges))
+	req.Header.Set("X-Kerberos-Storage-TotalChanges", strconv.Itoa(metadata.TotalChanges))
+	req.Header.Set("X-Kerberos-Storage-Regions", strings.Join(metadata.Regions, ","))
+
+	// In multi-camera mode the uploader is shared, the recording belongs to the camera that made it.
+	if metadata.CameraKey != "" {
+		req.Header.Set("X-Kerberos-Storage-Device", metadata.CameraKey)
+	}
+}
@@ -2,6 +2,7 @@ package components
 
 import (
 	"context"
+	"errors"
 	"os"
 	"strconv"
 	"sync/atomic"
@@ -14,6 +15,8 @@ import (
 	"github.com/kerberos-io/agent/machinery/src/cloud"
 	"github.com/kerberos-io/agent/machinery/src/computervision"
 	configService "github.com/kerberos-io/agent/machinery/src/config"
+	"github.com/kerberos-io/agent/machinery/src/database"
+	"github.com/kerberos-io/agent/machinery/src/hls"
 	"github.com/kerberos-io/agent/machinery/src/log"
 	"github.com/kerberos-io/agent/machinery/src/models"
 	"github.com/kerberos-io/agent/machinery/src/onvif"
@@ -29,55 +32,39 @@ func Bootstrap(configDirectory string, configuration *models.Configuration, comm
 	// We will keep track of the Kerberos Agent up time
 	// This is send to Kerberos Hub in a heartbeat.
 	uptimeStart := time.Now()
-
-	// Initiate the packet counter, this is being used to detect
-	// if a camera is going blocky, or got disconnected.
-	var packageCounter atomic.Value
-	packageCounter.Store(int64(0))
-	communication.PackageCounter = &packageCounter
-
-	var packageCounterSub atomic.Value
-	packageCounterSub.Store(int64(0))
-	communication.PackageCounterSub = &packageCounterSub
-
-	// This is used when the last packet was received (timestamp),
-	// this metric is used to determine if the camera is still online/connected.
-	var lastPacketTimer atomic.Value
-	packageCounter.Store(int64(0))
-	communication.LastPacketTimer = &lastPacketTimer
-
-	var lastPacketTimerSub atomic.Value
-	packageCounterSub.Store(int64(0))
-	communication.LastPacketTimerSub = &lastPacketTimerSub
-
-	// This is used to understand if we have a working Kerberos Hub connection
-	// cloudTimestamp will be updated when successfully sending heartbeats.
-	var cloudTimestamp atomic.Value
-	cloudTimestamp.Store(int64(0))
-	communication.CloudTimestamp = &cloudTimestamp
-
-	communication.HandleStream = make(chan string, 1)
-	communication.HandleSubStream = make(chan string, 1)
-	communication.HandleUpload = make(chan string, 1)
-	communication.HandleHeartBeat = make(chan string, 1)
-	communication.HandleLiveSD = make(chan int64, 1)
-	communication.HandleLiveHDKeepalive = make(chan string, 1)
-	communication.HandleLiveHDPeers = make(chan string, 1)
-	communication.IsConfiguring = abool.New()
+	initCommunication(communication)
 
 	cameraSettings := &models.Camera{}
 
-	// Before starting the agent, we have a control goroutine, that might
-	// do several checks to see if the agent is still operational.
-	go ControlAgent(communication)
-
 	// Handle heartbeats
 	go cloud.HandleHeartBeat(configuration, communication, uptimeStart)
 
+	// Apply the retention rules on the recordings directory, on a schedule.
+	go capture.HandleRetention(configDirectory, configuration)
+
+	// Watch the free disk space, and degrade recording when the disk is (almost) full.
+	communication.HandleDiskState = make(chan models.DiskStatus, 10)
+	go capture.HandleDiskWatchdog(configDirectory, configuration, communication)
+
+	// The changes of the state of the main and sub stream (connected, reconnecting, ...).
+	communication.HandleStreamState = make(chan models.StreamStatus, 10)
+
 	// We'll create a MQTT handler, which will be used to communicate with Kerberos Hub.
 	// Configure a MQTT client which helps for a bi-directional communication
 	mqttClient := routers.ConfigureMQTT(configDirectory, configuration, communication)
 
+	// Publish the changes of the disk state over MQTT, the client is replaced when the MQTT settings change.
+	go func() {
+		for status := range communication.HandleDiskState {
+			routers.SendDiskState(mqttClient, configuration, status)
+		}
+	}()
+	go func() {
+		for status := range communication.HandleStreamState {
+			routers.SendStreamState(mqttClient, configuration, status)
+		}
+	}()
+
 	// Run the agent and fire up all the other
 	// goroutines which do image capture, motion detection, onvif, etc.
 	for {
@@ -112,6 +99,44 @@ func Bootstrap(configDirectory string, configuration *models.Configuration, comm
 	}
 }
 
+// initCommunication creates the counters and channels that live as long as the agent (or camera).
+func initCommunication(communication *models.Communication) {
+	// Initiate the packet counter, this is being used to detect
+	// if a camera is going blocky, or got disconnected.
+	var packageCounter atomic.Value
+	packageCounter.Store(int64(0))
+	communication.PackageCounter = &packageCounter
+
+	var packageCounterSub atomic.Value
+	packageCounterSub.Store(int64(0))
+	communication.PackageCounterSub = &packageCounterSub
+
+	// This is used when the last packet was received (timestamp),
+	// this metric is used to determine if the camera is still online/connected.
+	var lastPacketTimer atomic.Value
+	packageCounter.Store(int64(0))
+	communication.LastPacketTimer = &lastPacketTimer
+
+	var lastPacketTimerSub atomic.Value
+	packageCounterSub.Store(int64(0))
+	communication.LastPacketTimerSub = &lastPacketTimerSub
+
+	// This is used to understand if we have a working Kerberos Hub connection
+	// cloudTimestamp will be updated when successfully sending heartbeats.
+	var cloudTimestamp atomic.Value
+	cloudTimestamp.Store(int64(0))
+	communication.CloudTimestamp = &cloudTimestamp
+
+	communication.HandleStream = make(chan string, 1)
+	communication.HandleSubStream = make(chan string, 1)
+	communication.HandleUpload = make(chan string, 1)
+	communication.HandleHeartBeat = make(chan string, 1)
+	communication.HandleLiveSD = make(chan int64, 1)
+	communication.HandleLiveHDKeepalive = make(chan string, 1)
+	communication.HandleLiveHDPeers = make(chan string, 1)
+	communication.IsConfiguring = abool.New()
+}
+
 func RunAgent(configDirectory string, configuration *models.Configuration, communication *models.Communication, mqttClient mqtt.Client, uptimeStart time.Time, cameraSettings *models.Camera, captureDevice *capture.Capture) string {
 
 	log.Log.Info("components.Kerberos.RunAgent(): Creating camera and processing threads.")
@@ -122,7 +147,7 @@ func RunAgent(configDirectory string, configuration *models.Configuration, commu
 	// Currently only support H264 encoded cameras, this will change.
 	// Establishing the camera connection without backchannel if no substream
 	rtspUrl := config.Capture.IPCamera.RTSP
-	rtspClient := captureDevice.SetMainClient(rtspUrl)
+	rtspClient := captureDevice.SetMainClient(rtspUrl, capture.GetStreamOptions(config, "main"))
 	if rtspUrl != "" {
 		err := rtspClient.Connect(context.Background())
 		if err != nil {
@@ -139,7 +164,7 @@ func RunAgent(configDirectory string, configuration *models.Configuration, commu
 		return status
 	}
 
-	log.Log.Info("components.Kerberos.RunAgent(): opened RTSP stream: " + rtspUrl)
+	log.Log.Info("components.Kerberos.RunAgent(): opened RTSP stream: " + rtspUrl + " (" + rtspClient.GetTransport() + ")")
 
 	// Get the video streams from the RTSP server.
 	videoStreams, err := rtspClient.GetVideoStreams()
@@ -174,40 +199,43 @@ func RunAgent(configDirectory string, configuration *models.Configuration, commu
 	// We might have a secondary rtsp url, so we might need to use that for livestreaming let us check first!
 	subStreamEnabled := false
 	subRtspUrl := config.Capture.IPCamera.SubRTSP
+	var rtspSubClient capture.RTSPClient
 	var videoSubStreams []packets.Stream
 
 	if subRtspUrl != "" && subRtspUrl != rtspUrl {
 		// For the sub stream we will not enable backchannel.
 		subStreamEnabled = true
-		rtspSubClient := captureDevice.SetSubClient(subRtspUrl)
-		captureDevice.RTSPSubClient = rtspSubClient
+		rtspSubClient = captureDevice.SetSubClient(subRtspUrl, capture.GetStreamOptions(config, "sub"))
 
 		err := rtspSubClient.Connect(context.Background())
-		if err != nil {
-			log.Log.Error("components.Kerberos.RunAgent(): error connecting to RTSP sub stream: " + err.Error())
-			time.Sleep(time.Second * 3)
-			return status
-		}
-		log.Log.Info("components.Kerberos.RunAgent(): opened RTSP sub stream: " + subRtspUrl)
+		if err == nil {
+			log.Log.Info("components.Kerberos.RunAgent(): opened RTSP sub stream: " + subRtspUrl + " (" + rtspSubClient.GetTransport() + ")")
 
-		// Get the video streams from the RTSP server.
-		videoSubStreams, err = rtspSubClient.GetVideoStreams()
-		if err != nil || len(videoSubStreams) == 0 {
-			log.Log.Error("components.Kerberos.RunAgent(): no video sub stream found, might be the wrong codec (we only support H264 for the moment)")
-			rtspSubClient.Close()
-			time.Sleep(time.Second * 3)
-			return status
+			// Get the video streams from the RTSP server.
+			videoSubStreams, err = rtspSubClient.GetVideoStreams()
+			if err == nil && len(videoSubStreams) == 0 {
+				err = errors.New("no video sub stream found, might be the wrong codec (we only support H264 for the moment)")
+			}
 		}
 
-		// Get the video stream from the RTSP server.
-		videoSubStream := videoSubStreams[0]
+		if err != nil {
+			// We continue without the sub stream, the consumers of the sub stream (motion, livestreams, ...)
+			// read the main stream until the sub stream is connected, nothing is restarted.
+			log.Log.Warning("components.Kerberos.RunAgent(): continuing with the main stream until the sub stream is available, error connecting to RTSP sub stream: " + err.Error())
+			rtspSubClient.Close()
+			rtspSubClient = nil
+			videoSubStreams = nil
+		} else {
+			// Get the video stream from the RTSP server.
+			videoSubStream := videoSubStreams[0]
 
-		width := videoSubStream.Width
-		height := videoSubStream.Height
+			width := videoSubStream.Width
+			height := videoSubStream.Height
 
-		// Set config values as well
-		configuration.Config.Capture.IPCamera.SubWidth = width
-		configuration.Config.Capture.IPCamera.SubHeight = height
+			// Set config values as well
+			configuration.Config.Capture.IPCamera.SubWidth = width
+			configuration.Config.Capture.IPCamera.SubHeight = height
+		}
 	}
 
 	// We are creating a queue to store the RTSP frames in, these frames will be
@@ -215,76 +243,131 @@ func RunAgent(configDirectory string, configuration *models.Configuration, commu
 	queue = packets.NewQueue()
 	communication.Queue = queue
 
-	// Set the maximum GOP count, this is used to determine the pre-recording time.
-	log.Log.Info("components.Kerberos.RunAgent(): SetMaxGopCount was set with: " + strconv.Itoa(int(config.Capture.PreRecording)+1))
-	queue.SetMaxGopCount(int(config.Capture.PreRecording) + 1) // GOP time frame is set to prerecording (we'll add 2 gops to leave some room).
+	// The queue holds (at least) the pre-recording time, and is bounded in size as well.
+	preRecording := time.Duration(config.Capture.PreRecording) * time.Second
+	log.Log.Info("components.Kerberos.RunAgent(): SetMaxDuration was set with: " + preRecording.String())
+	queue.SetMaxDuration(preRecording)
+	queue.SetMaxSize(preRecordingMaxSize(config))
 	queue.WriteHeader(videoStreams)
+
+	// The main stream is reconnected on its own when it fails, the consumers keep reading the queue.
+	rtspClient = capture.NewReconnectingClient(rtspClient, rtspUrl, capture.GetStreamOptions(config, "main"), "main")
+	captureDevice.RTSPClient = rtspClient
 	go rtspClient.Start(context.Background(), "main", queue, configuration, communication)
 
 	// Main stream is connected and ready to go.
 	communication.MainStreamConnected = true
 
-	// Try to create backchannel
-	rtspBackChannelClient := captureDevice.SetBackChannelClient(rtspUrl)
-	err = rtspBackChannelClient.ConnectBackChannel(context.Background())
-	if err == nil {
-		log.Log.Info("components.Kerberos.RunAgent(): opened RTSP backchannel stream: " + rtspUrl)
-		go rtspBackChannelClient.StartBackChannel(context.Background())
+	// Try to create backchannel, only RTSP cameras have a backchannel.
+	var rtspBackChannelClient *capture.Golibrtsp
+	if capture.SupportsBackChannel(rtspUrl) {
+		rtspBackChannelClient = captureDevice.SetBackChannelClient(rtspUrl, capture.GetStreamOptions(config, "main"))
+		err = rtspBackChannelClient.ConnectBackChannel(context.Background())
+		if err == nil {
+			log.Log.Info("components.Kerberos.RunAgent(): opened RTSP backchannel stream: " + rtspUrl)
+			go rtspBackChannelClient.StartBackChannel(context.Background())
+		}
 	}
 
-	rtspSubClient := captureDevice.RTSPSubClient
-	if subStreamEnabled && rtspSubClient != nil {
+	subStreamConnected := subStreamEnabled && rtspSubClient != nil
+	if subStreamEnabled {
 		subQueue = packets.NewQueue()
 		communication.SubQueue = subQueue
-		subQueue.SetMaxGopCount(1) // GOP time frame is set to prerecording (we'll add 2 gops to leave some room).
-		subQueue.WriteHeader(videoSubStreams)
-		go rtspSubClient.Start(context.Background(), "sub", subQueue, configuration, communication)
+		subQueue.SetMaxDuration(0) // Only the GOP that is being received.
+		if config.Capture.SubRecording == "true" || capture.SubOnlyEnabled(config) {
+			// The sub stream is recorded as well (or instead of the main stream, when the disk is
+			// almost full), so it needs the same pre-recording as the main stream.
+			subQueue.SetMaxDuration(preRecording)
+		}
+		subQueue.SetMaxSize(preRecordingMaxSize(config))
+		if subStreamConnected {
+			subQueue.WriteHeader(videoSubStreams)
+		}
 
-		// Sub stream is connected and ready to go.
-		communication.SubStreamConnected = true
+		// The sub stream is (re)connected on its own as well, also when it wasn't available at boot. When it
+		// fails the consumers of the main stream (recording, snapshots, ...) keep running, nothing is restarted.
+		rtspSubClient = capture.NewReconnectingClient(rtspSubClient, subRtspUrl, capture.GetStreamOptions(config, "sub"), "sub")
+		captureDevice.RTSPSubClient = rtspSubClient
+		communication.SubStreamConnected = subStreamConnected
+		go rtspSubClient.Start(context.Background(), "sub", subQueue, configuration, communication)
 	}
 
-	// Handle livestream SD (low resolution over MQTT)
+	// Handle livestream SD (low resolution over MQTT), it reads the main stream while the sub stream isn't available.
 	if subStreamEnabled {
-		livestreamCursor := subQueue.Latest()
-		go cloud.HandleLiveStreamSD(livestreamCursor, configuration, communication, mqttClient, rtspSubClient)
+		livestreamCursor := subQueue.Latest().Named("livestream-sd").Fallback(queue)
+		go cloud.HandleLiveStreamSD(livestreamCursor, configuration, communication, mqttClient, capture.NewFallbackClient(rtspSubClient, rtspClient, livestreamCursor))
 	} else {
-		livestreamCursor := queue.Latest()
+		livestreamCursor := queue.Latest().Named("livestream-sd")
 		go cloud.HandleLiveStreamSD(livestreamCursor, configuration, communication, mqttClient, rtspClient)
 	}
 
 	// Handle livestream HD (high resolution over WEBRTC)
 	communication.HandleLiveHDHandshake = make(chan models.RequestHDStreamPayload, 1)
 	if subStreamEnabled {
-		livestreamHDCursor := subQueue.Latest()
-		go cloud.HandleLiveStreamHD(livestreamHDCursor, configuration, communication, mqttClient, rtspSubClient)
+		livestreamHDCursor := subQueue.Latest().Named("livestream-hd").Fallback(queue)
+		go cloud.HandleLiveStreamHD(livestreamHDCursor, configuration, communication, mqttClient, capture.NewFallbackClient(rtspSubClient, rtspClient, livestreamHDCursor))
 	} else {
-		livestreamHDCursor := queue.Latest()
+		livestreamHDCursor := queue.Latest().Named("livestream-hd")
 		go cloud.HandleLiveStreamHD(livestreamHDCursor, configuration, communication, mqttClient, rtspClient)
 	}
 
-	// Handle recording, will write an mp4 to disk.
-	go capture.HandleRecordStream(queue, configDirectory, configuration, communication, rtspClient)
+	// Handle livestream over HLS, served by the agent itself.
+	if config.Capture.HLS == "true" {
+		go hls.HandleLiveStream("main", queue.Latest().Named("hls"), configuration, rtspClient)
+		if subStreamEnabled {
+			go hls.HandleLiveStream("sub", subQueue.Latest().Named("hls"), configuration, rtspSubClient)
+		}
+	}
+
+	// Handle recording, will write an mp4 to disk. When the disk is (almost) full, the disk watchdog
+	// degrades recording: motion based only, the sub stream only, or no recording at all.
+	if subStreamEnabled {
+		go capture.HandleRecording(queue, configDirectory, configuration, communication, rtspClient, subQueue, rtspSubClient, subStreamConnected)
+	} else {
+		go capture.HandleRecording(queue, configDirectory, configuration, communication, rtspClient, nil, nil, false)
+	}
+
+	// Handle manual recordings, requested through the API or MQTT.
+	communication.HandleRecord = make(chan models.ManualRecording, 10)
+	if subStreamEnabled {
+		go capture.HandleManualRecordings(queue, configDirectory, configuration, communication, rtspClient, subQueue, rtspSubClient, subStreamConnected)
+	} else {
+		go capture.HandleManualRecordings(queue, configDirectory, configuration, communication, rtspClient, nil, nil, false)
+	}
+
+	// Handle time-lapse, samples a keyframe of the main stream on an interval.
+	if config.Timelapse.Enabled == "true" {
+		go capture.HandleTimelapse(queue.Latest().Named("timelapse"), configDirectory, configuration)
+	}
+
+	// Handle snapshots, taken from the main stream on an interval and when motion is detected.
+	if config.Snapshots.Enabled == "true" {
+		communication.HandleSnapshot = make(chan models.MotionDataPartial, 1)
+		go capture.HandleSnapshots(queue.Latest().Named("snapshots"), configDirectory, configuration, communication, rtspClient)
+	}
 
-	// Handle processing of motion
+	// Handle processing of motion, it reads the main stream while the sub stream isn't available.
 	communication.HandleMotion = make(chan models.MotionDataPartial, 1)
 	if subStreamEnabled {
-		motionCursor := subQueue.Latest()
-		go computervision.ProcessMotion(motionCursor, configuration, communication, mqttClient, rtspSubClient)
+		motionCursor := subQueue.Latest().Named("motion").Fallback(queue)
+		go computervision.ProcessMotion(motionCursor, configuration, communication, mqttClient, capture.NewFallbackClient(rtspSubClient, rtspClient, motionCursor))
 	} else {
-		motionCursor := queue.Latest()
+		motionCursor := queue.Latest().Named("motion")
 		go computervision.ProcessMotion(motionCursor, configuration, communication, mqttClient, rtspClient)
 	}
 
 	// Handle Upload to cloud provider (Kerberos Hub, Kerberos Vault and others)
-	go cloud.HandleUpload(configDirectory, configuration, communication)
+	// In multi-camera mode the uploader is shared by the cameras.
+	if configuration.CameraID == "" {
+		go cloud.HandleUpload(configDirectory, configuration, communication)
+	}
 
 	// Handle ONVIF actions
 	communication.HandleONVIF = make(chan models.OnvifAction, 1)
 	go onvif.HandleONVIFActions(configuration, communication)
 
 	communication.HandleAudio = make(chan models.AudioDataPartial, 1)
-	if rtspBackChannelClient.HasBackChannel {
+	if rtspBackChannelClient != nil && rtspBackChannelClient.HasBackChannel {
 		communication.HasBackChannel = true
 		go WriteAudioToBackchannel(communication, rtspBackChannelClient)
 	}
@@ -313,7 +396,7 @@ func RunAgent(configDirectory string, configuration *models.Configuration, commu
 	configService.OverrideWithEnvironmentVariables(configuration)
 
 	// Here we are cleaning up everything!
-	if configuration.Config.Offline != "true" {
+	if configuration.Config.Offline != "true" && configuration.CameraID == "" {
 		select {
 		case communication.HandleUpload <- "stop":
 			log.Log.Info("components.Kerberos.RunAgent(): stopping upload")
@@ -358,9 +441,11 @@ func RunAgent(configDirectory string, configuration *models.Configuration, commu
 		communication.SubQueue = nil
 	}
 
-	err = rtspBackChannelClient.Close()
-	if err != nil {
-		log.Log.Error("components.Kerberos.RunAgent(): error closing RTSP backchannel stream: " + err.Error())
+	if rtspBackChannelClient != nil {
+		err = rtspBackChannelClient.Close()
+		if err != nil {
+			log.Log.Error("components.Kerberos.RunAgent(): error closing RTSP backchannel stream: " + err.Error())
+		}
 	}
 
 	time.Sleep(time.Second * 3)
@@ -371,6 +456,14 @@ func RunAgent(configDirectory string, configuration *models.Configuration, commu
 	close(communication.HandleMotion)
 	communication.HandleMotion = nil
 
+	close(communication.HandleRecord)
+	communication.HandleRecord = nil
+
+	if communication.HandleSnapshot != nil {
+		close(communication.HandleSnapshot)
+		communication.HandleSnapshot = nil
+	}
+
 	close(communication.HandleAudio)
 	communication.HandleAudio = nil
 
@@ -384,85 +477,14 @@ func RunAgent(configDirectory string, configuration *models.Configuration, commu
 	return status
 }
 
-// ControlAgent will check if the camera is still connected, if not it will restart the agent.
-// In the other thread we are keeping track of the number of packets received, and particular the keyframe packets.
-// Once we are not receiving any packets anymore, we will restart the agent.
-func ControlAgent(communication *models.Communication) {
-	log.Log.Debug("components.Kerberos.ControlAgent(): started")
-	packageCounter := communication.PackageCounter
-	packageSubCounter := communication.PackageCounterSub
-	go func() {
-		// A channel to check the camera activity
-		var previousPacket int64 = 0
-		var previousPacketSub int64 = 0
-		var occurence = 0
-		var occurenceSub = 0
-		for {
-
-			// If camera is connected, we'll check if we are still receiving packets.
-			if communication.CameraConnected {
-
-				// First we'll check the main stream.
-				packetsR := packageCounter.Load().(int64)
-				if packetsR == previousPacket {
-					// If we are already reconfiguring,
-					// we dont need to check if the stream is blocking.
-					if !communication.IsConfiguring.IsSet() {
-						occurence = occurence + 1
-					}
-				} else {
-					occurence = 0
-				}
-
-				log.Log.Info("components.Kerberos.ControlAgent(): Number of packets read from mainstream: " + strconv.FormatInt(packetsR, 10))
-
-				// After 15 seconds without activity this is thrown..
-				if occurence == 3 {
-					log.Log.Info("components.Kerberos.ControlAgent(): Restarting machinery because of blocking mainstream.")
-					select {
-					case communication.HandleBootstrap <- "restart":
-						log.Log.Info("components.Kerberos.ControlAgent(): Restarting machinery because of blocking substream.")
-					case <-time.After(1 * time.Second):
-						log.Log.Info("components.Kerberos.ControlAgent(): Restarting machinery because of blocking substream timed out")
-					}
-					occurence = 0
-				}
-
-				// Now we'll check the sub stream.
-				packetsSubR := packageSubCounter.Load().(int64)
-				if communication.SubStreamConnected {
-					if packetsSubR == previousPacketSub {
-						// If we are already reconfiguring,
-						// we dont need to check if the stream is blocking.
-						if !communication.IsConfiguring.IsSet() {
-							occurenceSub = occurenceSub + 1
-						}
-					} else {
-						occurenceSub = 0
-					}
-
-					log.Log.Info("components.Kerberos.ControlAgent(): Number of packets read from substream: " + strconv.FormatInt(packetsSubR, 10))
-
-					// After 15 seconds without activity this is thrown..
-					if occurenceSub == 3 {
-						select {
-						case communication.HandleBootstrap <- "restart":
-							log.Log.Info("components.Kerberos.ControlAgent(): Restarting machinery because of blocking substream.")
-						case <-time.After(1 * time.Second):
-							log.Log.Info("components.Kerberos.ControlAgent(): Restarting machinery because of blocking substream timed out")
-						}
-						occurenceSub = 0
-					}
-				}
-
-				previousPacket = packageCounter.Load().(int64)
-				previousPacketSub = packageSubCounter.Load().(int64)
-			}
-
-			time.Sleep(5 * time.Second)
-		}
-	}()
-	log.Log.Debug("components.Kerberos.ControlAgent(): finished")
+// preRecordingMaxSize returns the maximum size (bytes) of the queue, by default 100MB. A GOP that is
+// larger is still kept, so a high bitrate camera can have less pre-recording than configured.
+func preRecordingMaxSize(config models.Config) int {
+	size := config.Capture.PreRecordingMaxSize
+	if size <= 0 {
+		size = 100
+	}
+	return int(size) * 1024 * 1024
 }
 
 // GetDashboard godoc
@@ -472,7 +494,7 @@ func ControlAgent(communication *models.Communication) {
 // @Summary Get all information showed on the dashboard.
 // @Description Get all information showed on the dashboard.
 // @Success 200
-func GetDashboard(c *gin.Context, configDirectory string, configuration *models.Configuration, communication *models.Communication) {
+func GetDashboard(c *gin.Context, configDirectory string, configuration *models.Configuration, communication *models.Communication, captureDevice *capture.Capture) {
 
 	// Check if camera is online.
 	cameraIsOnline := communication.CameraConnected
@@ -488,33 +510,49 @@ func GetDashboard(c *gin.Context, configDirectory string, configuration *models.
 		}
 	}
 
-	// The total number of recordings stored in the directory.
+	// The total number of recordings, all days stored in this agent and the 5 latest recordings.
+	// We query the recording index, if it's not available we fallback to the recordings directory.
 	recordingDirectory := configDirectory + "/data/recordings"
-	numberOfRecordings := utils.NumberOfMP4sInDirectory(recordingDirectory)
-
-	// All days stored in this agent.
+	var eventFilter models.EventFilter
+	eventFilter.NumberOfElements = 5
+	eventFilter.CameraKey = database.CameraKey(configuration)
+	numberOfRecordings, err := database.CountRecordings(eventFilter.CameraKey)
 	days := []string{}
 	latestEvents := []models.Media{}
-	files, err := utils.ReadDirectory(recordingDirectory)
 	if err == nil {
-		events := utils.GetSortedDirectory(files)
-
-		// Get All days
-		days = utils.GetDays(events, recordingDirectory, configuration)
+		days, _ = database.GetIndexedDays(configuration)
+		latestEvents, _, _ = database.QueryRecordings(configDirectory, configuration, eventFilter)
+	} else {
+		numberOfRecordings = utils.NumberOfRecordingsInDirectory(recordingDirectory)
+		files, err := utils.ReadDirectory(recordingDirectory)
+		if err == nil {
+			events := utils.GetSortedDirectory(files)
+			days = utils.GetDays(events, recordingDirectory, configuration)
+			latestEvents = utils.GetMediaFormatted(events, recordingDirectory, configuration, eventFilter) // will get 5 latest recordings.
+		}
+	}
 
-		// Get all latest events
-		var eventFilter models.EventFilter
-		eventFilter.NumberOfElements = 5
-		latestEvents = utils.GetMediaFormatted(events, recordingDirectory, configuration, eventFilter) // will get 5 latest recordings.
+	// The transport the streams are read with (tcp, udp or multicast), auto might have switched to tcp.
+	mainStreamTransport := ""
+	subStreamTransport := ""
+	if communication.MainStreamConnected && captureDevice.RTSPClient != nil {
+		mainStreamTransport = captureDevice.RTSPClient.GetTransport()
+	}
+	if communication.SubStreamConnected && captureDevice.RTSPSubClient != nil {
+		subStreamTransport = captureDevice.RTSPSubClient.GetTransport()
 	}
 
 	c.JSON(200, gin.H{
-		"offlineMode":        configuration.Config.Offline,
-		"cameraOnline":       cameraIsOnline,
-		"cloudOnline":        cloudIsOnline,
-		"numberOfRecordings": numberOfRecordings,
-		"days":               days,
-		"latestEvents":       latestEvents,
+		"offlineMode":         configuration.Config.Offline,
+		"cameraOnline":        cameraIsOnline,
+		"cloudOnline":         cloudIsOnline,
+		"numberOfRecordings":  numberOfRecordings,
+		"days":                days,
+		"latestEvents":        latestEvents,
+		"disk":                capture.GetDiskStatus(),
+		"mainStreamTransport": mainStreamTransport,
+		"subStreamTransport":  subStreamTransport,
+		"streams":             captureDevice.GetStreamStates().Streams,
 	})
 }
 
@@ -524,7 +562,9 @@ func GetDashboard(c *gin.Context, configDirectory string, configuration *models.
 // @Tags general
 // @Param eventFilter body models.EventFilter true "Event filter"
 // @Summary Get the latest recordings (events) from the recordings directory.
-// @Description Get the latest recordings (events) from the recordings directory.
+// @Description Get the latest recordings (events) from the recordings index. The events can be filtered on
+// @Description time range, day, trigger and region. If there are more events, a cursor is returned which
+// @Description should be passed in the filter to get the next page.
 // @Success 200
 func GetLatestEvents(c *gin.Context, configDirectory string, configuration *models.Configuration, communication *models.Communication) {
 	var eventFilter models.EventFilter
@@ -534,6 +574,22 @@ func GetLatestEvents(c *gin.Context, configDirectory string, configuration *mode
 		if eventFilter.NumberOfElements == 0 {
 			eventFilter.NumberOfElements = 10
 		}
+		// In multi-camera mode, only the recordings of the camera are returned.
+		eventFilter.CameraKey = database.CameraKey(configuration)
+		if database.IndexAvailable() {
+			events, cursor, err := database.QueryRecordings(configDirectory, configuration, eventFilter)
+			if err == nil {
+				c.JSON(200, gin.H{
+					"events": events,
+					"cursor": cursor,
+				})
+			} else {
+				c.JSON(400, gin.H{
+					"data": "Something went wrong: " + err.Error(),
+				})
+			}
+			return
+		}
 		recordingDirectory := configDirectory + "/data/recordings"
 		files, err := utils.ReadDirectory(recordingDirectory)
 		if err == nil {
@@ -563,6 +619,19 @@ func GetLatestEvents(c *gin.Context, configDirectory string, configuration *mode
 // @Description Get all days stored in the recordings directory.
 // @Success 200
 func GetDays(c *gin.Context, configDirectory string, configuration *models.Configuration, communication *models.Communication) {
+	if database.IndexAvailable() {
+		days, err := database.GetIndexedDays(configuration)
+		if err == nil {
+			c.JSON(200, gin.H{
+				"events": days,
+			})
+		} else {
+			c.JSON(400, gin.H{
+				"data": "Something went wrong: " + err.Error(),
+			})
+		}
+		return
+	}
 	recordingDirectory := configDirectory + "/data/recordings"
 	files, err := utils.ReadDirectory(recordingDirectory)
 	if err == nil {
@@ -578,6 +647,68 @@ func GetDays(c *gin.Context, configDirectory string, configuration *models.Confi
 	}
 }
 
+// ExportMedia godoc
+// @Router /api/media/export [post]
+// @ID media-export
+// @Tags general
+// @Param exportRequest body models.ExportRequest true "Export request"
+// @Summary Export a clip of the recordings over a time range.
+// @Description Export a clip of the recordings over a time range. The recordings that overlap the time range are
+// @Description stitched together (without re-encoding) into a single MP4, which starts and ends at a keyframe.
+// @Produce video/mp4
+// @Success 200
+func ExportMedia(c *gin.Context, configDirectory string, configuration *models.Configuration) {
+	var exportRequest models.ExportRequest
+	err := c.BindJSON(&exportRequest)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
+	}
+	if exportRequest.From <= 0 || exportRequest.To <= exportRequest.From {
+		c.JSON(400, gin.H{
+			"data": "Something went wrong: from and to should be a valid time range.",
+		})
+		return
+	}
+
+	// The clip is written to a temporary file, and removed once it's downloaded.
+	exportDirectory := configDirectory + "/data/exports"
+	os.MkdirAll(exportDirectory, 0755)
+	file, err := os.CreateTemp(exportDirectory, "export-*.mp4")
+	if err != nil {
+		c.JSON(500, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	result, err := capture.ExportRecordings(configDirectory, configuration, exportRequest.From*1000, exportRequest.To*1000, file)
+	if err == capture.ErrNoFootage {
+		c.JSON(404, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
+	}
+	log.Log.Info("components.Kerberos.ExportMedia(): exported " + strconv.Itoa(len(result.Recordings)) + " recording(s) from " +
+		strconv.FormatInt(result.StartTime, 10) + " until " + strconv.FormatInt(result.EndTime, 10))
+
+	fileName := configuration.Config.Name + "_" + strconv.FormatInt(exportRequest.From, 10) + "_" + strconv.FormatInt(exportRequest.To, 10) + ".mp4"
+	c.Header("X-Export-Start", strconv.FormatInt(result.StartTime, 10))
+	c.Header("X-Export-End", strconv.FormatInt(result.EndTime, 10))
+	c.Header("Access-Control-Expose-Headers", "Content-Disposition, X-Export-Start, X-Export-End")
+	c.Header("Content-Type", "video/mp4")
+	c.FileAttachment(file.Name(), fileName)
+}
+
 // StopAgent godoc
 // @Router /api/camera/stop [post]
 // @ID camera-stop
@@ -618,23 +749,125 @@ func RestartAgent(c *gin.Context, communication *models.Communication) {
 	})
 }
 
+// GetGaps godoc
+// @Router /api/media/gaps [get]
+// @ID media-gaps
+// @Tags general
+// @Param from query int false "Start of the range, unix timestamp (seconds)"
+// @Param to query int false "End of the range, unix timestamp (seconds)"
+// @Summary Get the intervals without footage.
+// @Description Get the intervals without footage, detected while recording continuously (e.g. because the stream dropped).
+// @Description A gap is stored once recording resumes.
+// @Success 200 {array} models.RecordingGap
+func GetGaps(c *gin.Context, configuration *models.Configuration) {
+	var from, to int64
+	var err error
+	if value := c.Query("from"); value != "" {
+		from, err = strconv.ParseInt(value, 10, 64)
+	}
+	if value := c.Query("to"); value != "" && err == nil {
+		to, err = strconv.ParseInt(value, 10, 64)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{
+			"data": "Something went wrong: from and to should be unix timestamps.",
+		})
+		return
+	}
+	gaps, err := database.ListGaps(from*1000, to*1000, database.CameraKey(configuration))
+	if err != nil {
+		c.JSON(500, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gaps)
+}
+
 // MakeRecording godoc
 // @Router /api/camera/record [post]
 // @ID camera-record
 // @Tags camera
+// @Param recordRequest body models.RecordRequest false "Record request"
 // @Summary Make a recording.
-// @Description Make a recording.
-// @Success 200 {object} models.APIResponse
-func MakeRecording(c *gin.Context, communication *models.Communication) {
+// @Description Make a recording with a duration, pre-roll and label. The recording is made next to the continuous
+// @Description or motion based recordings, the returned ID can be used to poll or cancel the recording.
+// @Success 200 {object} models.ManualRecording
+func MakeRecording(c *gin.Context, configuration *models.Configuration, communication *models.Communication) {
+	var recordRequest models.RecordRequest
+	// The body is optional, without it we'll use the defaults.
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&recordRequest); err != nil {
+			c.JSON(400, gin.H{
+				"data": "Something went wrong: " + err.Error(),
+			})
+			return
+		}
+	}
 	log.Log.Info("components.Kerberos.MakeRecording(): sending signal to start recording.")
-	dataToPass := models.MotionDataPartial{
-		Timestamp:       time.Now().Unix(),
-		NumberOfChanges: 100000000, // hack set the number of changes to a high number to force recording
+	recording, err := capture.RequestManualRecording(configuration, communication, models.TriggerManual, recordRequest)
+	if err == capture.ErrRecordingDisabled || err == capture.ErrCameraDisconnected || err == capture.ErrDiskFull {
+		c.JSON(409, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
+	} else if err != nil {
+		c.JSON(400, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
 	}
-	communication.HandleMotion <- dataToPass //Save data to the channel
-	c.JSON(200, gin.H{
-		"recording": true,
-	})
+	c.JSON(200, recording)
+}
+
+// GetManualRecordings godoc
+// @Router /api/camera/record [get]
+// @ID camera-record-list
+// @Tags camera
+// @Summary Get the most recent manual recordings.
+// @Description Get the most recent manual recordings and their status, the newest first.
+// @Success 200 {array} models.ManualRecording
+func GetManualRecordings(c *gin.Context, configuration *models.Configuration) {
+	c.JSON(200, capture.ListManualRecordings(configuration.CameraID))
+}
+
+// GetManualRecording godoc
+// @Router /api/camera/record/{recording} [get]
+// @ID camera-record-get
+// @Tags camera
+// @Param recording path string true "Recording ID"
+// @Summary Get the status of a manual recording.
+// @Description Get the status of a manual recording: pending, recording, finished, cancelled or failed.
+// @Success 200 {object} models.ManualRecording
+func GetManualRecording(c *gin.Context, configuration *models.Configuration) {
+	recording, ok := capture.GetManualRecording(configuration.CameraID, c.Param("recording"))
+	if !ok {
+		c.JSON(404, gin.H{
+			"data": "Something went wrong: recording not found.",
+		})
+		return
+	}
+	c.JSON(200, recording)
+}
+
+// CancelManualRecording godoc
+// @Router /api/camera/record/{recording} [delete]
+// @ID camera-record-cancel
+// @Tags camera
+// @Param recording path string true "Recording ID"
+// @Summary Cancel a manual recording.
+// @Description Cancel a manual recording. A pending recording is not started, a recording in progress is
+// @Description closed, the footage recorded so far is kept.
+// @Success 200 {object} models.ManualRecording
+func CancelManualRecording(c *gin.Context, configuration *models.Configuration) {
+	recording, ok := capture.CancelManualRecording(configuration.CameraID, c.Param("recording"))
+	if !ok {
+		c.JSON(404, gin.H{
+			"data": "Something went wrong: recording not found.",
+		})
+		return
+	}
+	c.JSON(200, recording)
 }
 
 // GetSnapshotBase64 godoc
@@ -674,6 +907,101 @@ func GetSnapshotRaw(c *gin.Context, captureDevice *capture.Capture, configuratio
 	c.Data(200, "image/jpeg", bytes)
 }
 
+// GetStreamStates godoc
+// @Router /api/camera/streams [get]
+// @ID camera-streams
+// @Tags camera
+// @Summary Get the state of the main and sub stream.
+// @Description Get the state of the main and sub stream (connecting, connected, reconnecting or stopped), and the
+// @Description last changes of the state. A stream that fails is reconnected on its own, with an exponential backoff.
+// @Success 200 {object} models.StreamStates
+func GetStreamStates(c *gin.Context, captureDevice *capture.Capture) {
+	c.JSON(200, captureDevice.GetStreamStates())
+}
+
+// GetStreamStats godoc
+// @Router /api/camera/stats [get]
+// @ID camera-stats
+// @Tags camera
+// @Summary Get the statistics of the main and sub stream.
+// @Description Get the statistics of the main and sub stream: the measured fps and bitrate, the GOP length and
+// @Description keyframe interval, the lost (RTP) packets and decode errors, the depth of the queue and the lag
+// @Description of every consumer of the queue (motion detection, recording, livestream, ...).
+// @Success 200 {object} models.StreamStats
+func GetStreamStats(c *gin.Context, communication *models.Communication) {
+	c.JSON(200, capture.GetStreamStats(communication))
+}
+
+// GetSnapshots godoc
+// @Router /api/snapshots [get]
+// @ID snapshots
+// @Tags general
+// @Param trigger query string false "Only snapshots with this trigger (periodic or motion)"
+// @Param from query int false "Start of the range, unix timestamp (seconds)"
+// @Param to query int false "End of the range, unix timestamp (seconds)"
+// @Param limit query int false "Maximum number of snapshots, defaults to 100"
+// @Summary Get the snapshots stored in the snapshots directory.
+// @Description Get the snapshots stored in the snapshots directory, the most recent first. Snapshots are taken
+// @Description on an interval and when motion is detected.
+// @Success 200 {array} models.Snapshot
+func GetSnapshots(c *gin.Context, configDirectory string, configuration *models.Configuration) {
+	var from, to int64
+	limit := 100
+	var err error
+	if value := c.Query("from"); value != "" {
+		from, err = strconv.ParseInt(value, 10, 64)
+	}
+	if value := c.Query("to"); value != "" && err == nil {
+		to, err = strconv.ParseInt(value, 10, 64)
+	}
+	if value := c.Query("limit"); value != "" && err == nil {
+		limit, err = strconv.Atoi(value)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{
+			"data": "Something went wrong: from, to and limit should be numbers.",
+		})
+		return
+	}
+	// In multi-camera mode, only the snapshots of the camera are returned.
+	cameraKey := ""
+	if configuration.CameraID != "" {
+		cameraKey = configuration.Config.Key
+	}
+	snapshots, err := capture.GetSnapshots(configDirectory, cameraKey, c.Query("trigger"), from, to, limit)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(200, snapshots)
+}
+
+// GetSnapshot godoc
+// @Router /api/snapshots/{name} [get]
+// @ID snapshot
+// @Tags general
+// @Param name path string true "Name of the snapshot"
+// @Summary Get a snapshot from the snapshots directory in jpeg format.
+// @Description Get a snapshot from the snapshots directory in jpeg format, an encrypted snapshot is decrypted.
+// @Success 200
+func GetSnapshot(c *gin.Context, configDirectory string, configuration *models.Configuration) {
+	data, err := capture.ReadSnapshot(configDirectory, configuration, c.Param("name"))
+	if err == capture.ErrSnapshotNotFound {
+		c.JSON(404, gin.H{
+			"data": "Something went wrong: snapshot not found.",
+		})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
+	}
+	c.Data(200, "image/jpeg", data)
+}
+
 // GetConfig godoc
 // @Router /api/config [get]
 // @ID config
@@ -696,6 +1024,33 @@ func GetConfig(c *gin.Context, captureDevice *capture.Capture, configuration *mo
 	})
 }
 
+// UpdateCameraConfig godoc
+// @Router /api/cameras/{id}/config [post]
+// @ID camera-config
+// @Tags config
+// @Param id path string true "Camera ID"
+// @Param settings body object true "Settings of the camera"
+// @Summary Update the settings of a camera.
+// @Description Update the settings of a camera in multi-camera mode. The settings override the configuration
+// @Description of the agent (like the settings in the cameras list), the camera is restarted.
+// @Success 200
+func UpdateCameraConfig(c *gin.Context, configDirectory string, configuration *models.Configuration, communication *models.Communication) {
+	var settings map[string]interface{}
+	err := c.BindJSON(&settings)
+	if err == nil {
+		err = configService.SaveCameraConfig(configDirectory, settings, configuration, communication)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{
+			"data": "Something went wrong: " + err.Error(),
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"data": "☄ Reconfiguring",
+	})
+}
+
 // UpdateConfig godoc
 // @Router /api/config [post]
 // @ID config
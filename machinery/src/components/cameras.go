@@ -0,0 +1,230 @@
+package components
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+
+	"github.com/kerberos-io/agent/machinery/src/capture"
+	"github.com/kerberos-io/agent/machinery/src/cloud"
+	configService "github.com/kerberos-io/agent/machinery/src/config"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	routers "github.com/kerberos-io/agent/machinery/src/routers/mqtt"
+)
+
+// In multi-camera mode (the configuration has a list of cameras) every camera runs its own pipeline
+// (queue, motion detection, recording, ONVIF, ...) and is restarted on its own. The HTTP server, the
+// MQTT client, the uploader, the retention and the disk watchdog are shared by the cameras. The list
+// of cameras is read when the agent starts, adding or removing a camera requires a restart of the process.
+
+// Camera is a camera of the agent in multi-camera mode.
+type Camera struct {
+	ID            string
+	Configuration *models.Configuration
+	Communication *models.Communication
+	Capture       *capture.Capture
+}
+
+var (
+	cameras      []*Camera
+	camerasMutex sync.RWMutex
+)
+
+// FindCamera returns the camera with the given ID, or nil if there is no such camera.
+func FindCamera(id string) *Camera {
+	camerasMutex.RLock()
+	defer camerasMutex.RUnlock()
+	for _, camera := range cameras {
+		if camera.ID == id {
+			return camera
+		}
+	}
+	return nil
+}
+
+// Cameras returns the cameras of the agent, empty if the agent doesn't run in multi-camera mode.
+func Cameras() []*Camera {
+	camerasMutex.RLock()
+	defer camerasMutex.RUnlock()
+	return append([]*Camera(nil), cameras...)
+}
+
+// BootstrapCameras starts the shared services and a pipeline for every camera. It keeps running as long as
+// the agent does: when the configuration of the agent changes the shared services and all cameras are restarted.
+func BootstrapCameras(configDirectory string, configuration *models.Configuration, communication *models.Communication) {
+	log.Log.Debug("components.cameras.BootstrapCameras(): bootstrapping the kerberos agent in multi-camera mode.")
+
+	uptimeStart := time.Now()
+	initCommunication(communication)
+
+	// Apply the retention rules on the recordings directory, on a schedule.
+	go capture.HandleRetention(configDirectory, configuration)
+
+	// Watch the free disk space, and degrade recording when the disk is (almost) full.
+	communication.HandleDiskState = make(chan models.DiskStatus, 10)
+	go capture.HandleDiskWatchdog(configDirectory, configuration, communication)
+
+	// A single MQTT client is shared by the cameras, the messages are dispatched to the camera they're sent to.
+	var mqttMutex sync.RWMutex
+	mqttClient := routers.ConfigureMQTT(configDirectory, configuration, communication)
+	getMQTTClient := func() mqtt.Client {
+		mqttMutex.RLock()
+		defer mqttMutex.RUnlock()
+		return mqttClient
+	}
+	go func() {
+		for status := range communication.HandleDiskState {
+			routers.SendDiskState(getMQTTClient(), configuration, status)
+		}
+	}()
+
+	// Handle Upload to cloud provider (Kerberos Hub, Kerberos Vault and others)
+	go cloud.HandleUpload(configDirectory, configuration, communication)
+
+	for _, cameraConfig := range configuration.Config.Cameras {
+		if cameraConfig.ID == "" || FindCamera(cameraConfig.ID) != nil {
+			log.Log.Error("components.cameras.BootstrapCameras(): skipping camera without a (unique) id.")
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		camera := &Camera{
+			ID:            cameraConfig.ID,
+			Configuration: configService.CameraConfiguration(configuration, cameraConfig.ID),
+			Communication: &models.Communication{
+				Context:         &ctx,
+				CancelContext:   &cancel,
+				HandleBootstrap: make(chan string, 1),
+			},
+			Capture: &capture.Capture{},
+		}
+		camerasMutex.Lock()
+		cameras = append(cameras, camera)
+		camerasMutex.Unlock()
+		routers.RegisterDevice(camera.Configuration, camera.Communication)
+
+		log.Log.Info("components.cameras.BootstrapCameras(): starting camera " + camera.ID + " (" + camera.Configuration.Config.Key + ")")
+		go runCamera(configDirectory, camera, uptimeStart, getMQTTClient)
+	}
+
+	// The configuration of the agent is only applied (restarted) when a camera is connected,
+	// in multi-camera mode the cameras are restarted individually.
+	communication.CameraConnected = true
+
+	for {
+		status := <-communication.HandleBootstrap
+
+		for _, camera := range Cameras() {
+			select {
+			case camera.Communication.HandleBootstrap <- status:
+			case <-time.After(1 * time.Second):
+				log.Log.Info("components.cameras.BootstrapCameras(): sending " + status + " to camera " + camera.ID + " timed out")
+			}
+		}
+
+		if status == "stop" {
+			log.Log.Info("components.cameras.BootstrapCameras(): shutting down the agent in 3 seconds.")
+			time.Sleep(time.Second * 3)
+			os.Exit(0)
+		}
+
+		// The uploader only runs when the agent is not offline.
+		if configuration.Config.Offline != "true" {
+			select {
+			case communication.HandleUpload <- "stop":
+				log.Log.Info("components.cameras.BootstrapCameras(): stopping upload")
+			case <-time.After(1 * time.Second):
+				log.Log.Info("components.cameras.BootstrapCameras(): stopping upload timed out")
+			}
+		}
+
+		// We will re open the configuration, might have changed :O!
+		configService.OpenConfig(configDirectory, configuration)
+
+		// We will override the configuration with the environment variables
+		configService.OverrideWithEnvironmentVariables(configuration)
+
+		// Reset the MQTT client, might have provided new information, so we need to reconnect.
+		if routers.HasMQTTClientModified(configuration) {
+			mqttMutex.Lock()
+			routers.DisconnectMQTT(mqttClient, &configuration.Config)
+			mqttClient = routers.ConfigureMQTT(configDirectory, configuration, communication)
+			mqttMutex.Unlock()
+		}
+
+		go cloud.HandleUpload(configDirectory, configuration, communication)
+	}
+}
+
+// runCamera runs the pipeline of a camera, and restarts it when requested, until the camera is stopped.
+func runCamera(configDirectory string, camera *Camera, uptimeStart time.Time, mqttClient func() mqtt.Client) {
+	configuration := camera.Configuration
+	communication := camera.Communication
+	initCommunication(communication)
+
+	cameraSettings := &models.Camera{}
+
+	// The changes of the state of the main and sub stream of the camera are published over MQTT.
+	communication.HandleStreamState = make(chan models.StreamStatus, 10)
+	go func() {
+		for status := range communication.HandleStreamState {
+			routers.SendStreamState(mqttClient(), configuration, status)
+		}
+	}()
+
+	// Every camera is a device of its own, with its own heartbeat.
+	go cloud.HandleHeartBeat(configuration, communication, uptimeStart)
+
+	for {
+		status := RunAgent(configDirectory, configuration, communication, mqttClient(), uptimeStart, cameraSettings, camera.Capture)
+
+		if status == "stop" {
+			log.Log.Info("components.cameras.runCamera(): camera " + camera.ID + " is stopped.")
+			select {
+			case communication.HandleHeartBeat <- "stop":
+			case <-time.After(1 * time.Second):
+			}
+			return
+		}
+
+		if status == "not started" {
+			// We will re open the configuration, might have changed :O!
+			configService.OpenConfig(configDirectory, configuration)
+			// We will override the configuration with the environment variables
+			configService.OverrideWithEnvironmentVariables(configuration)
+		}
+
+		// We will create a new cancelable context, which will be used to cancel and restart.
+		ctx, cancel := context.WithCancel(context.Background())
+		communication.Context = &ctx
+		communication.CancelContext = &cancel
+	}
+}
+
+// GetCameras godoc
+// @Router /api/cameras [get]
+// @ID cameras
+// @Tags camera
+// @Summary Get the cameras of the agent.
+// @Description Get the cameras of the agent in multi-camera mode, the routes of a camera are available at /api/cameras/{id}/...
+// @Description The list is empty if the agent runs a single camera.
+// @Success 200 {array} models.CameraStatus
+func GetCameras(c *gin.Context) {
+	statuses := []models.CameraStatus{}
+	for _, camera := range Cameras() {
+		statuses = append(statuses, models.CameraStatus{
+			ID:                  camera.ID,
+			Key:                 camera.Configuration.Config.Key,
+			Name:                camera.Configuration.Config.Name,
+			FriendlyName:        camera.Configuration.Config.FriendlyName,
+			Connected:           camera.Communication.CameraConnected,
+			MainStreamConnected: camera.Communication.MainStreamConnected,
+			SubStreamConnected:  camera.Communication.SubStreamConnected,
+		})
+	}
+	c.JSON(200, statuses)
+}
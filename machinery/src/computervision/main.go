@@ -2,6 +2,7 @@ package computervision
 
 import (
 	"image"
+	"strconv"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -28,7 +29,8 @@ func ProcessMotion(motionCursor *packets.QueueCursor, configuration *models.Conf
 		pixelThreshold = 150
 	}
 
-	if config.Capture.Continuous == "true" {
+	// The disk watchdog can switch continuous recording to motion based recording, while we're running.
+	if config.Capture.Continuous == "true" && config.DiskWatchdog.Enabled != "true" {
 
 		log.Log.Info("computervision.main.ProcessMotion(): you've enabled continuous recording, so no motion detection required.")
 
@@ -53,6 +55,9 @@ func ProcessMotion(motionCursor *packets.QueueCursor, configuration *models.Conf
 			if len(pkt.Data) > 0 && pkt.IsKeyFrame {
 				grayImage, err := rtspClient.DecodePacketRaw(pkt)
 				if err == nil {
+					if j > 0 && grayImage.Bounds() != imageArray[0].Bounds() {
+						j = 0 // The size changed, start over.
+					}
 					imageArray[j] = &grayImage
 					j++
 				}
@@ -64,9 +69,17 @@ func ProcessMotion(motionCursor *packets.QueueCursor, configuration *models.Conf
 
 		// Calculate mask
 		var polyObjects []geo.Polygon
+		var regionNames []string
 
 		if config.Region != nil {
-			for _, polygon := range config.Region.Polygon {
+			for i, polygon := range config.Region.Polygon {
+				// We keep track of the names, so we can tell which regions fired.
+				regionName := polygon.ID
+				if regionName == "" {
+					regionName = "region-" + strconv.Itoa(i)
+				}
+				regionNames = append(regionNames, regionName)
+
 				coords := polygon.Coordinates
 				poly := geo.Polygon{}
 				for _, c := range coords {
@@ -81,24 +94,15 @@ func ProcessMotion(motionCursor *packets.QueueCursor, configuration *models.Conf
 			}
 		}
 
+		// The regions are drawn on the first image, when the size of the images changes (the sub stream
+		// is reconnecting, and the main stream is read instead) the regions are scaled to the new size.
 		img := imageArray[0]
+		var reference image.Rectangle
 		var coordinatesToCheck []int
+		var regionCoordinates [][]int
 		if img != nil {
-			bounds := img.Bounds()
-			rows := bounds.Dy()
-			cols := bounds.Dx()
-
-			// Make fixed size array of uinty8
-			for y := 0; y < rows; y++ {
-				for x := 0; x < cols; x++ {
-					for _, poly := range polyObjects {
-						point := geo.NewPoint(float64(x), float64(y))
-						if poly.Contains(point) {
-							coordinatesToCheck = append(coordinatesToCheck, y*cols+x)
-						}
-					}
-				}
-			}
+			reference = img.Bounds()
+			coordinatesToCheck, regionCoordinates = regionMask(polyObjects, reference, reference)
 		}
 
 		// If no region is set, we'll skip the motion detection
@@ -115,8 +119,20 @@ func ProcessMotion(motionCursor *packets.QueueCursor, configuration *models.Conf
 					continue
 				}
 
+				// Motion is only detected while we record on motion.
+				recordingConfiguration, _ := capture.RecordingConfiguration(configuration, false)
+				if recordingConfiguration.Config.Capture.Continuous == "true" {
+					continue
+				}
+
 				grayImage, err := rtspClient.DecodePacketRaw(pkt)
 				if err == nil {
+					if bounds := grayImage.Bounds(); bounds != imageArray[1].Bounds() {
+						// Start over with the images of the new size.
+						coordinatesToCheck, regionCoordinates = regionMask(polyObjects, reference, bounds)
+						imageArray[0] = &grayImage
+						imageArray[1] = &grayImage
+					}
 					imageArray[2] = &grayImage
 				}
 
@@ -160,13 +176,23 @@ func ProcessMotion(motionCursor *packets.QueueCursor, configuration *models.Conf
 								}
 							}
 
-							if config.Capture.Recording != "false" {
-								dataToPass := models.MotionDataPartial{
-									Timestamp:       time.Now().Unix(),
-									NumberOfChanges: changesToReturn,
-								}
+							dataToPass := models.MotionDataPartial{
+								Timestamp:       time.Now().Unix(),
+								NumberOfChanges: changesToReturn,
+								Trigger:         models.TriggerMotion,
+								Regions:         FindRegions(imageArray, regionCoordinates, regionNames),
+							}
+							if recordingConfiguration.Config.Capture.Recording != "false" {
 								communication.HandleMotion <- dataToPass //Save data to the channel
 							}
+
+							// Take a burst of snapshots, we don't wait if the previous burst is still busy.
+							if communication.HandleSnapshot != nil {
+								select {
+								case communication.HandleSnapshot <- dataToPass:
+								default:
+								}
+							}
 						}
 					}
 
@@ -185,15 +211,57 @@ func ProcessMotion(motionCursor *packets.QueueCursor, configuration *models.Conf
 	log.Log.Debug("computervision.main.ProcessMotion(): stop the motion detection.")
 }
 
+// regionMask returns the pixels (indexes) of an image of the bounds that are inside the regions, of all
+// regions and per region. The regions are drawn on an image of the reference bounds.
+func regionMask(polyObjects []geo.Polygon, reference image.Rectangle, bounds image.Rectangle) ([]int, [][]int) {
+	var coordinatesToCheck []int
+	regionCoordinates := make([][]int, len(polyObjects))
+	rows := bounds.Dy()
+	cols := bounds.Dx()
+	if rows == 0 || cols == 0 {
+		return coordinatesToCheck, regionCoordinates
+	}
+	scaleX := float64(reference.Dx()) / float64(cols)
+	scaleY := float64(reference.Dy()) / float64(rows)
+
+	// Make fixed size array of uinty8
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			for i, poly := range polyObjects {
+				point := geo.NewPoint(float64(x)*scaleX, float64(y)*scaleY)
+				if poly.Contains(point) {
+					coordinatesToCheck = append(coordinatesToCheck, y*cols+x)
+					regionCoordinates[i] = append(regionCoordinates[i], y*cols+x)
+				}
+			}
+		}
+	}
+	return coordinatesToCheck, regionCoordinates
+}
+
+// The minimum difference in intensity before a pixel is considered changed.
+const motionThreshold = 60
+
 func FindMotion(imageArray [3]*image.Gray, coordinatesToCheck []int, pixelChangeThreshold int) (thresholdReached bool, changesDetected int) {
 	image1 := imageArray[0]
 	image2 := imageArray[1]
 	image3 := imageArray[2]
-	threshold := 60
-	changes := AbsDiffBitwiseAndThreshold(image1, image2, image3, threshold, coordinatesToCheck)
+	changes := AbsDiffBitwiseAndThreshold(image1, image2, image3, motionThreshold, coordinatesToCheck)
 	return changes > pixelChangeThreshold, changes
 }
 
+// FindRegions returns the names of the regions in which changes were detected.
+func FindRegions(imageArray [3]*image.Gray, regionCoordinates [][]int, regionNames []string) []string {
+	regions := []string{}
+	for i, coordinates := range regionCoordinates {
+		changes := AbsDiffBitwiseAndThreshold(imageArray[0], imageArray[1], imageArray[2], motionThreshold, coordinates)
+		if changes > 0 {
+			regions = append(regions, regionNames[i])
+		}
+	}
+	return regions
+}
+
 func AbsDiffBitwiseAndThreshold(img1 *image.Gray, img2 *image.Gray, img3 *image.Gray, threshold int, coordinatesToCheck []int) int {
 	changes := 0
 	for i := 0; i < len(coordinatesToCheck); i++ {
@@ -221,6 +221,167 @@ func OverrideWithEnvironmentVariables(configuration *models.Configuration) {
 				}
 				break
 
+			/* Retention of recordings */
+			case "AGENT_RETENTION_INTERVAL":
+				interval, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Retention.Interval = interval
+				}
+				break
+			case "AGENT_RETENTION_MAX_AGE":
+				maxAge, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Retention.MaxAge = maxAge
+				}
+				break
+			case "AGENT_RETENTION_MIN_FREE_DISK":
+				minFreeDisk, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Retention.MinFreeDisk = minFreeDisk
+				}
+				break
+			case "AGENT_RETENTION_MAX_CONTINUOUS_SIZE":
+				size, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Retention.MaxContinuousSize = size
+				}
+				break
+			case "AGENT_RETENTION_MAX_MOTION_SIZE":
+				size, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Retention.MaxMotionSize = size
+				}
+				break
+			case "AGENT_RETENTION_KEEP_PENDING_UPLOADS":
+				configuration.Config.Retention.KeepPendingUploads = value
+				break
+			case "AGENT_RETENTION_SUB_MAX_AGE":
+				maxAge, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Retention.SubMaxAge = maxAge
+				}
+				break
+			case "AGENT_RETENTION_SUB_MAX_SIZE":
+				size, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Retention.SubMaxSize = size
+				}
+				break
+
+			/* Time-lapse */
+			case "AGENT_TIMELAPSE":
+				configuration.Config.Timelapse.Enabled = value
+				break
+			case "AGENT_TIMELAPSE_INTERVAL":
+				interval, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Timelapse.Interval = interval
+				}
+				break
+			case "AGENT_TIMELAPSE_PERIOD":
+				period, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Timelapse.Period = period
+				}
+				break
+			case "AGENT_TIMELAPSE_FPS":
+				fps, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Timelapse.FPS = fps
+				}
+				break
+			case "AGENT_TIMELAPSE_MAX_AGE":
+				maxAge, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Timelapse.MaxAge = maxAge
+				}
+				break
+			case "AGENT_TIMELAPSE_MAX_SIZE":
+				size, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Timelapse.MaxSize = size
+				}
+				break
+
+			/* Disk watchdog */
+			case "AGENT_DISK_WATCHDOG":
+				configuration.Config.DiskWatchdog.Enabled = value
+				break
+			case "AGENT_DISK_WATCHDOG_INTERVAL":
+				interval, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.DiskWatchdog.Interval = interval
+				}
+				break
+			case "AGENT_DISK_WATCHDOG_RETENTION":
+				percentage, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.DiskWatchdog.EmergencyRetention = percentage
+				}
+				break
+			case "AGENT_DISK_WATCHDOG_MOTION_ONLY":
+				percentage, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.DiskWatchdog.MotionOnly = percentage
+				}
+				break
+			case "AGENT_DISK_WATCHDOG_SUB_ONLY":
+				percentage, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.DiskWatchdog.SubOnly = percentage
+				}
+				break
+			case "AGENT_DISK_WATCHDOG_PAUSE":
+				percentage, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.DiskWatchdog.Pause = percentage
+				}
+				break
+
+			/* Snapshots */
+			case "AGENT_SNAPSHOTS":
+				configuration.Config.Snapshots.Enabled = value
+				break
+			case "AGENT_SNAPSHOTS_INTERVAL":
+				interval, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Snapshots.Interval = interval
+				}
+				break
+			case "AGENT_SNAPSHOTS_MOTION_COUNT":
+				count, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Snapshots.MotionCount = count
+				}
+				break
+			case "AGENT_SNAPSHOTS_MOTION_INTERVAL":
+				interval, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Snapshots.MotionInterval = interval
+				}
+				break
+			case "AGENT_SNAPSHOTS_QUALITY":
+				quality, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Snapshots.Quality = quality
+				}
+				break
+			case "AGENT_SNAPSHOTS_MAX_AGE":
+				maxAge, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Snapshots.MaxAge = maxAge
+				}
+				break
+			case "AGENT_SNAPSHOTS_MAX_SIZE":
+				size, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Snapshots.MaxSize = size
+				}
+				break
+			case "AGENT_SNAPSHOTS_UPLOAD":
+				configuration.Config.Snapshots.Upload = value
+				break
+
 			/* Camera configuration */
 			case "AGENT_CAPTURE_IPCAMERA_RTSP":
 				configuration.Config.Capture.IPCamera.RTSP = value
@@ -228,6 +389,21 @@ func OverrideWithEnvironmentVariables(configuration *models.Configuration) {
 			case "AGENT_CAPTURE_IPCAMERA_SUB_RTSP":
 				configuration.Config.Capture.IPCamera.SubRTSP = value
 				break
+			case "AGENT_CAPTURE_IPCAMERA_TRANSPORT":
+				configuration.Config.Capture.IPCamera.Transport = value
+				break
+			case "AGENT_CAPTURE_IPCAMERA_SUB_TRANSPORT":
+				configuration.Config.Capture.IPCamera.SubTransport = value
+				break
+			case "AGENT_CAPTURE_IPCAMERA_READ_TIMEOUT":
+				readTimeout, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Capture.IPCamera.ReadTimeout = readTimeout
+				}
+				break
+			case "AGENT_CAPTURE_IPCAMERA_USER_AGENT":
+				configuration.Config.Capture.IPCamera.UserAgent = value
+				break
 
 				/* ONVIF connnection settings */
 			case "AGENT_CAPTURE_IPCAMERA_ONVIF":
@@ -265,6 +441,12 @@ func OverrideWithEnvironmentVariables(configuration *models.Configuration) {
 					configuration.Config.Capture.PreRecording = duration
 				}
 				break
+			case "AGENT_CAPTURE_PRERECORDING_MAX_SIZE":
+				size, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Capture.PreRecordingMaxSize = size
+				}
+				break
 			case "AGENT_CAPTURE_POSTRECORDING":
 				duration, err := strconv.ParseInt(value, 10, 64)
 				if err == nil {
@@ -277,12 +459,18 @@ func OverrideWithEnvironmentVariables(configuration *models.Configuration) {
 					configuration.Config.Capture.MaxLengthRecording = duration
 				}
 				break
+			case "AGENT_CAPTURE_ALIGN_SEGMENTS":
+				configuration.Config.Capture.AlignSegments = value
+				break
 			case "AGENT_CAPTURE_PIXEL_CHANGE":
 				count, err := strconv.Atoi(value)
 				if err == nil {
 					configuration.Config.Capture.PixelChangeThreshold = count
 				}
 				break
+			case "AGENT_CAPTURE_CONTAINER":
+				configuration.Config.Capture.Container = value
+				break
 			case "AGENT_CAPTURE_FRAGMENTED":
 				configuration.Config.Capture.Fragmented = value
 				break
@@ -292,6 +480,36 @@ func OverrideWithEnvironmentVariables(configuration *models.Configuration) {
 					configuration.Config.Capture.FragmentedDuration = duration
 				}
 				break
+			case "AGENT_CAPTURE_HLS":
+				configuration.Config.Capture.HLS = value
+				break
+			case "AGENT_CAPTURE_HLS_LOWLATENCY":
+				configuration.Config.Capture.HLSLowLatency = value
+				break
+			case "AGENT_CAPTURE_HLS_SEGMENT_DURATION":
+				duration, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Capture.HLSSegmentDuration = duration
+				}
+				break
+			case "AGENT_CAPTURE_HLS_PART_DURATION":
+				duration, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Capture.HLSPartDuration = duration
+				}
+				break
+			case "AGENT_CAPTURE_SUB_RECORDING":
+				configuration.Config.Capture.SubRecording = value
+				break
+			case "AGENT_CAPTURE_PREVIEW":
+				configuration.Config.Capture.Preview = value
+				break
+			case "AGENT_CAPTURE_PREVIEW_INTERVAL":
+				interval, err := strconv.ParseInt(value, 10, 64)
+				if err == nil {
+					configuration.Config.Capture.PreviewInterval = interval
+				}
+				break
 
 			/* Conditions */
 
@@ -470,12 +688,95 @@ func OverrideWithEnvironmentVariables(configuration *models.Configuration) {
 			case "AGENT_ENCRYPTION_SYMMETRIC_KEY":
 				configuration.Config.Encryption.SymmetricKey = value
 				break
+			case "AGENT_ENCRYPTION_UPLOAD_FORMAT":
+				configuration.Config.Encryption.UploadFormat = value
+				break
+
+			/* Multi-camera mode */
+			case "AGENT_CAMERAS":
+				var cameras []models.CameraConfig
+				err := json.Unmarshal([]byte(value), &cameras)
+				if err == nil {
+					configuration.Config.Cameras = cameras
+				} else {
+					log.Log.Error("config.main.OverrideWithEnvironmentVariables(): AGENT_CAMERAS is not valid: " + err.Error())
+				}
+				break
 			}
 		}
 	}
+
+	// The settings of a camera take precedence over the environment variables, which apply to every camera.
+	if configuration.CameraID != "" {
+		applyCameraSettings(configuration)
+	}
+}
+
+// CameraConfiguration returns the configuration of a camera in multi-camera mode, the settings of the
+// agent with the settings of the camera on top.
+func CameraConfiguration(configuration *models.Configuration, id string) *models.Configuration {
+	cameraConfiguration := &models.Configuration{
+		Name:         configuration.Name,
+		Port:         configuration.Port,
+		CameraID:     id,
+		Config:       configuration.Config,
+		CustomConfig: configuration.CustomConfig,
+		GlobalConfig: configuration.GlobalConfig,
+	}
+	applyCameraSettings(cameraConfiguration)
+	return cameraConfiguration
+}
+
+// applyCameraSettings merges the settings of the camera into the configuration. The configuration is
+// copied first, so the camera doesn't share any settings (pointers) with the agent or other cameras.
+// A camera without a name or key gets one based on its ID.
+func applyCameraSettings(configuration *models.Configuration) {
+	agentKey := configuration.Config.Key
+	var settings map[string]interface{}
+	for _, camera := range configuration.Config.Cameras {
+		if camera.ID == configuration.CameraID {
+			settings = camera.Settings
+			break
+		}
+	}
+
+	if settings == nil {
+		log.Log.Error("config.main.applyCameraSettings(): camera " + configuration.CameraID + " is not configured")
+	}
+
+	// We start without the agent's key and name, so a camera never inherits them.
+	var config models.Config
+	data, err := json.Marshal(configuration.Config)
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+	}
+	config.Key = ""
+	config.Name = ""
+	if err == nil && settings != nil {
+		if data, err = json.Marshal(settings); err == nil {
+			err = json.Unmarshal(data, &config)
+		}
+	}
+	if err != nil {
+		log.Log.Error("config.main.applyCameraSettings(): settings of camera " + configuration.CameraID + " are not valid: " + err.Error())
+		return
+	}
+
+	if config.Key == "" {
+		config.Key = agentKey + "-" + configuration.CameraID
+	}
+	if config.Name == "" {
+		config.Name = configuration.CameraID
+	}
+	config.Cameras = nil
+	configuration.Config = config
 }
 
 func SaveConfig(configDirectory string, config models.Config, configuration *models.Configuration, communication *models.Communication) error {
+	// The settings of a camera (multi-camera mode) are part of the configuration of the agent.
+	if configuration.CameraID != "" {
+		return errors.New("the configuration of camera " + configuration.CameraID + " is part of the agent's configuration")
+	}
 	if !communication.IsConfiguring.IsSet() {
 		communication.IsConfiguring.Set()
 
@@ -502,6 +803,47 @@ func SaveConfig(configDirectory string, config models.Config, configuration *mod
 	}
 }
 
+// SaveCameraConfig stores the settings of a camera (multi-camera mode) in the configuration of the agent,
+// and restarts the camera. The settings override the settings of the agent, like in the cameras list.
+func SaveCameraConfig(configDirectory string, settings map[string]interface{}, configuration *models.Configuration, communication *models.Communication) error {
+	if configuration.CameraID == "" {
+		return errors.New("the agent is not running in multi-camera mode")
+	}
+	if communication.IsConfiguring.IsSet() {
+		return errors.New("☄ Already reconfiguring")
+	}
+	communication.IsConfiguring.Set()
+	defer communication.IsConfiguring.UnSet()
+
+	// We read the configuration of the agent as it's stored, without the environment variables.
+	var agentConfiguration models.Configuration
+	OpenConfig(configDirectory, &agentConfiguration)
+	found := false
+	for i, camera := range agentConfiguration.Config.Cameras {
+		if camera.ID == configuration.CameraID {
+			agentConfiguration.Config.Cameras[i].Settings = settings
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("camera " + configuration.CameraID + " is not part of the agent's configuration")
+	}
+	if err := StoreConfig(configDirectory, agentConfiguration.Config); err != nil {
+		return err
+	}
+
+	if communication.CameraConnected {
+		select {
+		case communication.HandleBootstrap <- "restart":
+			log.Log.Info("config.main.SaveCameraConfig(): update config, restart camera " + configuration.CameraID + ".")
+		case <-time.After(1 * time.Second):
+			log.Log.Info("config.main.SaveCameraConfig(): update config, restart camera " + configuration.CameraID + " timed out.")
+		}
+	}
+	return nil
+}
+
 func StoreConfig(configDirectory string, config models.Config) error {
 
 	// Encryption key can be set wrong.
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The gaps in the continuous recordings can't be derived from the recordings on disk (as recordings
+// are removed by the retention), so they are stored in their own bucket of the index.
+
+func gapKey(startTime int64, cameraKey string) []byte {
+	key := make([]byte, 8+len(cameraKey))
+	binary.BigEndian.PutUint64(key, uint64(startTime))
+	copy(key[8:], cameraKey)
+	return key
+}
+
+// AddGap stores an interval without footage.
+func AddGap(gap models.RecordingGap) {
+	db := getIndex()
+	if db == nil {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(gap)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(gapsBucket).Put(gapKey(gap.Start, gap.CameraKey), data)
+	})
+	if err != nil {
+		log.Log.Error("database.gaps.AddGap(): " + err.Error())
+	}
+}
+
+// ListGaps returns the gaps that overlap the range [from, to) (milliseconds), from old to new.
+// A range of 0 is unbounded. If a camera key is given, only the gaps of that camera are returned.
+func ListGaps(from int64, to int64, cameraKey string) ([]models.RecordingGap, error) {
+	gaps := []models.RecordingGap{}
+	db := getIndex()
+	if db == nil {
+		return gaps, ErrIndexNotAvailable
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(gapsBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var gap models.RecordingGap
+			if json.Unmarshal(v, &gap) != nil {
+				continue
+			}
+			if to > 0 && gap.Start >= to {
+				break
+			}
+			if gap.End > from && (cameraKey == "" || gap.CameraKey == cameraKey) {
+				gaps = append(gaps, gap)
+			}
+		}
+		return nil
+	})
+	return gaps, err
+}
+
+// RemoveGapsBefore removes the gaps that ended before a timestamp (milliseconds), as there
+// is no footage left around them.
+func RemoveGapsBefore(timestamp int64) {
+	db := getIndex()
+	if db == nil {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(gapsBucket)
+		c := bucket.Cursor()
+		var remove [][]byte
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var gap models.RecordingGap
+			if json.Unmarshal(v, &gap) == nil && gap.End >= timestamp {
+				break
+			}
+			remove = append(remove, append([]byte(nil), k...))
+		}
+		for _, k := range remove {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Log.Error("database.gaps.RemoveGapsBefore(): " + err.Error())
+	}
+}
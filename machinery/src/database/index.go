@@ -0,0 +1,534 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The recording index is an embedded (bbolt) database, stored in data/index.db. It keeps
+// track of the recordings in data/recordings, so the media APIs don't need to scan (and sort)
+// the recordings directory on every request. It is rebuilt from disk when the agent starts.
+// A recording of the sub stream (sub/<name>) is only indexed once its main recording is removed.
+//
+// Buckets:
+//
+//	recordings: filename -> IndexedRecording (JSON)
+//	timeline:   start time (8 bytes, milliseconds) + filename -> nothing, ordered by time
+//	gaps:       start time (8 bytes, milliseconds) -> RecordingGap (JSON), not rebuilt from disk
+var (
+	recordingsBucket = []byte("recordings")
+	timelineBucket   = []byte("timeline")
+	gapsBucket       = []byte("gaps")
+)
+
+var (
+	index      *bolt.DB
+	indexMutex sync.RWMutex
+)
+
+// ErrIndexNotAvailable is returned when the index couldn't be opened.
+var ErrIndexNotAvailable = errors.New("recording index is not available")
+
+// IndexedRecording is how a recording is stored in the index.
+type IndexedRecording struct {
+	Name          string                    `json:"name"`
+	Timestamp     int64                     `json:"timestamp"`  // Unix timestamp in seconds.
+	StartTime     int64                     `json:"start_time"` // Unix timestamp in milliseconds.
+	Size          int64                     `json:"size"`
+	PendingUpload bool                      `json:"pending_upload"`
+	Metadata      *models.RecordingMetadata `json:"metadata,omitempty"`
+}
+
+func timelineKey(startTime int64, name string) []byte {
+	key := make([]byte, 8+len(name))
+	binary.BigEndian.PutUint64(key, uint64(startTime))
+	copy(key[8:], name)
+	return key
+}
+
+func getIndex() *bolt.DB {
+	indexMutex.RLock()
+	defer indexMutex.RUnlock()
+	return index
+}
+
+// IndexAvailable returns true if the recording index is open.
+func IndexAvailable() bool {
+	return getIndex() != nil
+}
+
+// OpenIndex opens (or creates) the recording index in the data directory.
+func OpenIndex(configDirectory string) error {
+	db, err := bolt.Open(configDirectory+"/data/index.db", 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{recordingsBucket, timelineBucket, gapsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	indexMutex.Lock()
+	index = db
+	indexMutex.Unlock()
+	return nil
+}
+
+// CloseIndex closes the recording index.
+func CloseIndex() {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+	if index != nil {
+		index.Close()
+		index = nil
+	}
+}
+
+// newIndexedRecording describes a recording on disk, it returns false if it isn't a (valid) recording.
+func newIndexedRecording(configDirectory string, fileName string) (IndexedRecording, bool) {
+	recordingDirectory := configDirectory + "/data/recordings"
+	if !utils.IsRecording(fileName) {
+		return IndexedRecording{}, false
+	}
+	info, err := os.Stat(recordingDirectory + "/" + fileName)
+	if err != nil || !info.Mode().IsRegular() {
+		return IndexedRecording{}, false
+	}
+	timestamp, metadata, ok := utils.GetRecordingTimestamp(recordingDirectory, fileName)
+	if !ok {
+		return IndexedRecording{}, false
+	}
+	startTime := timestamp * 1000
+	if metadata != nil && metadata.StartTime > 0 {
+		startTime = metadata.StartTime
+	}
+	_, err = os.Stat(configDirectory + "/data/cloud/" + fileName)
+	return IndexedRecording{
+		Name:          fileName,
+		Timestamp:     timestamp,
+		StartTime:     startTime,
+		Size:          info.Size(),
+		PendingUpload: err == nil,
+		Metadata:      metadata,
+	}, true
+}
+
+func putRecording(tx *bolt.Tx, recording IndexedRecording) error {
+	recordings := tx.Bucket(recordingsBucket)
+	timeline := tx.Bucket(timelineBucket)
+
+	// The start time might have changed, so remove the previous position in the timeline.
+	if data := recordings.Get([]byte(recording.Name)); data != nil {
+		var previous IndexedRecording
+		if json.Unmarshal(data, &previous) == nil {
+			if err := timeline.Delete(timelineKey(previous.StartTime, previous.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	data, err := json.Marshal(recording)
+	if err != nil {
+		return err
+	}
+	if err := recordings.Put([]byte(recording.Name), data); err != nil {
+		return err
+	}
+	return timeline.Put(timelineKey(recording.StartTime, recording.Name), nil)
+}
+
+// ScanRecordings reads all recordings from disk, from old to new. This is slow for large directories,
+// it's used to rebuild the index, or when the index is not available. Recordings of the sub stream
+// are included when their main recording was removed, so they take its place.
+func ScanRecordings(configDirectory string) ([]IndexedRecording, error) {
+	recordings := []IndexedRecording{}
+	files, err := os.ReadDir(configDirectory + "/data/recordings")
+	if err != nil {
+		return recordings, err
+	}
+	for _, file := range files {
+		if recording, ok := newIndexedRecording(configDirectory, file.Name()); ok {
+			recordings = append(recordings, recording)
+		}
+	}
+	subRecordings, _ := ScanSubRecordings(configDirectory)
+	for _, recording := range subRecordings {
+		if !HasMainRecording(configDirectory, recording) {
+			recordings = append(recordings, recording)
+		}
+	}
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].StartTime < recordings[j].StartTime
+	})
+	return recordings, nil
+}
+
+// ScanSubRecordings reads all recordings of the sub stream (data/recordings/sub) from disk, from old to new.
+// The names are relative to data/recordings.
+func ScanSubRecordings(configDirectory string) ([]IndexedRecording, error) {
+	recordings := []IndexedRecording{}
+	files, err := os.ReadDir(configDirectory + "/data/recordings/" + utils.SubRecordingsDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return recordings, nil
+		}
+		return recordings, err
+	}
+	for _, file := range files {
+		if recording, ok := newIndexedRecording(configDirectory, utils.SubRecordingsDirectory+"/"+file.Name()); ok {
+			recordings = append(recordings, recording)
+		}
+	}
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].StartTime < recordings[j].StartTime
+	})
+	return recordings, nil
+}
+
+// HasMainRecording returns true if the main recording, that belongs to a recording of the sub stream, still exists.
+func HasMainRecording(configDirectory string, recording IndexedRecording) bool {
+	mainRecording := strings.TrimPrefix(recording.Name, utils.SubRecordingsDirectory+"/")
+	if recording.Metadata != nil && recording.Metadata.MainRecording != "" {
+		mainRecording = recording.Metadata.MainRecording
+	}
+	_, err := os.Stat(configDirectory + "/data/recordings/" + mainRecording)
+	return err == nil
+}
+
+// ListRecordings returns all recordings in the index, from old to new.
+func ListRecordings() ([]IndexedRecording, error) {
+	recordings := []IndexedRecording{}
+	db := getIndex()
+	if db == nil {
+		return recordings, ErrIndexNotAvailable
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(recordingsBucket)
+		c := tx.Bucket(timelineBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			var recording IndexedRecording
+			if data := bucket.Get(k[8:]); data != nil && json.Unmarshal(data, &recording) == nil {
+				recordings = append(recordings, recording)
+			}
+		}
+		return nil
+	})
+	return recordings, err
+}
+
+// RebuildIndex drops the index, and adds all recordings that are stored on disk.
+func RebuildIndex(configDirectory string) error {
+	db := getIndex()
+	if db == nil {
+		return ErrIndexNotAvailable
+	}
+	start := time.Now()
+	recordings, err := ScanRecordings(configDirectory)
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{recordingsBucket, timelineBucket} {
+			if err := tx.DeleteBucket(bucket); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+		for _, recording := range recordings {
+			if err := putRecording(tx, recording); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		log.Log.Info("database.index.RebuildIndex(): indexed " + strconv.Itoa(len(recordings)) + " recordings in " + time.Since(start).String())
+	}
+	return err
+}
+
+// IndexRecording adds (or updates) a recording in the index, the recording should be stored in data/recordings.
+func IndexRecording(configDirectory string, fileName string) {
+	db := getIndex()
+	if db == nil {
+		return
+	}
+	recording, ok := newIndexedRecording(configDirectory, fileName)
+	if !ok {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		return putRecording(tx, recording)
+	})
+	if err != nil {
+		log.Log.Error("database.index.IndexRecording(): " + err.Error())
+	}
+}
+
+// RemoveFromIndex removes a recording from the index.
+func RemoveFromIndex(fileName string) {
+	db := getIndex()
+	if db == nil {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		recordings := tx.Bucket(recordingsBucket)
+		data := recordings.Get([]byte(fileName))
+		if data == nil {
+			return nil
+		}
+		var recording IndexedRecording
+		if err := json.Unmarshal(data, &recording); err == nil {
+			if err := tx.Bucket(timelineBucket).Delete(timelineKey(recording.StartTime, recording.Name)); err != nil {
+				return err
+			}
+		}
+		return recordings.Delete([]byte(fileName))
+	})
+	if err != nil {
+		log.Log.Error("database.index.RemoveFromIndex(): " + err.Error())
+	}
+}
+
+// SetPendingUpload updates whether a recording (in the index) is still waiting to be uploaded.
+func SetPendingUpload(fileName string, pending bool) {
+	db := getIndex()
+	if db == nil {
+		return
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		recordings := tx.Bucket(recordingsBucket)
+		data := recordings.Get([]byte(fileName))
+		if data == nil {
+			return nil
+		}
+		var recording IndexedRecording
+		if err := json.Unmarshal(data, &recording); err != nil {
+			return err
+		}
+		recording.PendingUpload = pending
+		data, err := json.Marshal(recording)
+		if err != nil {
+			return err
+		}
+		return recordings.Put([]byte(fileName), data)
+	})
+	if err != nil {
+		log.Log.Error("database.index.SetPendingUpload(): " + err.Error())
+	}
+}
+
+// CameraKey returns the key the recordings of a camera are filtered on in multi-camera mode. It's
+// empty for a single camera, all the recordings are its own.
+func CameraKey(configuration *models.Configuration) string {
+	if configuration.CameraID == "" {
+		return ""
+	}
+	return configuration.Config.Key
+}
+
+// CountRecordings returns the number of recordings in the index, of a camera if a camera key is given.
+func CountRecordings(cameraKey string) (int, error) {
+	db := getIndex()
+	if db == nil {
+		return 0, ErrIndexNotAvailable
+	}
+	count := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		recordings := tx.Bucket(recordingsBucket)
+		if cameraKey == "" {
+			count = recordings.Stats().KeyN
+			return nil
+		}
+		return recordings.ForEach(func(k, v []byte) error {
+			if isCameraRecording(v, cameraKey) {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+// isCameraRecording returns true if the indexed recording (JSON) belongs to the camera.
+func isCameraRecording(data []byte, cameraKey string) bool {
+	var recording IndexedRecording
+	if data == nil || json.Unmarshal(data, &recording) != nil {
+		return false
+	}
+	return recording.Metadata != nil && recording.Metadata.CameraKey == cameraKey
+}
+
+func matchesFilter(recording IndexedRecording, eventFilter models.EventFilter) bool {
+	if eventFilter.CameraKey != "" {
+		if recording.Metadata == nil || recording.Metadata.CameraKey != eventFilter.CameraKey {
+			return false
+		}
+	}
+	if eventFilter.Trigger != "" {
+		if recording.Metadata == nil || recording.Metadata.Trigger != eventFilter.Trigger {
+			return false
+		}
+	}
+	if eventFilter.Region != "" {
+		if recording.Metadata == nil {
+			return false
+		}
+		found := false
+		for _, region := range recording.Metadata.Regions {
+			if region == eventFilter.Region {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryRecordings returns the recordings that match the filter, from new to old. If there are more
+// recordings, a cursor is returned which can be used (in the filter) to retrieve the next page.
+func QueryRecordings(configDirectory string, configuration *models.Configuration, eventFilter models.EventFilter) ([]models.Media, string, error) {
+	medias := []models.Media{}
+	db := getIndex()
+	if db == nil {
+		return medias, "", ErrIndexNotAvailable
+	}
+
+	// The range we are looking at, in milliseconds: [lower, upper).
+	var lower, upper int64
+	if eventFilter.TimestampOffsetStart > 0 {
+		lower = eventFilter.TimestampOffsetStart * 1000
+	}
+	if eventFilter.TimestampOffsetEnd > 0 {
+		upper = eventFilter.TimestampOffsetEnd * 1000
+	}
+	if eventFilter.Day != "" {
+		loc, _ := time.LoadLocation(configuration.Config.Timezone)
+		day, err := time.ParseInLocation("02-01-2006", eventFilter.Day, loc)
+		if err != nil {
+			return medias, "", errors.New("invalid day, expected DD-MM-YYYY")
+		}
+		if dayStart := day.UnixMilli(); dayStart > lower {
+			lower = dayStart
+		}
+		if dayEnd := day.AddDate(0, 0, 1).UnixMilli(); upper == 0 || dayEnd < upper {
+			upper = dayEnd
+		}
+	}
+
+	// The cursor is the position of the last recording of the previous page.
+	var seek []byte
+	if eventFilter.Cursor != "" {
+		cursor, err := base64.RawURLEncoding.DecodeString(eventFilter.Cursor)
+		if err != nil || len(cursor) < 8 {
+			return medias, "", errors.New("invalid cursor")
+		}
+		seek = cursor
+	}
+	if upper > 0 {
+		if upperKey := timelineKey(upper, ""); seek == nil || bytes.Compare(upperKey, seek) < 0 {
+			seek = upperKey
+		}
+	}
+
+	recordingDirectory := configDirectory + "/data/recordings"
+	nextCursor := ""
+	err := db.View(func(tx *bolt.Tx) error {
+		recordings := tx.Bucket(recordingsBucket)
+		c := tx.Bucket(timelineBucket).Cursor()
+
+		var k, lastKey []byte
+		if seek == nil {
+			k, _ = c.Last()
+		} else if k, _ = c.Seek(seek); k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+
+		for ; k != nil; k, _ = c.Prev() {
+			if int64(binary.BigEndian.Uint64(k[:8])) < lower {
+				break
+			}
+			data := recordings.Get(k[8:])
+			if data == nil {
+				continue
+			}
+			var recording IndexedRecording
+			if err := json.Unmarshal(data, &recording); err != nil {
+				continue
+			}
+			if !matchesFilter(recording, eventFilter) {
+				continue
+			}
+			if eventFilter.NumberOfElements > 0 && len(medias) >= eventFilter.NumberOfElements {
+				// There are more recordings, so we return a cursor to the last one we returned.
+				nextCursor = base64.RawURLEncoding.EncodeToString(lastKey)
+				break
+			}
+			medias = append(medias, utils.NewMedia(recording.Name, recordingDirectory, recording.Timestamp, recording.Metadata, configuration))
+			lastKey = append(lastKey[:0], k...)
+		}
+		return nil
+	})
+	return medias, nextCursor, err
+}
+
+// GetIndexedDays returns the days (DD-MM-YYYY) on which recordings were made, from new to old.
+// In multi-camera mode only the days of the camera are returned.
+func GetIndexedDays(configuration *models.Configuration) ([]string, error) {
+	days := []string{}
+	db := getIndex()
+	if db == nil {
+		return days, ErrIndexNotAvailable
+	}
+	loc, _ := time.LoadLocation(configuration.Config.Timezone)
+	cameraKey := CameraKey(configuration)
+	err := db.View(func(tx *bolt.Tx) error {
+		recordings := tx.Bucket(recordingsBucket)
+		c := tx.Bucket(timelineBucket).Cursor()
+		for k, _ := c.Last(); k != nil; {
+			if cameraKey != "" && !isCameraRecording(recordings.Get(k[8:]), cameraKey) {
+				k, _ = c.Prev()
+				continue
+			}
+			startTime := time.UnixMilli(int64(binary.BigEndian.Uint64(k[:8]))).In(loc)
+			days = append(days, startTime.Format("02-01-2006"))
+
+			// Jump to the last recording of the previous day.
+			dayStart := time.Date(startTime.Year(), startTime.Month(), startTime.Day(), 0, 0, 0, 0, loc)
+			if k, _ = c.Seek(timelineKey(dayStart.UnixMilli(), "")); k == nil {
+				k, _ = c.Last()
+			} else {
+				k, _ = c.Prev()
+			}
+		}
+		return nil
+	})
+	return days, err
+}
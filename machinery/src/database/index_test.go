@@ -0,0 +1,261 @@
+package database
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestIndex opens an index in a temporary directory, with the recordings.
+func openTestIndex(t *testing.T, recordings ...IndexedRecording) {
+	t.Helper()
+	configDirectory := t.TempDir()
+	if err := os.MkdirAll(configDirectory+"/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := OpenIndex(configDirectory); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(CloseIndex)
+	err := getIndex().Update(func(tx *bolt.Tx) error {
+		for _, recording := range recordings {
+			if err := putRecording(tx, recording); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRecording(name string, startTime time.Time, cameraKey string, trigger string, regions ...string) IndexedRecording {
+	return IndexedRecording{
+		Name:      name,
+		Timestamp: startTime.Unix(),
+		StartTime: startTime.UnixMilli(),
+		Metadata: &models.RecordingMetadata{
+			CameraKey: cameraKey,
+			StartTime: startTime.UnixMilli(),
+			Trigger:   trigger,
+			Regions:   regions,
+		},
+	}
+}
+
+// testRecordings are recordings of two cameras on two days (UTC).
+func testRecordings() []IndexedRecording {
+	day1 := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	day2 := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	return []IndexedRecording{
+		testRecording("a.mp4", day1.Add(8*time.Hour), "front", "motion", "door"),
+		testRecording("b.mp4", day1.Add(12*time.Hour), "garden", "continuous"),
+		testRecording("c.mp4", day1.Add(23*time.Hour), "front", "motion", "street"),
+		testRecording("d.mp4", day2.Add(1*time.Hour), "front", "manual"),
+		testRecording("e.mp4", day2.Add(9*time.Hour), "garden", "motion", "door"),
+	}
+}
+
+func mediaKeys(medias []models.Media) []string {
+	keys := []string{}
+	for _, media := range medias {
+		keys = append(keys, media.Key)
+	}
+	return keys
+}
+
+func TestQueryRecordings(t *testing.T) {
+	openTestIndex(t, testRecordings()...)
+	configuration := &models.Configuration{}
+	configuration.Config.Timezone = "UTC"
+	day2 := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		filter   models.EventFilter
+		expected []string
+	}{
+		{"all, from new to old", models.EventFilter{}, []string{"e.mp4", "d.mp4", "c.mp4", "b.mp4", "a.mp4"}},
+		{"day", models.EventFilter{Day: "01-03-2024"}, []string{"c.mp4", "b.mp4", "a.mp4"}},
+		{"day without recordings", models.EventFilter{Day: "03-03-2024"}, []string{}},
+		{"timestamp range", models.EventFilter{TimestampOffsetStart: day2.Add(-time.Hour).Unix(), TimestampOffsetEnd: day2.Add(9 * time.Hour).Unix()}, []string{"d.mp4", "c.mp4"}},
+		{"range and day", models.EventFilter{TimestampOffsetStart: day2.Add(-11 * time.Hour).Unix(), Day: "01-03-2024"}, []string{"c.mp4"}},
+		{"trigger", models.EventFilter{Trigger: "motion"}, []string{"e.mp4", "c.mp4", "a.mp4"}},
+		{"region", models.EventFilter{Region: "door"}, []string{"e.mp4", "a.mp4"}},
+		{"camera", models.EventFilter{CameraKey: "front"}, []string{"d.mp4", "c.mp4", "a.mp4"}},
+		{"camera and trigger", models.EventFilter{CameraKey: "garden", Trigger: "motion"}, []string{"e.mp4"}},
+		{"first page", models.EventFilter{NumberOfElements: 2}, []string{"e.mp4", "d.mp4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			medias, _, err := QueryRecordings("", configuration, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys := mediaKeys(medias); !reflect.DeepEqual(keys, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, keys)
+			}
+		})
+	}
+}
+
+func TestQueryRecordingsPages(t *testing.T) {
+	openTestIndex(t, testRecordings()...)
+	configuration := &models.Configuration{}
+	configuration.Config.Timezone = "UTC"
+
+	tests := []struct {
+		name     string
+		filter   models.EventFilter
+		expected [][]string // The pages.
+	}{
+		{"pages of 2", models.EventFilter{NumberOfElements: 2}, [][]string{{"e.mp4", "d.mp4"}, {"c.mp4", "b.mp4"}, {"a.mp4"}}},
+		{"pages of a filter", models.EventFilter{NumberOfElements: 1, CameraKey: "garden"}, [][]string{{"e.mp4"}, {"b.mp4"}}},
+		{"pages of a day", models.EventFilter{NumberOfElements: 2, Day: "01-03-2024"}, [][]string{{"c.mp4", "b.mp4"}, {"a.mp4"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := tt.filter
+			var pages [][]string
+			for len(pages) <= len(tt.expected) {
+				medias, cursor, err := QueryRecordings("", configuration, filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pages = append(pages, mediaKeys(medias))
+				if cursor == "" {
+					break
+				}
+				filter.Cursor = cursor
+			}
+			if !reflect.DeepEqual(pages, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, pages)
+			}
+		})
+	}
+
+	if _, _, err := QueryRecordings("", configuration, models.EventFilter{Cursor: "invalid"}); err == nil {
+		t.Fatal("expected an invalid cursor to be rejected")
+	}
+}
+
+func TestIndexedDaysAndCount(t *testing.T) {
+	openTestIndex(t, testRecordings()...)
+
+	tests := []struct {
+		name     string
+		cameraID string
+		key      string
+		timezone string
+		days     []string
+		count    int
+	}{
+		{"single camera", "", "front", "UTC", []string{"02-03-2024", "01-03-2024"}, 5},
+		{"camera", "frontdoor", "front", "UTC", []string{"02-03-2024", "01-03-2024"}, 3},
+		{"camera on one day", "garden", "garden", "UTC", []string{"02-03-2024", "01-03-2024"}, 2},
+		{"timezone", "", "front", "Europe/Brussels", []string{"02-03-2024", "01-03-2024"}, 5},
+		{"timezone moves a recording to the next day", "frontdoor", "front", "Asia/Tokyo", []string{"02-03-2024", "01-03-2024"}, 3},
+		{"unknown camera", "backyard", "backyard", "UTC", []string{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configuration := &models.Configuration{CameraID: tt.cameraID}
+			configuration.Config.Key = tt.key
+			configuration.Config.Timezone = tt.timezone
+			days, err := GetIndexedDays(configuration)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(days, tt.days) {
+				t.Fatalf("expected the days %v, got %v", tt.days, days)
+			}
+			count, err := CountRecordings(CameraKey(configuration))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.count {
+				t.Fatalf("expected %d recordings, got %d", tt.count, count)
+			}
+		})
+	}
+}
+
+func TestIndexUpdates(t *testing.T) {
+	recordings := testRecordings()
+	openTestIndex(t, recordings...)
+
+	// A recording that gets another start time moves in the timeline.
+	moved := recordings[0]
+	moved.StartTime = time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC).UnixMilli()
+	if err := getIndex().Update(func(tx *bolt.Tx) error { return putRecording(tx, moved) }); err != nil {
+		t.Fatal(err)
+	}
+	RemoveFromIndex("c.mp4")
+	RemoveFromIndex("unknown.mp4")
+	SetPendingUpload("d.mp4", true)
+
+	list, err := ListRecordings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, recording := range list {
+		names = append(names, recording.Name)
+		if recording.PendingUpload != (recording.Name == "d.mp4") {
+			t.Fatalf("%s: unexpected pending upload %v", recording.Name, recording.PendingUpload)
+		}
+	}
+	if expected := []string{"b.mp4", "d.mp4", "e.mp4", "a.mp4"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	if count, _ := CountRecordings(""); count != 4 {
+		t.Fatalf("expected 4 recordings, got %d", count)
+	}
+}
+
+func TestGaps(t *testing.T) {
+	openTestIndex(t)
+	gaps := []models.RecordingGap{
+		{Start: 1000, End: 2000, Reason: "disconnected", CameraKey: "front"},
+		{Start: 1000, End: 1500, Reason: "stream", CameraKey: "garden"},
+		{Start: 5000, End: 9000, Reason: "conditions", CameraKey: "front"},
+	}
+	for _, gap := range gaps {
+		AddGap(gap)
+	}
+
+	tests := []struct {
+		name      string
+		from, to  int64
+		cameraKey string
+		expected  []models.RecordingGap
+	}{
+		{"all", 0, 0, "", gaps},
+		{"camera", 0, 0, "front", []models.RecordingGap{gaps[0], gaps[2]}},
+		{"overlapping the start", 1800, 0, "", []models.RecordingGap{gaps[0], gaps[2]}},
+		{"overlapping the end", 0, 5001, "front", []models.RecordingGap{gaps[0], gaps[2]}},
+		{"before the range", 0, 1000, "", []models.RecordingGap{}},
+		{"between the gaps", 2000, 5000, "", []models.RecordingGap{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := ListGaps(tt.from, tt.to, tt.cameraKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(list, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, list)
+			}
+		})
+	}
+
+	RemoveGapsBefore(3000)
+	if list, _ := ListGaps(0, 0, ""); !reflect.DeepEqual(list, []models.RecordingGap{gaps[2]}) {
+		t.Fatalf("expected the gaps before 3000 to be removed, got %v", list)
+	}
+}
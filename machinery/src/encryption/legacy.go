@@ -0,0 +1,245 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// The number of blocks we decrypt at once, when reading a legacy file.
+const legacyReadBlocks = 4096
+
+// LegacyReader decrypts a file that was encrypted with AesEncrypt (AES-256-CBC), without reading
+// the complete file in memory. As every CBC block only depends on the previous ciphertext block,
+// we can decrypt from any position, so it implements io.ReadSeeker.
+type LegacyReader struct {
+	reader   io.ReadSeeker
+	block    cipher.Block
+	iv       []byte
+	blocks   int64
+	size     int64
+	position int64
+
+	// The blocks we decrypted last, starting at block index bufferStart.
+	buffer      []byte
+	bufferStart int64
+}
+
+// NewLegacyReader reads the salt of a legacy encrypted file, and creates a reader for it.
+func NewLegacyReader(reader io.ReadSeeker, password string) (*LegacyReader, error) {
+	header := make([]byte, 16)
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(reader, header); err != nil || !IsLegacy(header) {
+		return nil, errors.New("invalid crypto js aes encryption")
+	}
+	key, iv, err := DefaultEvpKDF([]byte(password), header[8:16])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fileSize, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	cipherSize := fileSize - 16
+	if cipherSize <= 0 || cipherSize%aes.BlockSize != 0 {
+		return nil, errors.New("invalid crypto js aes encryption")
+	}
+
+	r := &LegacyReader{
+		reader:      reader,
+		block:       block,
+		iv:          iv,
+		blocks:      cipherSize / aes.BlockSize,
+		bufferStart: -1,
+	}
+
+	// The size of the plaintext is defined by the padding in the last block.
+	if err := r.decryptBlocks(r.blocks - 1); err != nil {
+		return nil, err
+	}
+	padding := int64(r.buffer[len(r.buffer)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("invalid padding, wrong key?")
+	}
+	r.size = cipherSize - padding
+	return r, nil
+}
+
+// Size returns the size of the decrypted file.
+func (r *LegacyReader) Size() int64 {
+	return r.size
+}
+
+func (r *LegacyReader) decryptBlocks(first int64) error {
+	count := r.blocks - first
+	if count > legacyReadBlocks {
+		count = legacyReadBlocks
+	}
+	// We also need the previous ciphertext block, which is the IV of the first block we decrypt.
+	offset := 16 + first*aes.BlockSize
+	iv := r.iv
+	if first > 0 {
+		offset -= aes.BlockSize
+	}
+	if _, err := r.reader.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	data := make([]byte, (count+1)*aes.BlockSize)
+	if first > 0 {
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return err
+		}
+		iv = data[:aes.BlockSize]
+		data = data[aes.BlockSize:]
+	} else {
+		data = data[:count*aes.BlockSize]
+		if _, err := io.ReadFull(r.reader, data); err != nil {
+			return err
+		}
+	}
+	buffer := make([]byte, len(data))
+	cipher.NewCBCDecrypter(r.block, iv).CryptBlocks(buffer, data)
+	r.buffer = buffer
+	r.bufferStart = first
+	return nil
+}
+
+// Read decrypts the blocks that hold the requested data.
+func (r *LegacyReader) Read(p []byte) (int, error) {
+	if r.position >= r.size {
+		return 0, io.EOF
+	}
+	read := 0
+	for read < len(p) && r.position < r.size {
+		index := r.position / aes.BlockSize
+		if r.bufferStart < 0 || index < r.bufferStart || index >= r.bufferStart+int64(len(r.buffer)/aes.BlockSize) {
+			if err := r.decryptBlocks(index); err != nil {
+				return read, err
+			}
+		}
+		start := r.position - r.bufferStart*aes.BlockSize
+		end := int64(len(r.buffer))
+		if r.bufferStart*aes.BlockSize+end > r.size {
+			end = r.size - r.bufferStart*aes.BlockSize
+		}
+		n := copy(p[read:], r.buffer[start:end])
+		read += n
+		r.position += int64(n)
+	}
+	return read, nil
+}
+
+// Seek sets the (plaintext) position of the next read.
+func (r *LegacyReader) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = r.position + offset
+	case io.SeekEnd:
+		position = r.size + offset
+	default:
+		return 0, errors.New("encryption.legacy.Seek(): invalid whence")
+	}
+	if position < 0 {
+		return 0, errors.New("encryption.legacy.Seek(): invalid position")
+	}
+	r.position = position
+	return position, nil
+}
+
+// LegacySize returns the size of a file of size bytes, once encrypted with AesEncrypt or a LegacyWriter.
+func LegacySize(size int64) int64 {
+	return 16 + (size/aes.BlockSize+1)*aes.BlockSize
+}
+
+// LegacyWriter encrypts what is written to it in the format of AesEncrypt (AES-256-CBC, openssl and
+// crypto-js compatible), without keeping the complete file in memory. Close writes the padding.
+type LegacyWriter struct {
+	writer io.Writer
+	mode   cipher.BlockMode
+	block  []byte // The part of a block that is written, but not yet encrypted.
+	closed bool
+}
+
+// NewLegacyWriter writes the salt of a legacy encrypted file, and creates a writer for it.
+func NewLegacyWriter(writer io.Writer, password string) (*LegacyWriter, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, iv, err := DefaultEvpKDF([]byte(password), salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(append([]byte("Salted__"), salt...)); err != nil {
+		return nil, err
+	}
+	return &LegacyWriter{
+		writer: writer,
+		mode:   cipher.NewCBCEncrypter(block, iv),
+		block:  make([]byte, 0, aes.BlockSize),
+	}, nil
+}
+
+// Write encrypts the complete blocks, the remainder is kept until the next write.
+func (w *LegacyWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("encryption.legacy.Write(): writer is closed")
+	}
+	written := len(p)
+	if len(w.block) > 0 {
+		n := copy(w.block[len(w.block):aes.BlockSize], p)
+		w.block = w.block[:len(w.block)+n]
+		p = p[n:]
+		if len(w.block) < aes.BlockSize {
+			return written, nil
+		}
+		if err := w.encrypt(w.block); err != nil {
+			return 0, err
+		}
+		w.block = w.block[:0]
+	}
+	for len(p) >= aes.BlockSize {
+		blocks := len(p) - len(p)%aes.BlockSize
+		if blocks > legacyReadBlocks*aes.BlockSize {
+			blocks = legacyReadBlocks * aes.BlockSize
+		}
+		if err := w.encrypt(p[:blocks]); err != nil {
+			return 0, err
+		}
+		p = p[blocks:]
+	}
+	w.block = append(w.block, p...)
+	return written, nil
+}
+
+func (w *LegacyWriter) encrypt(data []byte) error {
+	encrypted := make([]byte, len(data))
+	w.mode.CryptBlocks(encrypted, data)
+	_, err := w.writer.Write(encrypted)
+	return err
+}
+
+// Close encrypts the last (padded) block, it doesn't close the underlying writer.
+func (w *LegacyWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.encrypt(PKCS5Padding(w.block, aes.BlockSize))
+}
@@ -0,0 +1,411 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Recordings are encrypted in chunks with AES-256-GCM, so they can be encrypted while they are
+// written, and decrypted (and seeked) as a stream. The file starts with a header:
+//
+//	magic (7 bytes) | version (1 byte) | chunk size (4 bytes) | salt (16 bytes)
+//
+// followed by the encrypted chunks:
+//
+//	nonce (12 bytes) | ciphertext (chunk size, or less for the final chunk) | tag (16 bytes)
+//
+// The key of a file is derived from the symmetric key and the salt. Every chunk has its own
+// random nonce, and is authenticated together with the header, its index and whether it's the
+// final chunk, so chunks can't be reordered, swapped between files or cut off.
+const (
+	ChunkedMagic        = "KERBENC"
+	ChunkedVersion      = 1
+	ChunkedHeaderSize   = len(ChunkedMagic) + 1 + 4 + chunkedSaltSize
+	DefaultChunkSize    = 64 * 1024
+	chunkedSaltSize     = 16
+	chunkedNonceSize    = 12
+	chunkedTagSize      = 16
+	chunkedOverheadSize = chunkedNonceSize + chunkedTagSize
+)
+
+// IsChunked returns true if the data starts with the header of a chunked encrypted file.
+func IsChunked(data []byte) bool {
+	return len(data) >= len(ChunkedMagic) && string(data[:len(ChunkedMagic)]) == ChunkedMagic
+}
+
+// IsLegacy returns true if the data was encrypted with AesEncrypt (crypto-js compatible).
+func IsLegacy(data []byte) bool {
+	return len(data) >= 8 && string(data[:8]) == "Salted__"
+}
+
+func newChunkCipher(symmetricKey string, salt []byte) (cipher.AEAD, error) {
+	if symmetricKey == "" {
+		return nil, errors.New("encryption.stream.newChunkCipher(): symmetric key should not be empty")
+	}
+	mac := hmac.New(sha256.New, []byte(symmetricKey))
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkAdditionalData(header []byte, index uint64, final bool) []byte {
+	ad := make([]byte, len(header)+9)
+	copy(ad, header)
+	binary.BigEndian.PutUint64(ad[len(header):], index)
+	if final {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
+
+// Writer encrypts everything that is written to it in chunks. It implements io.WriteSeeker, as
+// the MP4 muxer seeks back to the beginning of the file to update the size of the mdat box.
+// Writes are only possible at the end of the file, or in the first chunk, which is kept in
+// memory and encrypted again (with a new nonce) when it changes.
+type Writer struct {
+	writer    io.WriteSeeker
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+
+	// The first chunk, once it's written to the file.
+	firstChunk []byte
+	// The chunk we are currently filling.
+	chunk      []byte
+	chunkIndex uint64
+	// The plaintext offset of the current chunk, the current position and the total size.
+	chunkStart int64
+	position   int64
+	size       int64
+	closed     bool
+}
+
+// NewWriter creates a writer that encrypts with the symmetric key, and writes the header.
+func NewWriter(writer io.WriteSeeker, symmetricKey string) (*Writer, error) {
+	salt := make([]byte, chunkedSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newChunkCipher(symmetricKey, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, ChunkedHeaderSize)
+	copy(header, ChunkedMagic)
+	header[len(ChunkedMagic)] = ChunkedVersion
+	binary.BigEndian.PutUint32(header[len(ChunkedMagic)+1:], DefaultChunkSize)
+	copy(header[len(ChunkedMagic)+5:], salt)
+	if _, err := writer.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		writer:    writer,
+		aead:      aead,
+		header:    header,
+		chunkSize: DefaultChunkSize,
+		chunk:     make([]byte, 0, DefaultChunkSize),
+	}, nil
+}
+
+func (w *Writer) sealChunk(index uint64, plaintext []byte, final bool) ([]byte, error) {
+	nonce := make([]byte, chunkedNonceSize, chunkedNonceSize+len(plaintext)+chunkedTagSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, plaintext, chunkAdditionalData(w.header, index, final)), nil
+}
+
+func (w *Writer) flushChunk(final bool) error {
+	record, err := w.sealChunk(w.chunkIndex, w.chunk, final)
+	if err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(record); err != nil {
+		return err
+	}
+	if w.chunkIndex == 0 {
+		w.firstChunk = append([]byte(nil), w.chunk...)
+	}
+	w.chunkIndex++
+	w.chunkStart += int64(len(w.chunk))
+	w.chunk = w.chunk[:0]
+	return nil
+}
+
+// Write encrypts and writes the data, a chunk is written to the file once it's full.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("encryption.stream.Write(): writer is closed")
+	}
+
+	// Overwriting the first chunk, after it was written to the file.
+	if w.position < w.chunkStart {
+		if w.firstChunk == nil || w.position+int64(len(p)) > int64(len(w.firstChunk)) {
+			return 0, errors.New("encryption.stream.Write(): can only overwrite the first chunk")
+		}
+		copy(w.firstChunk[w.position:], p)
+		record, err := w.sealChunk(0, w.firstChunk, false)
+		if err != nil {
+			return 0, err
+		}
+		end, err := w.writer.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := w.writer.Seek(int64(ChunkedHeaderSize), io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := w.writer.Write(record); err != nil {
+			return 0, err
+		}
+		if _, err := w.writer.Seek(end, io.SeekStart); err != nil {
+			return 0, err
+		}
+		w.position += int64(len(p))
+		return len(p), nil
+	}
+
+	written := 0
+	for written < len(p) {
+		// A full chunk is only written once we are appending to the next one,
+		// as we might still seek back into it.
+		if len(w.chunk) == w.chunkSize && w.position == w.size {
+			if err := w.flushChunk(false); err != nil {
+				return written, err
+			}
+		}
+		offset := int(w.position - w.chunkStart)
+		end := offset + len(p) - written
+		if end > w.chunkSize {
+			end = w.chunkSize
+		}
+		if end > len(w.chunk) {
+			w.chunk = w.chunk[:end]
+		}
+		n := copy(w.chunk[offset:end], p[written:])
+		written += n
+		w.position += int64(n)
+		if w.position > w.size {
+			w.size = w.position
+		}
+	}
+	return written, nil
+}
+
+// Seek sets the (plaintext) position of the next write.
+func (w *Writer) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = w.position + offset
+	case io.SeekEnd:
+		position = w.size + offset
+	default:
+		return 0, errors.New("encryption.stream.Seek(): invalid whence")
+	}
+	if position < 0 || position > w.size {
+		return 0, errors.New("encryption.stream.Seek(): invalid position")
+	}
+	w.position = position
+	return position, nil
+}
+
+// Close writes the final chunk, it doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flushChunk(true)
+}
+
+// Reader decrypts a chunked encrypted file. It implements io.ReadSeeker, so it can be used
+// to serve (a range of) a recording without decrypting the whole file.
+type Reader struct {
+	reader    io.ReadSeeker
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int64
+	chunks    int64
+	size      int64
+	position  int64
+
+	// The last chunk we decrypted, we keep it as reads are typically sequential.
+	chunk      []byte
+	chunkIndex int64
+}
+
+// NewReader reads the header of a chunked encrypted file, and creates a reader for it.
+func NewReader(reader io.ReadSeeker, symmetricKey string) (*Reader, error) {
+	header := make([]byte, ChunkedHeaderSize)
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, errors.New("encryption.stream.NewReader(): invalid header")
+	}
+	if !IsChunked(header) {
+		return nil, errors.New("encryption.stream.NewReader(): not a chunked encrypted file")
+	}
+	if header[len(ChunkedMagic)] != ChunkedVersion {
+		return nil, errors.New("encryption.stream.NewReader(): unsupported version")
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[len(ChunkedMagic)+1:]))
+	if chunkSize == 0 {
+		return nil, errors.New("encryption.stream.NewReader(): invalid chunk size")
+	}
+	aead, err := newChunkCipher(symmetricKey, header[len(ChunkedMagic)+5:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Calculate the size of the plaintext, the final chunk is the only one which might be smaller.
+	fileSize, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	bodySize := fileSize - int64(ChunkedHeaderSize)
+	recordSize := chunkSize + chunkedOverheadSize
+	chunks := (bodySize + recordSize - 1) / recordSize
+	if chunks == 0 || bodySize-(chunks-1)*recordSize < chunkedOverheadSize {
+		return nil, errors.New("encryption.stream.NewReader(): file is truncated")
+	}
+
+	return &Reader{
+		reader:     reader,
+		aead:       aead,
+		header:     header,
+		chunkSize:  chunkSize,
+		chunks:     chunks,
+		size:       bodySize - chunks*chunkedOverheadSize,
+		chunkIndex: -1,
+	}, nil
+}
+
+// Size returns the size of the decrypted file.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) readChunk(index int64) error {
+	if index == r.chunkIndex {
+		return nil
+	}
+	recordSize := r.chunkSize + chunkedOverheadSize
+	if _, err := r.reader.Seek(int64(ChunkedHeaderSize)+index*recordSize, io.SeekStart); err != nil {
+		return err
+	}
+	record := make([]byte, recordSize)
+	n, err := io.ReadFull(r.reader, record)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n < chunkedOverheadSize {
+		return errors.New("encryption.stream.Read(): chunk is truncated")
+	}
+	record = record[:n]
+	final := index == r.chunks-1
+	chunk, err := r.aead.Open(record[chunkedNonceSize:chunkedNonceSize], record[:chunkedNonceSize], record[chunkedNonceSize:], chunkAdditionalData(r.header, uint64(index), final))
+	if err != nil {
+		return errors.New("encryption.stream.Read(): chunk could not be authenticated")
+	}
+	r.chunk = chunk
+	r.chunkIndex = index
+	return nil
+}
+
+// Read decrypts the chunks that hold the requested data.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.position >= r.size {
+		return 0, io.EOF
+	}
+	read := 0
+	for read < len(p) && r.position < r.size {
+		if err := r.readChunk(r.position / r.chunkSize); err != nil {
+			return read, err
+		}
+		n := copy(p[read:], r.chunk[r.position%r.chunkSize:])
+		read += n
+		r.position += int64(n)
+	}
+	return read, nil
+}
+
+// Seek sets the (plaintext) position of the next read.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = r.position + offset
+	case io.SeekEnd:
+		position = r.size + offset
+	default:
+		return 0, errors.New("encryption.stream.Seek(): invalid whence")
+	}
+	if position < 0 {
+		return 0, errors.New("encryption.stream.Seek(): invalid position")
+	}
+	r.position = position
+	return position, nil
+}
+
+// RecoverChunks decrypts the chunks of a file that was not closed properly (the final chunk is
+// missing, or the last chunk is incomplete), and writes the plaintext of all chunks that can be
+// authenticated. It returns the number of plaintext bytes that were recovered.
+func RecoverChunks(reader io.ReadSeeker, symmetricKey string, writer io.Writer) (int64, error) {
+	header := make([]byte, ChunkedHeaderSize)
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(reader, header); err != nil || !IsChunked(header) || header[len(ChunkedMagic)] != ChunkedVersion {
+		return 0, errors.New("encryption.stream.RecoverChunks(): invalid header")
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[len(ChunkedMagic)+1:]))
+	aead, err := newChunkCipher(symmetricKey, header[len(ChunkedMagic)+5:])
+	if err != nil {
+		return 0, err
+	}
+
+	var recovered int64
+	record := make([]byte, chunkSize+chunkedOverheadSize)
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(reader, record)
+		if n < chunkedOverheadSize {
+			return recovered, nil
+		}
+		// The chunk might be the final one (if the file was closed after all), or a regular one.
+		var chunk []byte
+		var errOpen error
+		for _, final := range []bool{false, true} {
+			chunk, errOpen = aead.Open(nil, record[:chunkedNonceSize], record[chunkedNonceSize:n], chunkAdditionalData(header, index, final))
+			if errOpen == nil {
+				break
+			}
+		}
+		if errOpen != nil {
+			return recovered, nil
+		}
+		if _, err := writer.Write(chunk); err != nil {
+			return recovered, err
+		}
+		recovered += int64(len(chunk))
+		if err != nil {
+			return recovered, nil
+		}
+	}
+}
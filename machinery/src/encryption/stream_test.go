@@ -0,0 +1,343 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+const testKey = "96ab185a8ec2f3bd9ff3c1f4db6a59c6"
+
+// memFile is an in-memory io.WriteSeeker, like the recording file the writer encrypts into.
+type memFile struct {
+	data     []byte
+	position int
+}
+
+func (m *memFile) Write(p []byte) (int, error) {
+	if end := m.position + len(p); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+	copy(m.data[m.position:], p)
+	m.position += len(p)
+	return len(p), nil
+}
+
+func (m *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		m.position = int(offset)
+	case io.SeekCurrent:
+		m.position += int(offset)
+	case io.SeekEnd:
+		m.position = len(m.data) + int(offset)
+	}
+	if m.position < 0 {
+		return 0, errors.New("invalid position")
+	}
+	return int64(m.position), nil
+}
+
+func testPlaintext(size int) []byte {
+	plaintext := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(plaintext)
+	return plaintext
+}
+
+// encrypt writes the plaintext in pieces of the write size, and returns the encrypted file.
+func encrypt(t *testing.T, plaintext []byte, writeSize int) []byte {
+	t.Helper()
+	var file memFile
+	writer, err := NewWriter(&file, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(plaintext); i += writeSize {
+		end := i + writeSize
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		if _, err := writer.Write(plaintext[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file.data
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		writeSize int
+	}{
+		{"empty", 0, 1},
+		{"single byte", 1, 1},
+		{"less than a chunk", DefaultChunkSize - 1, 4096},
+		{"exactly a chunk", DefaultChunkSize, 4096},
+		{"a chunk and a byte", DefaultChunkSize + 1, 4096},
+		{"multiple chunks", 3*DefaultChunkSize + 123, 1000},
+		{"writes larger than a chunk", 5*DefaultChunkSize + 7, 3 * DefaultChunkSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := testPlaintext(tt.size)
+			encrypted := encrypt(t, plaintext, tt.writeSize)
+			if !IsChunked(encrypted) {
+				t.Fatal("the file doesn't start with the chunked header")
+			}
+
+			reader, err := NewReader(bytes.NewReader(encrypted), testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reader.Size() != int64(tt.size) {
+				t.Fatalf("expected size %d, got %d", tt.size, reader.Size())
+			}
+			decrypted, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatal("the decrypted data doesn't match the plaintext")
+			}
+		})
+	}
+}
+
+func TestChunkedWriterOverwritesFirstChunk(t *testing.T) {
+	// The MP4 muxer seeks back to the beginning of the file, to update the size of the mdat box.
+	plaintext := testPlaintext(2*DefaultChunkSize + 500)
+	var file memFile
+	writer, err := NewWriter(&file, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Seek(4, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte{1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte{5, 6}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	copy(plaintext[4:], []byte{1, 2, 3, 4})
+	plaintext = append(plaintext, 5, 6)
+
+	reader, err := NewReader(bytes.NewReader(file.data), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatal("the decrypted data doesn't match the plaintext")
+	}
+}
+
+func TestChunkedReaderSeek(t *testing.T) {
+	size := 3*DefaultChunkSize + 1000
+	plaintext := testPlaintext(size)
+	reader, err := NewReader(bytes.NewReader(encrypt(t, plaintext, 4096)), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		whence int
+		length int
+		start  int // The expected (plaintext) position.
+	}{
+		{"start", 0, io.SeekStart, 100, 0},
+		{"inside the first chunk", 100, io.SeekStart, 100, 100},
+		{"across a chunk boundary", DefaultChunkSize - 10, io.SeekStart, 20, DefaultChunkSize - 10},
+		{"start of a chunk", DefaultChunkSize, io.SeekStart, 10, DefaultChunkSize},
+		{"spanning multiple chunks", 10, io.SeekStart, 2*DefaultChunkSize + 100, 10},
+		{"final chunk", 3*DefaultChunkSize + 5, io.SeekStart, 50, 3*DefaultChunkSize + 5},
+		{"from the end", -10, io.SeekEnd, 10, size - 10},
+		{"back to an earlier chunk", 20, io.SeekStart, 10, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			position, err := reader.Seek(tt.offset, tt.whence)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if position != int64(tt.start) {
+				t.Fatalf("expected position %d, got %d", tt.start, position)
+			}
+			buf := make([]byte, tt.length)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, plaintext[tt.start:tt.start+tt.length]) {
+				t.Fatal("the decrypted range doesn't match the plaintext")
+			}
+		})
+	}
+
+	// Reading past the end returns EOF.
+	if _, err := reader.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestChunkedReaderRejectsTampering(t *testing.T) {
+	plaintext := testPlaintext(2*DefaultChunkSize + 100)
+	encrypted := encrypt(t, plaintext, 4096)
+	recordSize := DefaultChunkSize + chunkedOverheadSize
+
+	swapped := append([]byte(nil), encrypted...)
+	copy(swapped[ChunkedHeaderSize:], encrypted[ChunkedHeaderSize+recordSize:ChunkedHeaderSize+2*recordSize])
+	copy(swapped[ChunkedHeaderSize+recordSize:], encrypted[ChunkedHeaderSize:ChunkedHeaderSize+recordSize])
+
+	tests := []struct {
+		name      string
+		encrypted []byte
+		key       string
+	}{
+		{"flipped byte", func() []byte {
+			tampered := append([]byte(nil), encrypted...)
+			tampered[ChunkedHeaderSize+recordSize+100] ^= 0xff
+			return tampered
+		}(), testKey},
+		{"swapped chunks", swapped, testKey},
+		{"final chunk cut off", encrypted[:ChunkedHeaderSize+2*recordSize], testKey},
+		{"wrong key", encrypted, "another-key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := NewReader(bytes.NewReader(tt.encrypted), tt.key)
+			if err != nil {
+				return
+			}
+			if _, err := io.ReadAll(reader); err == nil {
+				t.Fatal("expected the file to be rejected")
+			}
+		})
+	}
+}
+
+func TestRecoverChunks(t *testing.T) {
+	// A recording that wasn't closed: the full chunks are written, the final chunk is missing.
+	plaintext := testPlaintext(2*DefaultChunkSize + 100)
+	var file memFile
+	writer, err := NewWriter(&file, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+
+	var recovered bytes.Buffer
+	n, err := RecoverChunks(bytes.NewReader(file.data), testKey, &recovered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2*DefaultChunkSize || !bytes.Equal(recovered.Bytes(), plaintext[:n]) {
+		t.Fatalf("expected the 2 full chunks to be recovered, got %d bytes", n)
+	}
+}
+
+func TestLegacyRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 15, 16, 17, 1000} {
+		plaintext := testPlaintext(size)
+		encrypted, err := AesEncrypt(plaintext, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsLegacy(encrypted) || IsChunked(encrypted) {
+			t.Fatalf("size %d: the legacy format isn't detected", size)
+		}
+		decrypted, err := AesDecrypt(encrypted, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Fatalf("size %d: the decrypted data doesn't match the plaintext", size)
+		}
+	}
+}
+
+func TestLegacyWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		writeSize int
+	}{
+		{"empty", 0, 1},
+		{"one block", 16, 16},
+		{"one byte writes", 33, 1},
+		{"partial blocks", 1000, 7},
+		{"more than a read", legacyReadBlocks*aes.BlockSize + 100, 100000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plaintext := testPlaintext(test.size)
+			var encrypted bytes.Buffer
+			writer, err := NewLegacyWriter(&encrypted, testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(plaintext); i += test.writeSize {
+				end := i + test.writeSize
+				if end > len(plaintext) {
+					end = len(plaintext)
+				}
+				if _, err := writer.Write(plaintext[i:end]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if int64(encrypted.Len()) != LegacySize(int64(test.size)) {
+				t.Fatalf("the encrypted size is %d, expected %d", encrypted.Len(), LegacySize(int64(test.size)))
+			}
+
+			// It's readable by AesDecrypt (openssl and crypto-js) and the legacy reader. AesDecrypt
+			// decrypts in place, so it gets a copy.
+			decrypted, err := AesDecrypt(append([]byte(nil), encrypted.Bytes()...), testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatal("the decrypted data doesn't match the plaintext")
+			}
+			reader, err := NewLegacyReader(bytes.NewReader(encrypted.Bytes()), testKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err = io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Fatal("the legacy reader doesn't match the plaintext")
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package hls
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kerberos-io/agent/machinery/src/capture"
+	"github.com/kerberos-io/agent/machinery/src/log"
+	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+var (
+	// The muxers of the streams (main and sub) that are currently running.
+	muxers      = make(map[string]*Muxer)
+	muxersMutex sync.Mutex
+)
+
+func getMuxer(key string) *Muxer {
+	muxersMutex.Lock()
+	defer muxersMutex.Unlock()
+	return muxers[key]
+}
+
+// muxerKey returns the key of the muxer of a stream, in multi-camera mode it includes the camera.
+func muxerKey(cameraID string, streamType string) string {
+	if cameraID == "" {
+		return streamType
+	}
+	return cameraID + "/" + streamType
+}
+
+// HandleLiveStream creates HLS segments from the packets of a stream (main or sub), until the queue is closed.
+func HandleLiveStream(streamType string, livestreamCursor *packets.QueueCursor, configuration *models.Configuration, rtspClient capture.RTSPClient) {
+	log.Log.Debug("hls.main.HandleLiveStream(" + streamType + "): started")
+	config := configuration.Config
+
+	// The streams are known once the stream is connected, the sub stream might not be available at boot.
+	videoCodec := ""
+	streams, err := livestreamCursor.Streams()
+	if err != nil {
+		return
+	}
+	for _, stream := range streams {
+		if stream.IsVideo && (stream.Name == "H264" || stream.Name == "H265") {
+			videoCodec = stream.Name
+			break
+		}
+	}
+	if videoCodec == "" {
+		log.Log.Error("hls.main.HandleLiveStream(" + streamType + "): no H264 or H265 video stream found")
+		return
+	}
+
+	segmentDuration := time.Duration(config.Capture.HLSSegmentDuration) * time.Second
+	if segmentDuration <= 0 {
+		segmentDuration = 2 * time.Second
+	}
+	partDuration := time.Duration(config.Capture.HLSPartDuration) * time.Millisecond
+	if partDuration <= 0 {
+		partDuration = 200 * time.Millisecond
+	}
+	lowLatency := config.Capture.HLSLowLatency == "true"
+
+	// We can only carry AAC audio in the segments, G711 is transcoded.
+	audioStream := capture.GetRecordingAudioStream(rtspClient)
+	var transcoder *capture.AudioTranscoder
+	if audioStream != nil && audioStream.Name != "AAC" {
+		var err error
+		transcoder, err = capture.NewAudioTranscoder(audioStream.Name, audioStream.SampleRate, audioStream.Channels)
+		if err != nil {
+			log.Log.Error("hls.main.HandleLiveStream(" + streamType + "): unable to transcode audio, " + err.Error())
+			audioStream = nil
+		} else {
+			defer transcoder.Close()
+		}
+	}
+
+	muxer := NewMuxer(videoCodec, audioStream != nil, segmentDuration, partDuration, lowLatency)
+	key := muxerKey(configuration.CameraID, streamType)
+	muxersMutex.Lock()
+	muxers[key] = muxer
+	muxersMutex.Unlock()
+
+	var cursorError error
+	var pkt packets.Packet
+	for cursorError == nil {
+		pkt, cursorError = livestreamCursor.ReadPacket()
+		if cursorError != nil || len(pkt.Data) == 0 {
+			continue
+		}
+		pkts := []packets.Packet{pkt}
+		if transcoder != nil && pkt.IsAudio && (pkt.Codec == "PCM_MULAW" || pkt.Codec == "PCM_ALAW") {
+			var err error
+			pkts, err = transcoder.Transcode(pkt)
+			if err != nil {
+				log.Log.Error("hls.main.HandleLiveStream(" + streamType + "): " + err.Error())
+			}
+		}
+		for _, p := range pkts {
+			if err := muxer.WritePacket(p); err != nil {
+				log.Log.Error("hls.main.HandleLiveStream(" + streamType + "): " + err.Error())
+			}
+		}
+	}
+
+	muxersMutex.Lock()
+	if muxers[key] == muxer {
+		delete(muxers, key)
+	}
+	muxersMutex.Unlock()
+	muxer.Close()
+
+	log.Log.Debug("hls.main.HandleLiveStream(" + streamType + "): finished")
+}
+
+// GetLiveStream godoc
+// @Router /api/camera/live/{streamType}/{file} [get]
+// @ID camera-live
+// @Tags camera
+// @Param streamType path string true "Stream Type" Enums(main, sub)
+// @Param file path string true "The playlist (index.m3u8), the init segment (init.mp4), a segment or a part"
+// @Summary Get the HLS (or LL-HLS) live stream of the camera.
+// @Description Get the HLS live stream of the main or sub stream, the playlist is available at /api/camera/live/{streamType}/index.m3u8.
+// @Description In multi-camera mode the live stream of a camera is available at /api/cameras/{id}/camera/live/{streamType}/index.m3u8.
+// @Success 200
+func GetLiveStream(c *gin.Context) {
+	muxer := getMuxer(muxerKey(c.Param("id"), c.Param("streamType")))
+	if muxer == nil {
+		c.JSON(404, models.APIResponse{
+			Message: "Live stream is not available, make sure HLS is enabled and the camera is connected.",
+		})
+		return
+	}
+
+	c.Header("Access-Control-Allow-Origin", "*")
+	file := c.Param("file")
+	switch {
+	case file == "index.m3u8":
+		// Blocking playlist reload (LL-HLS), the client asks for a specific segment and part.
+		msn := int64(-1)
+		partID := int64(-1)
+		if value, err := strconv.ParseInt(c.Query("_HLS_msn"), 10, 64); err == nil {
+			msn = value
+			if value, err := strconv.ParseInt(c.Query("_HLS_part"), 10, 64); err == nil {
+				partID = value
+			}
+		}
+		playlist, err := muxer.Playlist(msn, partID)
+		if err != nil {
+			c.JSON(404, models.APIResponse{
+				Message: err.Error(),
+			})
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(200, "application/vnd.apple.mpegurl", []byte(playlist))
+
+	case file == "init.mp4":
+		data, err := muxer.Init()
+		if err != nil {
+			c.JSON(404, models.APIResponse{
+				Message: err.Error(),
+			})
+			return
+		}
+		c.Data(200, "video/mp4", data)
+
+	case strings.HasPrefix(file, "segment_") && strings.HasSuffix(file, ".mp4"):
+		segmentID, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(file, "segment_"), ".mp4"), 10, 64)
+		var data []byte
+		if err == nil {
+			data, err = muxer.Segment(segmentID)
+		}
+		if err != nil {
+			c.JSON(404, models.APIResponse{
+				Message: "Segment not found",
+			})
+			return
+		}
+		c.Data(200, "video/mp4", data)
+
+	case strings.HasPrefix(file, "part_") && strings.HasSuffix(file, ".mp4"):
+		ids := strings.Split(strings.TrimSuffix(strings.TrimPrefix(file, "part_"), ".mp4"), "_")
+		var data []byte
+		var err error
+		if len(ids) == 2 {
+			var segmentID uint64
+			var partID int
+			segmentID, err = strconv.ParseUint(ids[0], 10, 64)
+			if err == nil {
+				partID, err = strconv.Atoi(ids[1])
+			}
+			if err == nil {
+				data, err = muxer.Part(segmentID, partID)
+			}
+		}
+		if len(ids) != 2 || err != nil {
+			c.JSON(404, models.APIResponse{
+				Message: "Part not found",
+			})
+			return
+		}
+		c.Data(200, "video/mp4", data)
+
+	default:
+		c.JSON(404, models.APIResponse{
+			Message: "File not found",
+		})
+	}
+}
@@ -0,0 +1,492 @@
+package hls
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/kerberos-io/agent/machinery/src/capture"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+const (
+	// The number of complete segments we keep in the playlist.
+	segmentCount = 7
+	// The number of complete segments for which we still list the parts (LL-HLS).
+	partSegmentCount = 2
+)
+
+// part is a fragment (moof and mdat) of a segment. In low-latency mode a segment consists
+// of multiple parts, otherwise a segment has a single part.
+type part struct {
+	id          int
+	duration    time.Duration
+	independent bool
+	data        []byte
+}
+
+// segment is a sequence of parts, which always starts with a keyframe. A segment is a discontinuity
+// when the timestamps of the stream went back before it started (e.g. the camera was reconnected).
+type segment struct {
+	id            uint64
+	dateTime      time.Time
+	duration      time.Duration
+	parts         []*part
+	complete      bool
+	discontinuity bool
+}
+
+// Muxer creates HLS segments (fMP4) from the packets of a stream. When low latency is enabled
+// the segments are split in parts (LL-HLS), which are published as soon as they are complete.
+type Muxer struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	videoCodec      string
+	segmentDuration time.Duration
+	partDuration    time.Duration
+	lowLatency      bool
+
+	// The published init segment and segments, the last segment is the one we are building.
+	init                  []byte
+	segments              []*segment
+	discontinuitySequence uint64
+	closed                bool
+
+	// The state of the part that is being built.
+	parameterSets   capture.ParameterSets
+	audioConfig     *mpeg4audio.Config
+	hasAudio        bool
+	video           *capture.FragmentTrack
+	audio           *capture.FragmentTrack
+	started         bool
+	startTime       time.Duration
+	timeOffset      uint64
+	lastTs          uint64
+	partStart       uint64
+	partIndependent bool
+	segmentStart    uint64
+	sequenceNumber  uint32
+	nextSegmentID   uint64
+}
+
+// NewMuxer creates a muxer for a stream, hasAudio defines if an (AAC) audio track should be added.
+func NewMuxer(videoCodec string, hasAudio bool, segmentDuration time.Duration, partDuration time.Duration, lowLatency bool) *Muxer {
+	m := &Muxer{
+		videoCodec:      videoCodec,
+		hasAudio:        hasAudio,
+		segmentDuration: segmentDuration,
+		partDuration:    partDuration,
+		lowLatency:      lowLatency,
+		sequenceNumber:  1,
+		video:           capture.NewVideoTrack(),
+	}
+	m.cond = sync.NewCond(&m.mutex)
+	return m
+}
+
+// WritePacket adds a video packet, or an AAC audio packet, to the part we are building.
+func (m *Muxer) WritePacket(pkt packets.Packet) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if pkt.IsVideo {
+		return m.writeVideo(pkt)
+	} else if pkt.IsAudio && pkt.Codec == "AAC" && m.hasAudio {
+		return m.writeAudio(pkt)
+	}
+	return nil
+}
+
+func (m *Muxer) writeVideo(pkt packets.Packet) error {
+	if !m.started && !pkt.IsKeyFrame {
+		return nil
+	}
+
+	au, parameterSets, err := capture.SplitAccessUnit(m.videoCodec, pkt.Data)
+	if err != nil {
+		return err
+	}
+	if parameterSets.VPS != nil {
+		m.parameterSets.VPS = parameterSets.VPS
+	}
+	if parameterSets.SPS != nil {
+		m.parameterSets.SPS = parameterSets.SPS
+	}
+	if parameterSets.PPS != nil {
+		m.parameterSets.PPS = parameterSets.PPS
+	}
+	if len(au) == 0 {
+		return nil
+	}
+
+	if !m.started {
+		// After a discontinuity the timeline continues where the previous segment ended.
+		m.started = true
+		m.startTime = pkt.Time
+		m.timeOffset = m.partStart
+		m.partIndependent = true
+		if len(m.segments) == 0 {
+			m.segments = append(m.segments, &segment{
+				id:       m.nextSegmentID,
+				dateTime: time.Now(),
+			})
+			m.nextSegmentID++
+		}
+	}
+
+	ts := m.timestamp(pkt.Time, capture.VideoTimeScale)
+	if pkt.Time < m.startTime || ts < m.lastTs {
+		// The timestamps went back, we can't continue the current segment.
+		if err := m.discontinue(); err != nil {
+			return err
+		}
+		return m.writeVideo(pkt)
+	}
+	m.lastTs = ts
+	m.video.Complete(ts)
+
+	// A new segment starts at a keyframe, once the segment duration has passed.
+	// In low-latency mode we also publish a part, once the part duration has passed.
+	if pkt.IsKeyFrame && timeScaleToDuration(ts-m.segmentStart, capture.VideoTimeScale) >= m.segmentDuration {
+		if err := m.finishPart(ts); err != nil {
+			return err
+		}
+		m.finishSegment(ts)
+	} else if m.lowLatency && timeScaleToDuration(ts-m.partStart, capture.VideoTimeScale) >= m.partDuration {
+		if err := m.finishPart(ts); err != nil {
+			return err
+		}
+	}
+	if m.video.Len() == 0 {
+		m.partIndependent = pkt.IsKeyFrame
+	}
+
+	sample, err := fmp4.NewPartSampleH26x(0, pkt.IsKeyFrame, au)
+	if err != nil {
+		return err
+	}
+	m.video.Push(sample, ts)
+	return nil
+}
+
+// timestamp converts the time of a packet to a timestamp in the time scale of a track.
+func (m *Muxer) timestamp(t time.Duration, timeScale uint32) uint64 {
+	return m.timeOffset*uint64(timeScale)/capture.VideoTimeScale + capture.DurationToTimeScale(t-m.startTime, timeScale)
+}
+
+// discontinue ends the current segment when the timestamps of the stream went back (e.g. the camera
+// was reconnected). We wait for the next keyframe, which starts a new segment that is marked as a
+// discontinuity, its timestamps continue where the current segment ended.
+func (m *Muxer) discontinue() error {
+	m.video.Flush()
+	if m.audio != nil {
+		m.audio.Flush()
+	}
+	endTs := m.partStart
+	if m.video.Len() > 0 {
+		endTs = m.video.End()
+	}
+	if err := m.finishPart(endTs); err != nil {
+		return err
+	}
+	m.finishSegment(endTs)
+	if len(m.segments) > 1 {
+		m.segments[len(m.segments)-1].discontinuity = true
+	}
+	m.started = false
+	return nil
+}
+
+func (m *Muxer) writeAudio(pkt packets.Packet) error {
+	// Audio is only written once we have video, so both tracks start at the same time.
+	if !m.started || pkt.Time < m.startTime {
+		return nil
+	}
+
+	var adtsPackets mpeg4audio.ADTSPackets
+	if err := adtsPackets.Unmarshal(pkt.Data); err != nil {
+		return err
+	}
+	if len(adtsPackets) == 0 {
+		return nil
+	}
+
+	if m.audio == nil {
+		// Once the init segment is published we can't add an audio track anymore.
+		if m.init != nil {
+			return nil
+		}
+		m.audioConfig = &mpeg4audio.Config{
+			Type:         adtsPackets[0].Type,
+			SampleRate:   adtsPackets[0].SampleRate,
+			ChannelCount: adtsPackets[0].ChannelCount,
+		}
+		m.audio = capture.NewAudioTrack(m.audioConfig)
+	}
+
+	ts := m.timestamp(pkt.Time, m.audio.TimeScale())
+	for i, adtsPacket := range adtsPackets {
+		m.audio.Push(&fmp4.PartSample{
+			Payload: adtsPacket.AU,
+		}, ts+uint64(i*mpeg4audio.SamplesPerAccessUnit))
+	}
+	return nil
+}
+
+func (m *Muxer) writeInit() error {
+	init, err := capture.MarshalInit(m.videoCodec, m.parameterSets, m.audioConfig)
+	if err != nil {
+		return err
+	}
+	m.init = init
+	return nil
+}
+
+// finishPart publishes the samples we collected as a new part of the current segment.
+func (m *Muxer) finishPart(endTs uint64) error {
+	if m.video.Len() == 0 {
+		return nil
+	}
+	if m.init == nil {
+		if err := m.writeInit(); err != nil {
+			return err
+		}
+	}
+
+	data, err := capture.MarshalFragment(m.sequenceNumber, m.video, m.audio)
+	if err != nil {
+		return err
+	}
+	m.sequenceNumber++
+
+	current := m.segments[len(m.segments)-1]
+	duration := timeScaleToDuration(endTs-m.partStart, capture.VideoTimeScale)
+	current.parts = append(current.parts, &part{
+		id:          len(current.parts),
+		duration:    duration,
+		independent: m.partIndependent,
+		data:        data,
+	})
+	current.duration += duration
+	m.partStart = endTs
+	m.cond.Broadcast()
+	return nil
+}
+
+// finishSegment completes the current segment, and starts a new one.
+func (m *Muxer) finishSegment(endTs uint64) {
+	current := m.segments[len(m.segments)-1]
+	if len(current.parts) == 0 {
+		return
+	}
+	current.complete = true
+	m.segmentStart = endTs
+	m.segments = append(m.segments, &segment{
+		id:       m.nextSegmentID,
+		dateTime: time.Now(),
+	})
+	m.nextSegmentID++
+
+	// Only keep a sliding window of segments, the discontinuities that leave the window are counted.
+	if len(m.segments) > segmentCount+1 {
+		for _, s := range m.segments[:len(m.segments)-segmentCount-1] {
+			if s.discontinuity {
+				m.discontinuitySequence++
+			}
+		}
+		m.segments = m.segments[len(m.segments)-segmentCount-1:]
+	}
+	m.cond.Broadcast()
+}
+
+// Close stops the muxer, requests that are waiting will return.
+func (m *Muxer) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closed = true
+	m.cond.Broadcast()
+}
+
+// wait blocks until the condition is true, the muxer is closed or the timeout passed.
+// It should be called while holding the lock.
+func (m *Muxer) wait(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		m.mutex.Lock()
+		m.cond.Broadcast()
+		m.mutex.Unlock()
+	})
+	defer timer.Stop()
+	for !condition() {
+		if m.closed || time.Now().After(deadline) {
+			return false
+		}
+		m.cond.Wait()
+	}
+	return true
+}
+
+func (m *Muxer) findSegment(id uint64) *segment {
+	for _, s := range m.segments {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// hasPart returns true if the part (or the complete segment when partID < 0) is available.
+func (m *Muxer) hasPart(segmentID uint64, partID int) bool {
+	if len(m.segments) > 0 && segmentID < m.segments[0].id {
+		return true
+	}
+	s := m.findSegment(segmentID)
+	if s == nil {
+		return false
+	}
+	if partID < 0 {
+		return len(s.parts) > 0 || s.complete
+	}
+	return partID < len(s.parts) || s.complete
+}
+
+// Init returns the init segment, we wait until it's available.
+func (m *Muxer) Init() ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.wait(func() bool { return m.init != nil }, m.segmentDuration*3) {
+		return nil, errors.New("hls.muxer.Init(): init segment is not available")
+	}
+	return m.init, nil
+}
+
+// Segment returns a complete segment.
+func (m *Muxer) Segment(segmentID uint64) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := m.findSegment(segmentID)
+	if s == nil || !s.complete {
+		return nil, errors.New("hls.muxer.Segment(): segment is not available")
+	}
+	var data []byte
+	for _, p := range s.parts {
+		data = append(data, p.data...)
+	}
+	return data, nil
+}
+
+// Part returns a part of a segment, if the part is the next part (which is announced
+// with a preload hint), we block until it's available.
+func (m *Muxer) Part(segmentID uint64, partID int) ([]byte, error) {
+	if partID < 0 {
+		return nil, errors.New("hls.muxer.Part(): invalid part")
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.wait(func() bool { return m.hasPart(segmentID, partID) }, m.partDuration*10)
+	s := m.findSegment(segmentID)
+	if s == nil || partID >= len(s.parts) {
+		return nil, errors.New("hls.muxer.Part(): part is not available")
+	}
+	return s.parts[partID].data, nil
+}
+
+// Playlist returns the media playlist. When a segment (msn) and part are requested,
+// we block until they are available (blocking playlist reload of LL-HLS).
+func (m *Muxer) Playlist(msn int64, partID int64) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.lowLatency && msn >= 0 {
+		if !m.wait(func() bool { return m.hasPart(uint64(msn), int(partID)) }, m.segmentDuration*3) {
+			return "", errors.New("hls.muxer.Playlist(): requested segment is not available")
+		}
+	} else if !m.wait(func() bool { return len(m.segments) > 1 }, m.segmentDuration*3) {
+		return "", errors.New("hls.muxer.Playlist(): no segments available")
+	}
+	return m.playlist(), nil
+}
+
+func (m *Muxer) playlist() string {
+	targetDuration := m.segmentDuration
+	partTarget := m.partDuration
+	for _, s := range m.segments {
+		if s.complete && s.duration > targetDuration {
+			targetDuration = s.duration
+		}
+		for _, p := range s.parts {
+			if p.duration > partTarget {
+				partTarget = p.duration
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if m.lowLatency {
+		b.WriteString("#EXT-X-VERSION:9\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:7\n")
+	}
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	b.WriteString("#EXT-X-TARGETDURATION:" + strconv.Itoa(int(math.Ceil(targetDuration.Seconds()))) + "\n")
+	if m.lowLatency {
+		b.WriteString("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=" + formatSeconds(partTarget*3) + "\n")
+		b.WriteString("#EXT-X-PART-INF:PART-TARGET=" + formatSeconds(partTarget) + "\n")
+	}
+	if len(m.segments) > 0 {
+		b.WriteString("#EXT-X-MEDIA-SEQUENCE:" + strconv.FormatUint(m.segments[0].id, 10) + "\n")
+	}
+	if m.discontinuitySequence > 0 {
+		b.WriteString("#EXT-X-DISCONTINUITY-SEQUENCE:" + strconv.FormatUint(m.discontinuitySequence, 10) + "\n")
+	}
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+
+	completeSegments := len(m.segments) - 1
+	for i, s := range m.segments {
+		if !s.complete && !m.lowLatency {
+			break
+		}
+		if s.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + s.dateTime.UTC().Format("2006-01-02T15:04:05.000Z07:00") + "\n")
+		// The parts are only listed for the most recent segments.
+		if m.lowLatency && i >= completeSegments-partSegmentCount {
+			for _, p := range s.parts {
+				b.WriteString("#EXT-X-PART:DURATION=" + formatSeconds(p.duration) + ",URI=\"" + partName(s.id, p.id) + "\"")
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		if s.complete {
+			b.WriteString("#EXTINF:" + formatSeconds(s.duration) + ",\n")
+			b.WriteString(segmentName(s.id) + "\n")
+		} else {
+			b.WriteString("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"" + partName(s.id, len(s.parts)) + "\"\n")
+		}
+	}
+	return b.String()
+}
+
+func segmentName(segmentID uint64) string {
+	return "segment_" + strconv.FormatUint(segmentID, 10) + ".mp4"
+}
+
+func partName(segmentID uint64, partID int) string {
+	return "part_" + strconv.FormatUint(segmentID, 10) + "_" + strconv.Itoa(partID) + ".mp4"
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 5, 64)
+}
+
+func timeScaleToDuration(ts uint64, timeScale uint32) time.Duration {
+	return time.Duration(ts * uint64(time.Second) / uint64(timeScale))
+}
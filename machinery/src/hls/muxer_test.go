@@ -0,0 +1,136 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/kerberos-io/agent/machinery/src/internal/testutil"
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+func TestMuxerPlaylist(t *testing.T) {
+	tests := []struct {
+		name       string
+		lowLatency bool
+		packets    []packets.Packet
+		contains   []string // The lines that are expected in the playlist, in this order.
+		excludes   []string
+	}{
+		{
+			name:    "segments",
+			packets: testutil.H264Packets(100, 25, 10*time.Second),
+			contains: []string{
+				"#EXT-X-VERSION:7",
+				"#EXT-X-TARGETDURATION:1",
+				"#EXT-X-MEDIA-SEQUENCE:0",
+				"#EXT-X-MAP:URI=\"init.mp4\"",
+				"#EXTINF:1.00000,", "segment_0.mp4",
+				"#EXTINF:1.00000,", "segment_1.mp4",
+				"#EXTINF:1.00000,", "segment_2.mp4",
+			},
+			excludes: []string{"segment_3.mp4", "#EXT-X-PART", "#EXT-X-DISCONTINUITY"},
+		},
+		{
+			name:       "low latency parts",
+			lowLatency: true,
+			packets:    testutil.H264Packets(60, 25, 0),
+			contains: []string{
+				"#EXT-X-VERSION:9",
+				"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.60000",
+				"#EXT-X-PART-INF:PART-TARGET=0.20000",
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part_0_0.mp4\",INDEPENDENT=YES",
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part_0_1.mp4\"",
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part_0_4.mp4\"",
+				"#EXTINF:1.00000,", "segment_0.mp4",
+				"#EXT-X-PART:DURATION=0.20000,URI=\"part_2_0.mp4\",INDEPENDENT=YES",
+				"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part_2_1.mp4\"",
+			},
+			excludes: []string{"part_0_5.mp4", "segment_2.mp4"},
+		},
+		{
+			name: "timestamps going back",
+			packets: append(
+				testutil.H264Packets(40, 25, 10*time.Second),
+				testutil.H264Packets(60, 25, 0)...,
+			),
+			contains: []string{
+				"#EXTINF:1.00000,", "segment_0.mp4",
+				"#EXTINF:0.60000,", "segment_1.mp4",
+				"#EXT-X-DISCONTINUITY",
+				"#EXTINF:1.00000,", "segment_2.mp4",
+				"#EXTINF:1.00000,", "segment_3.mp4",
+			},
+			excludes: []string{"segment_4.mp4", "#EXT-X-DISCONTINUITY-SEQUENCE"},
+		},
+		{
+			name: "discontinuity leaving the window",
+			packets: append(
+				testutil.H264Packets(25, 25, 10*time.Second),
+				testutil.H264Packets(300, 25, 0)...,
+			),
+			contains: []string{
+				"#EXT-X-MEDIA-SEQUENCE:5",
+				"#EXT-X-DISCONTINUITY-SEQUENCE:1",
+				"segment_5.mp4",
+				"segment_11.mp4",
+			},
+			excludes: []string{"segment_4.mp4", "segment_12.mp4", "#EXT-X-DISCONTINUITY\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMuxer("H264", false, time.Second, 200*time.Millisecond, tt.lowLatency)
+			for _, pkt := range tt.packets {
+				if err := m.WritePacket(pkt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			playlist := m.playlist()
+
+			rest := playlist
+			for _, line := range tt.contains {
+				i := strings.Index(rest, line)
+				if i < 0 {
+					t.Fatalf("expected %q in the playlist:\n%s", line, playlist)
+				}
+				rest = rest[i+len(line):]
+			}
+			for _, line := range tt.excludes {
+				if strings.Contains(playlist, line) {
+					t.Fatalf("didn't expect %q in the playlist:\n%s", line, playlist)
+				}
+			}
+		})
+	}
+}
+
+func TestMuxerContinuesTimelineAfterDiscontinuity(t *testing.T) {
+	m := NewMuxer("H264", false, time.Second, 200*time.Millisecond, false)
+	pkts := append(testutil.H264Packets(40, 25, 10*time.Second), testutil.H264Packets(60, 25, 0)...)
+	for _, pkt := range pkts {
+		if err := m.WritePacket(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The segments after the discontinuity continue where the previous segment ended (1.6s).
+	baseTimes := []uint64{0, 90000, 144000, 234000}
+	for id, baseTime := range baseTimes {
+		data, err := m.Segment(uint64(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parts fmp4.Parts
+		if err := parts.Unmarshal(data); err != nil {
+			t.Fatal(err)
+		}
+		if parts[0].Tracks[0].BaseTime != baseTime {
+			t.Errorf("segment %d: expected base time %d, got %d", id, baseTime, parts[0].Tracks[0].BaseTime)
+		}
+		if parts[0].Tracks[0].Samples[0].IsNonSyncSample {
+			t.Errorf("segment %d: doesn't start with a keyframe", id)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Package testutil has the fixtures that are shared by the tests of the packages.
+package testutil
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/kerberos-io/agent/machinery/src/packets"
+)
+
+// SPS is the sequence parameter set of the H264 fixtures (baseline profile).
+var SPS = []byte{
+	0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02,
+	0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04,
+	0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9,
+	0x20,
+}
+
+// PPS is the picture parameter set of the H264 fixtures.
+var PPS = []byte{0x68, 0xce, 0x3c, 0x80}
+
+// H264AccessUnit returns the access unit (Annex-B) of frame i, a keyframe includes the parameter sets.
+// The slice is padded with padding bytes, to make the frames larger.
+func H264AccessUnit(i int, keyFrame bool, padding int) []byte {
+	startCode := []byte{0x00, 0x00, 0x00, 0x01}
+	var data []byte
+	if keyFrame {
+		data = append(data, startCode...)
+		data = append(data, SPS...)
+		data = append(data, startCode...)
+		data = append(data, PPS...)
+		data = append(data, startCode...)
+		data = append(data, 0x65, 0x88, 0x84, byte(i))
+	} else {
+		data = append(data, startCode...)
+		data = append(data, 0x41, 0x9a, 0x02, byte(i))
+	}
+	return append(data, bytes.Repeat([]byte{0x5a}, padding)...)
+}
+
+// H264Packets returns H264 packets at 25 fps, with a keyframe every gopSize frames, starting at a time.
+func H264Packets(frames int, gopSize int, start time.Duration) []packets.Packet {
+	var pkts []packets.Packet
+	for i := 0; i < frames; i++ {
+		isKeyFrame := i%gopSize == 0
+		pkts = append(pkts, packets.Packet{
+			IsVideo:    true,
+			IsKeyFrame: isKeyFrame,
+			Time:       start + time.Duration(i)*40*time.Millisecond,
+			Codec:      "H264",
+			Data:       H264AccessUnit(i, isKeyFrame, 0),
+		})
+	}
+	return pkts
+}
@@ -13,3 +13,14 @@ type Camera struct {
 	Codec       av.CodecType
 	Initialized bool
 }
+
+// CameraStatus is a camera of the agent in multi-camera mode, as returned by the API.
+type CameraStatus struct {
+	ID                  string `json:"id"`
+	Key                 string `json:"key"`
+	Name                string `json:"name"`
+	FriendlyName        string `json:"friendly_name"`
+	Connected           bool   `json:"connected"`
+	MainStreamConnected bool   `json:"main_stream_connected"`
+	SubStreamConnected  bool   `json:"sub_stream_connected"`
+}
@@ -22,6 +22,8 @@ type Communication struct {
 	HandleStream          chan string
 	HandleSubStream       chan string
 	HandleMotion          chan MotionDataPartial
+	HandleRecord          chan ManualRecording
+	HandleSnapshot        chan MotionDataPartial
 	HandleAudio           chan AudioDataPartial
 	HandleUpload          chan string
 	HandleHeartBeat       chan string
@@ -30,6 +32,8 @@ type Communication struct {
 	HandleLiveHDHandshake chan RequestHDStreamPayload
 	HandleLiveHDPeers     chan string
 	HandleONVIF           chan OnvifAction
+	HandleDiskState       chan DiskStatus
+	HandleStreamState     chan StreamStatus
 	IsConfiguring         *abool.AtomicBool
 	Queue                 *packets.Queue
 	SubQueue              *packets.Queue
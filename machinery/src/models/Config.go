@@ -1,9 +1,11 @@
 package models
 
 // A struct which contains the global, local and merged config.
+// In multi-camera mode every camera has its own configuration, CameraID is the camera it belongs to.
 type Configuration struct {
 	Name         string
 	Port         string
+	CameraID     string
 	Config       Config
 	CustomConfig Config
 	GlobalConfig Config
@@ -12,39 +14,51 @@ type Configuration struct {
 // Config is the highlevel struct which contains all the configuration of
 // your Kerberos Open Source instance.
 type Config struct {
-	Type              string       `json:"type"`
-	Key               string       `json:"key"`
-	Name              string       `json:"name"`
-	FriendlyName      string       `json:"friendly_name"`
-	Time              string       `json:"time" bson:"time"`
-	Offline           string       `json:"offline"`
-	AutoClean         string       `json:"auto_clean"`
-	RemoveAfterUpload string       `json:"remove_after_upload"`
-	MaxDirectorySize  int64        `json:"max_directory_size"`
-	Timezone          string       `json:"timezone"`
-	Capture           Capture      `json:"capture"`
-	Timetable         []*Timetable `json:"timetable"`
-	Region            *Region      `json:"region"`
-	Cloud             string       `json:"cloud" bson:"cloud"`
-	S3                *S3          `json:"s3,omitempty" bson:"s3,omitempty"`
-	KStorage          *KStorage    `json:"kstorage,omitempty" bson:"kstorage,omitempty"`
-	Dropbox           *Dropbox     `json:"dropbox,omitempty" bson:"dropbox,omitempty"`
-	MQTTURI           string       `json:"mqtturi" bson:"mqtturi,omitempty"`
-	MQTTUsername      string       `json:"mqtt_username" bson:"mqtt_username"`
-	MQTTPassword      string       `json:"mqtt_password" bson:"mqtt_password"`
-	STUNURI           string       `json:"stunuri" bson:"stunuri"`
-	ForceTurn         string       `json:"turn_force" bson:"turn_force"`
-	TURNURI           string       `json:"turnuri" bson:"turnuri"`
-	TURNUsername      string       `json:"turn_username" bson:"turn_username"`
-	TURNPassword      string       `json:"turn_password" bson:"turn_password"`
-	HeartbeatURI      string       `json:"heartbeaturi" bson:"heartbeaturi"` /*obsolete*/
-	HubEncryption     string       `json:"hub_encryption" bson:"hub_encryption"`
-	HubURI            string       `json:"hub_uri" bson:"hub_uri"`
-	HubKey            string       `json:"hub_key" bson:"hub_key"`
-	HubPrivateKey     string       `json:"hub_private_key" bson:"hub_private_key"`
-	HubSite           string       `json:"hub_site" bson:"hub_site"`
-	ConditionURI      string       `json:"condition_uri" bson:"condition_uri"`
-	Encryption        *Encryption  `json:"encryption,omitempty" bson:"encryption,omitempty"`
+	Type              string         `json:"type"`
+	Key               string         `json:"key"`
+	Name              string         `json:"name"`
+	FriendlyName      string         `json:"friendly_name"`
+	Time              string         `json:"time" bson:"time"`
+	Offline           string         `json:"offline"`
+	AutoClean         string         `json:"auto_clean"`
+	RemoveAfterUpload string         `json:"remove_after_upload"`
+	MaxDirectorySize  int64          `json:"max_directory_size"`
+	Retention         Retention      `json:"retention" bson:"retention"`
+	Timelapse         Timelapse      `json:"timelapse" bson:"timelapse"`
+	DiskWatchdog      DiskWatchdog   `json:"disk_watchdog" bson:"disk_watchdog"`
+	Snapshots         Snapshots      `json:"snapshots" bson:"snapshots"`
+	Timezone          string         `json:"timezone"`
+	Capture           Capture        `json:"capture"`
+	Timetable         []*Timetable   `json:"timetable"`
+	Region            *Region        `json:"region"`
+	Cloud             string         `json:"cloud" bson:"cloud"`
+	S3                *S3            `json:"s3,omitempty" bson:"s3,omitempty"`
+	KStorage          *KStorage      `json:"kstorage,omitempty" bson:"kstorage,omitempty"`
+	Dropbox           *Dropbox       `json:"dropbox,omitempty" bson:"dropbox,omitempty"`
+	MQTTURI           string         `json:"mqtturi" bson:"mqtturi,omitempty"`
+	MQTTUsername      string         `json:"mqtt_username" bson:"mqtt_username"`
+	MQTTPassword      string         `json:"mqtt_password" bson:"mqtt_password"`
+	STUNURI           string         `json:"stunuri" bson:"stunuri"`
+	ForceTurn         string         `json:"turn_force" bson:"turn_force"`
+	TURNURI           string         `json:"turnuri" bson:"turnuri"`
+	TURNUsername      string         `json:"turn_username" bson:"turn_username"`
+	TURNPassword      string         `json:"turn_password" bson:"turn_password"`
+	HeartbeatURI      string         `json:"heartbeaturi" bson:"heartbeaturi"` /*obsolete*/
+	HubEncryption     string         `json:"hub_encryption" bson:"hub_encryption"`
+	HubURI            string         `json:"hub_uri" bson:"hub_uri"`
+	HubKey            string         `json:"hub_key" bson:"hub_key"`
+	HubPrivateKey     string         `json:"hub_private_key" bson:"hub_private_key"`
+	HubSite           string         `json:"hub_site" bson:"hub_site"`
+	ConditionURI      string         `json:"condition_uri" bson:"condition_uri"`
+	Encryption        *Encryption    `json:"encryption,omitempty" bson:"encryption,omitempty"`
+	Cameras           []CameraConfig `json:"cameras,omitempty" bson:"cameras,omitempty"`
+}
+
+// CameraConfig is a camera of the agent in multi-camera mode. The settings of a camera (e.g. name, key,
+// capture and region) override the settings of the agent, the other settings are shared by all cameras.
+type CameraConfig struct {
+	ID       string                 `json:"id" bson:"id"`
+	Settings map[string]interface{} `json:"settings" bson:"settings"`
 }
 
 // Capture defines which camera type (Id) you are using (IP, USB or Raspberry Pi camera),
@@ -61,13 +75,78 @@ type Capture struct {
 	Continuous            string      `json:"continuous,omitempty"`
 	PostRecording         int64       `json:"postrecording"`
 	PreRecording          int64       `json:"prerecording"`
+	PreRecordingMaxSize   int64       `json:"prerecording_max_size,omitempty" bson:"prerecording_max_size,omitempty"` // MB
 	MaxLengthRecording    int64       `json:"maxlengthrecording"`
+	AlignSegments         string      `json:"align_segments,omitempty" bson:"align_segments,omitempty"`
 	TranscodingWebRTC     string      `json:"transcodingwebrtc"`
 	TranscodingResolution int64       `json:"transcodingresolution"`
 	ForwardWebRTC         string      `json:"forwardwebrtc"`
+	Container             string      `json:"container,omitempty" bson:"container,omitempty"` // mp4, fmp4, ts or mkv.
 	Fragmented            string      `json:"fragmented,omitempty" bson:"fragmented,omitempty"`
 	FragmentedDuration    int64       `json:"fragmentedduration,omitempty" bson:"fragmentedduration,omitempty"`
 	PixelChangeThreshold  int         `json:"pixelChangeThreshold,omitempty"`
+	HLS                   string      `json:"hls,omitempty" bson:"hls,omitempty"`
+	HLSLowLatency         string      `json:"hls_lowlatency,omitempty" bson:"hls_lowlatency,omitempty"`
+	HLSSegmentDuration    int64       `json:"hls_segmentduration,omitempty" bson:"hls_segmentduration,omitempty"`
+	HLSPartDuration       int64       `json:"hls_partduration,omitempty" bson:"hls_partduration,omitempty"`
+	Preview               string      `json:"preview,omitempty" bson:"preview,omitempty"`
+	SubRecording          string      `json:"sub_recording,omitempty" bson:"sub_recording,omitempty"`
+	PreviewInterval       int64       `json:"preview_interval,omitempty" bson:"preview_interval,omitempty"`
+}
+
+// Retention defines which recordings are removed, it's applied on a schedule (every Interval seconds).
+// A rule is disabled when its value is 0. Recordings that are still waiting to be uploaded
+// (in data/cloud) are never removed, unless KeepPendingUploads is set to "false".
+// The recordings of the sub stream (data/recordings/sub) have their own max age and size.
+type Retention struct {
+	Interval           int64  `json:"interval" bson:"interval"`
+	MaxAge             int64  `json:"max_age" bson:"max_age"`                         // days
+	MinFreeDisk        int64  `json:"min_free_disk" bson:"min_free_disk"`             // percentage
+	MaxContinuousSize  int64  `json:"max_continuous_size" bson:"max_continuous_size"` // MB
+	MaxMotionSize      int64  `json:"max_motion_size" bson:"max_motion_size"`         // MB
+	KeepPendingUploads string `json:"keep_pending_uploads" bson:"keep_pending_uploads"`
+	SubMaxAge          int64  `json:"sub_max_age" bson:"sub_max_age"`   // days
+	SubMaxSize         int64  `json:"sub_max_size" bson:"sub_max_size"` // MB
+}
+
+// Timelapse samples a keyframe of the main stream every Interval seconds, and creates an MP4
+// (played at FPS frames per second) for every Period hours in data/timelapse. Time-lapses are
+// removed after MaxAge days, or when they exceed MaxSize MB (0 is disabled).
+type Timelapse struct {
+	Enabled  string `json:"enabled" bson:"enabled"`
+	Interval int64  `json:"interval" bson:"interval"`
+	Period   int64  `json:"period" bson:"period"`
+	FPS      int64  `json:"fps" bson:"fps"`
+	MaxAge   int64  `json:"max_age" bson:"max_age"`
+	MaxSize  int64  `json:"max_size" bson:"max_size"`
+}
+
+// DiskWatchdog degrades recording when the free disk space (percentage) of the data volume drops below
+// a threshold, step by step: emergency retention, motion based recording only, recording the sub stream
+// only, and finally no recording at all. A threshold of 0 skips that step. The disk is checked every
+// Interval seconds.
+type DiskWatchdog struct {
+	Enabled            string `json:"enabled" bson:"enabled"`
+	Interval           int64  `json:"interval" bson:"interval"`
+	EmergencyRetention int64  `json:"emergency_retention" bson:"emergency_retention"` // percentage
+	MotionOnly         int64  `json:"motion_only" bson:"motion_only"`                 // percentage
+	SubOnly            int64  `json:"sub_only" bson:"sub_only"`                       // percentage
+	Pause              int64  `json:"pause" bson:"pause"`                             // percentage
+}
+
+// Snapshots stores a JPEG (of Quality 1-100) of the main stream in data/snapshots every Interval seconds,
+// and a burst of MotionCount snapshots (MotionInterval seconds apart) when motion is detected; 0 disables
+// either. Snapshots are removed after MaxAge days, or when they exceed MaxSize MB (0 is disabled), and are
+// uploaded to the cloud provider if Upload is enabled.
+type Snapshots struct {
+	Enabled        string `json:"enabled" bson:"enabled"`
+	Interval       int64  `json:"interval" bson:"interval"`
+	MotionCount    int64  `json:"motion_count" bson:"motion_count"`
+	MotionInterval int64  `json:"motion_interval" bson:"motion_interval"`
+	Quality        int64  `json:"quality" bson:"quality"`
+	MaxAge         int64  `json:"max_age" bson:"max_age"`
+	MaxSize        int64  `json:"max_size" bson:"max_size"`
+	Upload         string `json:"upload" bson:"upload"`
 }
 
 // IPCamera configuration, such as the RTSP url of the IPCamera and the FPS.
@@ -85,8 +164,22 @@ type IPCamera struct {
 	ONVIFXAddr    string `json:"onvif_xaddr" bson:"onvif_xaddr"`
 	ONVIFUsername string `json:"onvif_username" bson:"onvif_username"`
 	ONVIFPassword string `json:"onvif_password" bson:"onvif_password"`
+	Transport     string `json:"transport"`
+	SubTransport  string `json:"sub_transport"`
+	ReadTimeout   int64  `json:"read_timeout"`
+	UserAgent     string `json:"user_agent"`
 }
 
+// The transports to read an RTSP stream with (IPCamera.Transport and IPCamera.SubTransport). A transport
+// falls back to the next one when the camera doesn't support it: multicast to UDP, and UDP to TCP. Auto
+// starts with UDP, and switches to TCP when no packets are received.
+const (
+	TransportTCP       = "tcp"
+	TransportUDP       = "udp"
+	TransportMulticast = "multicast"
+	TransportAuto      = "auto"
+)
+
 // USBCamera configuration, such as the device path (/dev/video*)
 type USBCamera struct {
 	Device string `json:"device"`
@@ -171,4 +264,13 @@ type Encryption struct {
 	Fingerprint  string `json:"fingerprint" bson:"fingerprint"`
 	PrivateKey   string `json:"private_key" bson:"private_key"`
 	SymmetricKey string `json:"symmetric_key" bson:"symmetric_key"`
+	UploadFormat string `json:"upload_format" bson:"upload_format"` // legacy (default) or chunked
 }
+
+// The formats encrypted recordings are uploaded in. Recordings are encrypted in chunks (AES-256-GCM),
+// but are uploaded in the legacy format (AES-256-CBC, openssl and crypto-js compatible) by default, as
+// the consumers can't read the chunked format yet. Chunked is for the consumers that can.
+const (
+	EncryptionFormatChunked = "chunked"
+	EncryptionFormatLegacy  = "legacy"
+)
@@ -0,0 +1,21 @@
+package models
+
+// The states of the disk watchdog, from a healthy disk to a paused recorder.
+const (
+	DiskStateOK                 = "ok"
+	DiskStateEmergencyRetention = "emergency_retention"
+	DiskStateMotionOnly         = "motion_only"
+	DiskStateSubOnly            = "sub_only"
+	DiskStatePaused             = "paused"
+)
+
+// DiskStatus is the state of the disk watchdog, as shown in the dashboard and the heartbeat,
+// and published over MQTT when it changes.
+type DiskStatus struct {
+	State          string  `json:"state"`
+	FreePercentage float64 `json:"free_percentage"`
+	Free           uint64  `json:"free"`    // bytes
+	Total          uint64  `json:"total"`   // bytes
+	Since          int64   `json:"since"`   // Unix timestamp in milliseconds, of the last state change.
+	Checked        int64   `json:"checked"` // Unix timestamp in milliseconds, of the last check.
+}
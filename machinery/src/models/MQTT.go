@@ -148,7 +148,10 @@ type AudioPayload struct {
 
 // We received a recording request, we'll send it to the motion handler.
 type RecordPayload struct {
-	Timestamp int64 `json:"timestamp"` // timestamp of the recording request.
+	Timestamp int64  `json:"timestamp"`          // timestamp of the recording request.
+	Duration  int64  `json:"duration,omitempty"` // length of the recording (seconds).
+	PreRoll   *int64 `json:"pre_roll,omitempty"` // footage before the request (seconds).
+	Label     string `json:"label,omitempty"`
 }
 
 // We received a preset position request, we'll request it through onvif and send it back.
@@ -1,18 +1,32 @@
 package models
 
 type Media struct {
-	Key        string `json:"key"`
-	Path       string `json:"path"`
-	Day        string `json:"day"`
-	ShortDay   string `json:"short_day"`
-	Time       string `json:"time"`
-	Timestamp  string `json:"timestamp"`
-	CameraName string `json:"camera_name"`
-	CameraKey  string `json:"camera_key"`
+	Key        string             `json:"key"`
+	Path       string             `json:"path"`
+	Day        string             `json:"day"`
+	ShortDay   string             `json:"short_day"`
+	Time       string             `json:"time"`
+	Timestamp  string             `json:"timestamp"`
+	CameraName string             `json:"camera_name"`
+	CameraKey  string             `json:"camera_key"`
+	Poster     string             `json:"poster,omitempty"`  // The poster (JPEG) of the recording, served next to the recording.
+	Sprite     string             `json:"sprite,omitempty"`  // The WebVTT file of the thumbnail sprite, served next to the recording.
+	SubKey     string             `json:"sub_key,omitempty"` // The recording of the sub stream, if it was recorded as well.
+	Metadata   *RecordingMetadata `json:"metadata,omitempty"`
 }
 
 type EventFilter struct {
-	TimestampOffsetStart int64 `json:"timestamp_offset_start"`
-	TimestampOffsetEnd   int64 `json:"timestamp_offset_end"`
-	NumberOfElements     int   `json:"number_of_elements"`
+	TimestampOffsetStart int64  `json:"timestamp_offset_start"` // Only recordings started at or after this timestamp (seconds).
+	TimestampOffsetEnd   int64  `json:"timestamp_offset_end"`   // Only recordings started before this timestamp (seconds).
+	NumberOfElements     int    `json:"number_of_elements"`
+	Day                  string `json:"day,omitempty"`        // Only recordings of this day (DD-MM-YYYY).
+	Trigger              string `json:"trigger,omitempty"`    // Only recordings with this trigger (motion, manual, continuous or mqtt).
+	Region               string `json:"region,omitempty"`     // Only recordings with motion in this region.
+	CameraKey            string `json:"camera_key,omitempty"` // Only recordings of this camera (multi-camera mode).
+	Cursor               string `json:"cursor,omitempty"`     // The cursor returned with the previous page.
+}
+
+type ExportRequest struct {
+	From int64 `json:"from"` // Start of the clip, unix timestamp (seconds).
+	To   int64 `json:"to"`   // End of the clip, unix timestamp (seconds).
 }
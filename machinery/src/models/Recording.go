@@ -0,0 +1,90 @@
+package models
+
+// The different reasons why a recording was started.
+const (
+	TriggerMotion     = "motion"
+	TriggerManual     = "manual"
+	TriggerContinuous = "continuous"
+	TriggerMQTT       = "mqtt"
+	TriggerTimelapse  = "timelapse"
+	TriggerPeriodic   = "periodic"
+)
+
+// RecordingMetadata is stored as a JSON sidecar next to every recording
+// (<recording>.json), so tooling no longer needs to parse the filename.
+type RecordingMetadata struct {
+	Name         string   `json:"name" bson:"name"`
+	CameraKey    string   `json:"camera_key" bson:"camera_key"`
+	CameraName   string   `json:"camera_name" bson:"camera_name"`
+	StartTime    int64    `json:"start_time" bson:"start_time"`                           // Unix timestamp in milliseconds.
+	EndTime      int64    `json:"end_time" bson:"end_time"`                               // Unix timestamp in milliseconds.
+	Duration     int64    `json:"duration" bson:"duration"`                               // Duration in milliseconds.
+	SegmentStart int64    `json:"segment_start,omitempty" bson:"segment_start,omitempty"` // The wall-clock boundary of an aligned segment (milliseconds).
+	VideoCodec   string   `json:"video_codec" bson:"video_codec"`
+	AudioCodec   string   `json:"audio_codec" bson:"audio_codec"`
+	Width        int      `json:"width" bson:"width"`
+	Height       int      `json:"height" bson:"height"`
+	Trigger      string   `json:"trigger" bson:"trigger"`                 // motion, manual, continuous, mqtt, timelapse or periodic (snapshots).
+	Label        string   `json:"label,omitempty" bson:"label,omitempty"` // Label of a manual recording.
+	PeakChanges  int      `json:"peak_changes" bson:"peak_changes"`
+	TotalChanges int      `json:"total_changes" bson:"total_changes"`
+	Regions      []string `json:"regions" bson:"regions"`
+	Encrypted    bool     `json:"encrypted" bson:"encrypted"`
+	Poster       string   `json:"poster,omitempty" bson:"poster,omitempty"` // File name of the poster (JPEG).
+	Sprite       string   `json:"sprite,omitempty" bson:"sprite,omitempty"` // File name of the thumbnail sprite (WebVTT).
+	// The recordings of the main and sub stream are linked, the sub recording has the same name
+	// and is stored in data/recordings/sub. Both are relative to data/recordings.
+	Stream        string `json:"stream,omitempty" bson:"stream,omitempty"` // main or sub.
+	SubRecording  string `json:"sub_recording,omitempty" bson:"sub_recording,omitempty"`
+	MainRecording string `json:"main_recording,omitempty" bson:"main_recording,omitempty"`
+	// The timestamps of a recovered recording are estimated, when it had no sample journal.
+	ApproximateTiming bool `json:"approximate_timing,omitempty" bson:"approximate_timing,omitempty"`
+}
+
+// The states of a manual recording.
+const (
+	ManualRecordingPending   = "pending"
+	ManualRecordingRecording = "recording"
+	ManualRecordingFinished  = "finished"
+	ManualRecordingCancelled = "cancelled"
+	ManualRecordingFailed    = "failed"
+)
+
+// RecordRequest requests a manual recording (POST /api/camera/record, or the record action over MQTT).
+type RecordRequest struct {
+	Duration int64  `json:"duration"`           // Length of the recording after the request (seconds), defaults to the post recording.
+	PreRoll  *int64 `json:"pre_roll,omitempty"` // Footage before the request (seconds), limited to what's buffered. Defaults to the pre recording.
+	Label    string `json:"label"`              // Stored in the metadata of the recording.
+}
+
+// ManualRecording is a manual recording that was requested, it can be polled until it's finished.
+type ManualRecording struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"` // pending, recording, finished, cancelled or failed.
+	Trigger     string `json:"trigger"`
+	Label       string `json:"label,omitempty"`
+	Duration    int64  `json:"duration"`
+	PreRoll     int64  `json:"pre_roll"`
+	RequestedAt int64  `json:"requested_at"`        // Unix timestamp in milliseconds.
+	Recording   string `json:"recording,omitempty"` // Name of the recording, once it's started.
+	StartTime   int64  `json:"start_time,omitempty"`
+	EndTime     int64  `json:"end_time,omitempty"`
+	Error       string `json:"error,omitempty"`
+	CameraID    string `json:"camera_id,omitempty"` // The camera in multi-camera mode.
+}
+
+// The reasons why there are no continuous recordings for a while.
+const (
+	GapDisconnected = "disconnected" // The agent or the stream was restarted.
+	GapConditions   = "conditions"   // Recording was paused by the time window or URI conditions.
+	GapStream       = "stream"       // The stream stalled, without reconnecting.
+)
+
+// RecordingGap is an interval without footage, detected while recording continuously.
+type RecordingGap struct {
+	Start     int64  `json:"start"`    // Unix timestamp in milliseconds.
+	End       int64  `json:"end"`      // Unix timestamp in milliseconds.
+	Duration  int64  `json:"duration"` // Duration in milliseconds.
+	Reason    string `json:"reason"`   // disconnected, conditions or stream.
+	CameraKey string `json:"camera_key,omitempty"`
+}
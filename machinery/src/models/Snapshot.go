@@ -0,0 +1,13 @@
+package models
+
+// Snapshot is a JPEG in data/snapshots, taken periodically or when motion was detected.
+type Snapshot struct {
+	Name      string   `json:"name"`
+	Timestamp int64    `json:"timestamp"` // Unix timestamp in milliseconds.
+	Trigger   string   `json:"trigger"`   // periodic or motion.
+	Size      int64    `json:"size"`      // bytes
+	Width     int      `json:"width"`
+	Height    int      `json:"height"`
+	Regions   []string `json:"regions"`
+	Encrypted bool     `json:"encrypted"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import "github.com/kerberos-io/agent/machinery/src/packets"
+
+// The states of a stream (main or sub). A connected stream that fails (no keyframes anymore) is
+// reconnecting: it waits (backoff) before it's connecting again.
+const (
+	StreamStateConnecting   = "connecting"
+	StreamStateConnected    = "connected"
+	StreamStateReconnecting = "reconnecting"
+	StreamStateStopped      = "stopped"
+)
+
+// StreamStatus is the state of a stream, as shown in the dashboard. Every change of the state is
+// published over MQTT as an event.
+type StreamStatus struct {
+	Stream   string `json:"stream"` // main or sub
+	State    string `json:"state"`
+	Previous string `json:"previous"`          // The state before the change.
+	Attempt  int    `json:"attempt"`           // The number of failed reconnects, since the stream failed.
+	Backoff  int64  `json:"backoff,omitempty"` // milliseconds, before the stream is reconnected.
+	Error    string `json:"error,omitempty"`   // Why the stream failed, or couldn't be reconnected.
+	Since    int64  `json:"since"`             // Unix timestamp in milliseconds, of the state change.
+}
+
+// StreamStates are the states of the streams of the camera, and their last changes (events).
+type StreamStates struct {
+	Streams []StreamStatus `json:"streams"`
+	Events  []StreamStatus `json:"events"`
+}
+
+// StreamStats are the statistics of the main and sub stream, a stream that isn't running is left out.
+type StreamStats struct {
+	Main *packets.Stats `json:"main,omitempty"`
+	Sub  *packets.Stats `json:"sub,omitempty"`
+}
@@ -15,8 +15,10 @@ type OnvifCredentials struct {
 }
 
 type CameraStreams struct {
-	RTSP    string `json:"rtsp"`
-	SubRTSP string `json:"sub_rtsp"`
+	RTSP         string `json:"rtsp"`
+	SubRTSP      string `json:"sub_rtsp"`
+	Transport    string `json:"transport,omitempty"`
+	SubTransport string `json:"sub_transport,omitempty"`
 }
 
 type OnvifPanTilt struct {
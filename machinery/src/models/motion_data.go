@@ -1,8 +1,10 @@
 package models
 
 type MotionDataPartial struct {
-	Timestamp       int64 `json:"timestamp" bson:"timestamp"`
-	NumberOfChanges int   `json:"numberOfChanges" bson:"numberOfChanges"`
+	Timestamp       int64    `json:"timestamp" bson:"timestamp"`
+	NumberOfChanges int      `json:"numberOfChanges" bson:"numberOfChanges"`
+	Trigger         string   `json:"trigger" bson:"trigger"`
+	Regions         []string `json:"regions" bson:"regions"`
 }
 
 type MotionDataFull struct {
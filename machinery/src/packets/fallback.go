@@ -0,0 +1,103 @@
+package packets
+
+import (
+	"errors"
+)
+
+// The consumers of the sub stream (motion detection, livestreams) read the main stream while the sub
+// stream isn't available, so they don't stall while it's reconnecting. The queue of the sub stream is
+// marked unavailable, and the cursors with a fallback continue reading the main queue. The cursors switch
+// at a keyframe, so a consumer can decode the packets from the switch on.
+
+// errUnavailable is returned (internally) when the queue of a cursor with a fallback is unavailable.
+var errUnavailable = errors.New("the queue is unavailable")
+
+// SetAvailable marks whether the stream of the queue is connected, the queue is available when it's created.
+func (self *Queue) SetAvailable(available bool) {
+	self.lock.Lock()
+	if available && self.unavailable {
+		self.availableSince = self.buf.Tail
+	}
+	self.unavailable = !available
+	self.cond.Broadcast()
+	self.lock.Unlock()
+}
+
+// IsAvailable returns true if the stream of the queue is connected.
+func (self *Queue) IsAvailable() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return !self.unavailable
+}
+
+// latestKeyFrameSince returns the position of the latest keyframe, written at or after the position.
+func (self *Queue) latestKeyFrameSince(pos BufPos) (BufPos, bool) {
+	for i := len(self.keyframes) - 1; i >= 0; i-- {
+		if self.keyframes[i].LT(pos) {
+			break
+		}
+		if self.buf.IsValidPos(self.keyframes[i]) {
+			return self.keyframes[i], true
+		}
+	}
+	return 0, false
+}
+
+// Fallback sets the queue that is read, while the queue of the cursor is unavailable.
+func (self *QueueCursor) Fallback(queue *Queue) *QueueCursor {
+	self.fallbackQueue = queue
+	return self
+}
+
+// IsFallback returns true if the last packet was read from the fallback queue.
+func (self *QueueCursor) IsFallback() bool {
+	return self.onFallback
+}
+
+// readPacketOrFallback reads from the queue, or from the fallback queue while the queue is unavailable.
+func (self *QueueCursor) readPacketOrFallback() (pkt Packet, err error) {
+	for {
+		if !self.onFallback {
+			pkt, err = self.readPacket(true)
+			if err != errUnavailable {
+				return
+			}
+			// Continue with the latest keyframe of the fallback queue.
+			self.unregister()
+			self.fallback = self.fallbackQueue.DelayedKeyFrame(0).Named(self.name)
+			self.onFallback = true
+		}
+
+		if self.switchBack() {
+			self.fallback.unregister()
+			self.fallback = nil
+			self.onFallback = false
+			continue
+		}
+		return self.fallback.readPacket(false)
+	}
+}
+
+// switchBack positions the cursor at the first keyframe of the queue, once it's available again.
+func (self *QueueCursor) switchBack() bool {
+	self.que.cond.L.Lock()
+	defer self.que.cond.L.Unlock()
+	if self.que.unavailable {
+		return false
+	}
+	pos, ok := self.que.latestKeyFrameSince(self.que.availableSince)
+	if !ok {
+		return false
+	}
+	self.pos = pos
+	self.gotpos = true
+	return true
+}
+
+// unregister removes the cursor from the statistics of the queue.
+func (self *QueueCursor) unregister() {
+	self.que.cursorsLock.Lock()
+	delete(self.que.cursors, self)
+	self.registered = false
+	self.que.cursorsLock.Unlock()
+}
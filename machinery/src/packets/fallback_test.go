@@ -0,0 +1,97 @@
+package packets
+
+import (
+	"testing"
+	"time"
+)
+
+func testPacket(id byte, isKeyFrame bool) Packet {
+	return Packet{
+		IsVideo:    true,
+		IsKeyFrame: isKeyFrame,
+		Time:       time.Duration(id) * 40 * time.Millisecond,
+		Data:       []byte{id},
+	}
+}
+
+func TestCursorFallback(t *testing.T) {
+	streams := []Stream{{Name: "H264", IsVideo: true}}
+	sub := NewQueue()
+	sub.WriteHeader(streams)
+	main := NewQueue()
+	main.WriteHeader(streams)
+	cursor := sub.Oldest().Fallback(main)
+
+	// The steps write packets to the queues, and read the next packet.
+	tests := []struct {
+		name       string
+		write      func()
+		expected   byte
+		isFallback bool
+	}{
+		{"sub stream", func() {
+			sub.WritePacket(testPacket(1, true))
+		}, 1, false},
+		{"sub stream unavailable, from the latest keyframe of the main stream", func() {
+			main.WritePacket(testPacket(10, true))
+			main.WritePacket(testPacket(11, false))
+			sub.SetAvailable(false)
+		}, 10, true},
+		{"main stream", nil, 11, true},
+		{"sub stream available, but no keyframe yet", func() {
+			sub.SetAvailable(true)
+			sub.WritePacket(testPacket(2, false))
+			main.WritePacket(testPacket(12, false))
+		}, 12, true},
+		{"sub stream from its first keyframe", func() {
+			sub.WritePacket(testPacket(3, true))
+		}, 3, false},
+	}
+	for _, tt := range tests {
+		if tt.write != nil {
+			tt.write()
+		}
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if pkt.Data[0] != tt.expected || cursor.IsFallback() != tt.isFallback {
+			t.Fatalf("%s: expected packet %d (fallback %v), got %d (fallback %v)", tt.name, tt.expected, tt.isFallback, pkt.Data[0], cursor.IsFallback())
+		}
+	}
+}
+
+func TestCursorFallbackWhileWaiting(t *testing.T) {
+	streams := []Stream{{Name: "H264", IsVideo: true}}
+	sub := NewQueue()
+	sub.WriteHeader(streams)
+	main := NewQueue()
+	main.WriteHeader(streams)
+	main.WritePacket(testPacket(10, true))
+	cursor := sub.Latest().Fallback(main)
+
+	// The cursor is waiting for a packet of the sub stream, when it becomes unavailable.
+	read := make(chan Packet, 1)
+	go func() {
+		pkt, _ := cursor.ReadPacket()
+		read <- pkt
+	}()
+	time.Sleep(50 * time.Millisecond)
+	sub.SetAvailable(false)
+
+	select {
+	case pkt := <-read:
+		if pkt.Data[0] != 10 {
+			t.Fatalf("expected the keyframe of the main stream, got %d", pkt.Data[0])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the cursor didn't switch to the main stream")
+	}
+
+	// Closing the queues ends the cursor.
+	main.Close()
+	sub.Close()
+	if _, err := cursor.ReadPacket(); err == nil {
+		t.Fatal("expected the cursor to end")
+	}
+}
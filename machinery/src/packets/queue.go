@@ -24,9 +24,29 @@ type Queue struct {
 	lock                     *sync.RWMutex
 	cond                     *sync.Cond
 	curgopcount, maxgopcount int
+	maxduration              time.Duration // When set, the queue is sized by duration instead of GOP count.
+	maxsize                  int           // The maximum size (bytes) of the buffered packets, 0 is unlimited.
+	keyframes                []BufPos      // The positions of the buffered keyframes.
 	streams                  []Stream
 	videoidx                 int
 	closed                   bool
+
+	// When the stream is reconnected, the timestamps start over. They are shifted (offset) to
+	// continue after the last packet, so the timestamps in the queue keep increasing.
+	discontinued bool
+	offset       time.Duration
+	lastTime     time.Duration
+	lastWritten  time.Time
+
+	// A queue is unavailable while its stream isn't connected (e.g. it's reconnecting), the cursors with a
+	// fallback read another queue meanwhile (see fallback.go).
+	unavailable    bool
+	availableSince BufPos
+
+	// The statistics of the stream, and the cursors that are reading from the queue (see stats.go).
+	stats       queueStats
+	cursors     map[*QueueCursor]struct{}
+	cursorsLock *sync.Mutex
 }
 
 func NewQueue() *Queue {
@@ -36,6 +56,8 @@ func NewQueue() *Queue {
 	q.lock = &sync.RWMutex{}
 	q.cond = sync.NewCond(q.lock.RLocker())
 	q.videoidx = -1
+	q.cursors = make(map[*QueueCursor]struct{})
+	q.cursorsLock = &sync.Mutex{}
 	return q
 }
 
@@ -46,6 +68,23 @@ func (self *Queue) SetMaxGopCount(n int) {
 	return
 }
 
+// SetMaxDuration sizes the queue by duration: GOPs are only discarded when the GOPs that remain
+// still cover the duration, so the queue always holds at least the duration (and a complete GOP).
+func (self *Queue) SetMaxDuration(dur time.Duration) {
+	self.lock.Lock()
+	self.maxduration = dur
+	self.maxgopcount = 0
+	self.lock.Unlock()
+}
+
+// SetMaxSize bounds the size (bytes) of the buffered packets, whole GOPs are discarded until the queue
+// fits, but the GOP that is being received is always kept.
+func (self *Queue) SetMaxSize(size int) {
+	self.lock.Lock()
+	self.maxsize = size
+	self.lock.Unlock()
+}
+
 func (self *Queue) WriteHeader(streams []Stream) error {
 	self.lock.Lock()
 
@@ -83,6 +122,15 @@ func (self *Queue) Close() (err error) {
 	return
 }
 
+// Discontinue is called when the stream is reconnected, the timestamps of the packets written next
+// are shifted to continue after the last packet (plus the time the stream was gone).
+func (self *Queue) Discontinue() {
+	self.lock.Lock()
+	self.discontinued = !self.lastWritten.IsZero()
+	self.stats.discontinue()
+	self.lock.Unlock()
+}
+
 func (self *Queue) GetSize() int {
 	return self.buf.Count
 }
@@ -91,20 +139,46 @@ func (self *Queue) GetSize() int {
 func (self *Queue) WritePacket(pkt Packet) (err error) {
 	self.lock.Lock()
 
+	if self.discontinued {
+		self.offset = self.lastTime + time.Since(self.lastWritten) - pkt.Time
+		self.discontinued = false
+	}
+	pkt.Time += self.offset
+	self.lastTime = pkt.Time
+	self.lastWritten = time.Now()
+
+	isVideo := pkt.Idx == int8(self.videoidx)
+	self.stats.update(pkt, isVideo, self.lastWritten)
+
+	isKeyFrame := isVideo && pkt.IsKeyFrame
+	if isKeyFrame {
+		self.keyframes = append(self.keyframes, self.buf.Tail)
+	}
 	self.buf.Push(pkt)
-	if pkt.Idx == int8(self.videoidx) && pkt.IsKeyFrame {
+	if isKeyFrame {
 		self.curgopcount++
 	}
 
-	for self.curgopcount >= self.maxgopcount && self.buf.Count > 1 {
-		pkt := self.buf.Pop()
-		if pkt.Idx == int8(self.videoidx) && pkt.IsKeyFrame {
-			self.curgopcount--
+	if self.maxgopcount > 0 {
+		for self.curgopcount >= self.maxgopcount && self.buf.Count > 1 {
+			self.pop()
+			if self.curgopcount < self.maxgopcount {
+				break
+			}
 		}
-		if self.curgopcount < self.maxgopcount {
-			break
+	} else {
+		// Discard the oldest GOP, if the next GOP still covers the duration.
+		for len(self.keyframes) > 1 {
+			next := self.buf.Get(self.keyframes[1])
+			if pkt.Time-next.Time < self.maxduration {
+				break
+			}
+			self.popUntil(self.keyframes[1])
 		}
 	}
+	for self.maxsize > 0 && self.buf.Size > self.maxsize && len(self.keyframes) > 1 {
+		self.popUntil(self.keyframes[1])
+	}
 	//println("shrink", self.curgopcount, self.maxgopcount, self.buf.Head, self.buf.Tail, "count", self.buf.Count, "size", self.buf.Size)
 
 	self.cond.Broadcast()
@@ -113,11 +187,41 @@ func (self *Queue) WritePacket(pkt Packet) (err error) {
 	return
 }
 
+// pop discards the oldest packet.
+func (self *Queue) pop() {
+	if len(self.keyframes) > 0 && self.keyframes[0] == self.buf.Head {
+		self.keyframes = self.keyframes[1:]
+	}
+	pkt := self.buf.Pop()
+	if pkt.Idx == int8(self.videoidx) && pkt.IsKeyFrame {
+		self.curgopcount--
+	}
+}
+
+// popUntil discards the packets before a position.
+func (self *Queue) popUntil(pos BufPos) {
+	for self.buf.Head.LT(pos) {
+		self.pop()
+	}
+}
+
 type QueueCursor struct {
 	que    *Queue
 	pos    BufPos
 	gotpos bool
 	init   func(buf *Buf, videoidx int) BufPos
+
+	// The cursor is registered in the queue once it's read, so its lag is part of the statistics.
+	name       string
+	registered bool
+	waiting    bool
+	lastRead   time.Time
+	skipped    int64
+
+	// The queue that is read while the queue of the cursor is unavailable (see fallback.go).
+	fallbackQueue *Queue
+	fallback      *QueueCursor
+	onFallback    bool
 }
 
 func (self *Queue) newCursor() *QueueCursor {
@@ -126,6 +230,12 @@ func (self *Queue) newCursor() *QueueCursor {
 	}
 }
 
+// Named sets the name of the cursor (the consumer), as shown in the statistics.
+func (self *QueueCursor) Named(name string) *QueueCursor {
+	self.name = name
+	return self
+}
+
 // Create cursor position at latest packet.
 func (self *Queue) Latest() *QueueCursor {
 	cursor := self.newCursor()
@@ -163,6 +273,24 @@ func (self *Queue) DelayedTime(dur time.Duration) *QueueCursor {
 	return cursor
 }
 
+// Create cursor position at the last keyframe that is (at least) a duration before the latest packet.
+// If fewer is buffered, the cursor is positioned at the oldest keyframe.
+func (self *Queue) DelayedKeyFrame(dur time.Duration) *QueueCursor {
+	cursor := self.newCursor()
+	cursor.init = func(buf *Buf, videoidx int) BufPos {
+		if len(self.keyframes) == 0 {
+			return buf.Tail
+		}
+		end := buf.Get(buf.Tail - 1)
+		i := len(self.keyframes) - 1
+		for i > 0 && end.Time-buf.Get(self.keyframes[i]).Time < dur {
+			i--
+		}
+		return self.keyframes[i]
+	}
+	return cursor
+}
+
 // Create cursor position at specific delayed GOP count in buffered packets.
 func (self *Queue) DelayedGopCount(n int) *QueueCursor {
 	cursor := self.newCursor()
@@ -197,14 +325,34 @@ func (self *QueueCursor) Streams() (streams []Stream, err error) {
 
 // ReadPacket will not consume packets in Queue, it's just a cursor.
 func (self *QueueCursor) ReadPacket() (pkt Packet, err error) {
+	if self.fallbackQueue == nil {
+		return self.readPacket(false)
+	}
+	return self.readPacketOrFallback()
+}
+
+// readPacket reads the next packet, with canFallback errUnavailable is returned as soon as the queue is
+// unavailable.
+func (self *QueueCursor) readPacket(canFallback bool) (pkt Packet, err error) {
 	self.que.cond.L.Lock()
 	buf := self.que.buf
 	if !self.gotpos {
 		self.pos = self.init(buf, self.que.videoidx)
 		self.gotpos = true
 	}
+	if !self.registered {
+		self.que.cursorsLock.Lock()
+		self.que.cursors[self] = struct{}{}
+		self.registered = true
+		self.que.cursorsLock.Unlock()
+	}
 	for {
+		if canFallback && self.que.unavailable && !self.que.closed {
+			err = errUnavailable
+			break
+		}
 		if self.pos.LT(buf.Head) {
+			self.skipped += int64(buf.Head - self.pos)
 			self.pos = buf.Head
 		} else if self.pos.GT(buf.Tail) {
 			self.pos = buf.Tail
@@ -218,8 +366,11 @@ func (self *QueueCursor) ReadPacket() (pkt Packet, err error) {
 			err = io.EOF
 			break
 		}
+		self.waiting = true
 		self.que.cond.Wait()
 	}
+	self.waiting = false
+	self.lastRead = time.Now()
 	self.que.cond.L.Unlock()
 	return
 }
@@ -0,0 +1,164 @@
+package packets
+
+import (
+	"testing"
+	"time"
+)
+
+// writeQueue writes video packets at 25 fps (a keyframe every second) of 1000 bytes, from a timestamp.
+// An audio packet is written in front of every keyframe.
+func writeQueue(q *Queue, frames int, start time.Duration) {
+	for i := 0; i < frames; i++ {
+		pktTime := start + time.Duration(i)*40*time.Millisecond
+		if i%25 == 0 {
+			q.WritePacket(Packet{Idx: 1, IsAudio: true, Time: pktTime, Data: make([]byte, 10)})
+		}
+		q.WritePacket(Packet{
+			Idx:        0,
+			IsVideo:    true,
+			IsKeyFrame: i%25 == 0,
+			Time:       pktTime,
+			Data:       make([]byte, 1000),
+		})
+	}
+}
+
+func newTestQueue() *Queue {
+	q := NewQueue()
+	q.WriteHeader([]Stream{{Name: "H264", IsVideo: true}, {Name: "AAC", IsAudio: true}})
+	return q
+}
+
+// readQueue reads the packets that are buffered, from a cursor.
+func readQueue(t *testing.T, q *Queue, cursor *QueueCursor) []Packet {
+	t.Helper()
+	var pkts []Packet
+	for {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts = append(pkts, pkt)
+		if cursor.pos == q.buf.Tail {
+			return pkts
+		}
+	}
+}
+
+func TestQueueMaxDuration(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxDuration time.Duration
+		maxSize     int
+		// The queue should start at the keyframe of this second.
+		oldest time.Duration
+	}{
+		{"duration", 2 * time.Second, 0, 3 * time.Second},
+		{"duration that ends on a keyframe", 1960 * time.Millisecond, 0, 4 * time.Second},
+		{"size", 10 * time.Second, 60000, 4 * time.Second},
+		{"size of less than a GOP", 10 * time.Second, 10000, 5 * time.Second},
+		{"duration within the size", 2 * time.Second, 100000, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue()
+			q.SetMaxDuration(tt.maxDuration)
+			q.SetMaxSize(tt.maxSize)
+			// 6 GOPs, the last packet is at 5.96s.
+			writeQueue(q, 150, 0)
+
+			pkts := readQueue(t, q, q.Oldest())
+			if !pkts[0].IsKeyFrame || pkts[0].Time != tt.oldest {
+				t.Fatalf("the queue starts at %s (keyframe %v), expected the keyframe at %s", pkts[0].Time, pkts[0].IsKeyFrame, tt.oldest)
+			}
+			if end := pkts[len(pkts)-1].Time; end != 5960*time.Millisecond {
+				t.Fatalf("the queue ends at %s", end)
+			}
+			// Every GOP from the oldest keyframe is buffered, the audio in front of that keyframe isn't.
+			gops := int((6*time.Second - tt.oldest) / time.Second)
+			if len(pkts) != gops*26-1 || q.buf.Size != gops*25*1000+(gops-1)*10 {
+				t.Fatalf("%d packets of %d bytes are buffered, expected %d GOPs", len(pkts), q.buf.Size, gops)
+			}
+		})
+	}
+}
+
+func TestQueueDelayedKeyFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration
+		// The cursor should start at the keyframe of this second.
+		start time.Duration
+	}{
+		{"no delay", 0, 5 * time.Second},
+		{"less than a GOP", 500 * time.Millisecond, 5 * time.Second},
+		{"a GOP", time.Second, 4 * time.Second},
+		{"between keyframes", 2500 * time.Millisecond, 3 * time.Second},
+		{"more than is buffered", time.Minute, 0},
+	}
+	q := newTestQueue()
+	q.SetMaxDuration(10 * time.Second)
+	writeQueue(q, 150, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkts := readQueue(t, q, q.DelayedKeyFrame(tt.delay))
+			// The cursor starts at the keyframe, after the audio that was written in front of it.
+			if !pkts[0].IsVideo || !pkts[0].IsKeyFrame || pkts[0].Time != tt.start {
+				t.Fatalf("the cursor starts at %s (keyframe %v), expected the keyframe at %s", pkts[0].Time, pkts[0].IsKeyFrame, tt.start)
+			}
+		})
+	}
+
+	// Without a keyframe, the cursor waits for the next packet.
+	empty := newTestQueue()
+	empty.WritePacket(Packet{Idx: 1, IsAudio: true, Data: make([]byte, 5)})
+	read := make(chan Packet, 1)
+	go func() {
+		pkt, _ := empty.DelayedKeyFrame(time.Second).ReadPacket()
+		read <- pkt
+	}()
+	time.Sleep(50 * time.Millisecond)
+	writeQueue(empty, 1, 0)
+	select {
+	case pkt := <-read:
+		if len(pkt.Data) == 5 {
+			t.Fatal("the cursor starts at the packet that was written before it")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the cursor didn't read the next packet")
+	}
+}
+
+func TestQueueDiscontinue(t *testing.T) {
+	q := newTestQueue()
+	q.SetMaxDuration(time.Minute)
+	cursor := q.Oldest()
+
+	// A discontinuity before the first packet doesn't shift the timestamps.
+	q.Discontinue()
+	writeQueue(q, 50, time.Minute)
+	pkts := readQueue(t, q, cursor)
+	if pkts[0].Time != time.Minute {
+		t.Fatalf("the first packet is at %s, expected %s", pkts[0].Time, time.Minute)
+	}
+
+	// The stream is reconnected twice, and starts over at timestamp 0.
+	for i := 0; i < 2; i++ {
+		last := pkts[len(pkts)-1].Time
+		time.Sleep(50 * time.Millisecond)
+		q.Discontinue()
+		writeQueue(q, 50, 0)
+		pkts = readQueue(t, q, cursor)
+		if gap := pkts[0].Time - last; gap < 50*time.Millisecond || gap > time.Second {
+			t.Fatalf("the reconnected stream starts %s after the last packet, expected the time it was gone", gap)
+		}
+		for j := 1; j < len(pkts); j++ {
+			if pkts[j].Time < pkts[j-1].Time {
+				t.Fatalf("packet %d at %s is before the packet at %s", j, pkts[j].Time, pkts[j-1].Time)
+			}
+		}
+		if end := pkts[len(pkts)-1].Time - pkts[0].Time; end != 1960*time.Millisecond {
+			t.Fatalf("the reconnected stream lasts %s, expected the timestamps to be shifted together", end)
+		}
+	}
+}
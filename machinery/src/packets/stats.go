@@ -0,0 +1,186 @@
+package packets
+
+import (
+	"sort"
+	"time"
+)
+
+// The rates (fps and bitrate) are measured over a window, and a stream that didn't write a packet
+// for a window is reported as stalled (zero fps and bitrate).
+const statsWindow = 5 * time.Second
+
+// A cursor that isn't read (and isn't waiting for a packet) for a while is abandoned, it's dropped
+// from the statistics.
+const cursorIdleTimeout = 30 * time.Second
+
+// Stats are the statistics of a stream, measured while the packets are written to the queue.
+type Stats struct {
+	FPS              float64       `json:"fps"`               // Video frames per second.
+	Bitrate          int64         `json:"bitrate"`           // Bits per second, of the video and audio packets.
+	GOPLength        int           `json:"gop_length"`        // The number of video frames in the last GOP.
+	KeyFrameInterval int64         `json:"keyframe_interval"` // Milliseconds between the last two keyframes.
+	Packets          int64         `json:"packets"`
+	KeyFrames        int64         `json:"keyframes"`
+	LostPackets      int64         `json:"lost_packets"`   // Gaps in the RTP sequence numbers.
+	DecodeErrors     int64         `json:"decode_errors"`  // Packets that couldn't be depacketized or decoded.
+	QueueDepth       int           `json:"queue_depth"`    // The number of buffered packets.
+	QueueSize        int           `json:"queue_size"`     // The size (bytes) of the buffered packets.
+	QueueDuration    int64         `json:"queue_duration"` // Milliseconds between the oldest and the latest buffered packet.
+	Cursors          []CursorStats `json:"cursors"`
+}
+
+// CursorStats is how far a consumer (cursor) is behind the latest packet.
+type CursorStats struct {
+	Name        string `json:"name"`
+	Lag         int    `json:"lag"`          // The number of packets that aren't read yet.
+	LagDuration int64  `json:"lag_duration"` // Milliseconds between the next packet and the latest packet.
+	Skipped     int64  `json:"skipped"`      // Packets that were discarded before they were read.
+}
+
+// queueStats is updated for every packet that is written to the queue.
+type queueStats struct {
+	packets, keyFrames          int64
+	lostPackets, decodeErrors   int64
+	frames                      int // The number of video frames since the last keyframe.
+	gopLength                   int
+	lastKeyFrame                time.Duration
+	keyFrameInterval            time.Duration
+	windowStart                 time.Time
+	windowFrames, windowBytes   int64
+	fps                         float64
+	bitrate                     int64
+	hasKeyFrame, hasMeasurement bool
+}
+
+// update counts the packet, isVideo is true for the packets of the video stream.
+func (s *queueStats) update(pkt Packet, isVideo bool, now time.Time) {
+	s.packets++
+	s.windowBytes += int64(len(pkt.Data))
+	if isVideo {
+		if pkt.IsKeyFrame {
+			s.keyFrames++
+			if s.hasKeyFrame {
+				s.gopLength = s.frames
+				s.keyFrameInterval = pkt.Time - s.lastKeyFrame
+			}
+			s.hasKeyFrame = true
+			s.lastKeyFrame = pkt.Time
+			s.frames = 0
+		}
+		s.frames++
+		s.windowFrames++
+	}
+
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+	} else if elapsed := now.Sub(s.windowStart); elapsed >= statsWindow {
+		s.fps = float64(s.windowFrames) / elapsed.Seconds()
+		s.bitrate = int64(float64(s.windowBytes*8) / elapsed.Seconds())
+		s.hasMeasurement = true
+		s.windowStart = now
+		s.windowFrames = 0
+		s.windowBytes = 0
+	}
+}
+
+// discontinue starts the measurements over, for a reconnected stream: the interval to the last keyframe
+// and the rates of the previous connection don't apply to the new connection.
+func (s *queueStats) discontinue() {
+	s.hasKeyFrame = false
+	s.frames = 0
+	s.windowStart = time.Time{}
+	s.windowFrames = 0
+	s.windowBytes = 0
+	s.hasMeasurement = false
+	s.fps = 0
+	s.bitrate = 0
+}
+
+// ReportLostPackets counts the packets that were lost before they were received (e.g. a gap in the RTP
+// sequence numbers).
+func (self *Queue) ReportLostPackets(n int) {
+	self.lock.Lock()
+	self.stats.lostPackets += int64(n)
+	self.lock.Unlock()
+}
+
+// ReportDecodeError counts a packet that couldn't be depacketized or decoded.
+func (self *Queue) ReportDecodeError() {
+	self.lock.Lock()
+	self.stats.decodeErrors++
+	self.lock.Unlock()
+}
+
+// Stats returns the statistics of the stream, the queue and its cursors (consumers).
+func (self *Queue) Stats() Stats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	s := self.stats
+	stats := Stats{
+		GOPLength:        s.gopLength,
+		KeyFrameInterval: s.keyFrameInterval.Milliseconds(),
+		Packets:          s.packets,
+		KeyFrames:        s.keyFrames,
+		LostPackets:      s.lostPackets,
+		DecodeErrors:     s.decodeErrors,
+		QueueDepth:       self.buf.Count,
+		QueueSize:        self.buf.Size,
+		Cursors:          []CursorStats{},
+	}
+
+	// Until the first window is complete, we use what's measured so far (at least a second).
+	if !self.lastWritten.IsZero() && now.Sub(self.lastWritten) < statsWindow {
+		if s.hasMeasurement {
+			stats.FPS = s.fps
+			stats.Bitrate = s.bitrate
+		} else if elapsed := now.Sub(s.windowStart); elapsed >= time.Second {
+			stats.FPS = float64(s.windowFrames) / elapsed.Seconds()
+			stats.Bitrate = int64(float64(s.windowBytes*8) / elapsed.Seconds())
+		}
+	}
+
+	var latest Packet
+	if self.buf.Count > 0 {
+		latest = self.buf.Get(self.buf.Tail - 1)
+		stats.QueueDuration = (latest.Time - self.buf.Get(self.buf.Head).Time).Milliseconds()
+	}
+
+	self.cursorsLock.Lock()
+	for cursor := range self.cursors {
+		if !cursor.waiting && now.Sub(cursor.lastRead) > cursorIdleTimeout {
+			delete(self.cursors, cursor)
+			cursor.registered = false
+			continue
+		}
+		cursorStats := CursorStats{
+			Name:    cursor.name,
+			Skipped: cursor.skipped,
+		}
+		// The packets the cursor didn't read yet, might be discarded already.
+		pos := cursor.pos
+		if pos.LT(self.buf.Head) {
+			cursorStats.Skipped += int64(self.buf.Head - pos)
+			pos = self.buf.Head
+		}
+		if self.buf.IsValidPos(pos) {
+			cursorStats.Lag = int(self.buf.Tail - pos)
+			cursorStats.LagDuration = (latest.Time - self.buf.Get(pos).Time).Milliseconds()
+		}
+		stats.Cursors = append(stats.Cursors, cursorStats)
+	}
+	self.cursorsLock.Unlock()
+	sort.SliceStable(stats.Cursors, func(i, j int) bool {
+		return stats.Cursors[i].Name < stats.Cursors[j].Name
+	})
+
+	return stats
+}
+
+// KeyFrames returns the number of keyframes written to the queue.
+func (self *Queue) KeyFrames() int64 {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.stats.keyFrames
+}
@@ -0,0 +1,129 @@
+package packets
+
+import (
+	"testing"
+	"time"
+)
+
+// writeStats updates the statistics with video packets at 25 fps (a keyframe every second) of 100 bytes,
+// written in real time from the start.
+func writeStats(s *queueStats, frames int, pktStart time.Duration, start time.Time) {
+	for i := 0; i < frames; i++ {
+		offset := time.Duration(i) * 40 * time.Millisecond
+		pkt := Packet{
+			IsVideo:    true,
+			IsKeyFrame: i%25 == 0,
+			Time:       pktStart + offset,
+			Data:       make([]byte, 100),
+		}
+		s.update(pkt, true, start.Add(offset))
+	}
+}
+
+func TestQueueStatsUpdate(t *testing.T) {
+	tests := []struct {
+		name             string
+		frames           int
+		gopLength        int
+		keyFrameInterval time.Duration
+		hasMeasurement   bool
+		fps              float64 // The frames of the window (including the frame that completes it), per second.
+		bitrate          int64
+	}{
+		{"a single frame", 1, 0, 0, false, 0, 0},
+		{"less than a GOP", 20, 0, 0, false, 0, 0},
+		{"two keyframes", 26, 25, time.Second, false, 0, 0},
+		{"a complete window", 126, 25, time.Second, true, 25.2, 126 * 100 * 8 / 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s queueStats
+			writeStats(&s, tt.frames, 0, time.Unix(0, 0))
+			if s.packets != int64(tt.frames) || s.gopLength != tt.gopLength || s.keyFrameInterval != tt.keyFrameInterval {
+				t.Fatalf("expected %d packets, GOP %d and interval %s, got %d, %d and %s",
+					tt.frames, tt.gopLength, tt.keyFrameInterval, s.packets, s.gopLength, s.keyFrameInterval)
+			}
+			if s.hasMeasurement != tt.hasMeasurement || s.fps != tt.fps || s.bitrate != tt.bitrate {
+				t.Fatalf("expected measurement %v at %v fps and %d bps, got %v at %v fps and %d bps",
+					tt.hasMeasurement, tt.fps, tt.bitrate, s.hasMeasurement, s.fps, s.bitrate)
+			}
+		})
+	}
+}
+
+func TestQueueStatsDiscontinue(t *testing.T) {
+	var s queueStats
+	start := time.Unix(0, 0)
+	writeStats(&s, 126, time.Minute, start)
+	s.discontinue()
+
+	// The reconnected stream starts over at timestamp 0, a minute later.
+	writeStats(&s, 10, 0, start.Add(time.Minute))
+	if s.keyFrameInterval != time.Second || s.gopLength != 25 {
+		t.Fatalf("the interval to the keyframe of the previous connection is measured: %s (GOP %d)", s.keyFrameInterval, s.gopLength)
+	}
+	if s.hasMeasurement || s.fps != 0 || s.bitrate != 0 {
+		t.Fatalf("the rates of the previous connection are reported: %v fps, %d bps", s.fps, s.bitrate)
+	}
+	if s.windowFrames != 10 || !s.windowStart.Equal(start.Add(time.Minute)) {
+		t.Fatalf("the window doesn't start with the reconnected stream: %d frames since %s", s.windowFrames, s.windowStart)
+	}
+	if s.packets != 136 || s.keyFrames != 7 {
+		t.Fatalf("expected the totals to continue, got %d packets and %d keyframes", s.packets, s.keyFrames)
+	}
+
+	// The next keyframe of the reconnected stream is measured again.
+	writeStats(&s, 26, time.Second, start.Add(time.Minute+time.Second))
+	if s.keyFrameInterval != time.Second {
+		t.Fatalf("expected an interval of 1s, got %s", s.keyFrameInterval)
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	queue := NewQueue()
+	queue.WriteHeader([]Stream{{Name: "H264", IsVideo: true}})
+	cursor := queue.Oldest().Named("consumer")
+	idle := queue.Oldest().Named("idle")
+
+	for i := 0; i < 10; i++ {
+		queue.WritePacket(Packet{IsVideo: true, IsKeyFrame: i == 0, Time: time.Duration(i) * 40 * time.Millisecond, Data: make([]byte, 10)})
+	}
+	queue.ReportLostPackets(3)
+	queue.ReportDecodeError()
+	for i := 0; i < 4; i++ {
+		cursor.ReadPacket()
+	}
+	idle.ReadPacket()
+
+	stats := queue.Stats()
+	expected := Stats{
+		Packets:       10,
+		KeyFrames:     1,
+		LostPackets:   3,
+		DecodeErrors:  1,
+		QueueDepth:    10,
+		QueueSize:     100,
+		QueueDuration: 360,
+	}
+	if stats.Packets != expected.Packets || stats.KeyFrames != expected.KeyFrames || stats.LostPackets != expected.LostPackets ||
+		stats.DecodeErrors != expected.DecodeErrors || stats.QueueDepth != expected.QueueDepth || stats.QueueSize != expected.QueueSize ||
+		stats.QueueDuration != expected.QueueDuration {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+	if queue.KeyFrames() != 1 {
+		t.Fatalf("expected 1 keyframe, got %d", queue.KeyFrames())
+	}
+
+	cursors := []CursorStats{
+		{Name: "consumer", Lag: 6, LagDuration: 200},
+		{Name: "idle", Lag: 9, LagDuration: 320},
+	}
+	if len(stats.Cursors) != len(cursors) {
+		t.Fatalf("expected the cursors %+v, got %+v", cursors, stats.Cursors)
+	}
+	for i, cursorStats := range cursors {
+		if stats.Cursors[i] != cursorStats {
+			t.Fatalf("expected %+v, got %+v", cursorStats, stats.Cursors[i])
+		}
+	}
+}
@@ -37,6 +37,12 @@ type Stream struct {
 	// For H265, this is the vps.
 	VPS []byte
 
+	// SampleRate is the sample rate of an audio stream.
+	SampleRate int
+
+	// Channels is the number of channels of an audio stream.
+	Channels int
+
 	// IsBackChannel is true if this stream is a back channel.
 	IsBackChannel bool
 }
@@ -1,9 +1,12 @@
 package http
 
 import (
+	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"os"
-	"strconv"
+	"path"
 
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-contrib/pprof"
@@ -17,6 +20,7 @@ import (
 	"github.com/kerberos-io/agent/machinery/src/capture"
 	"github.com/kerberos-io/agent/machinery/src/encryption"
 	"github.com/kerberos-io/agent/machinery/src/models"
+	"github.com/kerberos-io/agent/machinery/src/utils"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 )
@@ -86,6 +90,9 @@ func StartServer(configDirectory string, configuration *models.Configuration, co
 	r.Handle("GET", "/file/*filepath", func(c *gin.Context) {
 		Files(c, configDirectory, configuration)
 	})
+	r.Handle("HEAD", "/file/*filepath", func(c *gin.Context) {
+		Files(c, configDirectory, configuration)
+	})
 
 	// Run the api on port
 	err = r.Run(":" + configuration.Port)
@@ -94,51 +101,82 @@ func StartServer(configDirectory string, configuration *models.Configuration, co
 	}
 }
 
+// Files serves a recording (or its poster and thumbnails), with support for range requests so it can
+// be played back (and seeked) in the browser. Encrypted recordings are decrypted while they are streamed,
+// only the requested range is decrypted.
 func Files(c *gin.Context, configDirectory string, configuration *models.Configuration) {
 
-	// Get File
-	filePath := configDirectory + "/data/recordings" + c.Param("filepath")
-	_, err := os.Open(filePath)
+	// Get File, make sure we don't leave the recordings directory.
+	fileName := path.Clean("/" + c.Param("filepath"))
+	filePath := configDirectory + "/data/recordings" + fileName
+	file, err := os.Open(filePath)
 	if err != nil {
 		c.JSON(404, gin.H{"error": "File not found"})
 		return
 	}
+	defer file.Close()
 
-	contents, err := os.ReadFile(filePath)
-	if err == nil {
-
-		// Get symmetric key
-		symmetricKey := configuration.Config.Encryption.SymmetricKey
-		encryptedRecordings := configuration.Config.Encryption.Recordings
-		// Decrypt file
-		if encryptedRecordings == "true" && symmetricKey != "" {
-
-			// Read file
-			if err != nil {
-				c.JSON(404, gin.H{"error": "File not found"})
-				return
-			}
-
-			// Decrypt file
-			contents, err = encryption.AesDecrypt(contents, symmetricKey)
-			if err != nil {
-				c.JSON(404, gin.H{"error": "File not found"})
-				return
-			}
-		}
-
-		// Get fileSize from contents
-		fileSize := len(contents)
-
-		// Send file to gin
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Content-Disposition", "attachment; filename="+filePath)
-		c.Header("Content-Type", "video/mp4")
-		c.Header("Content-Length", strconv.Itoa(fileSize))
-		// Send contents to gin
-		io.WriteString(c.Writer, string(contents))
-	} else {
+	fileInfo, err := file.Stat()
+	if err != nil || fileInfo.IsDir() {
 		c.JSON(404, gin.H{"error": "File not found"})
 		return
 	}
+
+	// Get symmetric key
+	symmetricKey := ""
+	encryptedRecordings := ""
+	if configuration.Config.Encryption != nil {
+		symmetricKey = configuration.Config.Encryption.SymmetricKey
+		encryptedRecordings = configuration.Config.Encryption.Recordings
+	}
+
+	// Check how the file was encrypted by looking at its header.
+	header := make([]byte, encryption.ChunkedHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	header = header[:n]
+
+	var contents io.ReadSeeker = file
+	if encryption.IsChunked(header) {
+		// Decrypt file, only the chunks that are requested.
+		contents, err = encryption.NewReader(file, symmetricKey)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "File not found"})
+			return
+		}
+	} else if encryption.IsLegacy(header) && encryptedRecordings == "true" && symmetricKey != "" {
+		// Decrypt file, legacy recordings are encrypted with AES-CBC.
+		contents, err = encryption.NewLegacyReader(file, symmetricKey)
+		if err != nil {
+			c.JSON(404, gin.H{"error": "File not found"})
+			return
+		}
+	}
+
+	// The ETag is based on the file on disk, so it changes when a recording is replaced.
+	etag := fmt.Sprintf("\"%x-%x\"", fileInfo.ModTime().UnixNano(), fileInfo.Size())
+
+	// Send file to gin, ServeContent handles the range, conditional and HEAD requests.
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, ETag, Last-Modified")
+	c.Header("Content-Disposition", "inline; filename=\""+path.Base(fileName)+"\"")
+	c.Header("Content-Type", contentType(fileName))
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, max-age=0, must-revalidate")
+	http.ServeContent(c.Writer, c.Request, path.Base(fileName), fileInfo.ModTime(), contents)
+}
+
+// contentType returns the content type of a recording, or one of the files next to it (poster, thumbnails),
+// based on its extension. Files we don't know are served as binary, not as a recording.
+func contentType(fileName string) string {
+	extension := path.Ext(fileName)
+	switch extension {
+	case ".mp4", ".ts", ".mkv", ".jpg":
+		return utils.RecordingContentType(fileName)
+	case ".vtt":
+		return "text/vtt"
+	}
+	if mimeType := mime.TypeByExtension(extension); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
 }
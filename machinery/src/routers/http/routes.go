@@ -5,6 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/kerberos-io/agent/machinery/src/capture"
 	"github.com/kerberos-io/agent/machinery/src/components"
+	"github.com/kerberos-io/agent/machinery/src/hls"
 	"github.com/kerberos-io/agent/machinery/src/onvif"
 	"github.com/kerberos-io/agent/machinery/src/routers/websocket"
 
@@ -35,7 +36,7 @@ func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configDirect
 		api.POST("/login", authMiddleware.LoginHandler)
 
 		api.GET("/dashboard", func(c *gin.Context) {
-			components.GetDashboard(c, configDirectory, configuration, communication)
+			components.GetDashboard(c, configDirectory, configuration, communication, captureDevice)
 		})
 
 		api.POST("/latest-events", func(c *gin.Context) {
@@ -46,6 +47,22 @@ func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configDirect
 			components.GetDays(c, configDirectory, configuration, communication)
 		})
 
+		api.GET("/media/gaps", func(c *gin.Context) {
+			components.GetGaps(c, configuration)
+		})
+
+		api.POST("/media/export", func(c *gin.Context) {
+			components.ExportMedia(c, configDirectory, configuration)
+		})
+
+		api.GET("/snapshots", func(c *gin.Context) {
+			components.GetSnapshots(c, configDirectory, configuration)
+		})
+
+		api.GET("/snapshots/:name", func(c *gin.Context) {
+			components.GetSnapshot(c, configDirectory, configuration)
+		})
+
 		api.GET("/config", func(c *gin.Context) {
 			components.GetConfig(c, captureDevice, configuration, communication)
 		})
@@ -77,7 +94,19 @@ func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configDirect
 		})
 
 		api.POST("/camera/record", func(c *gin.Context) {
-			components.MakeRecording(c, communication)
+			components.MakeRecording(c, configuration, communication)
+		})
+
+		api.GET("/camera/record", func(c *gin.Context) {
+			components.GetManualRecordings(c, configuration)
+		})
+
+		api.GET("/camera/record/:recording", func(c *gin.Context) {
+			components.GetManualRecording(c, configuration)
+		})
+
+		api.DELETE("/camera/record/:recording", func(c *gin.Context) {
+			components.CancelManualRecording(c, configuration)
 		})
 
 		api.GET("/camera/snapshot/jpeg", func(c *gin.Context) {
@@ -88,6 +117,17 @@ func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configDirect
 			components.GetSnapshotBase64(c, captureDevice, configuration, communication)
 		})
 
+		api.GET("/camera/streams", func(c *gin.Context) {
+			components.GetStreamStates(c, captureDevice)
+		})
+
+		api.GET("/camera/stats", func(c *gin.Context) {
+			components.GetStreamStats(c, communication)
+		})
+
+		// HLS live stream of the main or sub stream, e.g. /api/camera/live/main/index.m3u8
+		api.GET("/camera/live/:streamType/:file", hls.GetLiveStream)
+
 		// Onvif specific methods. Doesn't require any authorization.
 		// Will verify the current onvif settings.
 		api.POST("/camera/onvif/verify", onvif.VerifyOnvifConnection)
@@ -102,6 +142,204 @@ func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configDirect
 		api.POST("/camera/onvif/outputs/:output", DoTriggerRelayOutput)
 		api.POST("/camera/verify/:streamType", capture.VerifyCamera)
 
+		// In multi-camera mode, every camera has its own routes, e.g. /api/cameras/{id}/camera/snapshot/jpeg.
+		api.GET("/cameras", components.GetCameras)
+		cameras := api.Group("/cameras/:id")
+		{
+			cameras.GET("/dashboard", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetDashboard(c, configDirectory, camera.Configuration, camera.Communication, camera.Capture)
+				}
+			})
+
+			cameras.POST("/latest-events", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetLatestEvents(c, configDirectory, camera.Configuration, camera.Communication)
+				}
+			})
+
+			cameras.GET("/days", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetDays(c, configDirectory, camera.Configuration, camera.Communication)
+				}
+			})
+
+			cameras.GET("/media/gaps", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetGaps(c, camera.Configuration)
+				}
+			})
+
+			cameras.POST("/media/export", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.ExportMedia(c, configDirectory, camera.Configuration)
+				}
+			})
+
+			cameras.GET("/snapshots", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetSnapshots(c, configDirectory, camera.Configuration)
+				}
+			})
+
+			cameras.GET("/snapshots/:name", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetSnapshot(c, configDirectory, camera.Configuration)
+				}
+			})
+
+			cameras.GET("/config", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetConfig(c, camera.Capture, camera.Configuration, camera.Communication)
+				}
+			})
+
+			cameras.POST("/config", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.UpdateCameraConfig(c, configDirectory, camera.Configuration, camera.Communication)
+				}
+			})
+
+			cameras.POST("/camera/restart", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.RestartAgent(c, camera.Communication)
+				}
+			})
+
+			cameras.POST("/camera/stop", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.StopAgent(c, camera.Communication)
+				}
+			})
+
+			cameras.POST("/camera/record", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.MakeRecording(c, camera.Configuration, camera.Communication)
+				}
+			})
+
+			cameras.GET("/camera/record", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetManualRecordings(c, camera.Configuration)
+				}
+			})
+
+			cameras.GET("/camera/record/:recording", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetManualRecording(c, camera.Configuration)
+				}
+			})
+
+			cameras.DELETE("/camera/record/:recording", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.CancelManualRecording(c, camera.Configuration)
+				}
+			})
+
+			cameras.GET("/camera/snapshot/jpeg", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetSnapshotRaw(c, camera.Capture, camera.Configuration, camera.Communication)
+				}
+			})
+
+			cameras.GET("/camera/snapshot/base64", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetSnapshotBase64(c, camera.Capture, camera.Configuration, camera.Communication)
+				}
+			})
+
+			cameras.GET("/camera/streams", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetStreamStates(c, camera.Capture)
+				}
+			})
+
+			cameras.GET("/camera/stats", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					components.GetStreamStats(c, camera.Communication)
+				}
+			})
+
+			cameras.GET("/camera/live/:streamType/:file", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					hls.GetLiveStream(c)
+				}
+			})
+
+			cameras.GET("/ws", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					websocket.WebsocketHandler(c, camera.Communication, camera.Capture)
+				}
+			})
+
+			// The ONVIF and verification methods connect with the credentials (or URLs) in the request.
+			cameras.POST("/camera/onvif/verify", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					onvif.VerifyOnvifConnection(c)
+				}
+			})
+
+			cameras.POST("/camera/onvif/login", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					LoginToOnvif(c)
+				}
+			})
+
+			cameras.POST("/camera/onvif/capabilities", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					GetOnvifCapabilities(c)
+				}
+			})
+
+			cameras.POST("/camera/onvif/presets", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					GetOnvifPresets(c)
+				}
+			})
+
+			cameras.POST("/camera/onvif/gotopreset", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					GoToOnvifPreset(c)
+				}
+			})
+
+			cameras.POST("/camera/onvif/pantilt", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					DoOnvifPanTilt(c)
+				}
+			})
+
+			cameras.POST("/camera/onvif/zoom", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					DoOnvifZoom(c)
+				}
+			})
+
+			cameras.POST("/camera/onvif/inputs", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					DoGetDigitalInputs(c)
+				}
+			})
+
+			cameras.POST("/camera/onvif/outputs", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					DoGetRelayOutputs(c)
+				}
+			})
+
+			cameras.POST("/camera/onvif/outputs/:output", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					DoTriggerRelayOutput(c)
+				}
+			})
+
+			cameras.POST("/camera/verify/:streamType", func(c *gin.Context) {
+				if camera := findCamera(c); camera != nil {
+					capture.VerifyCamera(c)
+				}
+			})
+		}
+
 		// Secured endpoints..
 		api.Use(authMiddleware.MiddlewareFunc())
 		{
@@ -109,3 +347,15 @@ func AddRoutes(r *gin.Engine, authMiddleware *jwt.GinJWTMiddleware, configDirect
 	}
 	return api
 }
+
+// findCamera returns the camera of a namespaced route (multi-camera mode), if the camera doesn't exist
+// a 404 is returned and nil.
+func findCamera(c *gin.Context) *components.Camera {
+	camera := components.FindCamera(c.Param("id"))
+	if camera == nil {
+		c.JSON(404, gin.H{
+			"data": "Something went wrong: camera not found.",
+		})
+	}
+	return camera
+}
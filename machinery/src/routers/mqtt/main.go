@@ -11,9 +11,11 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/kerberos-io/agent/machinery/src/capture"
 	configService "github.com/kerberos-io/agent/machinery/src/config"
 	"github.com/kerberos-io/agent/machinery/src/encryption"
 	"github.com/kerberos-io/agent/machinery/src/log"
@@ -145,7 +147,41 @@ func ConfigureMQTT(configDirectory string, configuration *models.Configuration,
 	return nil
 }
 
-func MQTTListenerHandler(mqttClient mqtt.Client, hubKey string, configDirectory string, configuration *models.Configuration, communication *models.Communication) {
+// In multi-camera mode the cameras share a single MQTT client, every camera is a device of its own
+// (with its own key), so a message is handled by the camera it's sent to.
+type device struct {
+	configuration *models.Configuration
+	communication *models.Communication
+}
+
+var (
+	devices      []device
+	devicesMutex sync.Mutex
+)
+
+// RegisterDevice registers a camera (in multi-camera mode), so it receives the messages sent to its key.
+func RegisterDevice(configuration *models.Configuration, communication *models.Communication) {
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+	devices = append(devices, device{configuration: configuration, communication: communication})
+}
+
+// findDevice returns the configuration and communication of the device a message is sent to.
+func findDevice(deviceId string, configuration *models.Configuration, communication *models.Communication) (*models.Configuration, *models.Communication, bool) {
+	if deviceId == configuration.Config.Key {
+		return configuration, communication, true
+	}
+	devicesMutex.Lock()
+	defer devicesMutex.Unlock()
+	for _, d := range devices {
+		if d.configuration.Config.Key == deviceId {
+			return d.configuration, d.communication, true
+		}
+	}
+	return nil, nil, false
+}
+
+func MQTTListenerHandler(mqttClient mqtt.Client, hubKey string, configDirectory string, agentConfiguration *models.Configuration, agentCommunication *models.Communication) {
 	if hubKey == "" {
 		log.Log.Info("routers.mqtt.main.MQTTListenerHandler(): no hub key provided, not subscribing to kerberos/hub/{hubkey}")
 	} else {
@@ -165,7 +201,8 @@ func MQTTListenerHandler(mqttClient mqtt.Client, hubKey string, configDirectory
 			json.Unmarshal(msg.Payload(), &message)
 
 			// We will receive all messages from our hub, so we'll need to filter to the relevant device.
-			if message.Mid != "" && message.Timestamp != 0 && message.DeviceId == configuration.Config.Key {
+			configuration, communication, found := findDevice(message.DeviceId, agentConfiguration, agentCommunication)
+			if message.Mid != "" && message.Timestamp != 0 && found {
 				var payload models.Payload
 
 				// Messages might be hidden, if so we'll need to decrypt them using the Kerberos Hub private key.
@@ -289,10 +326,17 @@ func HandleRecording(mqttClient mqtt.Client, hubKey string, payload models.Paylo
 	json.Unmarshal(jsonData, &recordPayload)
 
 	if recordPayload.Timestamp != 0 {
-		motionDataPartial := models.MotionDataPartial{
-			Timestamp: recordPayload.Timestamp,
+		recordRequest := models.RecordRequest{
+			Duration: recordPayload.Duration,
+			PreRoll:  recordPayload.PreRoll,
+			Label:    recordPayload.Label,
+		}
+		recording, err := capture.RequestManualRecording(configuration, communication, models.TriggerMQTT, recordRequest)
+		if err != nil {
+			log.Log.Error("routers.mqtt.main.HandleRecording(): " + err.Error())
+		} else {
+			log.Log.Info("routers.mqtt.main.HandleRecording(): requested recording " + recording.ID)
 		}
-		communication.HandleMotion <- motionDataPartial
 	}
 }
 
@@ -571,6 +615,70 @@ func HandleTriggerRelay(mqttClient mqtt.Client, hubKey string, payload models.Pa
 	}
 }
 
+// SendDiskState publishes a change of the disk state (of the disk watchdog), in offline mode nothing is sent.
+func SendDiskState(mqttClient mqtt.Client, configuration *models.Configuration, status models.DiskStatus) {
+	config := configuration.Config
+	if mqttClient == nil || config.Offline == "true" {
+		return
+	}
+	if config.HubKey == "" {
+		mqttClient.Publish("kerberos/agent/"+config.Key, 2, false, "disk-"+status.State)
+		return
+	}
+	message := models.Message{
+		Payload: models.Payload{
+			Action:   "disk-state",
+			DeviceId: config.Key,
+			Value: map[string]interface{}{
+				"timestamp":       status.Since / 1000,
+				"state":           status.State,
+				"free_percentage": status.FreePercentage,
+				"free":            status.Free,
+				"total":           status.Total,
+			},
+		},
+	}
+	payload, err := models.PackageMQTTMessage(configuration, message)
+	if err == nil {
+		mqttClient.Publish("kerberos/hub/"+config.HubKey, 0, false, payload)
+	} else {
+		log.Log.Info("routers.mqtt.main.SendDiskState(): something went wrong while sending the disk state to hub: " + string(payload))
+	}
+}
+
+// SendStreamState publishes a change of the state of the main or sub stream, in offline mode nothing is sent.
+func SendStreamState(mqttClient mqtt.Client, configuration *models.Configuration, status models.StreamStatus) {
+	config := configuration.Config
+	if mqttClient == nil || config.Offline == "true" {
+		return
+	}
+	if config.HubKey == "" {
+		mqttClient.Publish("kerberos/agent/"+config.Key, 2, false, "stream-"+status.Stream+"-"+status.State)
+		return
+	}
+	message := models.Message{
+		Payload: models.Payload{
+			Action:   "stream-state",
+			DeviceId: config.Key,
+			Value: map[string]interface{}{
+				"timestamp": status.Since / 1000,
+				"stream":    status.Stream,
+				"state":     status.State,
+				"previous":  status.Previous,
+				"attempt":   status.Attempt,
+				"backoff":   status.Backoff,
+				"error":     status.Error,
+			},
+		},
+	}
+	payload, err := models.PackageMQTTMessage(configuration, message)
+	if err == nil {
+		mqttClient.Publish("kerberos/hub/"+config.HubKey, 0, false, payload)
+	} else {
+		log.Log.Info("routers.mqtt.main.SendStreamState(): something went wrong while sending the stream state to hub: " + string(payload))
+	}
+}
+
 func DisconnectMQTT(mqttClient mqtt.Client, config *models.Config) {
 	if mqttClient != nil {
 		// Cleanup all subscriptions
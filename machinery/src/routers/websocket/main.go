@@ -140,11 +140,11 @@ func ForwardSDStream(ctx context.Context, clientID string, connection *Connectio
 	rtspClient := captureDevice.RTSPSubClient
 	if rtspClient != nil {
 		queue = communication.SubQueue
-		cursor = queue.Latest()
+		cursor = queue.Latest().Named("websocket")
 	} else {
 		rtspClient = captureDevice.RTSPClient
 		queue = communication.Queue
-		cursor = queue.Latest()
+		cursor = queue.Latest().Named("websocket")
 	}
 
 logreader:
@@ -157,7 +157,7 @@ logreader:
 					continue
 				}
 				var img image.YCbCr
-				img, err = (*rtspClient).DecodePacket(pkt)
+				img, err = rtspClient.DecodePacket(pkt)
 				if err == nil {
 					bytes, _ := utils.ImageToBytes(&img)
 					encodedImage = base64.StdEncoding.EncodeToString(bytes)
@@ -3,19 +3,22 @@ package utils
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/kerberos-io/agent/machinery/src/encryption"
@@ -68,6 +71,17 @@ func DirSize(path string) (int64, error) {
 	return size, err
 }
 
+// GetDiskUsage returns the total and the available size (in bytes) of the filesystem that holds the path.
+func GetDiskUsage(path string) (total uint64, free uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(path, &stat); err != nil {
+		return
+	}
+	total = stat.Blocks * uint64(stat.Bsize)
+	free = stat.Bavail * uint64(stat.Bsize)
+	return
+}
+
 func FindOldestFile(dir string) (oldestFile os.FileInfo, err error) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -180,50 +194,102 @@ func GetSortedDirectory(files []os.FileInfo) []os.FileInfo {
 	return files
 }
 
+// GetRecordingTimestamp returns the start of a recording (Unix timestamp in seconds). We prefer the
+// metadata sidecar, for older recordings we fallback to the filename. If neither is available false is returned.
+func GetRecordingTimestamp(recordingDirectory string, fileName string) (int64, *models.RecordingMetadata, bool) {
+	if recordingMetadata, err := ReadRecordingMetadata(recordingDirectory + "/" + fileName); err == nil {
+		return recordingMetadata.StartTime / 1000, &recordingMetadata, true
+	}
+	fileParts := strings.Split(fileName, "_")
+	if len(fileParts) != 6 {
+		return 0, nil, false
+	}
+	timestampInt, err := strconv.ParseInt(fileParts[0], 10, 64)
+	if err != nil {
+		return 0, nil, false
+	}
+	return timestampInt, nil, true
+}
+
+// NewMedia describes a recording, as returned by the media APIs.
+func NewMedia(fileName string, recordingDirectory string, timestampInt int64, metadata *models.RecordingMetadata, configuration *models.Configuration) models.Media {
+	loc, _ := time.LoadLocation(configuration.Config.Timezone)
+	time := time.Unix(timestampInt, 0).In(loc)
+	day := time.Format("02-01-2006")
+	timeString := time.Format("15:04:05")
+	shortDay := time.Format("Jan _2")
+
+	cameraName := configuration.Config.Name
+	cameraKey := configuration.Config.Key
+	poster := ""
+	sprite := ""
+	subKey := ""
+	if metadata != nil {
+		// The previews are stored next to the recording, which might be in a subdirectory (sub stream).
+		directory := path.Dir(fileName)
+		if metadata.Poster != "" {
+			poster = path.Join(directory, metadata.Poster)
+		}
+		if metadata.Sprite != "" {
+			sprite = path.Join(directory, metadata.Sprite)
+		}
+		subKey = metadata.SubRecording
+		if metadata.CameraName != "" {
+			cameraName = metadata.CameraName
+		}
+		if metadata.CameraKey != "" {
+			cameraKey = metadata.CameraKey
+		}
+	}
+
+	return models.Media{
+		Key:        fileName,
+		Path:       recordingDirectory + "/" + fileName,
+		CameraName: cameraName,
+		CameraKey:  cameraKey,
+		Day:        day,
+		ShortDay:   shortDay,
+		Time:       timeString,
+		Timestamp:  strconv.FormatInt(timestampInt, 10),
+		Poster:     poster,
+		Sprite:     sprite,
+		SubKey:     subKey,
+		Metadata:   metadata,
+	}
+}
+
 func GetMediaFormatted(files []os.FileInfo, recordingDirectory string, configuration *models.Configuration, eventFilter models.EventFilter) []models.Media {
 	filePaths := []models.Media{}
 	count := 0
 	for _, file := range files {
 		fileName := file.Name()
-		fileParts := strings.Split(fileName, "_")
-		if len(fileParts) == 6 {
-			timestamp := fileParts[0]
-			timestampInt, err := strconv.ParseInt(timestamp, 10, 64)
-			if err == nil {
+		if !IsRecording(fileName) {
+			continue
+		}
 
-				// If we have an offset we will check if we should skip or not
-				if eventFilter.TimestampOffsetEnd > 0 {
-					// Medias are sorted from new to older. TimestampOffsetEnd holds the oldest
-					// timestamp of the previous batch of events. By doing this check, we make sure
-					// to skip the previous batch.
-					if timestampInt >= eventFilter.TimestampOffsetEnd {
-						continue
-					}
-				}
+		timestampInt, metadata, ok := GetRecordingTimestamp(recordingDirectory, fileName)
+		if !ok {
+			continue
+		}
+		if eventFilter.CameraKey != "" && (metadata == nil || metadata.CameraKey != eventFilter.CameraKey) {
+			continue
+		}
 
-				loc, _ := time.LoadLocation(configuration.Config.Timezone)
-				time := time.Unix(timestampInt, 0).In(loc)
-				day := time.Format("02-01-2006")
-				timeString := time.Format("15:04:05")
-				shortDay := time.Format("Jan _2")
-
-				media := models.Media{
-					Key:        fileName,
-					Path:       recordingDirectory + "/" + fileName,
-					CameraName: configuration.Config.Name,
-					CameraKey:  configuration.Config.Key,
-					Day:        day,
-					ShortDay:   shortDay,
-					Time:       timeString,
-					Timestamp:  timestamp,
-				}
-				filePaths = append(filePaths, media)
-				count = count + 1
-				if eventFilter.NumberOfElements > 0 && count >= eventFilter.NumberOfElements {
-					break
-				}
+		// If we have an offset we will check if we should skip or not
+		if eventFilter.TimestampOffsetEnd > 0 {
+			// Medias are sorted from new to older. TimestampOffsetEnd holds the oldest
+			// timestamp of the previous batch of events. By doing this check, we make sure
+			// to skip the previous batch.
+			if timestampInt >= eventFilter.TimestampOffsetEnd {
+				continue
 			}
 		}
+
+		filePaths = append(filePaths, NewMedia(fileName, recordingDirectory, timestampInt, metadata, configuration))
+		count = count + 1
+		if eventFilter.NumberOfElements > 0 && count >= eventFilter.NumberOfElements {
+			break
+		}
 	}
 	return filePaths
 }
@@ -232,17 +298,17 @@ func GetDays(files []os.FileInfo, recordingDirectory string, configuration *mode
 	days := []string{}
 	for _, file := range files {
 		fileName := file.Name()
-		fileParts := strings.Split(fileName, "_")
-		if len(fileParts) == 6 {
-			timestamp := fileParts[0]
-			timestampInt, err := strconv.ParseInt(timestamp, 10, 64)
-			if err == nil {
-				loc, _ := time.LoadLocation(configuration.Config.Timezone)
-				time := time.Unix(timestampInt, 0).In(loc)
-				day := time.Format("02-01-2006")
-				days = append(days, day)
-			}
+		if !IsRecording(fileName) {
+			continue
 		}
+		timestampInt, _, ok := GetRecordingTimestamp(recordingDirectory, fileName)
+		if !ok {
+			continue
+		}
+		loc, _ := time.LoadLocation(configuration.Config.Timezone)
+		time := time.Unix(timestampInt, 0).In(loc)
+		day := time.Format("02-01-2006")
+		days = append(days, day)
 	}
 	uniqueDays := Unique(days)
 	return uniqueDays
@@ -265,42 +331,133 @@ func NumberOfFilesInDirectory(path string) int {
 	return len(files)
 }
 
-// NumberOfMP4sInDirectory returns the count of all files with mp4 extension in current directory
-func NumberOfMP4sInDirectory(path string) int {
-	pattern := filepath.Join(path, "*.mp4")
-	files, _ := filepath.Glob(pattern)
-	return len(files)
+// NumberOfRecordingsInDirectory returns the count of all recordings (mp4, ts or mkv) in current directory
+func NumberOfRecordingsInDirectory(path string) int {
+	count := 0
+	files, _ := os.ReadDir(path)
+	for _, file := range files {
+		if IsRecording(file.Name()) {
+			count++
+		}
+	}
+	return count
 }
 
-func RandStringBytesRmndr(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
+// SubRecordingsDirectory is the directory (in data/recordings) of the recordings of the sub stream.
+const SubRecordingsDirectory = "sub"
+
+// IsSubRecording returns true if the recording (relative to data/recordings) is a recording of the sub stream.
+func IsSubRecording(fileName string) bool {
+	return strings.HasPrefix(fileName, SubRecordingsDirectory+"/")
+}
+
+// IsRecording returns true if the file is a recording (MP4, MPEG-TS or Matroska), and not one of the
+// files we keep next to it (such as the metadata sidecar).
+func IsRecording(fileName string) bool {
+	switch filepath.Ext(fileName) {
+	case ".mp4", ".ts", ".mkv":
+		return true
 	}
-	return string(b)
+	return false
+}
+
+// RecordingContentType returns the content type of a recording, depending on its container (or of a snapshot).
+func RecordingContentType(fileName string) string {
+	switch filepath.Ext(fileName) {
+	case ".ts":
+		return "video/mp2t"
+	case ".mkv":
+		return "video/x-matroska"
+	case ".jpg":
+		return "image/jpeg"
+	}
+	return "video/mp4"
+}
+
+// GetMediaDirectory returns the directory (relative to the config directory) of a file that is queued
+// for upload. The marker in data/cloud is empty for recordings, other media (like time-lapses) store
+// their directory in it.
+func GetMediaDirectory(configDirectory string, fileName string) string {
+	directory, err := os.ReadFile(configDirectory + "/data/cloud/" + fileName)
+	if err == nil && len(bytes.TrimSpace(directory)) > 0 {
+		return string(bytes.TrimSpace(directory))
+	}
+	return "data/recordings"
 }
 
-func CreateFragmentedMP4(fullName string, fragmentedDuration int64) {
-	path, _ := os.Getwd()
-	duration := fragmentedDuration * 1000
-	// This timescale is crucial, as it should be the same as the one defined in JOY4.
-	cmd := exec.Command("mp4fragment", "--timescale", "10000000", "--fragment-duration", strconv.FormatInt(duration, 10), fullName, fullName+"f.mp4")
-	cmd.Dir = path
-	log.Log.Info(cmd.String())
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+// MetadataPath returns the path of the JSON sidecar that belongs to a recording.
+func MetadataPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".json"
+}
+
+// WriteRecordingMetadata stores the metadata of a recording next to the recording itself.
+// The sidecar is written to a temporary file first, so readers never see a partial file.
+func WriteRecordingMetadata(recordingPath string, metadata models.RecordingMetadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
 	if err != nil {
-		log.Log.Error(fmt.Sprint(err) + ": " + stderr.String())
-	} else {
-		log.Log.Info("Created Fragmented: " + out.String())
+		return err
+	}
+	metadataPath := MetadataPath(recordingPath)
+	tempPath := metadataPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, metadataPath)
+}
+
+// ReadRecordingMetadata reads the JSON sidecar of a recording. Recordings made
+// by older versions of the agent do not have a sidecar, in that case an error is returned.
+func ReadRecordingMetadata(recordingPath string) (models.RecordingMetadata, error) {
+	var metadata models.RecordingMetadata
+	data, err := os.ReadFile(MetadataPath(recordingPath))
+	if err != nil {
+		return metadata, err
+	}
+	err = json.Unmarshal(data, &metadata)
+	return metadata, err
+}
+
+// PosterPath returns the path of the poster (JPEG) of a recording.
+func PosterPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".jpg"
+}
+
+// SpritePath returns the path of the thumbnail sprite (JPEG) of a recording.
+func SpritePath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + "_sprite.jpg"
+}
+
+// ThumbnailsPath returns the path of the WebVTT file that describes the thumbnail sprite of a recording.
+func ThumbnailsPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".vtt"
+}
+
+// SamplesPath returns the path of the sample journal of a recording, which is kept while an MP4 is
+// written so an interrupted recording can be recovered.
+func SamplesPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".samples"
+}
+
+// RemoveRecording removes a recording together with its metadata sidecar and previews.
+func RemoveRecording(recordingPath string) error {
+	err := os.Remove(recordingPath)
+	for _, sidecarPath := range []string{MetadataPath(recordingPath), PosterPath(recordingPath), SpritePath(recordingPath), ThumbnailsPath(recordingPath), SamplesPath(recordingPath)} {
+		if sidecarPath == recordingPath {
+			continue
+		}
+		if errSidecar := os.Remove(sidecarPath); errSidecar != nil && !os.IsNotExist(errSidecar) && err == nil {
+			err = errSidecar
+		}
 	}
+	return err
+}
 
-	// We will swap the files.
-	os.Remove(fullName)
-	os.Rename(fullName+"f.mp4", fullName)
+func RandStringBytesRmndr(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
+	}
+	return string(b)
 }
 
 func PrintEnvironmentVariables() {
@@ -359,8 +516,8 @@ func Decrypt(directoryOrFile string, symmetricKey []byte) {
 		for _, file := range dir {
 			// Check if file is not a directory
 			if !file.IsDir() {
-				// Check if an mp4 file
-				if strings.HasSuffix(file.Name(), ".mp4") {
+				// Check if a recording
+				if IsRecording(file.Name()) {
 					files = append(files, directoryOrFile+"/"+file.Name())
 				}
 			}
@@ -372,33 +529,56 @@ func Decrypt(directoryOrFile string, symmetricKey []byte) {
 	// We'll loop over all files and decrypt them one by one.
 	for _, file := range files {
 
-		// Read file
-		content, err := os.ReadFile(file)
-		if err != nil {
-			log.Log.Fatal(err.Error())
-			return
-		}
-		// Decrypt using AES key
-		decrypted, err := encryption.AesDecrypt(content, string(symmetricKey))
-		if err != nil {
-			log.Log.Fatal("Something went wrong while decrypting: " + err.Error())
-			return
-		}
-
 		// Write decrypted content to file with appended .decrypted
 		// Get filename split by / and get last element.
 		fileParts := strings.Split(file, "/")
 		fileName := fileParts[len(fileParts)-1]
 		pathToFile := strings.Join(fileParts[:len(fileParts)-1], "/")
+		if pathToFile == "" {
+			pathToFile = "."
+		}
 
-		err = os.WriteFile(pathToFile+"/decrypted/"+fileName, []byte(decrypted), 0644)
+		err := DecryptFile(file, pathToFile+"/decrypted/"+fileName, string(symmetricKey))
 		if err != nil {
-			log.Log.Fatal(err.Error())
+			log.Log.Fatal("Something went wrong while decrypting: " + err.Error())
 			return
 		}
 	}
 }
 
+// DecryptFile decrypts a single file, it supports both the chunked and the legacy format.
+func DecryptFile(source string, destination string, symmetricKey string) error {
+	file, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Both formats are decrypted as a stream, so we don't need to keep the file in memory.
+	header := make([]byte, encryption.ChunkedHeaderSize)
+	n, _ := file.ReadAt(header, 0)
+	var reader io.Reader
+	if encryption.IsChunked(header[:n]) {
+		reader, err = encryption.NewReader(file, symmetricKey)
+	} else {
+		reader, err = encryption.NewLegacyReader(file, symmetricKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	output, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, reader); err != nil {
+		output.Close()
+		os.Remove(destination)
+		return err
+	}
+	return output.Close()
+}
+
 func ImageToBytes(img image.Image) ([]byte, error) {
 	buffer := new(bytes.Buffer)
 	w := bufio.NewWriter(buffer)
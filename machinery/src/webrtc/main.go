@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -172,7 +173,7 @@ func InitializeWebRTCConnection(configuration *models.Configuration, communicati
 
 					// Set lock
 					CandidatesMutex.Lock()
-					peerConnections[handshake.SessionID] = nil
+					delete(peerConnections, sessionKey)
 					_, ok := CandidateArrays[sessionKey]
 					if ok {
 						close(CandidateArrays[sessionKey])
@@ -251,7 +252,9 @@ func InitializeWebRTCConnection(configuration *models.Configuration, communicati
 			})
 
 			// Create a channel which will be used to send candidates to the other peer
-			peerConnections[handshake.SessionID] = peerConnection
+			CandidatesMutex.Lock()
+			peerConnections[sessionKey] = peerConnection
+			CandidatesMutex.Unlock()
 
 			if err == nil {
 				//  Create a config map
@@ -307,23 +310,30 @@ func WriteToTrack(livestreamCursor *packets.QueueCursor, configuration *models.C
 
 	config := configuration.Config
 
-	// Make peerconnection map
-	peerConnections = make(map[string]*pionWebRTC.PeerConnection)
+	// Make peerconnection map, it's shared by the cameras in multi-camera mode.
+	CandidatesMutex.Lock()
+	if peerConnections == nil {
+		peerConnections = make(map[string]*pionWebRTC.PeerConnection)
+	}
+	CandidatesMutex.Unlock()
 
 	// Set the indexes for the video & audio streams
 	// Later when we read a packet we need to figure out which track to send it to.
 	hasH264 := false
 	hasPCM_MULAW := false
+	hasPCM_ALAW := false
 	streams, _ := rtspClient.GetStreams()
 	for _, stream := range streams {
 		if stream.Name == "H264" {
 			hasH264 = true
 		} else if stream.Name == "PCM_MULAW" {
 			hasPCM_MULAW = true
+		} else if stream.Name == "PCM_ALAW" {
+			hasPCM_ALAW = true
 		}
 	}
 
-	if !hasH264 && !hasPCM_MULAW {
+	if !hasH264 && !hasPCM_MULAW && !hasPCM_ALAW {
 		log.Log.Error("webrtc.main.WriteToTrack(): no valid video codec and audio codec found.")
 	} else {
 		if config.Capture.TranscodingWebRTC == "true" {
@@ -426,12 +436,21 @@ func WriteToTrack(livestreamCursor *packets.QueueCursor, configuration *models.C
 			}
 		}
 	}
-	for _, p := range peerConnections {
-		if p != nil {
-			p.Close()
+	// Only close the peer connections of this camera (the sessions are prefixed with the key of the camera).
+	var closing []*pionWebRTC.PeerConnection
+	CandidatesMutex.Lock()
+	for sessionKey, p := range peerConnections {
+		if strings.HasPrefix(sessionKey, config.Key+"/") {
+			closing = append(closing, p)
+			delete(peerConnections, sessionKey)
 		}
 	}
-
-	peerConnectionCount = 0
+	if len(peerConnections) == 0 {
+		atomic.StoreInt64(&peerConnectionCount, 0)
+	}
+	CandidatesMutex.Unlock()
+	for _, p := range closing {
+		p.Close()
+	}
 	log.Log.Info("webrtc.main.WriteToTrack(): stop writing to track.")
 }
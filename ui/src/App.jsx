@@ -205,6 +205,19 @@ class App extends React.Component {
               </Link>
             )}
 
+            {dashboard.disk && dashboard.disk.state !== 'ok' && (
+              <Link to="/settings">
+                <div className="offline-mode">
+                  <div>
+                    <Icon label="info" />
+                    Attention! The disk is almost full (
+                    {Math.floor(dashboard.disk.free_percentage)}% free), disk
+                    state: {dashboard.disk.state.replace('_', ' ')}.
+                  </div>
+                </div>
+              </Link>
+            )}
+
             <MainBody>{children}</MainBody>
           </Main>
         </div>
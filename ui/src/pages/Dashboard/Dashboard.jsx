@@ -274,7 +274,7 @@ class Dashboard extends React.Component {
                     />
                     <ModalBody>
                       <video controls autoPlay>
-                        <source src={currentRecording} type="video/mp4" />
+                        <source src={currentRecording} />
                       </video>
                     </ModalBody>
                     <ModalFooter
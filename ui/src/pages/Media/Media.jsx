@@ -131,7 +131,7 @@ class Media extends React.Component {
             />
             <ModalBody>
               <video controls autoPlay>
-                <source src={currentRecording} type="video/mp4" />
+                <source src={currentRecording} />
               </video>
             </ModalBody>
             <ModalFooter